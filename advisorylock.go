@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+)
+
+// lockWaitSeconds mysql GET_LOCK 的等待时间
+const lockWaitSeconds = 10
+
+// WithAdvisoryLock 供 TransactionManager 实现使用: 在 tm 的事务中持有 key 对应的 advisory lock 执行 fn,
+// 用于跨进程的临界区(如分配序号). 锁在事务提交或回滚后才释放, 参见 advisoryTxLock
+func WithAdvisoryLock(ctx context.Context, tm TransactionManager, key int64, fn func(ctx context.Context) error) error {
+	_, err := tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		db := tm.GetDb(ctx)
+		if db == nil {
+			return nil, dbNilErr
+		}
+		if err := advisoryTxLock(ctx, tm, db, key); err != nil {
+			return nil, err
+		}
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+// WithAdvisoryLock 参见 WithAdvisoryLock 函数
+func (tm *transactionManager) WithAdvisoryLock(ctx context.Context, key int64, fn func(ctx context.Context) error) error {
+	return WithAdvisoryLock(ctx, tm, key, fn)
+}
+
+// lockKeyOf 把字符串转换为 advisory lock 的 key
+func lockKeyOf(s string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return int64(h.Sum64())
+}
+
+// advisoryTxLock 在 ctx 的事务中对 key 加锁, 事务提交或回滚后才释放, 其他会话拿到锁时能读到本事务的写入.
+// db 为事务的连接. postgres 为 pg_advisory_xact_lock; mysql 的 GET_LOCK 是会话级的, 在连接池的另一个连接上获取(最多等待 10s),
+// 通过 AfterCommit/AfterRollback 释放并归还该连接; sqlite 的写事务本身是串行的, 不加锁
+func advisoryTxLock(ctx context.Context, tm TransactionManager, db *gorm.DB, key int64) error {
+	switch db.Dialect().GetName() {
+	case DialectPostgres:
+		return execRaw(ctx, db, "SELECT pg_advisory_xact_lock(?)", key).Error
+	case DialectMysql:
+		return mysqlSessionLock(ctx, tm, db, key)
+	default:
+		return nil
+	}
+}
+
+// mysqlSessionLock 在独占的连接上 GET_LOCK, 连接在事务结束时 RELEASE_LOCK 后归还
+func mysqlSessionLock(ctx context.Context, tm TransactionManager, db *gorm.DB, key int64) error {
+	pool, ok := tm.GetDb(context.Background()).CommonDB().(*sql.DB)
+	if !ok {
+		return errors.New("advisory lock needs a *sql.DB connection pool")
+	}
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("repository:%d", key)
+	query := withRawComment(ctx, db, "SELECT GET_LOCK(?, ?)")
+	start := time.Now()
+	var got sql.NullInt64
+	err = conn.QueryRowContext(ctx, query, name, lockWaitSeconds).Scan(&got)
+	logRaw(ctx, db, query, []interface{}{name, lockWaitSeconds}, 0, time.Since(start), err)
+	if err == nil && got.Int64 != 1 {
+		err = fmt.Errorf("get lock %s timeout", name)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			query := withRawComment(ctx, db, "SELECT RELEASE_LOCK(?)")
+			start := time.Now()
+			_, err := conn.ExecContext(context.Background(), query, name)
+			logRaw(ctx, db, query, []interface{}{name}, 0, time.Since(start), err)
+			if err != nil {
+				Warn("[repository] release lock failed", zap.String("lock", name), zap.Error(err))
+			}
+			_ = conn.Close()
+		})
+	}
+	tm.AfterCommit(ctx, release)
+	tm.AfterRollback(ctx, release)
+	return nil
+}
@@ -0,0 +1,167 @@
+package repository
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	c_ArrayContainsAll = "@> (?)"
+	c_ArrayContainedBy = "<@ (?)"
+	c_ArrayAny         = "= ANY"
+
+	OpArrayContainsAll = c_ArrayContainsAll
+	OpArrayContainedBy = c_ArrayContainedBy
+	// OpArrayAny 的 Args[0] 为单个元素
+	OpArrayAny = c_ArrayAny
+)
+
+// cardinalityFn ArrayField.Length 的列名前缀, 按 dialect 翻译
+const cardinalityFn = "cardinality("
+
+// ArrayField postgres 数组列. sqlite 及 mysql 没有数组类型, 数组列以 json 数组存储, 条件通过 json 函数实现
+type ArrayField string
+
+func (a ArrayField) Column() string {
+	return string(a)
+}
+
+func (a ArrayField) arrayCondition(op operator, vals interface{}) Condition {
+	if !IsArray(vals) {
+		panic(fmt.Sprintf("param for %s should be array or slice", op))
+	}
+	return &singleCondition{
+		field:   SimpleField(a),
+		op:      op,
+		sqlArg1: pgArray(vals),
+		rawVal1: vals,
+	}
+}
+
+// ContainsAll field @> (?), 包含 vals 的所有元素
+func (a ArrayField) ContainsAll(vals interface{}) Condition {
+	return a.arrayCondition(c_ArrayContainsAll, vals)
+}
+
+// ContainedBy field <@ (?), 所有元素都在 vals 中
+func (a ArrayField) ContainedBy(vals interface{}) Condition {
+	return a.arrayCondition(c_ArrayContainedBy, vals)
+}
+
+// Overlaps field && (?), 包含 vals 中任意一个元素
+func (a ArrayField) Overlaps(vals interface{}) Condition {
+	return a.arrayCondition(c_ArrayMatchAny, vals)
+}
+
+// Any ? = ANY(field), 包含元素 val
+func (a ArrayField) Any(val interface{}) Condition {
+	return &singleCondition{
+		field:   SimpleField(a),
+		op:      c_ArrayAny,
+		sqlArg1: val,
+		rawVal1: val,
+	}
+}
+
+// Length cardinality(field), 数组的长度, 用于条件及排序, 如 fields.Tags.Length().Gt(3)
+func (a ArrayField) Length() SimpleField {
+	return SimpleField(cardinalityFn + string(a) + ")")
+}
+
+// pgArray 把 slice 转换为 pq 支持的数组参数: 整数转换为 []int64, 字符串(包括自定义的字符串类型)转换为 []string,
+// 已经是 driver.Valuer (如 pq.StringArray) 的原样返回, 其他使用 pq.GenericArray
+func pgArray(val interface{}) interface{} {
+	if _, ok := val.(driver.Valuer); ok {
+		return val
+	}
+	rv := reflect.Indirect(reflect.ValueOf(val))
+	switch rv.Type().Elem().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		ints := make([]int64, rv.Len())
+		for i := range ints {
+			ints[i] = rv.Index(i).Int()
+		}
+		return pq.Array(ints)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		ints := make([]int64, rv.Len())
+		for i := range ints {
+			ints[i] = int64(rv.Index(i).Uint())
+		}
+		return pq.Array(ints)
+	case reflect.String:
+		strs := make([]string, rv.Len())
+		for i := range strs {
+			strs[i] = rv.Index(i).String()
+		}
+		return pq.Array(strs)
+	}
+	return pq.Array(val)
+}
+
+// jsonArray sqlite, mysql 中与 json 数组列比较的参数
+func jsonArray(val interface{}) string {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return "[]"
+	}
+	return string(b)
+}
+
+// columnForDialect 翻译 ArrayField.Length, 用于条件及排序
+func columnForDialect(column, dialect string) string {
+	if !strings.HasPrefix(column, cardinalityFn) {
+		return column
+	}
+	switch dialect {
+	case DialectSqlite3:
+		return "json_array_length(" + column[len(cardinalityFn):]
+	case DialectMysql:
+		return "JSON_LENGTH(" + column[len(cardinalityFn):]
+	}
+	return column
+}
+
+// arrayForDialect 数组操作符在各个 dialect 中的写法, 不是数组操作符时 ok 为 false
+func (sc *singleCondition) arrayForDialect(dialect string) (sql string, args []interface{}, ok bool) {
+	col := sc.field.Column()
+	switch sc.op {
+	case c_ArrayMatchAny, c_ArrayContainsAll, c_ArrayContainedBy, c_ArrayAny:
+	default:
+		return "", nil, false
+	}
+	switch dialect {
+	case DialectSqlite3:
+		switch sc.op {
+		case c_ArrayMatchAny:
+			return arrayMatchAnySqlite(col), []interface{}{sc.rawVal1}, true
+		case c_ArrayContainsAll:
+			return fmt.Sprintf("NOT EXISTS (SELECT 1 FROM json_each(?) AS v WHERE v.value NOT IN (SELECT value FROM json_each(%s)))", col),
+				[]interface{}{jsonArray(sc.rawVal1)}, true
+		case c_ArrayContainedBy:
+			return fmt.Sprintf("NOT EXISTS (SELECT 1 FROM json_each(%s) AS v WHERE v.value NOT IN (SELECT value FROM json_each(?)))", col),
+				[]interface{}{jsonArray(sc.rawVal1)}, true
+		default:
+			return fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(%s) WHERE json_each.value = ?)", col), []interface{}{sc.rawVal1}, true
+		}
+	case DialectMysql:
+		switch sc.op {
+		case c_ArrayMatchAny:
+			return fmt.Sprintf("JSON_OVERLAPS(%s, ?)", col), []interface{}{jsonArray(sc.rawVal1)}, true
+		case c_ArrayContainsAll:
+			return fmt.Sprintf("JSON_CONTAINS(%s, ?)", col), []interface{}{jsonArray(sc.rawVal1)}, true
+		case c_ArrayContainedBy:
+			return fmt.Sprintf("JSON_CONTAINS(?, %s)", col), []interface{}{jsonArray(sc.rawVal1)}, true
+		default:
+			return fmt.Sprintf("JSON_CONTAINS(%s, ?)", col), []interface{}{jsonArray([]interface{}{sc.rawVal1})}, true
+		}
+	}
+	if sc.op == c_ArrayAny {
+		return fmt.Sprintf("? = ANY(%s)", col), []interface{}{sc.sqlArg1}, true
+	}
+	return col + " " + string(sc.op), []interface{}{sc.sqlArg1}, true
+}
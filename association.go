@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Association 的类型, 与 gorm 的 Relationship.Kind 一致
+const (
+	AssociationHasOne     = "has_one"
+	AssociationHasMany    = "has_many"
+	AssociationBelongsTo  = "belongs_to"
+	AssociationManyToMany = "many_to_many"
+)
+
+// AssociationInfo Model 中由 gorm 定义的关联字段
+type AssociationInfo struct {
+	// Name 字段名, 用于 Preload
+	Name string
+	// Kind 为 Association* 常量之一
+	Kind string
+	// ForeignKeys 外键列; belongs to 时在本表, 其他在关联表(many to many 时在 JoinTable)
+	ForeignKeys []string
+	// AssociationForeignKeys 外键引用的列
+	AssociationForeignKeys []string
+	// JoinTable 仅 many to many 有效
+	JoinTable string
+}
+
+// Associations 返回 Model 中的所有关联字段
+func (e *Repository) Associations() []AssociationInfo {
+	var list []AssociationInfo
+	for _, f := range (&gorm.Scope{}).New(e.NewStruct()).Fields() {
+		r := f.Relationship
+		if r == nil || r.Kind == "" {
+			continue
+		}
+		info := AssociationInfo{
+			Name:                   f.Name,
+			Kind:                   r.Kind,
+			ForeignKeys:            r.ForeignDBNames,
+			AssociationForeignKeys: r.AssociationForeignDBNames,
+		}
+		if r.JoinTableHandler != nil {
+			info.JoinTable = r.JoinTableHandler.Table(nil)
+		}
+		list = append(list, info)
+	}
+	return list
+}
+
+type preloadOption struct {
+	association string
+	conds       []Condition
+}
+
+// Preload 在 Find 时以一条 IN 查询批量加载 association (参见 Associations), 避免逐行查询.
+// 嵌套的关联使用 "Orders.Items", cond 为关联表上的附加条件
+func Preload(association string, cond ...Condition) Option {
+	return &preloadOption{association: association, conds: cond}
+}
+
+func (po *preloadOption) Sql(db *gorm.DB) *gorm.DB {
+	if len(po.conds) == 0 {
+		return db.Preload(po.association)
+	}
+	return db.Preload(po.association, func(db *gorm.DB) *gorm.DB {
+		return ParseWhere(MatchAll(po.conds...), db)
+	})
+}
+
+// Association 管理一个 model 的关联, 通过 Repository.Association 创建
+type Association struct {
+	rep   *Repository
+	model Model
+	name  string
+}
+
+// Association 返回 model 上名为 name 的关联字段(参见 Associations)的管理接口, model 主键不能为零值.
+// 修改操作在 ctx 的事务中执行(没有事务时开启一个), many to many 时维护 JoinTable 中的行
+func (e *Repository) Association(model Model, name string) *Association {
+	return &Association{rep: e, model: model, name: name}
+}
+
+func (a *Association) association(ctx context.Context) (*gorm.Association, error) {
+	db := a.rep.getDb(ctx)
+	if db == nil {
+		return nil, dbNilErr
+	}
+	assoc := db.Model(a.model).Association(a.name)
+	return assoc, assoc.Error
+}
+
+func (a *Association) modify(ctx context.Context, fn func(assoc *gorm.Association) *gorm.Association) error {
+	_, err := a.rep.Tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		assoc, err := a.association(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fn(assoc).Error
+	})
+	return err
+}
+
+// Append 添加关联, related 为关联的 model (指针)
+func (a *Association) Append(ctx context.Context, related ...interface{}) error {
+	return a.modify(ctx, func(assoc *gorm.Association) *gorm.Association {
+		return assoc.Append(related...)
+	})
+}
+
+// Replace 以 related 替换现有的所有关联
+func (a *Association) Replace(ctx context.Context, related ...interface{}) error {
+	return a.modify(ctx, func(assoc *gorm.Association) *gorm.Association {
+		return assoc.Replace(related...)
+	})
+}
+
+// Delete 删除与 related 的关联, 不删除 related 本身
+func (a *Association) Delete(ctx context.Context, related ...interface{}) error {
+	return a.modify(ctx, func(assoc *gorm.Association) *gorm.Association {
+		return assoc.Delete(related...)
+	})
+}
+
+// Clear 删除所有关联, 不删除关联的 model
+func (a *Association) Clear(ctx context.Context) error {
+	return a.modify(ctx, func(assoc *gorm.Association) *gorm.Association {
+		return assoc.Clear()
+	})
+}
+
+// Find 查询关联的 model 写入 dest
+func (a *Association) Find(ctx context.Context, dest interface{}) error {
+	assoc, err := a.association(ctx)
+	if err != nil {
+		return err
+	}
+	return assoc.Find(dest).Error
+}
+
+// Count 关联的数量
+func (a *Association) Count(ctx context.Context) (int, error) {
+	assoc, err := a.association(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := assoc.Count()
+	return n, assoc.Error
+}
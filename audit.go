@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+)
+
+// AuditRecord 一次写操作的审计记录, Data 中 pii/secret 字段及 RedactColumn 注册的列已脱敏
+type AuditRecord struct {
+	Table string
+	Op    ChangeOp
+	Ids   []interface{}
+	// Data Create/Save 为 model 所有的列, Update 为更新的列, Delete 为空
+	Data      map[string]interface{}
+	Condition string
+	Time      time.Time
+}
+
+// AuditSink 审计记录的存储, 配置到 Repository.AuditSink 后, 写操作成功(事务提交)后同步调用, 不应阻塞
+type AuditSink interface {
+	Record(ctx context.Context, record AuditRecord) error
+}
+
+// AuditSinkFunc adapts a func to AuditSink
+type AuditSinkFunc func(ctx context.Context, record AuditRecord) error
+
+func (f AuditSinkFunc) Record(ctx context.Context, record AuditRecord) error {
+	return f(ctx, record)
+}
+
+// audit 由 notifyChange 调用
+func (e *Repository) audit(ctx context.Context, event ChangeEvent) {
+	record := AuditRecord{
+		Table: event.Table,
+		Op:    event.Op,
+		Ids:   event.Ids,
+		Time:  time.Now(),
+	}
+	if event.Model != nil && event.Diff == nil {
+		record.Data = RedactColumns(e.Value, modelColumns(event.Model))
+	} else if event.Diff != nil {
+		record.Data = RedactColumns(e.Value, event.Diff)
+	}
+	if event.Condition != nil {
+		where, _ := event.Condition.flatten()
+		record.Condition = where
+	}
+	if err := e.AuditSink.Record(ctx, record); err != nil {
+		Warn("[repository] record audit failed", zap.String("table", event.Table), zap.String("op", string(event.Op)), zap.Error(err))
+	}
+}
+
+// modelColumns model 的列名 -> 值
+func modelColumns(model interface{}) map[string]interface{} {
+	values := make(map[string]interface{})
+	for _, f := range (&gorm.Scope{}).New(model).Fields() {
+		if f.IsNormal && !f.IsIgnored {
+			values[f.DBName] = f.Field.Interface()
+		}
+	}
+	return values
+}
@@ -0,0 +1,161 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 主键生成策略, 用于 gorm tag, 如
+//
+//	Id string `gorm:"primary_key;AUTOUUID"`
+//	Id string `gorm:"primary_key;AUTOULID"`
+//	Id int64  `gorm:"primary_key;AUTOID:snowflake"` // 通过 RegisterIdGenerator 注册的生成器
+//	Id int64  `gorm:"primary_key;AUTOSEQ:order"`    // 序列 order 的下一个值, 参见 SetSequenceProvider, 省略序列名时使用表名
+//
+// Create/BatchCreate 等写入前, 字段为零值时生成
+const (
+	IdGeneratorUUID = "uuid"
+	IdGeneratorULID = "ulid"
+)
+
+// IdGenerator 生成一个主键值, 返回值需要能赋值给字段(相同类型或可转换)
+type IdGenerator func(ctx context.Context) (interface{}, error)
+
+var (
+	idGenerators = map[string]IdGenerator{
+		IdGeneratorUUID: func(ctx context.Context) (interface{}, error) { return NewUUID(), nil },
+		IdGeneratorULID: func(ctx context.Context) (interface{}, error) { return NewULID(), nil },
+	}
+	idGeneratorsLock sync.RWMutex
+
+	sequenceProvider     SequenceProvider
+	sequenceProviderLock sync.RWMutex
+)
+
+// SequenceProvider 返回序列 name 的下一个值, 用于 AUTOSEQ 的字段, 如 idgen.Allocator.Next
+type SequenceProvider func(ctx context.Context, name string) (int64, error)
+
+// SetSequenceProvider 设置 AUTOSEQ 使用的序列, 应在 main 中初始化时调用
+func SetSequenceProvider(p SequenceProvider) {
+	sequenceProviderLock.Lock()
+	defer sequenceProviderLock.Unlock()
+	sequenceProvider = p
+}
+
+func getSequenceProvider() SequenceProvider {
+	sequenceProviderLock.RLock()
+	defer sequenceProviderLock.RUnlock()
+	return sequenceProvider
+}
+
+// RegisterIdGenerator 注册名为 name 的生成器, 供 AUTOID:name 使用, 可以覆盖 uuid 及 ulid. 应在 main 中初始化时调用
+func RegisterIdGenerator(name string, g IdGenerator) {
+	idGeneratorsLock.Lock()
+	defer idGeneratorsLock.Unlock()
+	idGenerators[strings.ToLower(name)] = g
+}
+
+func getIdGenerator(name string) IdGenerator {
+	idGeneratorsLock.RLock()
+	defer idGeneratorsLock.RUnlock()
+	return idGenerators[strings.ToLower(name)]
+}
+
+// handleAutoIdTag 为零值的 AUTOUUID/AUTOULID/AUTOID/AUTOSEQ 字段生成值
+func (es *execScope) handleAutoIdTag(ctx context.Context) error {
+	for _, f := range es.scope.Fields() {
+		if !f.IsBlank {
+			continue
+		}
+		if seq, ok := f.TagSettingsGet("AUTOSEQ"); ok {
+			if err := es.nextSequence(ctx, f, seq); err != nil {
+				return err
+			}
+			continue
+		}
+		var name string
+		if _, ok := f.TagSettingsGet("AUTOUUID"); ok {
+			name = IdGeneratorUUID
+		} else if _, ok := f.TagSettingsGet("AUTOULID"); ok {
+			name = IdGeneratorULID
+		} else if v, ok := f.TagSettingsGet("AUTOID"); ok {
+			name = v
+		} else {
+			continue
+		}
+		g := getIdGenerator(name)
+		if g == nil {
+			return fmt.Errorf("repository: id generator %q of %s is not registered", name, f.DBName)
+		}
+		id, err := g(ctx)
+		if err != nil {
+			return err
+		}
+		if err = f.Set(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextSequence 没有指定序列名时 gorm 返回 AUTOSEQ, 此时使用表名
+func (es *execScope) nextSequence(ctx context.Context, f *gorm.Field, seq string) error {
+	p := getSequenceProvider()
+	if p == nil {
+		return fmt.Errorf("repository: AUTOSEQ of %s without SequenceProvider", f.DBName)
+	}
+	if seq == "AUTOSEQ" {
+		seq = es.rep.TableName()
+	}
+	id, err := p(ctx, seq)
+	if err != nil {
+		return err
+	}
+	return f.Set(id)
+}
+
+// NewUUID 随机的 UUID (version 4), 如 0f8fad5b-d9cb-469f-a165-70867728950e
+func NewUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	var buf [36]byte
+	hex.Encode(buf[0:8], b[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:])
+	return string(buf[:])
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULID 26 个字符的 ULID, 前 48 位为毫秒时间戳, 按字符串排序即按生成时间排序(同一毫秒内无序), 适合作为索引友好的主键
+func NewULID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixNano()/1e6)<<16)
+	_, _ = rand.Read(b[6:])
+	// 128 位按 5 位一组编码, 最高 2 位补 0
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	var buf [26]byte
+	for i := 25; i >= 0; i-- {
+		buf[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(buf[:])
+}
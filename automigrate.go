@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrAutoMigrateDisabled DBConfig.AutoMigrate 没有开启
+var ErrAutoMigrateDisabled = errors.New("auto migrate is disabled, set DBConfig.AutoMigrate to enable it")
+
+// dbConfigGetter 可选接口, TransactionManager 实现后可以读取其 DBConfig
+type dbConfigGetter interface {
+	DBConfig() *DBConfig
+}
+
+// DBConfig 返回该事务管理器对应的配置
+func (tm *transactionManager) DBConfig() *DBConfig {
+	return GetDBByDatabaseName(tm.database, tm.serviceName).DbConfig
+}
+
+func autoMigrateEnabled(tm TransactionManager) bool {
+	cg, ok := tm.(dbConfigGetter)
+	if !ok {
+		return false
+	}
+	conf := cg.DBConfig()
+	return conf != nil && conf.AutoMigrate
+}
+
+// AutoMigrate 根据 gorm tag 创建表, 补充缺失的列和索引(包括 unique_index), 不会删除或修改已有的列.
+// 需要在 DBConfig 中开启 AutoMigrate, 通常只在开发/测试环境开启
+func (e *Repository) AutoMigrate(ctx context.Context) error {
+	if !autoMigrateEnabled(e.Tm) {
+		return ErrAutoMigrateDisabled
+	}
+	db := e.getDb(ctx)
+	if db == nil {
+		return dbNilErr
+	}
+	return db.AutoMigrate(e.NewStruct()).Error
+}
+
+// MigrateAll 对默认数据库(同 NewRepository)执行 AutoMigrate
+func MigrateAll(models ...Model) error {
+	tm := NewTransactionManager("", "")
+	if !autoMigrateEnabled(tm) {
+		return ErrAutoMigrateDisabled
+	}
+	db := tm.GetDb(context.Background())
+	if db == nil {
+		return dbNilErr
+	}
+	values := make([]interface{}, 0, len(models))
+	for _, m := range models {
+		values = append(values, NewStruct(m))
+	}
+	return db.AutoMigrate(values...).Error
+}
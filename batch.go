@@ -0,0 +1,333 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// defaultBatchSize 自适应批量大小的初始值
+const defaultBatchSize = 500
+
+// AfterRepoBatchCreateHook 由 Model 实现, BatchCreate 全部写入后调用一次(在第一个 model 上调用),
+// 用于一次性的副作用(一次缓存失效, 一个事件). 没有实现时逐行调用 AfterRepoCreate
+type AfterRepoBatchCreateHook interface {
+	AfterRepoBatchCreate(ctx context.Context, models []Model) error
+}
+
+// toModels models 可以是 []Model, 或元素实现了 Model 的 slice (如 []*User)
+func toModels(models interface{}) ([]Model, error) {
+	if list, ok := models.([]Model); ok {
+		return list, nil
+	}
+	v := Indirect(reflect.ValueOf(models))
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, errors.New("models should be array or slice")
+	}
+	list := make([]Model, 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i)
+		if elem.Kind() != reflect.Ptr && elem.CanAddr() {
+			elem = elem.Addr()
+		}
+		m, ok := elem.Interface().(Model)
+		if !ok {
+			return nil, fmt.Errorf("%s does not implement Model", elem.Type())
+		}
+		list = append(list, m)
+	}
+	return list, nil
+}
+
+// ErrReturningIdsNotSupported 当前 dialect 无法返回批量写入的主键
+var ErrReturningIdsNotSupported = errors.New("returning ids is not supported for this dialect")
+
+// BatchCreate 在一个事务中分批(参见 Repository.BatchSize)以多行 insert 写入 models, 每个 model 的 BeforeRepoCreate 照常调用.
+// 自增主键会回填到 models 中: postgres/sqlite 通过 RETURNING, mysql 通过 LastInsertId 推算(要求 auto_increment_increment = 1).
+//
+// 有默认值的列只有在所有行都为零值时才会省略(使用数据库默认值)
+func (e *Repository) BatchCreate(ctx context.Context, models interface{}) error {
+	_, err := e.batchWrite(ctx, StmtBatchCreate, models, nil)
+	return err
+}
+
+// BatchCreateReturningIds 同 BatchCreate, 返回按 models 顺序排列的主键
+func (e *Repository) BatchCreateReturningIds(ctx context.Context, models interface{}) ([]interface{}, error) {
+	return e.batchWrite(ctx, StmtBatchCreate, models, nil)
+}
+
+// BatchUpsert 批量写入, conflict 列冲突时更新其他列(AUTOCREATETIME 的列除外).
+// postgres/sqlite 需要 conflict 列上有唯一索引, mysql 忽略 conflict, 使用表上所有的唯一索引
+func (e *Repository) BatchUpsert(ctx context.Context, models interface{}, conflict ...FieldInterface) error {
+	_, err := e.BatchUpsertReturningIds(ctx, models, conflict...)
+	if err == ErrReturningIdsNotSupported {
+		return nil
+	}
+	return err
+}
+
+// BatchUpsertReturningIds 同 BatchUpsert, 返回插入或更新的行的主键. mysql 无法得知更新的行, 返回 ErrReturningIdsNotSupported
+func (e *Repository) BatchUpsertReturningIds(ctx context.Context, models interface{}, conflict ...FieldInterface) ([]interface{}, error) {
+	if len(conflict) == 0 {
+		return nil, errors.New("batch upsert without conflict fields")
+	}
+	return e.batchWrite(ctx, StmtBatchUpsert, models, conflict)
+}
+
+func (e *Repository) batchWrite(ctx context.Context, op string, models interface{}, conflict []FieldInterface) (ids []interface{}, err error) {
+	list, err := toModels(models)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	for _, m := range list {
+		if err = e.validate(ctx, m); err != nil {
+			return nil, err
+		}
+		if err = e.checkWrite(ctx, m); err != nil {
+			return nil, err
+		}
+	}
+	err = e.intercept(ctx, &StatementInfo{Op: op, Model: list}, func(ctx context.Context, stmt *StatementInfo) error {
+		var err error
+		ids, err = e.batchCreate(ctx, list, conflict)
+		if err == nil || err == ErrReturningIdsNotSupported {
+			e.afterWrite(ctx, stmt, true)
+			e.shadowBatch(ctx, op, list, conflict)
+		}
+		return e.wrapTimeout(ctx, op, err)
+	})
+	return ids, err
+}
+
+func (e *Repository) batchCreate(ctx context.Context, list []Model, conflict []FieldInterface) ([]interface{}, error) {
+	res, err := e.Tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		db := e.getDb(ctx)
+		if db == nil {
+			return nil, dbNilErr
+		}
+		scopes := make([]*execScope, 0, len(list))
+		for i, m := range list {
+			es := &execScope{
+				model: m,
+				scope: db.NewScope(m),
+				rep:   e,
+			}
+			if err := es.beforeRepoCreateCallback(ctx, m); err != nil {
+				return nil, restoreAllPlaintext(ctx, list[:i], err)
+			}
+			scopes = append(scopes, es)
+		}
+		idsKnown := true
+		dialect := db.Dialect().GetName()
+		tuner := e.batchTuner(dialect)
+		columns := len(insertColumns(scopes))
+		for start := 0; start < len(scopes); {
+			end := start + tuner.next(dialect, columns)
+			if end > len(scopes) {
+				end = len(scopes)
+			}
+			startTime := time.Now()
+			known, err := e.insertRows(ctx, db, scopes[start:end], conflict)
+			if err != nil {
+				return nil, restoreAllPlaintext(ctx, list, err)
+			}
+			tuner.observe(end-start, time.Since(startTime))
+			idsKnown = idsKnown && known
+			start = end
+		}
+		for _, m := range list {
+			if err := decryptFields(ctx, m); err != nil {
+				return nil, err
+			}
+		}
+		if err := afterBatchCreate(ctx, list); err != nil {
+			return nil, err
+		}
+		if !idsKnown {
+			return nil, nil
+		}
+		ids := make([]interface{}, 0, len(list))
+		for _, m := range list {
+			id, _ := e.primaryValue(m)
+			ids = append(ids, id)
+		}
+		return ids, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, ErrReturningIdsNotSupported
+	}
+	return res.([]interface{}), nil
+}
+
+func afterBatchCreate(ctx context.Context, list []Model) error {
+	if h, ok := list[0].(AfterRepoBatchCreateHook); ok {
+		return h.AfterRepoBatchCreate(ctx, list)
+	}
+	for _, m := range list {
+		if i0, ok := m.(interface {
+			AfterRepoCreate(ctx context.Context) error
+		}); ok {
+			if err := i0.AfterRepoCreate(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// insertColumns 所有行共用的列; 零值的主键, 以及所有行都为零值且有默认值的列会被省略
+func insertColumns(scopes []*execScope) []*gorm.Field {
+	var fields []*gorm.Field
+	for _, f := range scopes[0].scope.Fields() {
+		if !f.IsNormal || f.IsIgnored {
+			continue
+		}
+		if f.IsPrimaryKey || f.HasDefaultValue {
+			blank := true
+			for _, es := range scopes {
+				if rf, ok := es.scope.FieldByName(f.Name); ok && !rf.IsBlank {
+					blank = false
+					break
+				}
+			}
+			if blank {
+				continue
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// upsertClause 冲突时更新除 conflict 列, 主键, AUTOCREATETIME 列以外的列
+func upsertClause(scope *gorm.Scope, dialect string, fields []*gorm.Field, conflict []FieldInterface, pk string) string {
+	skip := make(map[string]bool)
+	var conflictCols []string
+	for _, c := range conflict {
+		skip[c.Column()] = true
+		conflictCols = append(conflictCols, scope.Quote(c.Column()))
+	}
+	var sets []string
+	for _, f := range fields {
+		if _, ok := f.TagSettingsGet("AUTOCREATETIME"); ok || f.IsPrimaryKey || f.DBName == pk || skip[f.DBName] {
+			continue
+		}
+		col := scope.Quote(f.DBName)
+		if dialect == DialectMysql {
+			sets = append(sets, fmt.Sprintf("%s=VALUES(%s)", col, col))
+		} else {
+			sets = append(sets, fmt.Sprintf("%s=EXCLUDED.%s", col, col))
+		}
+	}
+	if dialect == DialectMysql {
+		if len(sets) == 0 {
+			// 没有可更新的列时, 用主键赋值为自身实现 "冲突时忽略"
+			col := scope.Quote(pk)
+			sets = append(sets, fmt.Sprintf("%s=%s", col, col))
+		}
+		return " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ",")
+	}
+	if len(sets) == 0 {
+		return fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(conflictCols, ","))
+	}
+	return fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(conflictCols, ","), strings.Join(sets, ","))
+}
+
+// insertStatement 写入 scopes 的多行 insert 语句
+func insertStatement(scopes []*execScope, fields []*gorm.Field) (string, []interface{}) {
+	first := scopes[0].scope
+	var cols []string
+	for _, f := range fields {
+		cols = append(cols, first.Quote(f.DBName))
+	}
+	rowPlaceholder := "(" + strings.TrimSuffix(strings.Repeat("?,", len(fields)), ",") + ")"
+	rows := make([]string, 0, len(scopes))
+	vars := make([]interface{}, 0, len(scopes)*len(fields))
+	for _, es := range scopes {
+		rows = append(rows, rowPlaceholder)
+		for _, f := range fields {
+			rf, _ := es.scope.FieldByName(f.Name)
+			vars = append(vars, rf.Field.Interface())
+		}
+	}
+	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", first.QuotedTableName(), strings.Join(cols, ","), strings.Join(rows, ","))
+	return sql, vars
+}
+
+// insertRows 以一条多行 insert 写入 scopes, conflict 不为空时为 upsert. 返回是否回填了主键
+func (e *Repository) insertRows(ctx context.Context, db *gorm.DB, scopes []*execScope, conflict []FieldInterface) (bool, error) {
+	first := scopes[0].scope
+	dialect := db.Dialect().GetName()
+	fields := insertColumns(scopes)
+	if len(fields) == 0 {
+		return false, errors.New("batch create without columns")
+	}
+	sql, vars := insertStatement(scopes, fields)
+	if len(conflict) > 0 {
+		sql += upsertClause(first, dialect, fields, conflict, e.PrimaryField().Column())
+	}
+
+	pk := first.PrimaryField()
+	switch {
+	case pk == nil:
+		return false, execRaw(ctx, db, sql, vars...).Error
+	case dialect == DialectPostgres || dialect == DialectSqlite3:
+		return e.insertReturning(db, sql+" RETURNING "+first.Quote(pk.DBName), vars, scopes, conflict)
+	case dialect == DialectMysql && len(conflict) == 0:
+		// mysql 的多行 insert, LastInsertId 是第一行的自增 id
+		res, err := execRawResult(ctx, db, sql, vars...)
+		if err != nil {
+			return false, err
+		}
+		firstId, err := res.LastInsertId()
+		if err != nil {
+			return false, err
+		}
+		for i, es := range scopes {
+			if es.scope.PrimaryKeyZero() {
+				if err = es.scope.PrimaryField().Set(firstId + int64(i)); err != nil {
+					return false, err
+				}
+			}
+		}
+		return true, nil
+	default:
+		return false, execRaw(ctx, db, sql, vars...).Error
+	}
+}
+
+// insertReturning 按 VALUES 的顺序回填主键. upsert 中 DO NOTHING 的行不会返回, 此时无法对应, 不回填
+func (e *Repository) insertReturning(db *gorm.DB, sql string, vars []interface{}, scopes []*execScope, conflict []FieldInterface) (bool, error) {
+	sqlRows, err := db.Raw(sql, vars...).Rows()
+	if err != nil {
+		return false, err
+	}
+	defer sqlRows.Close()
+	var ids []interface{}
+	for sqlRows.Next() {
+		var id interface{}
+		if err = sqlRows.Scan(&id); err != nil {
+			return false, err
+		}
+		ids = append(ids, id)
+	}
+	if err = sqlRows.Err(); err != nil {
+		return false, err
+	}
+	if len(ids) != len(scopes) {
+		return false, nil
+	}
+	for i, es := range scopes {
+		if err = es.scope.PrimaryField().Set(ids[i]); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
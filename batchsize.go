@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	minBatchSize              = 10
+	maxBatchSize              = 10000
+	defaultBatchTargetLatency = 200 * time.Millisecond
+)
+
+// maxBindParams 每条语句允许的最大参数个数
+var maxBindParams = map[string]int{
+	DialectPostgres: 65535,
+	DialectMysql:    65535,
+	// SQLITE_MAX_VARIABLE_NUMBER, 3.32 之前的默认值
+	DialectSqlite3: 999,
+}
+
+// batchTuner 根据每批的耗时调整批量写入的行数: 超过目标耗时的 1.5 倍时减半, 不到一半时增加 50%.
+// 同一张表的 tuner 在 BatchCreate 之间共享, 后续的导入从已经调整过的大小开始
+type batchTuner struct {
+	mu     sync.Mutex
+	size   int
+	target time.Duration
+	fixed  bool
+}
+
+var batchTuners sync.Map
+
+// batchTuner BatchSize > 0 时使用固定大小, 否则返回表(及 dialect)共享的自适应 tuner
+func (e *Repository) batchTuner(dialect string) *batchTuner {
+	if e.BatchSize > 0 {
+		return &batchTuner{size: e.BatchSize, fixed: true}
+	}
+	target := e.BatchTargetLatency
+	if target <= 0 {
+		target = defaultBatchTargetLatency
+	}
+	v, _ := batchTuners.LoadOrStore(dialect+":"+e.TableName(), &batchTuner{size: defaultBatchSize, target: target})
+	t := v.(*batchTuner)
+	t.mu.Lock()
+	t.target = target
+	t.mu.Unlock()
+	return t
+}
+
+// next 下一批的行数, 每行 columns 个参数, 不超过 dialect 的参数个数限制
+func (t *batchTuner) next(dialect string, columns int) int {
+	t.mu.Lock()
+	size := t.size
+	t.mu.Unlock()
+	if limit, ok := maxBindParams[dialect]; ok && columns > 0 && size*columns > limit {
+		size = limit / columns
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// observe 记录一批 rows 行的耗时. 只有满批才会增大, 避免最后的零头把大小调小
+func (t *batchTuner) observe(rows int, d time.Duration) {
+	if t.fixed {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case d > t.target*3/2:
+		size := rows / 2
+		if size < minBatchSize {
+			size = minBatchSize
+		}
+		t.size = size
+	case d < t.target/2 && rows >= t.size:
+		size := t.size * 3 / 2
+		if size > maxBatchSize {
+			size = maxBatchSize
+		}
+		t.size = size
+	}
+}
@@ -0,0 +1,167 @@
+package repository
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+)
+
+// ErrCircuitOpen 数据库连续失败, 熔断期间直接返回, 不再等待连接超时
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+const (
+	circuitBreakerKey      = "repository:circuit_breaker"
+	defaultCircuitCooldown = 10 * time.Second
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker 每个连接(主库及每个从库)一个. 连续 threshold 次连接类错误后打开, cooldown 后进入半开状态,
+// 半开时只放行一个探测语句, 成功则关闭, 失败则重新打开
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// registerCircuitBreaker DBConfig.CircuitBreakerThreshold > 0 时给 db 加上熔断, 返回 nil 表示未开启.
+// perStatement 为 true 时通过 gorm callback 对每个语句生效, 用于从库; 主库在 intercept 及开启事务时检查, 参见 guardDb
+func registerCircuitBreaker(db *gorm.DB, dbConf *DBConfig, name string, perStatement bool) *circuitBreaker {
+	if dbConf.CircuitBreakerThreshold <= 0 {
+		return nil
+	}
+	cb := &circuitBreaker{name: name, threshold: dbConf.CircuitBreakerThreshold, cooldown: dbConf.CircuitBreakerCooldown}
+	if cb.cooldown <= 0 {
+		cb.cooldown = defaultCircuitCooldown
+	}
+	// 之后从 db clone 出来的连接(包括事务)都带有 breaker
+	db.InstantSet(circuitBreakerKey, cb)
+	if !perStatement {
+		return cb
+	}
+	callbacks := db.Callback()
+	for _, p := range []*gorm.CallbackProcessor{callbacks.Create(), callbacks.Query(), callbacks.Update(), callbacks.Delete(), callbacks.RowQuery()} {
+		p.Before("repository:statement_start").Register("repository:circuit_breaker", func(scope *gorm.Scope) {
+			if err := cb.allow(); err != nil {
+				scope.Err(err)
+			}
+		})
+		p.After("repository:statement_end").Register("repository:circuit_breaker_result", func(scope *gorm.Scope) {
+			if err := scope.DB().Error; err != ErrCircuitOpen {
+				cb.done(err)
+			}
+		})
+	}
+	return cb
+}
+
+// circuitOf db 上的 breaker, 没有开启时为 nil
+func circuitOf(db *gorm.DB) *circuitBreaker {
+	if db == nil {
+		return nil
+	}
+	if v, ok := db.Get(circuitBreakerKey); ok {
+		return v.(*circuitBreaker)
+	}
+	return nil
+}
+
+// allow 是否可以执行, 半开时只放行一个探测
+func (cb *circuitBreaker) allow() error {
+	if cb == nil {
+		return nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return ErrCircuitOpen
+		}
+		cb.state = circuitHalfOpen
+		cb.probing = true
+		return nil
+	case circuitHalfOpen:
+		if cb.probing {
+			return ErrCircuitOpen
+		}
+		cb.probing = true
+	}
+	return nil
+}
+
+// done 记录执行结果, 只有连接类错误计为失败
+func (cb *circuitBreaker) done(err error) {
+	if cb == nil {
+		return
+	}
+	failed := isConnectionError(err)
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if !failed {
+		if cb.state != circuitClosed {
+			Info("[repository] circuit breaker closed", zap.String("db", cb.name))
+		}
+		cb.state = circuitClosed
+		cb.failures = 0
+		cb.probing = false
+		return
+	}
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= cb.threshold {
+		if cb.state != circuitOpen {
+			Warn("[repository] circuit breaker opened", zap.String("db", cb.name), zap.Int("failures", cb.failures), zap.Error(err))
+			getMetrics().IncCounter("repository_circuit_open_total", map[string]string{"db": cb.name})
+		}
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+		cb.probing = false
+	}
+}
+
+// isOpen 用于选择从库, 不占用半开时的探测
+func (cb *circuitBreaker) isOpen() bool {
+	if cb == nil {
+		return false
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state == circuitOpen && time.Since(cb.openedAt) < cb.cooldown
+}
+
+// isConnectionError 连接不可用类的错误, 不包括 record not found, 约束冲突等业务错误
+func isConnectionError(err error) bool {
+	if err == nil || gorm.IsRecordNotFoundError(err) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "connection refused") || strings.Contains(msg, "connection reset") || strings.Contains(msg, "broken pipe") ||
+		strings.Contains(msg, "too many connections") || strings.Contains(msg, "the database system is starting up")
+}
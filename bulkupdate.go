@@ -0,0 +1,187 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// BulkUpdate 以主键为 key, 把每个 model 的 updateFields 更新为各自的值. 每批只执行一条语句:
+// postgres 为 UPDATE ... FROM (VALUES ...), 其他为 CASE 主键 WHEN ... THEN ... END.
+// 每个 model 的 BeforeRepoUpdate/AfterRepoUpdate 照常调用, AUTOUPDATETIME 的列会自动加入更新; 主键为零值时返回 error.
+// MandatoryCondition 及租户条件同样生效, 不满足条件的行不会更新
+func (e *Repository) BulkUpdate(ctx context.Context, models interface{}, updateFields []FieldInterface) error {
+	list, err := toModels(models)
+	if err != nil || len(list) == 0 {
+		return err
+	}
+	if len(updateFields) == 0 {
+		return errors.New("bulk update without fields")
+	}
+	for _, m := range list {
+		// 只更新 updateFields, 与 Update 一致只校验枚举值
+		columns := modelColumns(m)
+		updated := make(map[string]interface{}, len(updateFields))
+		for _, f := range updateFields {
+			if v, ok := columns[f.Column()]; ok {
+				updated[f.Column()] = v
+			}
+		}
+		if err = e.validateEnums(updated); err != nil {
+			return err
+		}
+		if err = e.checkWrite(ctx, m); err != nil {
+			return err
+		}
+	}
+	return e.intercept(ctx, &StatementInfo{Op: StmtBulkUpdate, Model: list}, func(ctx context.Context, stmt *StatementInfo) error {
+		if err := e.wrapTimeout(ctx, StmtBulkUpdate, e.bulkUpdate(ctx, list, updateFields)); err != nil {
+			return err
+		}
+		e.afterWrite(ctx, stmt, false)
+		e.shadowBulkUpdate(ctx, list, updateFields)
+		return nil
+	})
+}
+
+func (e *Repository) bulkUpdate(ctx context.Context, list []Model, updateFields []FieldInterface) error {
+	_, err := e.Tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		db := e.getDb(ctx)
+		if db == nil {
+			return nil, dbNilErr
+		}
+		scopes := make([]*execScope, 0, len(list))
+		for i, m := range list {
+			es := &execScope{
+				model: m,
+				scope: db.NewScope(m),
+				rep:   e,
+			}
+			if _, ok := e.primaryValue(m); !ok {
+				return nil, restoreAllPlaintext(ctx, list[:i], fmt.Errorf("bulk update %s with zero primary key", e.TableName()))
+			}
+			if err := es.beforeRepoUpdateCallback(ctx, m); err != nil {
+				return nil, restoreAllPlaintext(ctx, list[:i], err)
+			}
+			scopes = append(scopes, es)
+		}
+		fields, err := bulkUpdateFields(scopes[0].scope, updateFields, e.PrimaryField().Column())
+		if err != nil {
+			return nil, restoreAllPlaintext(ctx, list, err)
+		}
+
+		dialect := db.Dialect().GetName()
+		tuner := e.batchTuner(dialect)
+		params := 2*len(fields) + 1
+		if dialect == DialectPostgres {
+			params = len(fields) + 1
+		}
+		for start := 0; start < len(scopes); {
+			end := start + tuner.next(dialect, params)
+			if end > len(scopes) {
+				end = len(scopes)
+			}
+			startTime := time.Now()
+			if err = e.updateRows(ctx, db, scopes[start:end], fields); err != nil {
+				return nil, restoreAllPlaintext(ctx, list, err)
+			}
+			tuner.observe(end-start, time.Since(startTime))
+			start = end
+		}
+		for _, es := range scopes {
+			if err = es.afterRepoUpdateCallback(ctx, es.model.(Model)); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// bulkUpdateFields updateFields 对应的 gorm 字段, 加上 AUTOUPDATETIME 的字段, 不包含主键
+func bulkUpdateFields(scope *gorm.Scope, updateFields []FieldInterface, pk string) ([]*gorm.Field, error) {
+	seen := make(map[string]bool)
+	var fields []*gorm.Field
+	for _, uf := range updateFields {
+		f, ok := scope.FieldByName(uf.Column())
+		if !ok || !f.IsNormal {
+			return nil, fmt.Errorf("unknown column %s", uf.Column())
+		}
+		if f.IsPrimaryKey || f.DBName == pk || seen[f.DBName] {
+			continue
+		}
+		seen[f.DBName] = true
+		fields = append(fields, f)
+	}
+	for _, f := range scope.Fields() {
+		if _, ok := f.TagSettingsGet("AUTOUPDATETIME"); ok && f.IsNormal && !seen[f.DBName] {
+			seen[f.DBName] = true
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+// updateRows 以一条语句更新 scopes
+func (e *Repository) updateRows(ctx context.Context, db *gorm.DB, scopes []*execScope, fields []*gorm.Field) error {
+	first := scopes[0].scope
+	table := first.QuotedTableName()
+	pk := e.PrimaryField().Column()
+	ids := make([]interface{}, 0, len(scopes))
+	for _, es := range scopes {
+		id, _ := e.primaryValue(es.model)
+		ids = append(ids, id)
+	}
+	condition, err := e.mandatory(ctx, e.PrimaryField().In(ids))
+	if err != nil {
+		return err
+	}
+	where, whereArgs := condition.flattenDialect(db.Dialect().GetName())
+
+	var sql string
+	var vars []interface{}
+	if db.Dialect().GetName() == DialectPostgres {
+		// 第一行为表的行类型的 NULL, 用来确定 VALUES 各列的类型, 不会匹配任何行
+		aliases := []string{"c0"}
+		typed := []string{fmt.Sprintf("(NULL::%s).%s", table, first.Quote(pk))}
+		var sets []string
+		for i, f := range fields {
+			alias := fmt.Sprintf("c%d", i+1)
+			aliases = append(aliases, alias)
+			typed = append(typed, fmt.Sprintf("(NULL::%s).%s", table, first.Quote(f.DBName)))
+			sets = append(sets, fmt.Sprintf("%s = v.%s", first.Quote(f.DBName), alias))
+		}
+		rows := []string{"(" + strings.Join(typed, ",") + ")"}
+		rowPlaceholder := "(" + strings.TrimSuffix(strings.Repeat("?,", len(fields)+1), ",") + ")"
+		for i, es := range scopes {
+			rows = append(rows, rowPlaceholder)
+			vars = append(vars, ids[i])
+			for _, f := range fields {
+				rf, _ := es.scope.FieldByName(f.Name)
+				vars = append(vars, rf.Field.Interface())
+			}
+		}
+		// where 中的列不带表名, 因此 VALUES 的列使用别名避免冲突
+		sql = fmt.Sprintf("UPDATE %s SET %s FROM (VALUES %s) AS v(%s) WHERE %s.%s = v.c0 AND %s",
+			table, strings.Join(sets, ", "), strings.Join(rows, ","), strings.Join(aliases, ","), table, first.Quote(pk), where)
+	} else {
+		var sets []string
+		for _, f := range fields {
+			var sb strings.Builder
+			fmt.Fprintf(&sb, "%s = CASE %s", first.Quote(f.DBName), first.Quote(pk))
+			for i, es := range scopes {
+				rf, _ := es.scope.FieldByName(f.Name)
+				sb.WriteString(" WHEN ? THEN ?")
+				vars = append(vars, ids[i], rf.Field.Interface())
+			}
+			fmt.Fprintf(&sb, " ELSE %s END", first.Quote(f.DBName))
+			sets = append(sets, sb.String())
+		}
+		sql = fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, strings.Join(sets, ", "), where)
+	}
+	return execRaw(ctx, db, sql, append(vars, whereArgs...)...).Error
+}
@@ -0,0 +1,440 @@
+package repository
+
+import (
+	"container/list"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueryCache 缓存 Find 的结果, 配置到 Repository.QueryCache 后, Find 会先查缓存.
+// 缓存中的数据是共享的, 调用方不应修改返回的 model
+type QueryCache interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, val interface{}, ttl time.Duration)
+	Delete(key string)
+}
+
+// defaultMemoryCacheEntries NewMemoryQueryCache 默认的最大条目数
+const defaultMemoryCacheEntries = 10000
+
+type memoryCacheItem struct {
+	key      string
+	val      interface{}
+	expireAt time.Time
+}
+
+// memoryQueryCache LRU, 超过 maxEntries 时淘汰最久未使用的条目
+type memoryQueryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	lru        *list.List
+	items      map[string]*list.Element
+}
+
+// NewMemoryQueryCache 进程内的 QueryCache, ttl <= 0 表示不过期. maxEntries 为最大条目数, 默认 10000
+func NewMemoryQueryCache(maxEntries ...int) QueryCache {
+	mc := &memoryQueryCache{maxEntries: defaultMemoryCacheEntries, lru: list.New(), items: make(map[string]*list.Element)}
+	if len(maxEntries) > 0 && maxEntries[0] > 0 {
+		mc.maxEntries = maxEntries[0]
+	}
+	return mc
+}
+
+func (mc *memoryQueryCache) Get(key string) (interface{}, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	elem, ok := mc.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*memoryCacheItem)
+	if !item.expireAt.IsZero() && time.Now().After(item.expireAt) {
+		mc.remove(elem)
+		return nil, false
+	}
+	mc.lru.MoveToFront(elem)
+	return item.val, true
+}
+
+func (mc *memoryQueryCache) Set(key string, val interface{}, ttl time.Duration) {
+	item := &memoryCacheItem{key: key, val: val}
+	if ttl > 0 {
+		item.expireAt = time.Now().Add(ttl)
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if elem, ok := mc.items[key]; ok {
+		elem.Value = item
+		mc.lru.MoveToFront(elem)
+		return
+	}
+	mc.items[key] = mc.lru.PushFront(item)
+	for mc.lru.Len() > mc.maxEntries {
+		mc.remove(mc.lru.Back())
+	}
+}
+
+func (mc *memoryQueryCache) Delete(key string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if elem, ok := mc.items[key]; ok {
+		mc.remove(elem)
+	}
+}
+
+func (mc *memoryQueryCache) remove(elem *list.Element) {
+	mc.lru.Remove(elem)
+	delete(mc.items, elem.Value.(*memoryCacheItem).key)
+}
+
+// errNotCacheable options 中有无法作为缓存 key 的 Option (如 Lock, 自定义的 Option), 此时不使用缓存
+var errNotCacheable = errors.New("query is not cacheable")
+
+// queryCacheKey 表名 + where(包括 MandatoryCondition 和租户条件) + options, 参见 describeOptions
+func (e *Repository) queryCacheKey(ctx context.Context, condition Condition, options ...Option) (string, error) {
+	condition, err := e.mandatory(ctx, condition)
+	if err != nil {
+		return "", err
+	}
+	sql, args := condition.flatten()
+	vars, err := describeArgs(args)
+	if err != nil {
+		return "", err
+	}
+	opts, err := describeOptions(ctx, options)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s|%s|%s|%s", e.tableFor(ctx), sql, vars, opts), nil
+}
+
+// describeOptions 把影响查询结果的 options 转换为字符串, 有无法转换的 Option 时返回 errNotCacheable
+func describeOptions(ctx context.Context, options []Option) (string, error) {
+	parts := make([]string, 0, len(options))
+	for _, opt := range options {
+		var part string
+		switch o := opt.(type) {
+		case *cachedOption, *statementTimeoutOption, *maxStalenessOption:
+			// 不影响结果
+			continue
+		case *limitOption:
+			part = fmt.Sprintf("limit(%d,%d)", o.offset, o.limit)
+		case *orderOption:
+			part = fmt.Sprintf("order(%s %s)", o.field.Column(), o.order.String())
+		case *orderByOption:
+			pairs := make([]string, 0, len(o.pairs))
+			for _, p := range o.pairs {
+				target := p.Expr
+				if target == "" {
+					target = p.Field.Column()
+				}
+				args, err := describeArgs(p.Args)
+				if err != nil {
+					return "", err
+				}
+				pairs = append(pairs, fmt.Sprintf("%s %d %d %s", target, p.Order, p.Nulls, args))
+			}
+			part = fmt.Sprintf("orderBy(%s)", strings.Join(pairs, ","))
+		case *selectOption:
+			args, err := describeArgs(o.args)
+			if err != nil {
+				return "", err
+			}
+			part = fmt.Sprintf("select(%s %s)", describeFields(o.columns), args)
+		case *writeColumnsOption:
+			part = fmt.Sprintf("columns(%s %t)", describeFields(o.columns), o.omit)
+		case *hintOption:
+			part = fmt.Sprintf("hint(%s)", o.hint)
+		case *useIndexOption:
+			part = fmt.Sprintf("index(%s)", strings.Join(o.indexes, ","))
+		case *tableOption:
+			part = fmt.Sprintf("table(%s)", o.table)
+		case *joinOption:
+			args, err := describeArgs(o.args)
+			if err != nil {
+				return "", err
+			}
+			part = fmt.Sprintf("join(%s %s)", o.query, args)
+		case *groupOption:
+			part = fmt.Sprintf("group(%s)", describeFields(o.fields))
+		case *idOrderOption:
+			ids, err := describeArgs(o.ids)
+			if err != nil {
+				return "", err
+			}
+			part = fmt.Sprintf("idOrder(%s %s)", o.column, ids)
+		case *nearestOption:
+			part = fmt.Sprintf("nearest(%s %v %v %d)", o.field.Column(), o.lat, o.lng, o.n)
+		case *preloadOption:
+			conds := make([]string, 0, len(o.conds))
+			for _, c := range o.conds {
+				sql, args := c.flatten()
+				vars, err := describeArgs(args)
+				if err != nil {
+					return "", err
+				}
+				conds = append(conds, sql+" "+vars)
+			}
+			part = fmt.Sprintf("preload(%s %s)", o.association, strings.Join(conds, ","))
+		case *withOption:
+			q := o.query
+			sub, err := q.Repo.queryCacheKey(ctx, q.condition(), q.options()...)
+			if err != nil {
+				return "", err
+			}
+			part = fmt.Sprintf("with(%s %t %s %s %s)", o.name, o.recursive, o.column, o.refColumn, sub)
+		default:
+			return "", errNotCacheable
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "|"), nil
+}
+
+// describeArgs 把参数编码为 JSON 数组, 每个参数为 "类型:JSON", 因此 "1" 与 1, []string{"a b"} 与 []string{"a", "b"} 不会相同.
+// driver.Valuer (如 pq.Array) 按 Value() 编码, 其他指针按指向的值编码; 无法编码的参数返回 errNotCacheable
+func describeArgs(args []interface{}) (string, error) {
+	parts := make([]string, 0, len(args))
+	for _, arg := range args {
+		rv := reflect.ValueOf(arg)
+		if valuer, ok := arg.(driver.Valuer); ok && (rv.Kind() != reflect.Ptr || !rv.IsNil()) {
+			v, err := valuer.Value()
+			if err != nil {
+				return "", errNotCacheable
+			}
+			rv = reflect.ValueOf(v)
+		}
+		for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+			rv = rv.Elem()
+		}
+		typ, val := "nil", interface{}(nil)
+		if rv.IsValid() && rv.Kind() != reflect.Ptr {
+			typ, val = rv.Type().String(), rv.Interface()
+		}
+		b, err := json.Marshal(val)
+		if err != nil {
+			return "", errNotCacheable
+		}
+		parts = append(parts, typ+":"+string(b))
+	}
+	b, err := json.Marshal(parts)
+	if err != nil {
+		return "", errNotCacheable
+	}
+	return string(b), nil
+}
+
+func describeFields(fields []FieldInterface) string {
+	cols := make([]string, 0, len(fields))
+	for _, f := range fields {
+		cols = append(cols, f.Column())
+	}
+	return strings.Join(cols, ",")
+}
+
+// cachedFind 命中时返回 slice 的副本, 并按 ctx 执行 afterFindCallback
+func (e *Repository) cachedFind(ctx context.Context, condition Condition, options ...Option) (interface{}, bool, error) {
+	if e.QueryCache == nil {
+		return nil, false, nil
+	}
+	key, err := e.queryCacheKey(ctx, condition, options...)
+	if err != nil {
+		return nil, false, nil
+	}
+	val, ok := e.QueryCache.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	slice, err := e.cachedRows(ctx, val)
+	return slice, true, err
+}
+
+// rawFindKey ctx 中为 true 时 findNoCache 不执行 afterFindCallback. 缓存中保存的是未经 Policy 及 AfterFind 处理的行,
+// 每次命中时再按调用方的 ctx 对副本执行
+type rawFindKey struct{}
+
+func withRawFind(ctx context.Context) context.Context {
+	return context.WithValue(ctx, rawFindKey{}, true)
+}
+
+// cachedRows 复制缓存中的 slice 指针 val, 对每一行执行 afterFindCallback (Policy.CanRead, AfterFind 回调及 AfterRepoFind)
+func (e *Repository) cachedRows(ctx context.Context, val interface{}) (interface{}, error) {
+	slice := copySlice(val)
+	if err := e.afterFindCallback(ctx, slice); err != nil {
+		return nil, err
+	}
+	return slice, nil
+}
+
+// copySlice 返回 slice 指针 val 的副本, 每一行都复制, 回调及调用方的修改不影响缓存
+func copySlice(val interface{}) interface{} {
+	src := reflect.ValueOf(val).Elem()
+	dst := reflect.MakeSlice(src.Type(), 0, src.Len())
+	for i := 0; i < src.Len(); i++ {
+		dst = appendRow(dst, src.Index(i).Interface())
+	}
+	slice := reflect.New(src.Type())
+	slice.Elem().Set(dst)
+	return slice.Interface()
+}
+
+type cachedOption struct {
+	ttl time.Duration
+	key string
+}
+
+// Cached 把 Find/FindAndCount 的结果写入 Repository.QueryCache, ttl 内相同的查询直接返回缓存, 用于枚举, 配置表等
+// 开销大且很少变化的查询. key 为空时以表名, sql (包括 MandatoryCondition 及租户条件), 参数及 options 作为 key.
+// 没有配置 QueryCache 时不生效
+func Cached(ttl time.Duration, key ...string) Option {
+	return &cachedOption{ttl: ttl, key: strings.Join(key, ":")}
+}
+
+// Sql Find 中处理, 这里不修改查询
+func (co *cachedOption) Sql(db *gorm.DB) *gorm.DB {
+	return db
+}
+
+func cachedOptionOf(options []Option) *cachedOption {
+	for _, opt := range options {
+		if co, ok := opt.(*cachedOption); ok {
+			return co
+		}
+	}
+	return nil
+}
+
+// resultCacheKey kind 为 find 或 count, 没有指定 key 时同 queryCacheKey
+func (e *Repository) resultCacheKey(ctx context.Context, kind string, co *cachedOption, condition Condition, options []Option) (string, error) {
+	if co.key != "" {
+		return fmt.Sprintf("%s|%s|%s", e.tableFor(ctx), kind, co.key), nil
+	}
+	key, err := e.queryCacheKey(ctx, condition, options...)
+	if err != nil {
+		return "", err
+	}
+	return kind + "|" + key, nil
+}
+
+// findResultCached 未命中时查询数据库并写入缓存, options 无法作为 key 时不使用缓存
+func (e *Repository) findResultCached(ctx context.Context, co *cachedOption, condition Condition, options []Option) (interface{}, error) {
+	key, err := e.resultCacheKey(ctx, "find", co, condition, options)
+	if err != nil && err != errNotCacheable {
+		return nil, err
+	}
+	if err == nil {
+		if val, ok := e.QueryCache.Get(key); ok {
+			return e.cachedRows(ctx, val)
+		}
+	}
+	cacheable := err == nil
+	findCtx := ctx
+	if cacheable {
+		findCtx = withRawFind(ctx)
+	}
+	var slice interface{}
+	if e.routed(ctx) {
+		slice, err = e.findRouted(findCtx, condition, options)
+	} else {
+		var chunked bool
+		if slice, chunked, err = e.findInChunks(findCtx, condition, options); !chunked {
+			slice, err = e.findNoCache(findCtx, condition, options...)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !cacheable {
+		return slice, nil
+	}
+	e.QueryCache.Set(key, slice, co.ttl)
+	return e.cachedRows(ctx, slice)
+}
+
+// countResultCached 同 findResultCached, 缓存 Count 的结果
+func (e *Repository) countResultCached(ctx context.Context, co *cachedOption, condition Condition, options []Option) (int, error) {
+	key, err := e.resultCacheKey(ctx, "count", co, condition, countOptions(options))
+	if err == errNotCacheable {
+		return e.Count(ctx, condition, options...)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if val, ok := e.QueryCache.Get(key); ok {
+		return val.(int), nil
+	}
+	total, err := e.Count(ctx, condition, options...)
+	if err != nil {
+		return 0, err
+	}
+	e.QueryCache.Set(key, total, co.ttl)
+	return total, nil
+}
+
+// PreloadSpec 一个需要预热的 Find 查询, Repo 需要配置 QueryCache
+type PreloadSpec struct {
+	Repo      *Repository
+	Condition Condition
+	Options   []Option
+	// TTL 缓存过期时间, <= 0 表示不过期
+	TTL time.Duration
+	// Refresh 刷新间隔, <= 0 表示不刷新
+	Refresh time.Duration
+}
+
+func (ps *PreloadSpec) load(ctx context.Context) error {
+	if ps.Repo.QueryCache == nil {
+		return fmt.Errorf("preload %s: QueryCache is not set", ps.Repo.TableName())
+	}
+	key, err := ps.Repo.queryCacheKey(ctx, ps.Condition, ps.Options...)
+	if err != nil {
+		return err
+	}
+	// 绕过缓存读取数据库, afterFindCallback 在命中时按调用方的 ctx 执行
+	slice, err := ps.Repo.findNoCache(withRawFind(ctx), ps.Condition, ps.Options...)
+	if err != nil {
+		return err
+	}
+	ps.Repo.QueryCache.Set(key, slice, ps.TTL)
+	return nil
+}
+
+// PreloadCache 启动时执行 specs 中的查询并写入缓存, 任何一个失败都会返回 error.
+// 设置了 Refresh 的查询会在后台定期刷新, 直到 ctx 结束; 刷新失败时保留旧数据
+func PreloadCache(ctx context.Context, specs []PreloadSpec) error {
+	for i := range specs {
+		if err := specs[i].load(ctx); err != nil {
+			return err
+		}
+	}
+	for i := range specs {
+		ps := specs[i]
+		if ps.Refresh <= 0 {
+			continue
+		}
+		go func() {
+			ticker := time.NewTicker(ps.Refresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := ps.load(ctx); err != nil {
+						Warn("[repository] refresh preloaded cache failed", zap.String("table", ps.Repo.TableName()), zap.Error(err))
+					}
+				}
+			}
+		}()
+	}
+	return nil
+}
@@ -3,10 +3,106 @@ package repository
 import (
 	"context"
 	"github.com/jinzhu/gorm"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+// CallbackPhase 回调执行的阶段
+type CallbackPhase string
+
+const (
+	// BeforeValidate 在 Create/Save 校验前, 参见 SetValidator
+	BeforeValidate CallbackPhase = "before_validate"
+	BeforeCreate   CallbackPhase = "before_create"
+	AfterCreate    CallbackPhase = "after_create"
+	BeforeUpdate   CallbackPhase = "before_update"
+	AfterUpdate    CallbackPhase = "after_update"
+	// AfterFind 在 Find/FindOne/FindByIds 读取(并解密)后对每一行执行, model 为行的指针
+	AfterFind CallbackPhase = "after_find"
+)
+
+// RepoCallback 注册到 Repository 的回调, model 为 Create/Save 的 model 或 Update 的 update, 返回 error 时中止操作
+type RepoCallback func(ctx context.Context, rep *Repository, model interface{}) error
+
+type callbackEntry struct {
+	order int
+	fn    RepoCallback
+}
+
+// CallbackOption 注册回调的选项
+type CallbackOption func(*callbackEntry)
+
+// CallbackOrder 同一阶段的回调按 order 从小到大执行, 相同时按注册顺序. 默认为 0.
+// order < 0 的回调在 model 自身的 hook(如 BeforeRepoCreate)之前执行, 其余在之后
+func CallbackOrder(order int) CallbackOption {
+	return func(c *callbackEntry) {
+		c.order = order
+	}
+}
+
+var (
+	globalCallbacks    = make(map[CallbackPhase][]callbackEntry)
+	globalCallbackLock sync.RWMutex
+)
+
+// RegisterGlobalCallback 注册对所有 Repository 生效的回调(如审计, 指标), 先于 Repository.RegisterCallback 的回调执行.
+// 应在 main 中初始化时调用
+func RegisterGlobalCallback(phase CallbackPhase, fn RepoCallback, opts ...CallbackOption) {
+	globalCallbackLock.Lock()
+	defer globalCallbackLock.Unlock()
+	globalCallbacks[phase] = appendCallback(globalCallbacks[phase], fn, opts)
+}
+
+// RegisterCallback 注册仅对当前 Repository 生效的回调, 不需要修改 model 的类型. 应在初始化时调用
+func (e *Repository) RegisterCallback(phase CallbackPhase, fn RepoCallback, opts ...CallbackOption) {
+	if e.callbacks == nil {
+		e.callbacks = make(map[CallbackPhase][]callbackEntry)
+	}
+	e.callbacks[phase] = appendCallback(e.callbacks[phase], fn, opts)
+}
+
+func appendCallback(list []callbackEntry, fn RepoCallback, opts []CallbackOption) []callbackEntry {
+	c := callbackEntry{fn: fn}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	list = append(list, c)
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].order < list[j].order
+	})
+	return list
+}
+
+// runCallbacks 执行 phase 的全局及 Repository 的回调, hook 为 model 自身的 hook, 在 order < 0 的回调之后执行
+func (e *Repository) runCallbacks(ctx context.Context, phase CallbackPhase, model interface{}, hook func() error) error {
+	globalCallbackLock.RLock()
+	list := append([]callbackEntry(nil), globalCallbacks[phase]...)
+	globalCallbackLock.RUnlock()
+	list = append(list, e.callbacks[phase]...)
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].order < list[j].order
+	})
+	hooked := hook == nil
+	for _, c := range list {
+		if !hooked && c.order >= 0 {
+			hooked = true
+			if err := hook(); err != nil {
+				return err
+			}
+		}
+		if err := c.fn(ctx, e, model); err != nil {
+			return err
+		}
+	}
+	if !hooked {
+		return hook()
+	}
+	return nil
+}
+
 type execScope struct {
 	model interface{}
 	scope *gorm.Scope
@@ -19,21 +115,41 @@ func (es *execScope) beforeRepoCreateCallback(ctx context.Context, data Model) (
 		return err
 	}
 
-	if i0, ok := data.(interface {
-		BeforeRepoCreate(ctx context.Context) error
-	}); ok {
-		err = i0.BeforeRepoCreate(ctx)
+	if err = es.handleAutoIdTag(ctx); err != nil {
+		return err
+	}
+
+	if err = es.rep.stampTenant(ctx, es.scope); err != nil {
+		return err
 	}
-	return
+
+	err = es.rep.runCallbacks(ctx, BeforeCreate, data, func() error {
+		if i0, ok := data.(interface {
+			BeforeRepoCreate(ctx context.Context) error
+		}); ok {
+			return i0.BeforeRepoCreate(ctx)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return encryptFields(ctx, data)
 }
 
 func (es *execScope) afterRepoCreateCallback(ctx context.Context, data Model) (err error) {
-	if i0, ok := data.(interface {
-		AfterRepoCreate(ctx context.Context) error
-	}); ok {
-		err = i0.AfterRepoCreate(ctx)
+	// 写入后恢复明文
+	if err = decryptFields(ctx, data); err != nil {
+		return err
 	}
-	return
+	return es.rep.runCallbacks(ctx, AfterCreate, data, func() error {
+		if i0, ok := data.(interface {
+			AfterRepoCreate(ctx context.Context) error
+		}); ok {
+			return i0.AfterRepoCreate(ctx)
+		}
+		return nil
+	})
 }
 
 func (es *execScope) beforeRepoUpdateCallback(ctx context.Context, data interface{}) (err error) {
@@ -42,21 +158,64 @@ func (es *execScope) beforeRepoUpdateCallback(ctx context.Context, data interfac
 		return err
 	}
 
-	if i0, ok := data.(interface {
-		BeforeRepoUpdate(ctx context.Context) error
-	}); ok {
-		err = i0.BeforeRepoUpdate(ctx)
+	err = es.rep.runCallbacks(ctx, BeforeUpdate, data, func() error {
+		if i0, ok := data.(interface {
+			BeforeRepoUpdate(ctx context.Context) error
+		}); ok {
+			return i0.BeforeRepoUpdate(ctx)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	return
+	return encryptUpdate(ctx, es.rep.Value, data)
 }
 
 func (es *execScope) afterRepoUpdateCallback(ctx context.Context, data Model) (err error) {
-	if i0, ok := data.(interface {
-		AfterRepoUpdate(ctx context.Context) error
-	}); ok {
-		err = i0.AfterRepoUpdate(ctx)
+	if err = decryptFields(ctx, data); err != nil {
+		return err
 	}
-	return
+	return es.rep.runCallbacks(ctx, AfterUpdate, data, func() error {
+		if i0, ok := data.(interface {
+			AfterRepoUpdate(ctx context.Context) error
+		}); ok {
+			return i0.AfterRepoUpdate(ctx)
+		}
+		return nil
+	})
+}
+
+// afterFindCallback 对 data (struct 指针或 slice 指针)的每一行执行 AfterFind 的回调及 model 的 AfterRepoFind
+func (e *Repository) afterFindCallback(ctx context.Context, data interface{}) error {
+	v := Indirect(reflect.ValueOf(data))
+	if v.Kind() != reflect.Slice {
+		return e.afterFindRow(ctx, data)
+	}
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i)
+		if elem.Kind() != reflect.Ptr {
+			elem = elem.Addr()
+		}
+		if err := e.afterFindRow(ctx, elem.Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Repository) afterFindRow(ctx context.Context, row interface{}) error {
+	if err := e.checkRead(ctx, row); err != nil {
+		return err
+	}
+	return e.runCallbacks(ctx, AfterFind, row, func() error {
+		if i0, ok := row.(interface {
+			AfterRepoFind(ctx context.Context) error
+		}); ok {
+			return i0.AfterRepoFind(ctx)
+		}
+		return nil
+	})
 }
 
 func (es *execScope) handleAutoTimeTag(tag string) (err error) {
@@ -83,8 +242,8 @@ func (es *execScope) handleAutoTimeTag(tag string) (err error) {
 
 // Model 实现此接口, DeleteById 将会通过 Updates 执行, 需要update 哪些字段, 请在 BeforeSoftDelete 中实现
 type SoftDeleteHook interface {
-	// 在 Delete, DeleteById 中生效
+	// 在 Delete, DeleteById, DeleteByIds 中生效
 	BeforeSoftDelete(ctx context.Context) error
-	// 仅在 DeleteById 时调用
+	// 仅在 DeleteById, DeleteByIds 时调用
 	AfterSoftDelete(ctx context.Context) error
 }
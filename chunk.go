@@ -0,0 +1,250 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+const defaultInChunkSize = 1000
+
+func (e *Repository) inChunkSize() int {
+	switch {
+	case e.InChunkSize == 0:
+		return defaultInChunkSize
+	case e.InChunkSize < 0:
+		return 0
+	}
+	return e.InChunkSize
+}
+
+// splitIn condition 中以 AND 连接的 In 条件(有多个时取值最多的一个)去重后超过 size 个值时, 拆分为每个最多 size 个值的条件,
+// 各部分匹配的行不重叠; 不需要拆分时返回 nil
+func splitIn(condition Condition, size int) []Condition {
+	target := largestIn(condition)
+	if target == nil || size <= 0 || idsLen(target.rawVal1) <= size {
+		return nil
+	}
+	values := uniqueIds(target.rawVal1)
+	if len(values) <= size {
+		return nil
+	}
+	var parts []Condition
+	for start := 0; start < len(values); start += size {
+		end := start + size
+		if end > len(values) {
+			end = len(values)
+		}
+		chunk := values[start:end]
+		leaf := &singleCondition{field: target.field, op: c_In, sqlArg1: inValues(chunk), rawVal1: chunk}
+		parts = append(parts, replaceCondition(condition, target, leaf))
+	}
+	return parts
+}
+
+func largestIn(condition Condition) *singleCondition {
+	var best *singleCondition
+	larger := func(c *singleCondition) {
+		if c != nil && (best == nil || idsLen(c.rawVal1) > idsLen(best.rawVal1)) {
+			best = c
+		}
+	}
+	switch c := condition.(type) {
+	case *singleCondition:
+		if c.op == c_In {
+			return c
+		}
+	case *compoundCondition:
+		if c.logic == and {
+			larger(largestIn(c.condition1))
+			larger(largestIn(c.condition2))
+		}
+	case *conditionGroup:
+		if c.logic == and {
+			for _, child := range c.conditions {
+				larger(largestIn(child))
+			}
+		}
+	}
+	return best
+}
+
+// replaceCondition 复制 condition, 其中的 target 替换为 with
+func replaceCondition(condition Condition, target *singleCondition, with Condition) Condition {
+	switch c := condition.(type) {
+	case *singleCondition:
+		if c == target {
+			return with
+		}
+	case *compoundCondition:
+		return &compoundCondition{
+			condition1: replaceCondition(c.condition1, target, with),
+			condition2: replaceCondition(c.condition2, target, with),
+			logic:      c.logic,
+		}
+	case *conditionGroup:
+		conds := make([]Condition, len(c.conditions))
+		for i, child := range c.conditions {
+			conds[i] = replaceCondition(child, target, with)
+		}
+		return &conditionGroup{conditions: conds, logic: c.logic}
+	}
+	return condition
+}
+
+// splittable 拆分后各部分的结果可以合并: 没有分组, 聚合, CTE, 距离排序及表达式排序
+func splittable(options []Option) bool {
+	for _, opt := range options {
+		switch o := opt.(type) {
+		case *groupOption, *withOption, *nearestOption, *explainAnalyzeOption:
+			return false
+		case *orderByOption:
+			for _, p := range o.pairs {
+				if p.Expr != "" {
+					return false
+				}
+			}
+		case *selectOption:
+			for _, c := range o.columns {
+				if _, ok := c.(*reduceFieldImpl); ok {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// findInChunks condition 中的 In 超过 InChunkSize 个值时按 splitIn 拆分查询并合并, ok 为 false 时不需要拆分
+func (e *Repository) findInChunks(ctx context.Context, condition Condition, options []Option) (slice interface{}, ok bool, err error) {
+	if !splittable(options) || !e.mergeableOrders(options) {
+		return nil, false, nil
+	}
+	parts := splitIn(condition, e.inChunkSize())
+	if parts == nil {
+		return nil, false, nil
+	}
+	slice, err = e.findMerged(ctx, options, len(parts), func(i int, options []Option) (interface{}, error) {
+		return e.findNoCache(ctx, parts[i], options...)
+	})
+	return slice, true, err
+}
+
+// countInChunks 同 findInChunks, 各部分 Count 的和
+func (e *Repository) countInChunks(ctx context.Context, condition Condition, options []Option) (total int, ok bool, err error) {
+	for _, opt := range countOptions(options) {
+		switch opt.(type) {
+		case *groupOption, *selectOption, *withOption:
+			return 0, false, nil
+		}
+	}
+	parts := splitIn(condition, e.inChunkSize())
+	if parts == nil {
+		return 0, false, nil
+	}
+	for _, part := range parts {
+		n, err := e.count(ctx, part, options...)
+		if err != nil {
+			return 0, true, err
+		}
+		total += n
+	}
+	return total, true, nil
+}
+
+// findByIdChunks 每 size 个 id 执行一次查询并合并结果, 数据库不需要处理(及规划)超长的 IN 列表. ordered 时每次查询按 ids 的顺序排序
+func (e *Repository) findByIdChunks(ctx context.Context, ids []interface{}, size int, additional []Condition, ordered bool) (interface{}, error) {
+	slice := e.NewSlice()
+	merged := reflect.ValueOf(slice).Elem()
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+		cond := e.PrimaryField().In(ids[start:end])
+		if len(additional) > 0 {
+			cond = cond.And(MatchAll(additional...))
+		}
+		var options []Option
+		if ordered {
+			options = append(options, &idOrderOption{column: e.PrimaryField().Column(), ids: ids[start:end]})
+		}
+		part, err := e.Find(ctx, cond, options...)
+		if err != nil {
+			return e.NewSlice(), err
+		}
+		merged = reflect.AppendSlice(merged, reflect.ValueOf(part).Elem())
+	}
+	reflect.ValueOf(slice).Elem().Set(merged)
+	return slice, nil
+}
+
+// FindByIdsOrdered 同 FindByIds, 但先去掉重复的 id, 结果按 ids 的顺序(postgres 按 array_position, mysql 按 FIELD 排序), 不存在的 id 被跳过.
+// ids 为 nil 或不是 slice 时返回空 slice
+func (e *Repository) FindByIdsOrdered(ctx context.Context, ids interface{}, additional ...Condition) (interface{}, error) {
+	unique := uniqueIds(ids)
+	if len(unique) == 0 {
+		return e.NewSlice(), nil
+	}
+	size := e.inChunkSize()
+	if size <= 0 {
+		size = len(unique)
+	}
+	return e.findByIdChunks(ctx, unique, size, additional, true)
+}
+
+// idOrderOption 按 ids 中的位置排序
+type idOrderOption struct {
+	column string
+	ids    []interface{}
+}
+
+func (io *idOrderOption) Sql(db *gorm.DB) *gorm.DB {
+	switch db.Dialect().GetName() {
+	case DialectPostgres:
+		return db.Order(gorm.Expr(fmt.Sprintf("array_position(?, %s)", io.column), pq.Array(inValues(io.ids))))
+	case DialectMysql:
+		return db.Order(gorm.Expr(fmt.Sprintf("FIELD(%s%s)", io.column, strings.Repeat(", ?", len(io.ids))), io.ids...))
+	}
+	var sb strings.Builder
+	sb.WriteString("CASE " + io.column)
+	args := make([]interface{}, 0, len(io.ids))
+	for i, id := range io.ids {
+		sb.WriteString(fmt.Sprintf(" WHEN ? THEN %d", i))
+		args = append(args, id)
+	}
+	sb.WriteString(" END")
+	return db.Order(gorm.Expr(sb.String(), args...))
+}
+
+// idsLen ids 的长度, nil 或不是 slice 时为 0
+func idsLen(ids interface{}) int {
+	v := reflect.ValueOf(ids)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return 0
+	}
+	return v.Len()
+}
+
+// uniqueIds 去重, 保持第一次出现的顺序, 数值类型的 id 按 staticKey 精确比较
+func uniqueIds(ids interface{}) []interface{} {
+	if idsLen(ids) == 0 {
+		return []interface{}{}
+	}
+	v := reflect.ValueOf(ids)
+	seen := make(map[interface{}]bool, v.Len())
+	unique := make([]interface{}, 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		id := v.Index(i).Interface()
+		if seen[staticKey(id)] {
+			continue
+		}
+		seen[staticKey(id)] = true
+		unique = append(unique, id)
+	}
+	return unique
+}
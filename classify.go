@@ -0,0 +1,489 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// 数据分级 tag, 例如
+//
+//	Phone    string `repo:"pii,mask=phone"`
+//	Password string `repo:"secret"`
+//	IdCard   string `repo:"pii,encrypt"`
+//
+// pii: 日志中按 mask profile 脱敏;
+// secret: 日志中完全隐藏, Find 默认不查询(需要显式 Select), 配置了 FieldCipher 时加密存储;
+// encrypt: pii 字段也加密存储
+const classTagName = "repo"
+
+type Classification string
+
+const (
+	ClassNone   Classification = ""
+	ClassPII    Classification = "pii"
+	ClassSecret Classification = "secret"
+)
+
+// FieldClass 一个带分级 tag 的字段
+type FieldClass struct {
+	Name    string
+	Column  string
+	Class   Classification
+	Mask    string
+	Encrypt bool
+}
+
+func parseClassTag(tag string) (fc FieldClass, ok bool) {
+	if tag == "" {
+		return
+	}
+	for _, part := range strings.Split(tag, ",") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == string(ClassPII):
+			fc.Class = ClassPII
+		case part == string(ClassSecret):
+			fc.Class = ClassSecret
+			fc.Encrypt = true
+		case part == "encrypt":
+			fc.Encrypt = true
+		case strings.HasPrefix(part, "mask="):
+			fc.Mask = part[len("mask="):]
+		}
+	}
+	if fc.Class == ClassNone {
+		return fc, false
+	}
+	if fc.Mask == "" {
+		fc.Mask = MaskAll
+	}
+	return fc, true
+}
+
+var classCache sync.Map // reflect.Type -> []FieldClass
+
+// ClassifiedFields 返回 model 中带分级 tag 的字段
+func ClassifiedFields(model interface{}) []FieldClass {
+	rt := Indirect(reflect.ValueOf(model)).Type()
+	if v, ok := classCache.Load(rt); ok {
+		return v.([]FieldClass)
+	}
+	var fcs []FieldClass
+	for _, sf := range (&gorm.Scope{}).New(NewStruct(model)).GetModelStruct().StructFields {
+		fc, ok := parseClassTag(sf.Tag.Get(classTagName))
+		if !ok {
+			continue
+		}
+		fc.Name = sf.Name
+		fc.Column = sf.DBName
+		fcs = append(fcs, fc)
+	}
+	classCache.Store(rt, fcs)
+	return fcs
+}
+
+// mask profiles
+const (
+	MaskAll   = "all"
+	MaskEmail = "email"
+	MaskPhone = "phone"
+	MaskName  = "name"
+)
+
+var maskProfiles = map[string]func(string) string{
+	MaskAll: func(string) string {
+		return "***"
+	},
+	MaskEmail: func(s string) string {
+		at := strings.LastIndex(s, "@")
+		if at <= 0 {
+			return "***"
+		}
+		r, _ := utf8.DecodeRuneInString(s)
+		return string(r) + "***" + s[at:]
+	},
+	MaskPhone: func(s string) string {
+		if len(s) <= 4 {
+			return "***"
+		}
+		return "***" + s[len(s)-4:]
+	},
+	MaskName: func(s string) string {
+		if s == "" {
+			return ""
+		}
+		r, _ := utf8.DecodeRuneInString(s)
+		return string(r) + "**"
+	},
+}
+var maskLock sync.RWMutex
+
+// RegisterMaskProfile 注册(或覆盖)一个 mask profile, 应在 init 中调用
+func RegisterMaskProfile(name string, fn func(string) string) {
+	maskLock.Lock()
+	defer maskLock.Unlock()
+	maskProfiles[name] = fn
+}
+
+// MaskValue 用 profile 脱敏 val, 未知的 profile 按 MaskAll 处理
+func MaskValue(profile string, val string) string {
+	maskLock.RLock()
+	fn, ok := maskProfiles[profile]
+	maskLock.RUnlock()
+	if !ok {
+		fn = maskProfiles[MaskAll]
+	}
+	return fn(val)
+}
+
+// Redact 返回 model 的 column -> value, pii 字段按 mask profile 脱敏, secret 字段隐藏. 用于日志
+func Redact(model interface{}) interface{} {
+	v := Indirect(reflect.ValueOf(model))
+	if v.Kind() != reflect.Struct {
+		return model
+	}
+	fcs := ClassifiedFields(model)
+	if len(fcs) == 0 {
+		return model
+	}
+	classes := make(map[string]FieldClass, len(fcs))
+	for _, fc := range fcs {
+		classes[fc.Name] = fc
+	}
+	out := make(map[string]interface{})
+	for _, f := range (&gorm.Scope{}).New(model).Fields() {
+		if !f.IsNormal {
+			continue
+		}
+		fc, ok := classes[f.Name]
+		switch {
+		case !ok:
+			out[f.DBName] = f.Field.Interface()
+		case fc.Class == ClassSecret:
+			out[f.DBName] = "***"
+		default:
+			fv := reflect.Indirect(f.Field)
+			if !fv.IsValid() {
+				out[f.DBName] = nil
+				continue
+			}
+			out[f.DBName] = MaskValue(fc.Mask, fmt.Sprint(fv.Interface()))
+		}
+	}
+	return out
+}
+
+// MaskModel 返回 model 的脱敏副本, 类型不变, 用于导出, 返回给前端等: pii 字段按 mask profile 脱敏, secret 字段为 "***".
+// 非 string 的 pii/secret 字段置为零值. model 可以是 struct, struct 指针, 或它们的 slice(及 slice 指针), 原值不会被修改
+func MaskModel(model interface{}) interface{} {
+	v := reflect.ValueOf(model)
+	if !v.IsValid() {
+		return model
+	}
+	if iv := Indirect(v); iv.Kind() == reflect.Slice {
+		out := reflect.MakeSlice(iv.Type(), iv.Len(), iv.Len())
+		for i := 0; i < iv.Len(); i++ {
+			out.Index(i).Set(reflect.ValueOf(MaskModel(iv.Index(i).Interface())))
+		}
+		if v.Kind() == reflect.Ptr {
+			p := reflect.New(out.Type())
+			p.Elem().Set(out)
+			return p.Interface()
+		}
+		return out.Interface()
+	}
+	sv := Indirect(v)
+	if sv.Kind() != reflect.Struct || (v.Kind() == reflect.Ptr && v.IsNil()) {
+		return model
+	}
+	fcs := ClassifiedFields(model)
+	if len(fcs) == 0 {
+		return model
+	}
+	cp := reflect.New(sv.Type())
+	cp.Elem().Set(sv)
+	for _, fc := range fcs {
+		f := cp.Elem().FieldByName(fc.Name)
+		if !f.CanSet() {
+			continue
+		}
+		masked := "***"
+		switch {
+		case f.Kind() == reflect.String:
+			if fc.Class == ClassPII {
+				masked = MaskValue(fc.Mask, f.String())
+			}
+			f.SetString(masked)
+		case f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.String && !f.IsNil():
+			if fc.Class == ClassPII {
+				masked = MaskValue(fc.Mask, f.Elem().String())
+			}
+			p := reflect.New(f.Type().Elem())
+			p.Elem().SetString(masked)
+			f.Set(p)
+		default:
+			f.Set(reflect.Zero(f.Type()))
+		}
+	}
+	if v.Kind() == reflect.Ptr {
+		return cp.Interface()
+	}
+	return cp.Elem().Interface()
+}
+
+// FieldCipher 加解密 secret 字段 (以及带 encrypt 的 pii 字段), 仅处理 string 类型的字段.
+// 密文通常比明文长, 注意列的长度
+type FieldCipher interface {
+	Encrypt(ctx context.Context, plaintext string) (string, error)
+	Decrypt(ctx context.Context, ciphertext string) (string, error)
+}
+
+var fieldCipher FieldCipher
+
+// SetFieldCipher 应在 main 中初始化时调用, 未设置时不加密
+func SetFieldCipher(c FieldCipher) {
+	fieldCipher = c
+}
+
+// transformEncrypted 对 model (struct 指针) 中需要加密的 string 字段执行 fn
+func transformEncrypted(ctx context.Context, model interface{}, fn func(context.Context, string) (string, error)) error {
+	v := Indirect(reflect.ValueOf(model))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	for _, fc := range ClassifiedFields(model) {
+		if !fc.Encrypt {
+			continue
+		}
+		f := v.FieldByName(fc.Name)
+		if f.Kind() != reflect.String || !f.CanSet() || f.String() == "" {
+			continue
+		}
+		s, err := fn(ctx, f.String())
+		if err != nil {
+			return err
+		}
+		f.SetString(s)
+	}
+	return nil
+}
+
+// encryptFields 写入前编码 codec 字段(参见 codecTagName)并加密需要加密的字段
+func encryptFields(ctx context.Context, model interface{}) error {
+	if err := encodeFields(model); err != nil {
+		return err
+	}
+	if fieldCipher == nil {
+		return nil
+	}
+	return transformEncrypted(ctx, model, fieldCipher.Encrypt)
+}
+
+// restorePlaintext 写入失败时恢复 model 的明文, 返回 err
+func restorePlaintext(ctx context.Context, model interface{}, err error) error {
+	if decErr := decryptFields(ctx, model); decErr != nil {
+		Warn("[repository] restore plaintext failed", zap.Error(decErr))
+	}
+	return err
+}
+
+// restoreAllPlaintext 批量写入失败时恢复已加密的 models 的明文, 返回 err
+func restoreAllPlaintext(ctx context.Context, models []Model, err error) error {
+	for _, m := range models {
+		restorePlaintext(ctx, m, nil)
+	}
+	return err
+}
+
+// transformEncryptedMap 对 update (key 为列名或字段名) 中 model 需要加密的 string 值执行 fn
+func transformEncryptedMap(ctx context.Context, model interface{}, update map[string]interface{}, fn func(context.Context, string) (string, error)) error {
+	for _, fc := range ClassifiedFields(model) {
+		if !fc.Encrypt {
+			continue
+		}
+		for _, key := range []string{fc.Column, fc.Name} {
+			s, ok := update[key].(string)
+			if !ok || s == "" {
+				continue
+			}
+			out, err := fn(ctx, s)
+			if err != nil {
+				return err
+			}
+			update[key] = out
+		}
+	}
+	return nil
+}
+
+// encryptUpdate 加密 Update 的 update: struct 指针, 或 map[string]interface{} (按 model 的字段)
+func encryptUpdate(ctx context.Context, model interface{}, update interface{}) error {
+	m, isMap := update.(map[string]interface{})
+	if !isMap {
+		return encryptFields(ctx, update)
+	}
+	if err := encodeUpdateMap(model, m); err != nil {
+		return err
+	}
+	if fieldCipher == nil {
+		return nil
+	}
+	return transformEncryptedMap(ctx, model, m, fieldCipher.Encrypt)
+}
+
+// decryptUpdate 写入后恢复 update 的明文, 参见 encryptUpdate
+func decryptUpdate(ctx context.Context, model interface{}, update interface{}) error {
+	m, isMap := update.(map[string]interface{})
+	if !isMap {
+		return decryptRow(ctx, update)
+	}
+	restoreUpdateMap(model, m)
+	if fieldCipher == nil {
+		return nil
+	}
+	return transformEncryptedMap(ctx, model, m, fieldCipher.Decrypt)
+}
+
+// decryptFields model 可以是 struct 指针, 或 slice 指针
+func decryptFields(ctx context.Context, model interface{}) error {
+	if model == nil {
+		return nil
+	}
+	v := Indirect(reflect.ValueOf(model))
+	if v.Kind() != reflect.Slice {
+		return decryptRow(ctx, model)
+	}
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i)
+		if elem.Kind() != reflect.Ptr {
+			if !elem.CanAddr() {
+				continue
+			}
+			elem = elem.Addr()
+		}
+		if err := decryptRow(ctx, elem.Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptRow 解密 row (struct 指针)后解码 codec 字段
+func decryptRow(ctx context.Context, row interface{}) error {
+	if fieldCipher != nil {
+		if err := transformEncrypted(ctx, row, fieldCipher.Decrypt); err != nil {
+			return err
+		}
+	}
+	return decodeFields(row)
+}
+
+// denySecretColumns 只查询非 secret 的列: 没有 Select 时查询所有非 secret 的列, Select/SelectExpr 中的 * (及 table.*)
+// 展开为非 secret 的列. 显式 Select 的 secret 列照常查询.
+// 列名以 ctx 中的表名限定, Joins 的表有同名列时不会出现歧义
+func (e *Repository) denySecretColumns(ctx context.Context, options []Option) []Option {
+	fcs := ClassifiedFields(e.Value)
+	if len(fcs) == 0 {
+		return options
+	}
+	secret := make(map[string]bool)
+	for _, fc := range fcs {
+		if fc.Class == ClassSecret {
+			secret[fc.Name] = true
+		}
+	}
+	if len(secret) == 0 {
+		return options
+	}
+	var cols []string
+	for _, f := range (&gorm.Scope{}).New(e.NewStruct()).Fields() {
+		if f.IsNormal && !secret[f.Name] {
+			cols = append(cols, f.DBName)
+		}
+	}
+	table := e.tableFor(ctx)
+	out := make([]Option, 0, len(options)+1)
+	selected := false
+	for _, opt := range options {
+		if so, ok := opt.(*selectOption); ok {
+			selected = true
+			opt = expandStar(so, table, cols)
+		}
+		out = append(out, opt)
+	}
+	if !selected {
+		fields := make([]FieldInterface, len(cols))
+		for i, col := range cols {
+			fields[i] = SimpleField(table + "." + col)
+		}
+		out = append(out, Select(fields...))
+	}
+	return out
+}
+
+// expandStar 把 so 中的 * 及 t.* 替换为 cols, * 以 table 限定, t.* 以 t 限定. 没有 * 时原样返回
+func expandStar(so *selectOption, table string, cols []string) *selectOption {
+	columns := make([]FieldInterface, 0, len(so.columns))
+	expanded := false
+	for _, c := range so.columns {
+		parts := splitSelect(c.Column())
+		star := false
+		for i, part := range parts {
+			part = strings.TrimSpace(part)
+			if part != "*" && !strings.HasSuffix(part, ".*") {
+				continue
+			}
+			prefix := strings.TrimSuffix(part, "*")
+			if prefix == "" {
+				prefix = table + "."
+			}
+			names := make([]string, len(cols))
+			for j, col := range cols {
+				names[j] = prefix + col
+			}
+			parts[i] = strings.Join(names, ", ")
+			star = true
+		}
+		if !star {
+			columns = append(columns, c)
+			continue
+		}
+		expanded = true
+		columns = append(columns, SimpleField(strings.Join(parts, ", ")))
+	}
+	if !expanded {
+		return so
+	}
+	return &selectOption{columns: columns, args: so.args}
+}
+
+// splitSelect 按不在括号及引号中的逗号拆分 select 的表达式
+func splitSelect(expr string) []string {
+	var parts []string
+	depth, start := 0, 0
+	var quote rune
+	for i, r := range expr {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			parts = append(parts, expr[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, expr[start:])
+}
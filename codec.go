@@ -0,0 +1,289 @@
+package repository
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Codec 把 struct 类型的字段序列化后存入 text/bytea/jsonb 列.
+//
+// 字段类型不方便实现 sql.Scanner / driver.Valuer 时, 以 codec tag 指定 codec 及存储编码结果的字段(string 或 []byte), 参见 codecTagName.
+// 否则 gorm 只把实现了 sql.Scanner / driver.Valuer 的 struct 当作列, 字段类型需要委托给 EncodeColumn / DecodeColumn:
+//
+//	type Profile struct{ ... }
+//
+//	func (p Profile) Value() (driver.Value, error) { return repository.EncodeColumn(repository.CodecJSON, p) }
+//	func (p *Profile) Scan(src interface{}) error  { return repository.DecodeColumn(repository.CodecJSON, src, p) }
+//
+// msgpack, protobuf 等通过 RegisterCodec 注册, 例如
+//
+//	repository.RegisterCodec("msgpack", repository.FuncCodec{MarshalFunc: msgpack.Marshal, UnmarshalFunc: msgpack.Unmarshal})
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// textCodec 可选接口, Text 返回 true 时 EncodeColumn 返回 string (用于 text/jsonb 列), 否则返回 []byte (用于 bytea 列)
+type textCodec interface {
+	Text() bool
+}
+
+const CodecJSON = "json"
+
+// FuncCodec adapts a pair of marshal/unmarshal functions to Codec
+type FuncCodec struct {
+	MarshalFunc   func(v interface{}) ([]byte, error)
+	UnmarshalFunc func(data []byte, v interface{}) error
+	// IsText 为 true 时编码结果以 string 写入
+	IsText bool
+}
+
+func (fc FuncCodec) Marshal(v interface{}) ([]byte, error) {
+	return fc.MarshalFunc(v)
+}
+
+func (fc FuncCodec) Unmarshal(data []byte, v interface{}) error {
+	return fc.UnmarshalFunc(data, v)
+}
+
+func (fc FuncCodec) Text() bool {
+	return fc.IsText
+}
+
+var (
+	codecs = map[string]Codec{
+		CodecJSON: FuncCodec{MarshalFunc: json.Marshal, UnmarshalFunc: json.Unmarshal, IsText: true},
+	}
+	codecLock sync.RWMutex
+)
+
+// RegisterCodec 注册(或覆盖)一个 Codec, 应在 init 中调用
+func RegisterCodec(name string, c Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	codecs[name] = c
+}
+
+// GetCodec returns the codec registered as name
+func GetCodec(name string) (Codec, bool) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// EncodeColumn 用于 driver.Valuer, 按 codec 序列化 v
+func EncodeColumn(codec string, v interface{}) (driver.Value, error) {
+	c, ok := GetCodec(codec)
+	if !ok {
+		return nil, fmt.Errorf("codec %s is not registered", codec)
+	}
+	data, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(textCodec); ok && tc.Text() {
+		return string(data), nil
+	}
+	return data, nil
+}
+
+// DecodeColumn 用于 sql.Scanner, 按 codec 反序列化 src 到 v, src 为 NULL 时不修改 v
+func DecodeColumn(codec string, src interface{}, v interface{}) error {
+	c, ok := GetCodec(codec)
+	if !ok {
+		return fmt.Errorf("codec %s is not registered", codec)
+	}
+	switch data := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		if len(data) == 0 {
+			return nil
+		}
+		return c.Unmarshal(data, v)
+	case string:
+		if data == "" {
+			return nil
+		}
+		return c.Unmarshal([]byte(data), v)
+	default:
+		return fmt.Errorf("can not decode %T with codec %s", src, codec)
+	}
+}
+
+// codecTagName 以 Codec 编解码的字段, 例如
+//
+//	type User struct {
+//		Profile     Profile `gorm:"-" codec:"json,field=ProfileData"`
+//		ProfileData []byte  `gorm:"column:profile"`
+//	}
+//
+// 写入前 Profile 编码到 ProfileData (在 FieldCipher 加密之前), 读取后从 ProfileData 解码到 Profile (在解密之后).
+// Update 的 map 中以 Profile 为 key 的值编码后写入 ProfileData 的列
+const codecTagName = "codec"
+
+// codecField 一个带 codec tag 的字段
+type codecField struct {
+	Name  string
+	Codec string
+	// Store 存储编码结果的字段, Column 为其列名
+	Store  string
+	Column string
+}
+
+var codecFieldCache sync.Map // reflect.Type -> []codecField
+
+// codecFields 返回 model 中带 codec tag 的字段
+func codecFields(model interface{}) []codecField {
+	rt := Indirect(reflect.ValueOf(model)).Type()
+	if v, ok := codecFieldCache.Load(rt); ok {
+		return v.([]codecField)
+	}
+	var cfs []codecField
+	if rt.Kind() == reflect.Struct {
+		fields := (&gorm.Scope{}).New(reflect.New(rt).Interface()).GetModelStruct().StructFields
+		for _, sf := range fields {
+			tag := sf.Tag.Get(codecTagName)
+			if tag == "" {
+				continue
+			}
+			parts := strings.Split(tag, ",")
+			cf := codecField{Name: sf.Name, Codec: strings.TrimSpace(parts[0])}
+			for _, part := range parts[1:] {
+				if part = strings.TrimSpace(part); strings.HasPrefix(part, "field=") {
+					cf.Store = part[len("field="):]
+				}
+			}
+			for _, store := range fields {
+				if store.Name == cf.Store {
+					cf.Column = store.DBName
+				}
+			}
+			cfs = append(cfs, cf)
+		}
+	}
+	codecFieldCache.Store(rt, cfs)
+	return cfs
+}
+
+// codecStore cf 的存储字段, 只支持 string 及 []byte
+func codecStore(v reflect.Value, cf codecField) (reflect.Value, error) {
+	f := v.FieldByName(cf.Store)
+	if f.Kind() == reflect.String || f.IsValid() && f.Type() == reflect.TypeOf([]byte(nil)) {
+		return f, nil
+	}
+	return f, fmt.Errorf("codec field %s of %s should be stored in a string or []byte field, got %q", cf.Name, v.Type(), cf.Store)
+}
+
+// encodeFields 把 model (struct 指针) 中带 codec tag 的字段编码到存储字段, nil 编码为空值
+func encodeFields(model interface{}) error {
+	v := Indirect(reflect.ValueOf(model))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	for _, cf := range codecFields(model) {
+		store, err := codecStore(v, cf)
+		if err != nil {
+			return err
+		}
+		if !store.CanSet() {
+			continue
+		}
+		val, err := encodeCodecValue(cf, v.FieldByName(cf.Name))
+		if err != nil {
+			return err
+		}
+		if store.Kind() == reflect.String {
+			store.SetString(string(toBytes(val)))
+		} else {
+			store.SetBytes(toBytes(val))
+		}
+	}
+	return nil
+}
+
+// decodeFields 从存储字段解码到 model (struct 指针) 中带 codec tag 的字段, 存储字段为空时字段为零值
+func decodeFields(model interface{}) error {
+	v := Indirect(reflect.ValueOf(model))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	for _, cf := range codecFields(model) {
+		store, err := codecStore(v, cf)
+		if err != nil {
+			return err
+		}
+		f := v.FieldByName(cf.Name)
+		if !f.CanSet() {
+			continue
+		}
+		out := reflect.New(f.Type())
+		if err = DecodeColumn(cf.Codec, store.Interface(), out.Interface()); err != nil {
+			return fmt.Errorf("decode %s of %s: %w", cf.Name, v.Type(), err)
+		}
+		f.Set(out.Elem())
+	}
+	return nil
+}
+
+// encodeUpdateMap update 中以 codec 字段名为 key 的值编码后以存储字段的列名写入, 原来的 key 保留(gorm 忽略 gorm:"-" 的字段)
+func encodeUpdateMap(model interface{}, update map[string]interface{}) error {
+	for _, cf := range codecFields(model) {
+		val, ok := update[cf.Name]
+		if !ok {
+			continue
+		}
+		if _, ok := update[cf.Column]; ok {
+			return fmt.Errorf("update sets both %s and %s", cf.Name, cf.Column)
+		}
+		encoded, err := encodeCodecValue(cf, reflect.ValueOf(val))
+		if err != nil {
+			return err
+		}
+		update[cf.Column] = encoded
+	}
+	return nil
+}
+
+// restoreUpdateMap 写入后去掉 encodeUpdateMap 加上的列
+func restoreUpdateMap(model interface{}, update map[string]interface{}) {
+	for _, cf := range codecFields(model) {
+		if _, ok := update[cf.Name]; ok {
+			delete(update, cf.Column)
+		}
+	}
+}
+
+// encodeCodecValue 按 cf.Codec 编码 v, nil 指针, map, slice 编码为 nil
+func encodeCodecValue(cf codecField, v reflect.Value) (driver.Value, error) {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil, nil
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+	}
+	val, err := EncodeColumn(cf.Codec, v.Interface())
+	if err != nil {
+		return nil, fmt.Errorf("encode %s: %w", cf.Name, err)
+	}
+	return val, nil
+}
+
+func toBytes(val driver.Value) []byte {
+	switch b := val.(type) {
+	case []byte:
+		return b
+	case string:
+		return []byte(b)
+	}
+	return nil
+}
@@ -9,6 +9,8 @@ type Condition interface {
 	And(Condition) Condition
 	Or(Condition) Condition
 	flatten() (sql string, args []interface{})
+	// flattenDialect 按 dialect 翻译 postgres 专有的操作符, dialect 为空时同 flatten
+	flattenDialect(dialect string) (sql string, args []interface{})
 }
 
 type logic string
@@ -44,7 +46,26 @@ func (sc *singleCondition) Or(condition Condition) Condition {
 }
 
 func (sc *singleCondition) flatten() (sql string, args []interface{}) {
-	sql = sc.field.Column() + " " + string(sc.op)
+	return sc.flattenDialect("")
+}
+
+func (sc *singleCondition) flattenDialect(dialect string) (sql string, args []interface{}) {
+	if sql, args, ok := sc.arrayForDialect(dialect); ok {
+		return sql, args
+	}
+	if sql, args, ok := sc.timeForDialect(dialect); ok {
+		return sql, args
+	}
+	if values, ok := sc.sqlArg1.([]interface{}); ok && len(values) == 0 {
+		// gorm 把空 slice 展开为 NULL, IN (NULL) 及 NOT IN (NULL) 都不匹配任何行
+		switch sc.op {
+		case c_In:
+			return "1=0", nil
+		case c_NotIn:
+			return "1=1", nil
+		}
+	}
+	sql = columnForDialect(sc.field.Column(), dialect) + " " + string(sc.op.forDialect(dialect))
 	switch sc.op.ParamCount() {
 	case 1:
 		args = append(args, sc.sqlArg1)
@@ -79,8 +100,12 @@ func (cc *compoundCondition) Or(condition Condition) Condition {
 }
 
 func (cc *compoundCondition) flatten() (sql string, args []interface{}) {
-	sql1, args1 := cc.condition1.flatten()
-	sql2, args2 := cc.condition2.flatten()
+	return cc.flattenDialect("")
+}
+
+func (cc *compoundCondition) flattenDialect(dialect string) (sql string, args []interface{}) {
+	sql1, args1 := cc.condition1.flattenDialect(dialect)
+	sql2, args2 := cc.condition2.flattenDialect(dialect)
 	if sql1 == "" {
 		return sql2, args2
 	}
@@ -115,9 +140,13 @@ func (cg *conditionGroup) Or(condition Condition) Condition {
 }
 
 func (cg *conditionGroup) flatten() (sql string, args []interface{}) {
+	return cg.flattenDialect("")
+}
+
+func (cg *conditionGroup) flattenDialect(dialect string) (sql string, args []interface{}) {
 	var sqls []string
 	for _, c := range cg.conditions {
-		s, a := c.flatten()
+		s, a := c.flattenDialect(dialect)
 		if s == "" {
 			continue
 		}
@@ -173,3 +202,70 @@ func MatchAny(conditions ...Condition) *conditionGroup {
 		logic:      or,
 	}
 }
+
+// ConditionNode 是 Condition 的只读视图, 供非 gorm 的实现(如 mongo)把条件树翻译成自己的查询语言
+type ConditionNode struct {
+	// Logic 为 "AND" / "OR" 时是组合节点, 为空时是叶子节点
+	Logic    string
+	Children []*ConditionNode
+
+	// 以下仅叶子节点有效
+	Column string
+	// Op 为 Op* 常量之一
+	Op string
+	// Args 是传给 sql 的参数(Like 系列已拼好 %), RawArgs 是调用方传入的原始值
+	Args    []interface{}
+	RawArgs []interface{}
+}
+
+// IsLeaf reports whether the node is a single field condition
+func (n *ConditionNode) IsLeaf() bool {
+	return n.Logic == ""
+}
+
+// Inspect converts condition to a ConditionNode tree. Empty groups are dropped, nil means no where clause
+func Inspect(condition Condition) *ConditionNode {
+	switch c := condition.(type) {
+	case nil:
+		return nil
+	case *singleCondition:
+		node := &ConditionNode{
+			Column: c.field.Column(),
+			Op:     string(c.op),
+		}
+		switch c.op.ParamCount() {
+		case 1:
+			node.Args = []interface{}{c.sqlArg1}
+			node.RawArgs = []interface{}{c.rawVal1}
+		case 2:
+			node.Args = []interface{}{c.sqlArg1, c.sqlArg2}
+			node.RawArgs = []interface{}{c.rawVal1, c.rawVal2}
+		}
+		return node
+	case *compoundCondition:
+		return inspectGroup(c.logic, c.condition1, c.condition2)
+	case *conditionGroup:
+		return inspectGroup(c.logic, c.conditions...)
+	default:
+		return nil
+	}
+}
+
+func inspectGroup(l logic, conditions ...Condition) *ConditionNode {
+	var children []*ConditionNode
+	for _, c := range conditions {
+		if n := Inspect(c); n != nil {
+			children = append(children, n)
+		}
+	}
+	switch len(children) {
+	case 0:
+		return nil
+	case 1:
+		return children[0]
+	}
+	return &ConditionNode{
+		Logic:    string(l),
+		Children: children,
+	}
+}
@@ -0,0 +1,190 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfigFromFile 读取配置文件并为其中的每个 service 调用 SetServiceDBConfig.
+// 按扩展名识别 .toml, .yaml/.yml, .json, 字段名使用 DBConfig 的 toml tag, 例如:
+//
+//	[services.order]
+//	dialect = "postgres"
+//	dsn = "host=db user=order password=${ORDER_DB_PASSWORD} dbname=order"
+//	db_conn_pool_max_open = 20
+//	db_conn_pool_max_lifetime = "30m"
+//
+// 没有 services 时, 顶层的每个 key 都是一个 service. dsn 和 replicas 中的 ${VAR} 及 ${VAR:-default} 会替换为环境变量,
+// 时间使用 "30s" 这样的字符串(整数为纳秒)
+func LoadConfigFromFile(path string) error {
+	confs, err := ParseConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for serviceName, conf := range confs {
+		SetServiceDBConfig(serviceName, conf)
+	}
+	return nil
+}
+
+// ParseConfigFile 同 LoadConfigFromFile, 但只返回解析出的配置
+func ParseConfigFile(path string) (map[string]*DBConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]interface{})
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported config file type: %s", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	services := raw
+	if s, ok := raw["services"].(map[string]interface{}); ok {
+		services = s
+	}
+	confs := make(map[string]*DBConfig, len(services))
+	for serviceName, v := range services {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("config of service %s is not a table", serviceName)
+		}
+		conf := &DBConfig{}
+		if err = decodeConfig(m, conf); err != nil {
+			return nil, fmt.Errorf("config of service %s: %w", serviceName, err)
+		}
+		conf.Dsn = expandEnv(conf.Dsn)
+		for i, dsn := range conf.Replicas {
+			conf.Replicas[i] = expandEnv(dsn)
+		}
+		confs[serviceName] = conf
+	}
+	return confs, nil
+}
+
+var envRe = regexp.MustCompile(`\$\{(\w+)(?::-([^}]*))?\}`)
+
+// expandEnv 只替换 ${VAR} 形式, 避免误伤密码中的 $
+func expandEnv(s string) string {
+	return envRe.ReplaceAllStringFunc(s, func(m string) string {
+		sub := envRe.FindStringSubmatch(m)
+		if v, ok := os.LookupEnv(sub[1]); ok {
+			return v
+		}
+		return sub[2]
+	})
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// decodeConfig 按 toml tag 把 m 写入 conf, 未知的 key 返回 error
+func decodeConfig(m map[string]interface{}, conf *DBConfig) error {
+	rv := reflect.ValueOf(conf).Elem()
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < rv.NumField(); i++ {
+		tag := strings.Split(rv.Type().Field(i).Tag.Get("toml"), ",")[0]
+		if tag != "" && tag != "-" {
+			fields[tag] = rv.Field(i)
+		}
+	}
+	for key, v := range m {
+		f, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("unknown key %s", key)
+		}
+		if err := setConfigValue(f, v); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func setConfigValue(f reflect.Value, v interface{}) error {
+	if f.Type() == durationType {
+		switch d := v.(type) {
+		case string:
+			parsed, err := time.ParseDuration(d)
+			if err != nil {
+				return err
+			}
+			f.SetInt(int64(parsed))
+			return nil
+		case int, int64, float64:
+			f.SetInt(reflect.ValueOf(d).Convert(reflect.TypeOf(int64(0))).Int())
+			return nil
+		}
+		return fmt.Errorf("invalid duration %v", v)
+	}
+	switch f.Kind() {
+	case reflect.String:
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expect string, got %T", v)
+		}
+		f.SetString(s)
+	case reflect.Bool:
+		b, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("expect bool, got %T", v)
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		switch n := v.(type) {
+		case int:
+			f.SetInt(int64(n))
+		case int64:
+			f.SetInt(n)
+		case float64:
+			f.SetInt(int64(n))
+		default:
+			return fmt.Errorf("expect integer, got %T", v)
+		}
+	case reflect.Float32, reflect.Float64:
+		switch n := v.(type) {
+		case int:
+			f.SetFloat(float64(n))
+		case int64:
+			f.SetFloat(float64(n))
+		case float64:
+			f.SetFloat(n)
+		default:
+			return fmt.Errorf("expect number, got %T", v)
+		}
+	case reflect.Slice:
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("expect array, got %T", v)
+		}
+		out := reflect.MakeSlice(f.Type(), 0, len(list))
+		for _, item := range list {
+			elem := reflect.New(f.Type().Elem()).Elem()
+			if err := setConfigValue(elem, item); err != nil {
+				return err
+			}
+			out = reflect.Append(out, elem)
+		}
+		f.Set(out)
+	default:
+		return fmt.Errorf("unsupported field type %s", f.Type())
+	}
+	return nil
+}
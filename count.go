@@ -0,0 +1,154 @@
+package repository
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+type joinOption struct {
+	query string
+	args  []interface{}
+}
+
+func (jo *joinOption) Sql(db *gorm.DB) *gorm.DB {
+	return db.Joins(jo.query, jo.args...)
+}
+
+// Join 添加 JOIN, 如 Join("JOIN users ON users.id = orders.user_id AND users.status = ?", 1). 用于 Find/FindInto/Count,
+// 条件及排序中与其他表同名的列需要带表名
+func Join(query string, args ...interface{}) Option {
+	return &joinOption{query: query, args: args}
+}
+
+type groupOption struct {
+	fields []FieldInterface
+}
+
+func (g *groupOption) Sql(db *gorm.DB) *gorm.DB {
+	cols := make([]string, len(g.fields))
+	for i, f := range g.fields {
+		cols[i] = f.Column()
+	}
+	return db.Group(strings.Join(cols, ", "))
+}
+
+// GroupBy 添加 GROUP BY, 通常与 Select 的聚合字段一起使用, 结果使用 FindInto 读取. Count 时返回分组数
+func GroupBy(fields ...FieldInterface) Option {
+	return &groupOption{fields: fields}
+}
+
+// countOptions Count 使用的 options: 去掉排序及 Limit, Select(Distinct(...)) 转换为 count(DISTINCT ...), 其他 Select 忽略
+func countOptions(options []Option) []Option {
+	var out []Option
+	for _, opt := range options {
+		switch o := opt.(type) {
+		case *limitOption, *orderOption, *orderByOption, *nearestOption:
+		case *selectOption:
+			if len(o.columns) == 1 && len(o.args) == 0 {
+				if rf, ok := o.columns[0].(*reduceFieldImpl); ok && strings.HasPrefix(rf.reduceFmt, "DISTINCT") {
+					out = append(out, SelectExpr("count("+rf.Column()+")"))
+				}
+			}
+		default:
+			out = append(out, opt)
+		}
+	}
+	return out
+}
+
+// Exists 是否存在满足条件的行, 执行 SELECT 1 ... LIMIT 1, 比 Count 在大表上快得多. options 同 Count, 排序, Limit 及 Select 被忽略
+func (e *Repository) Exists(ctx context.Context, condition Condition, options ...Option) (exists bool, err error) {
+	err = e.intercept(ctx, &StatementInfo{Op: StmtExists, Condition: condition, Options: options}, func(ctx context.Context, stmt *StatementInfo) error {
+		if e.routed(ctx) {
+			total, err := e.countRouted(ctx, stmt.Condition, stmt.Options...)
+			exists = total > 0
+			return err
+		}
+		return e.withStatementTimeout(ctx, stmt.Options, func(ctx context.Context) error {
+			query, err := e.parseWhere(ctx, stmt.Condition)
+			if err != nil {
+				return err
+			}
+			if query == nil {
+				return dbNilErr
+			}
+			query = e.parseOptions(ctx, query.Model(e.NewStruct()), append(existsOptions(stmt.Options), SelectExpr("1"))...)
+			// 不使用 Pluck: Pluck 会覆盖 Select, 丢掉 parseOptions 加上的 hint
+			rows, err := query.Limit(1).Rows()
+			if err != nil {
+				return wrapTimeout(ctx, query, e.TableName(), StmtExists, err)
+			}
+			defer rows.Close()
+			exists = rows.Next()
+			return wrapTimeout(ctx, query, e.TableName(), StmtExists, rows.Err())
+		})
+	})
+	return
+}
+
+// existsOptions 同 countOptions, 但去掉所有 Select
+func existsOptions(options []Option) []Option {
+	var out []Option
+	for _, opt := range countOptions(options) {
+		if _, ok := opt.(*selectOption); !ok {
+			out = append(out, opt)
+		}
+	}
+	return out
+}
+
+// countSelect countOptions 中没有 Select 时加上 count(*)
+func countSelect(options []Option) []Option {
+	for _, opt := range options {
+		if _, ok := opt.(*selectOption); ok {
+			return options
+		}
+	}
+	return append(options, SelectExpr("count(*)"))
+}
+
+// grouped options 中是否有 GroupBy
+func grouped(options []Option) bool {
+	for _, opt := range options {
+		if _, ok := opt.(*groupOption); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CountGrouped 按 groupField 分组计数, 只执行一条 GROUP BY 语句, 如各个状态的数量. key 为数据库驱动返回的值(整数为 int64, 字符串为 string),
+// 没有行的分组不在结果中. 不支持分区路由
+func (e *Repository) CountGrouped(ctx context.Context, groupField FieldInterface, condition Condition) (map[interface{}]int, error) {
+	result := make(map[interface{}]int)
+	err := e.intercept(ctx, &StatementInfo{Op: StmtCount, Condition: condition}, func(ctx context.Context, stmt *StatementInfo) error {
+		query, err := e.parseWhere(ctx, stmt.Condition)
+		if err != nil {
+			return err
+		}
+		if query == nil {
+			return dbNilErr
+		}
+		col := query.NewScope(e.NewStruct()).Quote(groupField.Column())
+		rows, err := query.Model(e.NewStruct()).Select(col + ", count(*)").Group(col).Rows()
+		if err != nil {
+			return wrapTimeout(ctx, query, e.TableName(), "CountGrouped", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var key interface{}
+			var n int
+			if err = rows.Scan(&key, &n); err != nil {
+				return err
+			}
+			if b, ok := key.([]byte); ok {
+				key = string(b)
+			}
+			result[key] = n
+		}
+		return rows.Err()
+	})
+	return result, err
+}
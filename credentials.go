@@ -0,0 +1,218 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Credentials 数据库用户名和密码
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialProvider 在建立连接时(以及 DBConfig.CredentialRefreshInterval 定期检查轮换时)提供数据库的用户名密码,
+// 配置后 dsn 中不需要包含密码
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// CredentialProviderFunc adapts a func to CredentialProvider
+type CredentialProviderFunc func(ctx context.Context) (Credentials, error)
+
+func (f CredentialProviderFunc) Credentials(ctx context.Context) (Credentials, error) {
+	return f(ctx)
+}
+
+const credentialTimeout = 10 * time.Second
+
+// VaultCredentialProvider 通过 Vault HTTP API 读取用户名密码, 支持 KV v2 (data.data) 以及 database secrets engine (data)
+type VaultCredentialProvider struct {
+	// Addr 如 https://vault:8200
+	Addr  string
+	Token string
+	// Path 如 secret/data/order-db 或 database/creds/order
+	Path string
+	// UsernameKey, PasswordKey 默认为 username, password
+	UsernameKey string
+	PasswordKey string
+	// Client 为空时使用 http.DefaultClient
+	Client *http.Client
+}
+
+func (v *VaultCredentialProvider) Credentials(ctx context.Context) (Credentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(v.Addr, "/")+"/v1/"+strings.TrimLeft(v.Path, "/"), nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Credentials{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Credentials{}, fmt.Errorf("vault %s: %s", v.Path, resp.Status)
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.Unmarshal(body, &secret); err != nil {
+		return Credentials{}, err
+	}
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		data = inner
+	}
+	return credentialsFrom(data, v.UsernameKey, v.PasswordKey)
+}
+
+// AWSSecretsManagerProvider 从 AWS Secrets Manager 读取 JSON 格式的 secret (RDS 的格式, 包含 username, password).
+// 为避免依赖 aws sdk, 由使用方提供 GetSecretString, 通常为
+//
+//	func(ctx context.Context, id string) (string, error) {
+//		out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: &id})
+//		if err != nil {
+//			return "", err
+//		}
+//		return *out.SecretString, nil
+//	}
+type AWSSecretsManagerProvider struct {
+	SecretId        string
+	GetSecretString func(ctx context.Context, secretId string) (string, error)
+	// UsernameKey, PasswordKey 默认为 username, password
+	UsernameKey string
+	PasswordKey string
+}
+
+func (a *AWSSecretsManagerProvider) Credentials(ctx context.Context) (Credentials, error) {
+	if a.GetSecretString == nil {
+		return Credentials{}, errors.New("AWSSecretsManagerProvider.GetSecretString is nil")
+	}
+	s, err := a.GetSecretString(ctx, a.SecretId)
+	if err != nil {
+		return Credentials{}, err
+	}
+	data := make(map[string]interface{})
+	if err = json.Unmarshal([]byte(s), &data); err != nil {
+		return Credentials{}, fmt.Errorf("secret %s is not json: %w", a.SecretId, err)
+	}
+	return credentialsFrom(data, a.UsernameKey, a.PasswordKey)
+}
+
+func credentialsFrom(data map[string]interface{}, usernameKey, passwordKey string) (Credentials, error) {
+	if usernameKey == "" {
+		usernameKey = "username"
+	}
+	if passwordKey == "" {
+		passwordKey = "password"
+	}
+	username, _ := data[usernameKey].(string)
+	password, _ := data[passwordKey].(string)
+	if username == "" || password == "" {
+		return Credentials{}, fmt.Errorf("secret has no %s or %s", usernameKey, passwordKey)
+	}
+	return Credentials{Username: username, Password: password}, nil
+}
+
+// resolveDsn 没有 CredentialProvider 时返回 dsn 本身
+func resolveDsn(dbConf *DBConfig, dsn string) (string, Credentials, error) {
+	if dbConf.CredentialProvider == nil {
+		return dsn, Credentials{}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), credentialTimeout)
+	defer cancel()
+	c, err := dbConf.CredentialProvider.Credentials(ctx)
+	if err != nil {
+		return "", Credentials{}, fmt.Errorf("resolve credentials: %w", err)
+	}
+	dsn, err = withCredentials(dbConf.Dialect, dsn, c)
+	return dsn, c, err
+}
+
+// withCredentials 把用户名密码写入 dsn, 覆盖 dsn 中已有的
+func withCredentials(dialect, dsn string, c Credentials) (string, error) {
+	switch dialect {
+	case DialectPostgres:
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			u, err := url.Parse(dsn)
+			if err != nil {
+				return "", err
+			}
+			u.User = url.UserPassword(c.Username, c.Password)
+			return u.String(), nil
+		}
+		// key=value 格式, 后出现的 key 覆盖前面的
+		return fmt.Sprintf("%s user=%s password=%s", dsn, pgQuote(c.Username), pgQuote(c.Password)), nil
+	case DialectMysql:
+		if i := strings.LastIndex(dsn, "@"); i >= 0 {
+			dsn = dsn[i+1:]
+		}
+		return c.Username + ":" + c.Password + "@" + dsn, nil
+	default:
+		return "", fmt.Errorf("credential provider is not supported for %s", dialect)
+	}
+}
+
+func pgQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return "'" + s + "'"
+}
+
+// watchCredentials 定期检查凭证是否轮换, 轮换后以新凭证重新连接整个 service(参见 ReloadServiceDBConfig)
+func (s *DBInfo) watchCredentials() {
+	dbConf := s.DbConfig
+	if dbConf.CredentialProvider == nil || dbConf.CredentialRefreshInterval <= 0 {
+		return
+	}
+	closed := s.closedChan()
+	go func() {
+		ticker := time.NewTicker(dbConf.CredentialRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), credentialTimeout)
+			c, err := dbConf.CredentialProvider.Credentials(ctx)
+			cancel()
+			if err != nil {
+				Warn("[repository] refresh credentials failed", zap.String("service", s.ServiceName), zap.Error(err))
+				continue
+			}
+			if c == s.credentials {
+				continue
+			}
+			select {
+			case <-closed:
+				// 同一 service 的其他数据库已经触发了重新连接
+				return
+			default:
+			}
+			Info("[repository] credentials rotated, reconnecting", zap.String("service", s.ServiceName))
+			if err = ReloadServiceDBConfig(s.ServiceName, dbConf); err != nil {
+				Error("[repository] reconnect after credential rotation failed", zap.String("service", s.ServiceName), zap.Error(err))
+			}
+		}
+	}()
+}
@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+type withOption struct {
+	name  string
+	query Query
+	// 以下仅递归 CTE 有效
+	recursive bool
+	column    string
+	refColumn string
+}
+
+// With 以 subquery 定义名为 name 的 CTE (WITH name AS (...)), 主查询通过 InCTE 引用. 只对 Find 有效
+func With(name string, subquery Query) *withOption {
+	return &withOption{name: name, query: subquery}
+}
+
+// WithRecursive 递归 CTE: 初始为 anchor 查出的行, 之后反复加入 anchor.Repo 的表中 column 等于 CTE 中已有行的 refColumn 的行,
+// 直到没有新的行. 例如查询组织树中 rootId 及其所有下级:
+//
+//	orgRepo.Find(ctx, InCTE(SimpleField("id"), "tree", "id"),
+//		WithRecursive("tree", orgRepo.Query(SimpleField("id").Eq(rootId)), "parent_id", "id"))
+//
+// anchor 不应使用 Select 等改变列的 Option. 数据有环时不会结束, 应保证是树. 只对 Find 有效
+func WithRecursive(name string, anchor Query, column, refColumn string) *withOption {
+	return &withOption{name: name, query: anchor, recursive: true, column: column, refColumn: refColumn}
+}
+
+// Sql findNoCache 中处理, 这里不修改查询
+func (wo *withOption) Sql(db *gorm.DB) *gorm.DB {
+	return db
+}
+
+// withClause 生成 WITH [RECURSIVE] name AS (...), ... , 没有 CTE 时返回空
+func withClause(ctx context.Context, options []Option) (string, []interface{}, error) {
+	var parts []string
+	var args []interface{}
+	recursive := false
+	for _, opt := range options {
+		wo, ok := opt.(*withOption)
+		if !ok {
+			continue
+		}
+		expr, err := wo.query.sqlExpr(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		if !wo.recursive {
+			parts = append(parts, wo.name+" AS (?)")
+			args = append(args, expr)
+			continue
+		}
+		recursive = true
+		// 表的所有行(带 MandatoryCondition, 租户, 软删除等条件)作为子查询, 避免与 CTE 的列名冲突
+		all, err := wo.query.Repo.Query(MatchAll()).sqlExpr(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		parts = append(parts, fmt.Sprintf("%s AS (SELECT * FROM (?) AS repository_cte_anchor UNION ALL "+
+			"SELECT repository_cte_t.* FROM (?) AS repository_cte_t JOIN %s ON repository_cte_t.%s = %s.%s)",
+			wo.name, wo.name, wo.column, wo.name, wo.refColumn))
+		args = append(args, expr, all)
+	}
+	if len(parts) == 0 {
+		return "", nil, nil
+	}
+	clause := "WITH "
+	if recursive {
+		clause = "WITH RECURSIVE "
+	}
+	return clause + strings.Join(parts, ", "), args, nil
+}
+
+// findWithCTE 以 WITH ... <主查询> 执行 query, query 为已经应用了条件及 Option 的查询
+func (e *Repository) findWithCTE(ctx context.Context, query *gorm.DB, options []Option, slice interface{}) (bool, error) {
+	clause, args, err := withClause(ctx, options)
+	if err != nil || clause == "" {
+		return false, err
+	}
+	db := e.getReadDb(ctx, options...)
+	if db == nil {
+		return true, dbNilErr
+	}
+	args = append(args, query.Model(e.NewStruct()).QueryExpr())
+	return true, db.Raw(clause+" ?", args...).Scan(slice).Error
+}
+
+type cteCondition struct {
+	field  FieldInterface
+	cte    string
+	column string
+}
+
+// InCTE field IN (SELECT column FROM cte), 用于引用 With/WithRecursive 定义的 CTE. Inspect 不识别, 返回 nil
+func InCTE(field FieldInterface, cte string, column string) Condition {
+	return &cteCondition{field: field, cte: cte, column: column}
+}
+
+func (cc *cteCondition) And(condition Condition) Condition {
+	return &compoundCondition{
+		condition1: cc,
+		condition2: condition,
+		logic:      and,
+	}
+}
+
+func (cc *cteCondition) Or(condition Condition) Condition {
+	return &compoundCondition{
+		condition1: cc,
+		condition2: condition,
+		logic:      or,
+	}
+}
+
+func (cc *cteCondition) flatten() (sql string, args []interface{}) {
+	return cc.flattenDialect("")
+}
+
+func (cc *cteCondition) flattenDialect(dialect string) (sql string, args []interface{}) {
+	return fmt.Sprintf("%s IN (SELECT %s FROM %s)", cc.field.Column(), cc.column, cc.cte), nil
+}
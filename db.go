@@ -1,7 +1,11 @@
 package repository
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
 	"sync"
 	"time"
 )
@@ -13,43 +17,82 @@ type DBInfo struct {
 	ServiceName string
 	DbConfig    *DBConfig
 	Conn        *gorm.DB
+
+	replicas      []*replica
+	replicaCursor uint64
+
+	closeOnce  sync.Once
+	closedInit sync.Once
+	closed     chan struct{}
+	// credentials 建立连接时 CredentialProvider 提供的凭证
+	credentials Credentials
 }
 
 type DBConfig struct {
 	Dialect     string        `toml:"dialect"`
-	Dsn         string        `toml:"dsn"`                       // data source name
-	DriverName  string        `toml:"driver_name"`               // data source driver name
-	Retry       int           `toml:"retry"`                     // retry time
-	MaxIdle     int           `toml:"db_conn_pool_max_idle"`     // zero means defaultMaxIdleConns; negative means 0
-	MaxOpen     int           `toml:"db_conn_pool_max_open"`     // <= 0 means unlimited
-	MaxLifetime time.Duration `toml:"db_conn_pool_max_lifetime"` // maximum amount of time a connection may be reused
+	Dsn         string        `toml:"dsn"`                        // data source name
+	DriverName  string        `toml:"driver_name"`                // data source driver name
+	Retry       int           `toml:"retry"`                      // retry time
+	MaxIdle     int           `toml:"db_conn_pool_max_idle"`      // zero means defaultMaxIdleConns; negative means 0
+	MaxOpen     int           `toml:"db_conn_pool_max_open"`      // <= 0 means unlimited
+	MaxLifetime time.Duration `toml:"db_conn_pool_max_lifetime"`  // maximum amount of time a connection may be reused
+	MaxIdleTime time.Duration `toml:"db_conn_pool_max_idle_time"` // maximum amount of time a connection may be idle, zero means no limit
+
+	Replicas               []string      `toml:"replicas"`                  // replica dsn, Find outside transaction reads from replicas
+	ReplicaLagPollInterval time.Duration `toml:"replica_lag_poll_interval"` // zero means 5s
+	LagProbe               LagProbe      `toml:"-"`                         // nil means DefaultLagProbe
+	StickyPrimaryWindow    time.Duration `toml:"sticky_primary_window"`     // reads in a read session go to the primary this long after a write, zero means 2s, see WithReadSession
+
+	AutoMigrate bool `toml:"auto_migrate"` // allow Repository.AutoMigrate / MigrateAll, for dev and staging only
+
+	CredentialProvider        CredentialProvider `toml:"-"`                           // resolve username/password at connect time, see CredentialProvider
+	CredentialRefreshInterval time.Duration      `toml:"credential_refresh_interval"` // check credential rotation and reconnect, zero disables
+
+	SlowQueryThreshold time.Duration `toml:"slow_query_threshold"` // zero disables slow query detection, Repository.SlowQueryThreshold overrides
+	SlowQueryExplain   bool          `toml:"slow_query_explain"`   // capture EXPLAIN output of slow queries
+
+	IdleTxThreshold time.Duration `toml:"idle_tx_threshold"` // report transactions idle longer than this with the stack at Begin, zero disables, see IdleTransactions
+	MaxTxDuration   time.Duration `toml:"max_tx_duration"`   // roll back transactions running longer than this and cancel their ctx, zero disables, see TimeoutTransaction
+
+	SQLComment bool `toml:"sql_comment"` // append a sqlcommenter style comment with caller and ctx tags to every statement, see WithSQLComment
+
+	CircuitBreakerThreshold int           `toml:"circuit_breaker_threshold"` // consecutive connection errors that open the breaker of the primary or a replica, zero disables, see ErrCircuitOpen
+	CircuitBreakerCooldown  time.Duration `toml:"circuit_breaker_cooldown"`  // time before a half-open probe, zero means 10s
+
+	MaxConcurrentQueries int     `toml:"max_concurrent_queries"` // repository operations or transactions (statements on replicas) running at once per connection pool, callers wait or fail with ctx, zero disables
+	QueryRateLimit       float64 `toml:"query_rate_limit"`       // repository operations or transactions (statements on replicas) started per second per connection pool, zero disables
+	QueryRateBurst       int     `toml:"query_rate_burst"`       // token bucket size of QueryRateLimit, zero means ceil(QueryRateLimit)
 }
 
 var dbRegister = make(map[string]*DBInfo, 1)
-var lock = &sync.Mutex{}
+var lock = &sync.RWMutex{}
 var ServiceConfigMap = make(map[string]*DBConfig, 0)
 
 func GetDBByDatabaseName(database, serviceName string) *DBInfo {
 	mapKey := serviceName + "#" + database
-	_, ok := dbRegister[mapKey]
-	if !ok {
-		lock.Lock()
-		defer lock.Unlock()
-		_, recheck := dbRegister[mapKey]
-		if !recheck {
-			var dbConf *DBConfig
-			dbConf, ok := ServiceConfigMap[serviceName]
-			if !ok {
-				panic("can not find service config, please set config first!!!")
-			}
+	lock.RLock()
+	dbInfo, ok := dbRegister[mapKey]
+	lock.RUnlock()
+	if ok {
+		return dbInfo
+	}
 
-			dbInfo := &DBInfo{
-				ServiceName: serviceName,
-				DbConfig:    dbConf,
-			}
-			dbInfo.InitDBConnect()
-			dbRegister[mapKey] = dbInfo
+	lock.Lock()
+	defer lock.Unlock()
+	_, recheck := dbRegister[mapKey]
+	if !recheck {
+		var dbConf *DBConfig
+		dbConf, ok := ServiceConfigMap[serviceName]
+		if !ok {
+			panic("can not find service config, please set config first!!!")
+		}
+
+		dbInfo := &DBInfo{
+			ServiceName: serviceName,
+			DbConfig:    dbConf,
 		}
+		dbInfo.InitDBConnect()
+		dbRegister[mapKey] = dbInfo
 	}
 	return dbRegister[mapKey]
 }
@@ -60,17 +103,143 @@ func GetDB(database, serviceName string) *gorm.DB {
 }
 
 func (s *DBInfo) InitDBConnect() {
+	if err := s.connect(); err != nil {
+		panic(err)
+	}
+}
+
+// connect 建立主库及从库的连接, 失败时关闭已经建立的连接
+func (s *DBInfo) connect() error {
 	dbConf := s.DbConfig
-	db, err := gorm.Open(dbConf.Dialect, dbConf.Dsn)
+	dsn, creds, err := resolveDsn(dbConf, dbConf.Dsn)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	db, err := gorm.Open(dbConf.Dialect, dsn)
+	if err != nil {
+		return err
+	}
+	s.credentials = creds
+
+	applyPoolConfig(db, dbConf)
+	if isSqliteMemory(dbConf) {
+		db.DB().SetMaxOpenConns(1)
 	}
 
+	registerStatementCallbacks(db, dbConf)
+	registerCircuitBreaker(db, dbConf, s.ServiceName+":primary", false)
+	registerLimiter(db, dbConf, s.ServiceName+":primary", false)
 	s.Conn = db
+	if err = s.initReplicas(); err != nil {
+		db.Close()
+		return err
+	}
+	s.watchCredentials()
+	return nil
+}
+
+// applyPoolConfig 按 DBConfig 设置连接池, 零值使用 database/sql 的默认值
+func applyPoolConfig(db *gorm.DB, dbConf *DBConfig) {
+	sqlDB := db.DB()
+	if dbConf.MaxIdle > 0 {
+		sqlDB.SetMaxIdleConns(dbConf.MaxIdle)
+	} else if dbConf.MaxIdle < 0 {
+		sqlDB.SetMaxIdleConns(0)
+	}
+	if dbConf.MaxOpen > 0 {
+		sqlDB.SetMaxOpenConns(dbConf.MaxOpen)
+	}
+	if dbConf.MaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(dbConf.MaxLifetime)
+	}
+	if dbConf.MaxIdleTime > 0 {
+		sqlDB.SetConnMaxIdleTime(dbConf.MaxIdleTime)
+	}
+}
+
+// PoolStats 返回主库连接池的统计
+func (s *DBInfo) PoolStats() sql.DBStats {
+	return s.Conn.DB().Stats()
+}
+
+// PoolStats 返回所有已注册数据库主库的连接池统计, key 为 "<serviceName>#<database>"
+func PoolStats() map[string]sql.DBStats {
+	lock.Lock()
+	defer lock.Unlock()
+	stats := make(map[string]sql.DBStats, len(dbRegister))
+	for key, info := range dbRegister {
+		stats[key] = info.PoolStats()
+	}
+	return stats
+}
+
+// drainPollInterval Close 等待正在使用的连接归还时的检查间隔
+const drainPollInterval = 50 * time.Millisecond
+
+// closedChan Close 时关闭的 channel, 后台的从库延迟检测及凭证检查以此退出
+func (s *DBInfo) closedChan() chan struct{} {
+	s.closedInit.Do(func() {
+		s.closed = make(chan struct{})
+	})
+	return s.closed
+}
+
+// Close 停止从库延迟检测, 等待正在使用的连接归还(直到 ctx 结束)后关闭主库和从库的连接. 可以重复调用
+func (s *DBInfo) Close(ctx context.Context) error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closedChan())
+		conns := []*gorm.DB{s.Conn}
+		for _, r := range s.replicas {
+			conns = append(conns, r.conn)
+		}
+		for _, conn := range conns {
+			if conn == nil {
+				continue
+			}
+			drain(ctx, conn.DB())
+			if e := conn.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// drain 等待 db 中没有正在使用的连接, 或 ctx 结束
+func drain(ctx context.Context, db *sql.DB) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for db.Stats().InUse > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CloseAll 关闭所有已注册的数据库并刷新日志, 用于服务退出. 关闭后再调用 GetDB 会重新建立连接
+func CloseAll(ctx context.Context) error {
+	lock.Lock()
+	infos := dbRegister
+	dbRegister = make(map[string]*DBInfo, 1)
+	lock.Unlock()
+
+	var err error
+	for key, info := range infos {
+		if e := info.Close(ctx); e != nil {
+			Error("[repository] close db failed", zap.String("db", key), zap.Error(e))
+			if err == nil {
+				err = fmt.Errorf("close %s: %w", key, e)
+			}
+		}
+	}
+	_ = Sync()
+	return err
 }
 
 // SetServiceDBConfig todo 有问题，需要加锁
 func SetServiceDBConfig(serviceName string, dbConf *DBConfig) {
 	ServiceConfigMap[serviceName] = dbConf
 }
-
@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+)
+
+// QueryDescription 是 Find(condition, options...) 将要执行的查询的只读描述, 供 linter, 文档生成, 权限检查等外部工具使用
+type QueryDescription struct {
+	Table string
+	// Columns 查询的列, 没有 Select 时为 model 的全部列(不含 secret 列)
+	Columns []string
+	// Where 包含 MandatoryCondition 的条件树, 没有条件时为 nil
+	Where *ConditionNode
+	// WhereSQL, Args 为 Where 展开后的 sql(使用 ? 占位)及参数
+	WhereSQL string
+	Args     []interface{}
+	// TenantColumn 配置了 TenantResolver 时为租户列, 运行时会追加 TenantColumn = 租户 的条件
+	TenantColumn string
+	Orders       []OrderSpec
+	Offset       int
+	// Limit <= 0 表示不限制
+	Limit int
+	// Joins Join 添加的 join 子句(参数未展开)
+	Joins []string
+}
+
+// Describe 描述 Find(condition, options...) 的查询. 租户条件依赖 ctx, 只记录租户列, 不包含在 Where 中
+func (e *Repository) Describe(condition Condition, options ...Option) QueryDescription {
+	if e.MandatoryCondition != nil {
+		condition = condition.And(e.MandatoryCondition)
+	}
+	if e.OptimizeConditions {
+		condition = Optimize(condition)
+	}
+	spec := InspectOptions(e.denySecretColumns(context.Background(), options)...)
+	desc := QueryDescription{
+		Table:   e.TableName(),
+		Columns: spec.Columns,
+		Orders:  spec.Orders,
+		Offset:  spec.Offset,
+		Limit:   spec.Limit,
+	}
+	for _, opt := range options {
+		if jo, ok := opt.(*joinOption); ok {
+			desc.Joins = append(desc.Joins, jo.query)
+		}
+	}
+	if len(desc.Columns) == 0 {
+		for _, f := range (&gorm.Scope{}).New(e.NewStruct()).Fields() {
+			if f.IsNormal {
+				desc.Columns = append(desc.Columns, f.DBName)
+			}
+		}
+	}
+	if e.TenantResolver != nil {
+		desc.TenantColumn = e.tenantField().Column()
+	}
+	desc.WhereSQL, desc.Args = condition.flatten()
+	if desc.WhereSQL != "" {
+		desc.Where = Inspect(condition)
+	}
+	return desc
+}
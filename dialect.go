@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"fmt"
+)
+
+// DBConfig.Dialect 支持的取值, 需要在 main 中 import 对应的驱动, 如
+//
+//	import _ "github.com/jinzhu/gorm/dialects/postgres"
+//	import _ "github.com/jinzhu/gorm/dialects/sqlite"
+const (
+	DialectPostgres = "postgres"
+	DialectMysql    = "mysql"
+	DialectSqlite3  = "sqlite3"
+)
+
+// forDialect 把 postgres 专有的操作符翻译为 dialect 支持的写法
+func (op operator) forDialect(dialect string) operator {
+	switch dialect {
+	case DialectSqlite3, DialectMysql:
+		// sqlite 的 LIKE 对 ascii 不区分大小写, mysql 取决于 collation (默认 *_ci 不区分)
+		switch op {
+		case c_ILike: // c_IStartsWith / c_IContains 与 c_ILike 取值相同
+			return c_Like
+		case c_NotILike:
+			return c_NotLike
+		}
+	}
+	return op
+}
+
+// arrayMatchAnySqlite sqlite 没有数组类型, 数组列以 json 数组存储, 通过 json_each 实现 &&
+func arrayMatchAnySqlite(column string) string {
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(%s) WHERE json_each.value IN (?))", column)
+}
+
+// isSqliteMemory in-memory sqlite 每个连接都是独立的数据库, 连接池只能有一个连接
+func isSqliteMemory(conf *DBConfig) bool {
+	return conf.Dialect == DialectSqlite3 && (conf.Dsn == ":memory:" || conf.Dsn == "file::memory:")
+}
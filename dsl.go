@@ -0,0 +1,473 @@
+package repository
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// 管理后台的查询 DSL, 例如
+//
+//	status = 1 AND (name ~ "foo" OR id IN (1, 2)) ORDER BY created_at DESC LIMIT 50 OFFSET 100
+//
+// 支持的操作符: = != <> < <= > >= ~(包含, 不区分大小写) !~ LIKE ILIKE IN NOT IN BETWEEN IS NULL IS NOT NULL.
+// 字段必须在 QueryPolicy.Fields 中, 值只能是数字, 字符串, true/false, 不会拼接进 sql
+
+// DSL 操作符名, 用于 QueryPolicy.Operators
+const (
+	DslEq       = "="
+	DslNotEq    = "!="
+	DslLt       = "<"
+	DslLte      = "<="
+	DslGt       = ">"
+	DslGte      = ">="
+	DslContains = "~"
+	DslNotMatch = "!~"
+	DslLike     = "LIKE"
+	DslILike    = "ILIKE"
+	DslIn       = "IN"
+	DslNotIn    = "NOT IN"
+	DslBetween  = "BETWEEN"
+	DslIsNull   = "IS NULL"
+	DslNotNull  = "IS NOT NULL"
+)
+
+const (
+	defaultDslMaxLimit   = 1000
+	defaultDslMaxClauses = 32
+)
+
+// QueryPolicy 限制 DSL 可以查询的内容
+type QueryPolicy struct {
+	// Fields DSL 中的字段名 -> 字段, 不在其中的字段会被拒绝
+	Fields map[string]FieldInterface
+	// Operators 允许的操作符(Dsl* 常量), 为空表示全部允许
+	Operators []string
+	// MaxLimit LIMIT 的上限, 没有 LIMIT 时也会使用, 默认 1000
+	MaxLimit int
+	// MaxClauses 条件个数的上限, 默认 32
+	MaxClauses int
+}
+
+func (p *QueryPolicy) allowOp(op string) bool {
+	if len(p.Operators) == 0 {
+		return true
+	}
+	for _, o := range p.Operators {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseQuery 把 DSL 解析为 Condition 和 Options, condition 为 nil 表示没有过滤条件
+func ParseQuery(query string, policy *QueryPolicy) (Condition, []Option, error) {
+	tokens, err := lexDsl(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &dslParser{tokens: tokens, policy: policy}
+	return p.parse()
+}
+
+type dslTokenKind int
+
+const (
+	dslEOF dslTokenKind = iota
+	dslIdent
+	dslNumber
+	dslString
+	dslSymbol
+)
+
+type dslToken struct {
+	kind dslTokenKind
+	text string
+	pos  int
+}
+
+func lexDsl(s string) ([]dslToken, error) {
+	var tokens []dslToken
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(rs) && (unicode.IsLetter(rs[i]) || unicode.IsDigit(rs[i]) || rs[i] == '_' || rs[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, dslToken{dslIdent, string(rs[start:i]), start})
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			start := i
+			i++
+			for i < len(rs) && (unicode.IsDigit(rs[i]) || rs[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, dslToken{dslNumber, string(rs[start:i]), start})
+		case r == '"' || r == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for ; i < len(rs) && rs[i] != r; i++ {
+				if rs[i] == '\\' && i+1 < len(rs) {
+					i++
+				}
+				sb.WriteRune(rs[i])
+			}
+			if i >= len(rs) {
+				return nil, fmt.Errorf("dsl: unterminated string at %d", start)
+			}
+			i++
+			tokens = append(tokens, dslToken{dslString, sb.String(), start})
+		default:
+			if i+1 < len(rs) {
+				two := string(rs[i : i+2])
+				if two == "!=" || two == "<>" || two == "<=" || two == ">=" || two == "!~" {
+					tokens = append(tokens, dslToken{dslSymbol, two, i})
+					i += 2
+					continue
+				}
+			}
+			if strings.ContainsRune("=<>~(),", r) {
+				tokens = append(tokens, dslToken{dslSymbol, string(r), i})
+				i++
+				continue
+			}
+			return nil, fmt.Errorf("dsl: unexpected %q at %d", r, i)
+		}
+	}
+	return append(tokens, dslToken{kind: dslEOF, pos: len(rs)}), nil
+}
+
+type dslParser struct {
+	tokens  []dslToken
+	pos     int
+	policy  *QueryPolicy
+	clauses int
+}
+
+func (p *dslParser) peek() dslToken {
+	return p.tokens[p.pos]
+}
+
+func (p *dslParser) next() dslToken {
+	t := p.tokens[p.pos]
+	if t.kind != dslEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword 关键字不区分大小写
+func (p *dslParser) keyword(words ...string) bool {
+	for i, w := range words {
+		if p.pos+i >= len(p.tokens) {
+			return false
+		}
+		t := p.tokens[p.pos+i]
+		if t.kind != dslIdent || !strings.EqualFold(t.text, w) {
+			return false
+		}
+	}
+	p.pos += len(words)
+	return true
+}
+
+func (p *dslParser) symbol(s string) bool {
+	if t := p.peek(); t.kind == dslSymbol && t.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *dslParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("dsl: at %d: %s", p.peek().pos, fmt.Sprintf(format, args...))
+}
+
+func (p *dslParser) parse() (cond Condition, options []Option, err error) {
+	if !p.isClauseEnd() {
+		if cond, err = p.parseOr(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if p.keyword("ORDER", "BY") {
+		for {
+			fld, err := p.parseField()
+			if err != nil {
+				return nil, nil, err
+			}
+			if p.keyword("DESC") {
+				options = append(options, fld.Desc())
+			} else {
+				p.keyword("ASC")
+				options = append(options, fld.Asc())
+			}
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	maxLimit := p.policy.MaxLimit
+	if maxLimit <= 0 {
+		maxLimit = defaultDslMaxLimit
+	}
+	limit, offset := maxLimit, 0
+	if p.keyword("LIMIT") {
+		if limit, err = p.parseInt(); err != nil {
+			return nil, nil, err
+		}
+		if limit > maxLimit {
+			return nil, nil, p.errorf("limit %d exceeds %d", limit, maxLimit)
+		}
+	}
+	if p.keyword("OFFSET") {
+		if offset, err = p.parseInt(); err != nil {
+			return nil, nil, err
+		}
+	}
+	options = append(options, Limit(offset, limit))
+	if p.peek().kind != dslEOF {
+		return nil, nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	return cond, options, nil
+}
+
+func (p *dslParser) isClauseEnd() bool {
+	t := p.peek()
+	if t.kind == dslEOF {
+		return true
+	}
+	return t.kind == dslIdent && (strings.EqualFold(t.text, "ORDER") || strings.EqualFold(t.text, "LIMIT") || strings.EqualFold(t.text, "OFFSET"))
+}
+
+func (p *dslParser) parseOr() (Condition, error) {
+	var conds []Condition
+	for {
+		c, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, c)
+		if !p.keyword("OR") {
+			break
+		}
+	}
+	if len(conds) == 1 {
+		return conds[0], nil
+	}
+	return MatchAny(conds...), nil
+}
+
+func (p *dslParser) parseAnd() (Condition, error) {
+	var conds []Condition
+	for {
+		c, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, c)
+		if !p.keyword("AND") {
+			break
+		}
+	}
+	if len(conds) == 1 {
+		return conds[0], nil
+	}
+	return MatchAll(conds...), nil
+}
+
+func (p *dslParser) parsePrimary() (Condition, error) {
+	if p.symbol("(") {
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(")") {
+			return nil, p.errorf("expect )")
+		}
+		return c, nil
+	}
+	p.clauses++
+	maxClauses := p.policy.MaxClauses
+	if maxClauses <= 0 {
+		maxClauses = defaultDslMaxClauses
+	}
+	if p.clauses > maxClauses {
+		return nil, p.errorf("too many clauses, max %d", maxClauses)
+	}
+	return p.parseComparison()
+}
+
+func (p *dslParser) parseField() (FieldInterface, error) {
+	t := p.next()
+	if t.kind != dslIdent {
+		return nil, fmt.Errorf("dsl: at %d: expect field, got %q", t.pos, t.text)
+	}
+	fld, ok := p.policy.Fields[t.text]
+	if !ok {
+		return nil, fmt.Errorf("dsl: at %d: field %q is not allowed", t.pos, t.text)
+	}
+	return fld, nil
+}
+
+func (p *dslParser) parseComparison() (Condition, error) {
+	fld, err := p.parseField()
+	if err != nil {
+		return nil, err
+	}
+	var op string
+	switch {
+	case p.keyword("IS", "NOT", "NULL"):
+		op = DslNotNull
+	case p.keyword("IS", "NULL"):
+		op = DslIsNull
+	case p.keyword("NOT", "IN"):
+		op = DslNotIn
+	case p.keyword("IN"):
+		op = DslIn
+	case p.keyword("BETWEEN"):
+		op = DslBetween
+	case p.keyword("LIKE"):
+		op = DslLike
+	case p.keyword("ILIKE"):
+		op = DslILike
+	default:
+		t := p.next()
+		if t.kind != dslSymbol {
+			return nil, fmt.Errorf("dsl: at %d: expect operator, got %q", t.pos, t.text)
+		}
+		op = t.text
+		if op == "<>" {
+			op = DslNotEq
+		}
+	}
+	if !p.policy.allowOp(op) {
+		return nil, p.errorf("operator %s is not allowed", op)
+	}
+
+	switch op {
+	case DslIsNull:
+		return fld.IsNull(), nil
+	case DslNotNull:
+		return fld.NotNull(), nil
+	case DslIn, DslNotIn:
+		vals, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		if op == DslIn {
+			return fld.In(vals), nil
+		}
+		return fld.NotIn(vals), nil
+	case DslBetween:
+		v1, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword("AND") {
+			return nil, p.errorf("expect AND in BETWEEN")
+		}
+		v2, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return fld.Between(v1, v2), nil
+	}
+
+	val, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case DslEq:
+		return fld.Eq(val), nil
+	case DslNotEq:
+		return fld.NotEq(val), nil
+	case DslLt:
+		return fld.Lt(val), nil
+	case DslLte:
+		return fld.Lte(val), nil
+	case DslGt:
+		return fld.Gt(val), nil
+	case DslGte:
+		return fld.Gte(val), nil
+	}
+	s, ok := val.(string)
+	if !ok {
+		return nil, p.errorf("operator %s requires a string", op)
+	}
+	switch op {
+	case DslContains:
+		return fld.IContains(s), nil
+	case DslNotMatch:
+		return fld.NotILike("%" + s + "%"), nil
+	case DslLike:
+		return fld.Like(s), nil
+	case DslILike:
+		return fld.ILike(s), nil
+	}
+	return nil, p.errorf("unknown operator %s", op)
+}
+
+func (p *dslParser) parseList() ([]interface{}, error) {
+	if !p.symbol("(") {
+		return nil, p.errorf("expect (")
+	}
+	var vals []interface{}
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+		if p.symbol(")") {
+			return vals, nil
+		}
+		if !p.symbol(",") {
+			return nil, p.errorf("expect , or )")
+		}
+	}
+}
+
+func (p *dslParser) parseValue() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case dslString:
+		return t.text, nil
+	case dslNumber:
+		if i, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("dsl: at %d: bad number %q", t.pos, t.text)
+		}
+		return f, nil
+	case dslIdent:
+		if strings.EqualFold(t.text, "true") {
+			return true, nil
+		}
+		if strings.EqualFold(t.text, "false") {
+			return false, nil
+		}
+	}
+	return nil, fmt.Errorf("dsl: at %d: expect value, got %q", t.pos, t.text)
+}
+
+func (p *dslParser) parseInt() (int, error) {
+	t := p.next()
+	if t.kind != dslNumber {
+		return 0, fmt.Errorf("dsl: at %d: expect integer, got %q", t.pos, t.text)
+	}
+	n, err := strconv.Atoi(t.text)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("dsl: at %d: bad integer %q", t.pos, t.text)
+	}
+	return n, nil
+}
@@ -0,0 +1,171 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrInvalidEnum 条件中使用了 EnumField 未声明的值, 此时不执行 sql
+var ErrInvalidEnum = errors.New("invalid enum value")
+
+// EnumField 取值限定在声明的集合中的列, 在数据库的 CHECK 约束之前发现非法的值:
+// Eq/NotEq/In/NotIn 使用未声明的值时, 查询返回 ErrInvalidEnum; 注册到 Repository.Enums 后,
+// Create/Save/Update 写入未声明的值时返回 *ValidationError (Tag 为 "enum"). 值可以是字符串或整数(包括自定义的类型)
+type EnumField struct {
+	SimpleField
+	values []interface{}
+}
+
+// NewEnumField 声明 column 可以取的值
+func NewEnumField(column string, values ...interface{}) *EnumField {
+	return &EnumField{SimpleField: SimpleField(column), values: inValues(values)}
+}
+
+// Values 声明的值, 自定义类型已转换为 string/int64
+func (f *EnumField) Values() []interface{} {
+	return f.values
+}
+
+// Check 不是声明的值时返回 ErrInvalidEnum
+func (f *EnumField) Check(val interface{}) error {
+	rv := reflect.ValueOf(val)
+	if !rv.IsValid() {
+		// NULL 不属于枚举值的校验范围, 由 NOT NULL 约束处理
+		return nil
+	}
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if !valuesContain(f.values, inValues([]interface{}{rv.Interface()})[0]) {
+		return fmt.Errorf("%w: %s = %v, expected one of %v", ErrInvalidEnum, f.Column(), val, f.values)
+	}
+	return nil
+}
+
+// checkAll vals 为 slice
+func (f *EnumField) checkAll(vals interface{}) error {
+	rv := reflect.ValueOf(vals)
+	for i := 0; i < rv.Len(); i++ {
+		if err := f.Check(rv.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *EnumField) Eq(val interface{}) Condition {
+	if err := f.Check(val); err != nil {
+		return &invalidCondition{err: err}
+	}
+	return f.SimpleField.Eq(val)
+}
+
+func (f *EnumField) NotEq(val interface{}) Condition {
+	if err := f.Check(val); err != nil {
+		return &invalidCondition{err: err}
+	}
+	return f.SimpleField.NotEq(val)
+}
+
+func (f *EnumField) In(val interface{}) Condition {
+	if IsArray(val) {
+		if err := f.checkAll(val); err != nil {
+			return &invalidCondition{err: err}
+		}
+	}
+	return f.SimpleField.In(val)
+}
+
+func (f *EnumField) NotIn(val interface{}) Condition {
+	if IsArray(val) {
+		if err := f.checkAll(val); err != nil {
+			return &invalidCondition{err: err}
+		}
+	}
+	return f.SimpleField.NotIn(val)
+}
+
+// invalidCondition 构造时发现错误的条件, mandatory 中返回 err; 直接使用 flatten 时不匹配任何行
+type invalidCondition struct {
+	err error
+}
+
+func (ic *invalidCondition) And(condition Condition) Condition {
+	return &compoundCondition{
+		condition1: ic,
+		condition2: condition,
+		logic:      and,
+	}
+}
+
+func (ic *invalidCondition) Or(condition Condition) Condition {
+	return &compoundCondition{
+		condition1: ic,
+		condition2: condition,
+		logic:      or,
+	}
+}
+
+func (ic *invalidCondition) flatten() (sql string, args []interface{}) {
+	return ic.flattenDialect("")
+}
+
+func (ic *invalidCondition) flattenDialect(dialect string) (sql string, args []interface{}) {
+	return "1=0", nil
+}
+
+// conditionErr 返回条件树中第一个 invalidCondition 的 error
+func conditionErr(condition Condition) error {
+	switch c := condition.(type) {
+	case *invalidCondition:
+		return c.err
+	case *compoundCondition:
+		if err := conditionErr(c.condition1); err != nil {
+			return err
+		}
+		return conditionErr(c.condition2)
+	case *conditionGroup:
+		for _, child := range c.conditions {
+			if err := conditionErr(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateEnums 校验 values (列名 -> 值) 中 Repository.Enums 的列, 表达式(如 Incr)不校验
+func (e *Repository) validateEnums(values map[string]interface{}) error {
+	if len(e.Enums) == 0 {
+		return nil
+	}
+	verr := &ValidationError{Table: e.TableName()}
+	for _, f := range e.Enums {
+		val, ok := values[f.Column()]
+		if !ok {
+			continue
+		}
+		if _, isExpr := val.(*gorm.SqlExpr); isExpr {
+			continue
+		}
+		if err := f.Check(val); err != nil {
+			verr.Violations = append(verr.Violations, FieldViolation{
+				Field:   f.Column(),
+				Tag:     "enum",
+				Param:   strings.Trim(fmt.Sprint(f.values), "[]"),
+				Message: err.Error(),
+			})
+		}
+	}
+	if len(verr.Violations) == 0 {
+		return nil
+	}
+	return verr
+}
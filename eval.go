@@ -0,0 +1,263 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// columnValue row 中 col 列的值, 指针会被解引用, NULL 或没有该列时为 nil
+func columnValue(row interface{}, col string) interface{} {
+	f, ok := (&gorm.Scope{}).New(row).FieldByName(col)
+	if !ok {
+		return nil
+	}
+	fv := reflect.Indirect(f.Field)
+	if !fv.IsValid() {
+		return nil
+	}
+	return fv.Interface()
+}
+
+// Match 在 Go 中计算条件, row 为 model (struct 或 struct 指针). nil 表示没有条件, 总是匹配.
+// 不支持 Raw 条件及聚合字段
+func (n *ConditionNode) Match(row interface{}) (bool, error) {
+	if n == nil {
+		return true, nil
+	}
+	if !n.IsLeaf() {
+		isOr := n.Logic == "OR"
+		for _, c := range n.Children {
+			ok, err := c.Match(row)
+			if err != nil {
+				return false, err
+			}
+			if ok == isOr {
+				return isOr, nil
+			}
+		}
+		return !isOr, nil
+	}
+
+	val := columnValue(row, n.Column)
+	switch n.Op {
+	case OpEq:
+		return valuesEqual(val, n.Args[0]), nil
+	case OpNotEq:
+		return !valuesEqual(val, n.Args[0]), nil
+	case OpIsNull:
+		return val == nil, nil
+	case OpNotNull:
+		return val != nil, nil
+	case OpEmpty:
+		return val == "", nil
+	case OpLt, OpLte, OpGt, OpGte:
+		c, ok := CompareValues(val, n.Args[0])
+		if !ok {
+			return false, fmt.Errorf("repository: can not compare %T with %T", val, n.Args[0])
+		}
+		switch n.Op {
+		case OpLt:
+			return c < 0, nil
+		case OpLte:
+			return c <= 0, nil
+		case OpGt:
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	case OpIn:
+		return valuesContain(n.Args[0], val), nil
+	case OpNotIn:
+		return !valuesContain(n.Args[0], val), nil
+	case OpArrayMatchAny, OpArrayContainsAll, OpArrayContainedBy, OpArrayAny:
+		rv := reflect.ValueOf(val)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return false, fmt.Errorf("repository: %s is not an array", n.Column)
+		}
+		switch n.Op {
+		case OpArrayAny:
+			return valuesContain(val, n.RawArgs[0]), nil
+		case OpArrayContainedBy:
+			for i := 0; i < rv.Len(); i++ {
+				if !valuesContain(n.RawArgs[0], rv.Index(i).Interface()) {
+					return false, nil
+				}
+			}
+			return true, nil
+		case OpArrayContainsAll:
+			wv := reflect.ValueOf(n.RawArgs[0])
+			for i := 0; i < wv.Len(); i++ {
+				if !valuesContain(val, wv.Index(i).Interface()) {
+					return false, nil
+				}
+			}
+			return true, nil
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if valuesContain(n.RawArgs[0], rv.Index(i).Interface()) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case OpTruncEq:
+		tv, ok := val.(time.Time)
+		if !ok {
+			return false, fmt.Errorf("repository: %s is not a time", n.Column)
+		}
+		from, to := TimeUnitRange(n.Args[0].(string), n.Args[1].(time.Time))
+		return !tv.Before(from) && tv.Before(to), nil
+	case OpBetween:
+		c1, ok1 := CompareValues(val, n.Args[0])
+		c2, ok2 := CompareValues(val, n.Args[1])
+		if !ok1 || !ok2 {
+			return false, fmt.Errorf("repository: can not compare %T with %T", val, n.Args[0])
+		}
+		return c1 >= 0 && c2 <= 0, nil
+	case OpLike, OpILike, OpNotLike, OpNotILike:
+		ignoreCase := n.Op == OpILike || n.Op == OpNotILike
+		ok := likeMatch(fmt.Sprint(n.Args[0]), fmt.Sprint(val), ignoreCase)
+		if n.Op == OpNotLike || n.Op == OpNotILike {
+			return !ok, nil
+		}
+		return ok, nil
+	default:
+		return false, errors.New("repository: unsupported operator " + n.Op)
+	}
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if c, ok := CompareValues(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func valuesContain(list interface{}, val interface{}) bool {
+	lv := reflect.ValueOf(list)
+	for i := 0; i < lv.Len(); i++ {
+		if valuesEqual(lv.Index(i).Interface(), val) {
+			return true
+		}
+	}
+	return false
+}
+
+func likeMatch(pattern, s string, ignoreCase bool) bool {
+	var sb strings.Builder
+	if ignoreCase {
+		sb.WriteString("(?i)")
+	}
+	sb.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String()).MatchString(s)
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// compare 支持数值, 字符串, time.Time; ok 为 false 表示无法比较. 整数之间精确比较, 不经过 float64
+func CompareValues(a, b interface{}) (int, bool) {
+	if c, ok := compareIntegers(reflect.ValueOf(a), reflect.ValueOf(b)); ok {
+		return c, true
+	}
+	if fa, ok := toFloat64(a); ok {
+		fb, ok := toFloat64(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch av := a.(type) {
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	case time.Time:
+		bv, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av.Before(bv):
+			return -1, true
+		case av.After(bv):
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// compareIntegers a, b 都是整数时比较, 有符号与无符号混合时按数值比较
+func compareIntegers(a, b reflect.Value) (int, bool) {
+	sa, ua, ok := integerOf(a)
+	if !ok {
+		return 0, false
+	}
+	sb, ub, ok := integerOf(b)
+	if !ok {
+		return 0, false
+	}
+	switch {
+	case !ua && !ub:
+		return compareOrdered(sa < sb, sa > sb), true
+	case ua && ub:
+		return compareOrdered(uint64(sa) < uint64(sb), uint64(sa) > uint64(sb)), true
+	case ua:
+		// a 无符号, b 有符号
+		if sb < 0 {
+			return 1, true
+		}
+		return compareOrdered(uint64(sa) < uint64(sb), uint64(sa) > uint64(sb)), true
+	default:
+		if sa < 0 {
+			return -1, true
+		}
+		return compareOrdered(uint64(sa) < uint64(sb), uint64(sa) > uint64(sb)), true
+	}
+}
+
+// integerOf 整数的值, unsigned 时 v 为 uint64 的位模式
+func integerOf(rv reflect.Value) (v int64, unsigned bool, ok bool) {
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), false, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), true, true
+	}
+	return 0, false, false
+}
@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+type explainAnalyzeOption struct{}
+
+// ExplainAnalyze 用于 Explain, 实际执行查询并返回真实的耗时和行数(EXPLAIN ANALYZE). sqlite 不支持
+func ExplainAnalyze() *explainAnalyzeOption {
+	return &explainAnalyzeOption{}
+}
+
+// Sql Explain 中处理, 这里不修改查询
+func (eo *explainAnalyzeOption) Sql(db *gorm.DB) *gorm.DB {
+	return db
+}
+
+// Explain 返回 Find(ctx, condition, options...) 会执行的 sql 的执行计划, 在同一连接(事务内为事务连接, 否则可能为从库)上执行 EXPLAIN.
+// 用于调试接口和管理工具
+func (e *Repository) Explain(ctx context.Context, condition Condition, options ...Option) (plan string, err error) {
+	err = e.intercept(ctx, &StatementInfo{Op: StmtExplain, Condition: condition, Options: options}, func(ctx context.Context, stmt *StatementInfo) error {
+		var err error
+		plan, err = e.explain(ctx, stmt.Condition, stmt.Options...)
+		return e.wrapTimeout(ctx, StmtExplain, err)
+	})
+	return
+}
+
+func (e *Repository) explain(ctx context.Context, condition Condition, options ...Option) (string, error) {
+	condition, err := e.mandatory(ctx, condition)
+	if err != nil {
+		return "", err
+	}
+	db := e.getReadDb(ctx, options...)
+	if db == nil {
+		return "", dbNilErr
+	}
+	analyze := false
+	for _, opt := range options {
+		if _, ok := opt.(*explainAnalyzeOption); ok {
+			analyze = true
+		}
+	}
+	prefix, err := explainPrefix(db.Dialect().GetName(), analyze)
+	if err != nil {
+		return "", err
+	}
+	query := e.parseOptions(ctx, ParseWhere(condition, db), e.denySecretColumns(ctx, options)...)
+	rows, err := db.New().Raw(prefix+"?", query.Model(e.NewStruct()).QueryExpr()).Rows()
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	return formatPlan(rows)
+}
+
+func explainPrefix(dialect string, analyze bool) (string, error) {
+	switch {
+	case dialect == DialectSqlite3 && analyze:
+		return "", fmt.Errorf("explain analyze is not supported by %s", dialect)
+	case dialect == DialectSqlite3:
+		return "EXPLAIN QUERY PLAN ", nil
+	case dialect == DialectPostgres && analyze:
+		return "EXPLAIN (ANALYZE) ", nil
+	case analyze:
+		return "EXPLAIN ANALYZE ", nil
+	default:
+		return "EXPLAIN ", nil
+	}
+}
+
+// formatPlan 每行结果一行, 多列以 " | " 分隔
+func formatPlan(rows *sql.Rows) (string, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return "", err
+		}
+		fields := make([]string, 0, len(values))
+		for _, v := range values {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			fields = append(fields, fmt.Sprint(v))
+		}
+		lines = append(lines, strings.Join(fields, " | "))
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+	return strings.Join(lines, "\n"), nil
+}
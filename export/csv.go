@@ -0,0 +1,148 @@
+// Package export 把 Repository 的查询结果流式地导出为 CSV, 按主键分批读取, 不在内存中缓存整张表
+package export
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/shaynewu/repository"
+)
+
+// defaultBatchSize 每批读取的默认行数
+const defaultBatchSize = 500
+
+// utf8BOM Excel 据此识别 UTF-8 编码, 否则中文乱码
+const utf8BOM = "\xEF\xBB\xBF"
+
+// ExportCSV 按主键升序分批查询满足 condition 的行(带 MandatoryCondition 等), 写入 w, 每批 batchSize 行(<= 0 时为 500), 写完后 flush.
+// condition 为 nil 时导出所有行. fields 为导出的列, 为空时导出 model 的所有列; secret 字段总是被跳过.
+// 表头为 gorm tag 中的 COMMENT, 没有时为列名. pii 字段原样导出, 需要脱敏时在 AfterFind 的回调中使用 repository.MaskModel
+func ExportCSV(ctx context.Context, repo *repository.Repository, condition repository.Condition, w io.Writer, batchSize int, fields ...repository.FieldInterface) error {
+	return export(ctx, repo, condition, csv.NewWriter(w), batchSize, fields)
+}
+
+// ExportExcel 同 ExportCSV, 但先写入 UTF-8 BOM, Excel 可以直接打开
+func ExportExcel(ctx context.Context, repo *repository.Repository, condition repository.Condition, w io.Writer, batchSize int, fields ...repository.FieldInterface) error {
+	if _, err := io.WriteString(w, utf8BOM); err != nil {
+		return err
+	}
+	return ExportCSV(ctx, repo, condition, w, batchSize, fields...)
+}
+
+func export(ctx context.Context, repo *repository.Repository, condition repository.Condition, cw *csv.Writer, batchSize int, fields []repository.FieldInterface) error {
+	if condition == nil {
+		condition = repository.MatchAll()
+	}
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	columns, header := columnsOf(repo, fields)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	pk := repo.PrimaryField()
+	var last interface{}
+	for {
+		cond := condition
+		if last != nil {
+			cond = cond.And(pk.Gt(last))
+		}
+		slice, err := repo.Find(ctx, cond, pk.Asc(), repository.Limit(0, batchSize))
+		if err != nil {
+			return err
+		}
+		sv := reflect.ValueOf(slice).Elem()
+		for i := 0; i < sv.Len(); i++ {
+			scope := (&gorm.Scope{}).New(sv.Index(i).Interface())
+			record := make([]string, len(columns))
+			for j, col := range columns {
+				if f, ok := scope.FieldByName(col); ok {
+					record[j] = format(f.Field)
+				}
+			}
+			if err = cw.Write(record); err != nil {
+				return err
+			}
+			if f, ok := scope.FieldByName(pk.Column()); ok {
+				last = f.Field.Interface()
+			}
+		}
+		cw.Flush()
+		if err = cw.Error(); err != nil {
+			return err
+		}
+		if sv.Len() < batchSize || last == nil {
+			return nil
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// columnsOf 导出的列及表头
+func columnsOf(repo *repository.Repository, fields []repository.FieldInterface) (columns, header []string) {
+	model := repo.NewStruct()
+	secret := make(map[string]bool)
+	for _, fc := range repository.ClassifiedFields(model) {
+		if fc.Class == repository.ClassSecret {
+			secret[fc.Column] = true
+		}
+	}
+	byColumn := make(map[string]*gorm.StructField)
+	var all []string
+	for _, f := range (&gorm.Scope{}).New(model).GetModelStruct().StructFields {
+		if f.IsIgnored || f.Relationship != nil {
+			continue
+		}
+		byColumn[f.DBName] = f
+		if !secret[f.DBName] {
+			all = append(all, f.DBName)
+		}
+	}
+	if len(fields) == 0 {
+		columns = all
+	} else {
+		for _, f := range fields {
+			if !secret[f.Column()] {
+				columns = append(columns, f.Column())
+			}
+		}
+	}
+	for _, col := range columns {
+		title := col
+		if f, ok := byColumn[col]; ok {
+			if comment, ok := f.TagSettingsGet("COMMENT"); ok && comment != "" {
+				title = comment
+			}
+		}
+		header = append(header, title)
+	}
+	return
+}
+
+func format(v reflect.Value) string {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	switch val := v.Interface().(type) {
+	case time.Time:
+		if val.IsZero() {
+			return ""
+		}
+		return val.Format("2006-01-02 15:04:05")
+	case []byte:
+		return string(val)
+	case fmt.Stringer:
+		return val.String()
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -3,8 +3,7 @@ package repository
 import (
 	"database/sql/driver"
 	"fmt"
-	"github.com/jinzhu/copier"
-	"github.com/lib/pq"
+	"github.com/jinzhu/gorm"
 	"reflect"
 	"strings"
 )
@@ -36,11 +35,35 @@ const (
 	c_Raw           = "RAW"
 )
 
+// 导出的操作符, 用于 ConditionNode.Op
+//
+// 注意 Like, StartsWith, Contains 共用 OpLike (ILike 同理), 区别只在 ConditionNode.Args 中的 %
+const (
+	OpEq            = c_Eq
+	OpNotEq         = c_NotEq
+	OpIsNull        = c_IsNull
+	OpNotNull       = c_NotNull
+	OpEmpty         = c_Empty
+	OpLt            = c_Lt
+	OpLte           = c_Lte
+	OpGt            = c_Gt
+	OpGte           = c_Gte
+	OpIn            = c_In
+	OpNotIn         = c_NotIn
+	OpArrayMatchAny = c_ArrayMatchAny
+	OpBetween       = c_Between
+	OpLike          = c_Like
+	OpILike         = c_ILike
+	OpNotLike       = c_NotLike
+	OpNotILike      = c_NotILike
+	OpRaw           = c_Raw
+)
+
 func (op operator) ParamCount() int {
 	switch op {
 	case c_IsNull, c_NotNull, c_Empty, c_Raw:
 		return 0
-	case c_Between:
+	case c_Between, c_TruncEq:
 		return 2
 	default:
 		return 1
@@ -108,6 +131,8 @@ type FieldInterface interface {
 	// field && (?)
 	//
 	// val should be array or slice
+	//
+	// Deprecated: use ArrayField.Overlaps
 	ArrayMatchAny(val interface{}) Condition
 
 	// field between ? and ?
@@ -139,12 +164,22 @@ type FieldInterface interface {
 	Desc() Option
 }
 
+// Incrementer 可选接口, 数值列的原子增减, SimpleField 实现
+type Incrementer interface {
+	// field + ?, 用于 Update 的 map value
+	Incr(delta interface{}) *gorm.SqlExpr
+
+	// field - ?, 用于 Update 的 map value
+	Decr(delta interface{}) *gorm.SqlExpr
+}
+
 type SimpleField string
 
 const _Id = SimpleField("id")
 
 // implements hint
 var _ FieldInterface = (*SimpleField)(nil)
+var _ Incrementer = (*SimpleField)(nil)
 
 func (s SimpleField) Column() string {
 	return string(s)
@@ -225,23 +260,7 @@ func (s SimpleField) Gte(val interface{}) Condition {
 	}
 }
 
-// val should be array or slice
-func asArray(val interface{}) interface{} {
-	if _, ok := val.(driver.Valuer); ok {
-		// already driver Value, e.g. pq.StringArray
-		return val
-	}
-	switch val.(type) {
-	case []int32, *[]int32, []int, *[]int:
-		var i64a []int64
-		_ = copier.Copy(&i64a, val)
-		return pq.Array(&i64a) // todo 这地方有问题
-	default:
-		return pq.Array(val) // todo 这地方有问题
-	}
-}
-
-// val should be array or slice
+// val should be array or slice, 为空时不匹配任何行
 func (s SimpleField) In(val interface{}) Condition {
 	if !IsArray(val) {
 		panic("param for In should be array or slice")
@@ -249,12 +268,12 @@ func (s SimpleField) In(val interface{}) Condition {
 	return &singleCondition{
 		field:   s,
 		op:      c_In,
-		sqlArg1: val,
+		sqlArg1: inValues(val),
 		rawVal1: val,
 	}
 }
 
-// val should be array or slice
+// val should be array or slice, 为空时匹配所有行
 func (s SimpleField) NotIn(val interface{}) Condition {
 	if !IsArray(val) {
 		panic("param for NotIn should be array or slice")
@@ -262,11 +281,44 @@ func (s SimpleField) NotIn(val interface{}) Condition {
 	return &singleCondition{
 		field:   s,
 		op:      c_NotIn,
-		sqlArg1: val,
+		sqlArg1: inValues(val),
 		rawVal1: val,
 	}
 }
 
+// inValues 把 In/NotIn 的参数展开为元素的列表, 由 gorm 展开为 (?,?,...):
+// 自定义的字符串, 整数等类型(如枚举)转换为基础类型, 实现了 driver.Valuer 的元素原样保留.
+// slice 本身实现了 driver.Valuer (如 pq.StringArray) 时同样按元素展开, 而不是作为一个参数
+func inValues(val interface{}) []interface{} {
+	rv := reflect.ValueOf(val)
+	values := make([]interface{}, rv.Len())
+	for i := range values {
+		ev := rv.Index(i)
+		if ev.Kind() == reflect.Interface && !ev.IsNil() {
+			ev = ev.Elem()
+		}
+		if v, ok := ev.Interface().(driver.Valuer); ok {
+			values[i] = v
+			continue
+		}
+		switch ev.Kind() {
+		case reflect.String:
+			values[i] = ev.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			values[i] = ev.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			values[i] = ev.Uint()
+		case reflect.Float32, reflect.Float64:
+			values[i] = ev.Float()
+		case reflect.Bool:
+			values[i] = ev.Bool()
+		default:
+			values[i] = ev.Interface()
+		}
+	}
+	return values
+}
+
 func IsArray(val interface{}) bool {
 	rt := reflect.TypeOf(val)
 	switch rt.Kind() {
@@ -281,16 +333,10 @@ func IsArray(val interface{}) bool {
 }
 
 // val should be array or slice
+//
+// Deprecated: use ArrayField.Overlaps
 func (s SimpleField) ArrayMatchAny(val interface{}) Condition {
-	if !IsArray(val) {
-		panic("param for ArrayMatchAny should be array or slice")
-	}
-	return &singleCondition{
-		field:   s,
-		op:      c_ArrayMatchAny,
-		sqlArg1: asArray(val),
-		rawVal1: val,
-	}
+	return ArrayField(s).Overlaps(val)
 }
 
 func (s SimpleField) Between(val1, val2 interface{}) Condition {
@@ -392,6 +438,24 @@ func (s SimpleField) Desc() Option {
 	}
 }
 
+func (s SimpleField) Incr(delta interface{}) *gorm.SqlExpr {
+	return Expr(string(s)+" + ?", delta)
+}
+
+func (s SimpleField) Decr(delta interface{}) *gorm.SqlExpr {
+	return Expr(string(s)+" - ?", delta)
+}
+
+// Expr 作为 Update 的 map value 时原样写入 SET, 在数据库中原子地计算, 例如
+//
+//	repo.Update(ctx, map[string]interface{}{"count": Expr("count + ?", 1)}, cond)
+//	repo.Update(ctx, map[string]interface{}{"stock": fields.Stock.Decr(n)}, fields.Stock.Gte(n))
+//
+// struct 形式的 Update 不支持表达式
+func Expr(expr string, args ...interface{}) *gorm.SqlExpr {
+	return gorm.Expr(expr, args...)
+}
+
 type reduceFieldImpl struct {
 	FieldInterface
 	reduceFmt string
@@ -412,6 +476,23 @@ func Distinct(flds ...FieldInterface) FieldInterface {
 	}
 }
 
+type aliasField struct {
+	FieldInterface
+	alias string
+}
+
+func (af *aliasField) Column() string {
+	return af.FieldInterface.Column() + " AS " + af.alias
+}
+
+// As 用于 Select, 如 Select(As(Sum(fields.Amount), "total"))
+func As(fi FieldInterface, alias string) FieldInterface {
+	return &aliasField{
+		FieldInterface: fi,
+		alias:          alias,
+	}
+}
+
 func Sum(fi FieldInterface) FieldInterface {
 	return &reduceFieldImpl{
 		FieldInterface: fi,
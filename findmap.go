@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"context"
+	"reflect"
+)
+
+// FindMap 同 Find, 结果以 keyField 列的值为 key. key 的类型与 model 中字段的类型相同(指针字段解引用, NULL 的行被跳过),
+// 如 int64 的 Id 需要以 m[int64(id)] 取值. keyField 的值重复时保留排序在后的行
+func (e *Repository) FindMap(ctx context.Context, keyField FieldInterface, condition Condition, options ...Option) (map[interface{}]Model, error) {
+	slice, err := e.Find(ctx, condition, options...)
+	if err != nil {
+		return nil, err
+	}
+	return indexRows(slice, keyField.Column()), nil
+}
+
+// FindMapByIds 同 FindByIds, 结果以主键为 key, 不存在的 id 不在结果中
+func (e *Repository) FindMapByIds(ctx context.Context, ids interface{}, additional ...Condition) (map[interface{}]Model, error) {
+	slice, err := e.FindByIds(ctx, ids, additional...)
+	if err != nil {
+		return nil, err
+	}
+	return indexRows(slice, e.PrimaryField().Column()), nil
+}
+
+// indexRows slice 为 NewSlice 返回的 slice 指针
+func indexRows(slice interface{}, column string) map[interface{}]Model {
+	sv := reflect.ValueOf(slice).Elem()
+	m := make(map[interface{}]Model, sv.Len())
+	for i := 0; i < sv.Len(); i++ {
+		row := sv.Index(i).Interface()
+		if key := columnValue(row, column); key != nil {
+			m[key] = row.(Model)
+		}
+	}
+	return m
+}
@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/jinzhu/gorm"
+)
+
+// First 按 orderBy 排序后的第一行, 执行 ORDER BY ... LIMIT 1; orderBy 为空时按主键升序. 不存在时返回 gorm.ErrRecordNotFound.
+// 与 FindOne (任意一行)不同, 结果是确定的
+func (e *Repository) First(ctx context.Context, condition Condition, orderBy ...Option) (Model, error) {
+	if !hasOrder(orderBy) {
+		orderBy = append(orderBy[:len(orderBy):len(orderBy)], e.PrimaryField().Asc())
+	}
+	return e.firstOf(ctx, condition, orderBy)
+}
+
+// Last 按 orderBy 排序后的最后一行, 即以相反的顺序(包括 NULLS FIRST/LAST)取第一行; orderBy 为空时为主键最大的行
+func (e *Repository) Last(ctx context.Context, condition Condition, orderBy ...Option) (Model, error) {
+	if !hasOrder(orderBy) {
+		orderBy = append(orderBy[:len(orderBy):len(orderBy)], e.PrimaryField().Asc())
+	}
+	reversed := make([]Option, len(orderBy))
+	for i, opt := range orderBy {
+		reversed[i] = reverseOrder(opt)
+	}
+	return e.firstOf(ctx, condition, reversed)
+}
+
+func (e *Repository) firstOf(ctx context.Context, condition Condition, options []Option) (Model, error) {
+	slice, err := e.Find(ctx, condition, append(append([]Option(nil), options...), Limit(0, 1))...)
+	if err != nil {
+		return nil, err
+	}
+	sv := reflect.ValueOf(slice).Elem()
+	if sv.Len() == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return sv.Index(0).Interface().(Model), nil
+}
+
+func hasOrder(options []Option) bool {
+	for _, opt := range options {
+		switch opt.(type) {
+		case *orderOption, *orderByOption:
+			return true
+		}
+	}
+	return false
+}
+
+// reverseOrder 反转排序的方向, 不是排序的 Option 原样返回
+func reverseOrder(opt Option) Option {
+	switch o := opt.(type) {
+	case *orderOption:
+		return &orderOption{field: o.field, order: -o.order}
+	case *orderByOption:
+		pairs := make([]OrderPair, len(o.pairs))
+		for i, p := range o.pairs {
+			if p.Order < 0 {
+				p.Order = ASC
+			} else {
+				p.Order = DESC
+			}
+			switch p.Nulls {
+			case NullsFirst:
+				p.Nulls = NullsLast
+			case NullsLast:
+				p.Nulls = NullsFirst
+			}
+			pairs[i] = p
+		}
+		return &orderByOption{pairs: pairs}
+	}
+	return opt
+}
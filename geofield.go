@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// geoPoint WGS84 的点, PostGIS 的坐标顺序为 (lng, lat)
+const geoPoint = "ST_SetSRID(ST_MakePoint(?, ?), 4326)"
+
+// GeoField PostGIS 的 geometry/geography 列(SRID 4326), 坐标参数为 WGS84 的经纬度, 距离单位为米.
+// 条件只支持 postgres, Inspect 不识别, 返回 nil
+type GeoField string
+
+func (g GeoField) Column() string {
+	return string(g)
+}
+
+// WithinRadius ST_DWithin(field, point, meters), 与 (lat, lng) 的球面距离不超过 meters, 可以使用 GiST 索引
+func (g GeoField) WithinRadius(lat, lng, meters float64) Condition {
+	return &geoCondition{
+		sql:  fmt.Sprintf("ST_DWithin(%s::geography, %s::geography, ?)", g, geoPoint),
+		args: []interface{}{lng, lat, meters},
+	}
+}
+
+// IntersectsBBox ST_Intersects(field, ST_MakeEnvelope(...)), 与矩形范围相交, 如地图可视区域内的点
+func (g GeoField) IntersectsBBox(minLat, minLng, maxLat, maxLng float64) Condition {
+	return &geoCondition{
+		sql:  fmt.Sprintf("ST_Intersects(%s::geometry, ST_MakeEnvelope(?, ?, ?, ?, 4326))", g),
+		args: []interface{}{minLng, minLat, maxLng, maxLat},
+	}
+}
+
+// Distance ST_Distance(field, point), 与 (lat, lng) 的球面距离(米), 用于 Select, 如 As(fields.Location.Distance(lat, lng), "distance")
+func (g GeoField) Distance(lat, lng float64) FieldInterface {
+	return SimpleField(fmt.Sprintf("ST_Distance(%s::geography, ST_SetSRID(ST_MakePoint(%v, %v), 4326)::geography)", g, lng, lat))
+}
+
+// OrderByDistance 按与 (lat, lng) 的距离排序
+func (g GeoField) OrderByDistance(lat, lng float64, order ORDER) Option {
+	return OrderBy(OrderPair{
+		Expr:  fmt.Sprintf("ST_Distance(%s::geography, %s::geography)", g, geoPoint),
+		Args:  []interface{}{lng, lat},
+		Order: order,
+	})
+}
+
+// NearestTo 距离 (lat, lng) 最近的 n 行, 通过 <-> 排序使用 GiST 索引做 KNN 查询, 不需要先用 WithinRadius 缩小范围
+func (g GeoField) NearestTo(lat, lng float64, n int) Option {
+	return &nearestOption{field: g, lat: lat, lng: lng, n: n}
+}
+
+type nearestOption struct {
+	field    GeoField
+	lat, lng float64
+	n        int
+}
+
+func (no *nearestOption) Sql(db *gorm.DB) *gorm.DB {
+	db = OrderBy(OrderPair{
+		Expr:  fmt.Sprintf("%s <-> %s", no.field, geoPoint),
+		Args:  []interface{}{no.lng, no.lat},
+		Order: ASC,
+	}).Sql(db)
+	return db.Limit(no.n)
+}
+
+type geoCondition struct {
+	sql  string
+	args []interface{}
+}
+
+func (gc *geoCondition) And(condition Condition) Condition {
+	return &compoundCondition{
+		condition1: gc,
+		condition2: condition,
+		logic:      and,
+	}
+}
+
+func (gc *geoCondition) Or(condition Condition) Condition {
+	return &compoundCondition{
+		condition1: gc,
+		condition2: condition,
+		logic:      or,
+	}
+}
+
+func (gc *geoCondition) flatten() (sql string, args []interface{}) {
+	return gc.flattenDialect("")
+}
+
+func (gc *geoCondition) flattenDialect(dialect string) (sql string, args []interface{}) {
+	return gc.sql, gc.args
+}
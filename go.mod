@@ -3,10 +3,13 @@ module github.com/shaynewu/repository
 go 1.16
 
 require (
-	github.com/jinzhu/copier v0.3.2 // indirect
+	github.com/BurntSushi/toml v1.2.1
+	github.com/DATA-DOG/go-sqlmock v1.5.0
 	github.com/jinzhu/gorm v1.9.16 // indirect
 	github.com/lib/pq v1.10.4 // indirect
 	github.com/natefinch/lumberjack v2.0.0+incompatible // indirect
+	go.mongodb.org/mongo-driver v1.7.4
 	go.uber.org/zap v1.19.1 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 	gorm.io/gorm v1.22.3 // indirect
 )
@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+
+	"github.com/jinzhu/gorm"
+)
+
+type guardKey struct{}
+
+// dbGuard 一个连接池的熔断及限流
+type dbGuard struct {
+	breaker *circuitBreaker
+	limiter *dbLimiter
+}
+
+// heldGuard ctx 中的标记, released 之后(如 AfterCommit 中使用的 ctx)不再放行
+type heldGuard struct {
+	dbGuard
+	released int32
+}
+
+// guardDb 占用 db 的限流名额并检查熔断, 返回带有标记的 ctx 及释放名额的 release.
+// ctx 已由外层的操作或事务占用时直接放行(返回的 breaker 为 nil), 避免嵌套的操作(如操作中开启的事务,
+// 事务中 RequiresNew 开启的事务)等待外层持有的名额而死锁, 或在半开时因外层占用了探测而被拒绝
+func guardDb(ctx context.Context, db *gorm.DB) (_ context.Context, breaker *circuitBreaker, release func(), err error) {
+	g := dbGuard{breaker: circuitOf(db), limiter: limiterOf(db)}
+	if g.breaker == nil && g.limiter == nil {
+		return ctx, nil, func() {}, nil
+	}
+	if held, ok := ctx.Value(guardKey{}).(*heldGuard); ok && held.dbGuard == g && atomic.LoadInt32(&held.released) == 0 {
+		return ctx, nil, func() {}, nil
+	}
+	releaseSlot, err := g.limiter.acquire(ctx)
+	if err != nil {
+		return ctx, nil, nil, err
+	}
+	if err = g.breaker.allow(); err != nil {
+		releaseSlot()
+		return ctx, nil, nil, err
+	}
+	held := &heldGuard{dbGuard: g}
+	release = func() {
+		atomic.StoreInt32(&held.released, 1)
+		releaseSlot()
+	}
+	return context.WithValue(ctx, guardKey{}, held), g.breaker, release, nil
+}
+
+// guard 由 intercept 调用, 对主库上的所有操作执行限流及熔断检查, 包括 gorm callback 拦截不到的 Count/Pluck/Exists 等 row query,
+// 以及通过 Exec 执行的批量写入. 事务中的操作在开启事务时已经检查
+func (e *Repository) guard(ctx context.Context, stmt *StatementInfo, next Invoker) error {
+	db := e.Tm.GetDb(ctx)
+	if db == nil {
+		return next(ctx, stmt)
+	}
+	if _, inTx := db.CommonDB().(*sql.Tx); inTx {
+		return next(ctx, stmt)
+	}
+	ctx, breaker, release, err := guardDb(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer release()
+	err = next(ctx, stmt)
+	if !errors.Is(err, ErrCircuitOpen) {
+		breaker.done(err)
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultPingTimeout ctx 没有 deadline 时 Ping 的超时时间
+const defaultPingTimeout = 3 * time.Second
+
+// Ping 检查主库及所有从库的连接, 返回第一个错误
+func (s *DBInfo) Ping(ctx context.Context) error {
+	for name, err := range s.ping(ctx) {
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ping 并发 ping 主库和从库, key 为 "primary" 或 "replica-<i>"
+func (s *DBInfo) ping(ctx context.Context) map[string]error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultPingTimeout)
+		defer cancel()
+	}
+	conns := make(map[string]*sql.DB)
+	if s.Conn != nil {
+		conns["primary"] = s.Conn.DB()
+	}
+	for i, r := range s.replicas {
+		conns[fmt.Sprintf("replica-%d", i)] = r.conn.DB()
+	}
+
+	res := make(map[string]error, len(conns))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, conn := range conns {
+		wg.Add(1)
+		go func(name string, conn *sql.DB) {
+			defer wg.Done()
+			err := conn.PingContext(ctx)
+			mu.Lock()
+			res[name] = err
+			mu.Unlock()
+		}(name, conn)
+	}
+	wg.Wait()
+	return res
+}
+
+// HealthCheck ping 所有已注册(已经初始化连接)的数据库, 用于 k8s readiness probe.
+// key 为 "<serviceName>#<database>/primary" 或 "<serviceName>#<database>/replica-<i>", 成功时 value 为 nil
+func HealthCheck(ctx context.Context) map[string]error {
+	lock.Lock()
+	infos := make(map[string]*DBInfo, len(dbRegister))
+	for key, info := range dbRegister {
+		infos[key] = info
+	}
+	lock.Unlock()
+
+	res := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for key, info := range infos {
+		wg.Add(1)
+		go func(key string, info *DBInfo) {
+			defer wg.Done()
+			for name, err := range info.ping(ctx) {
+				mu.Lock()
+				res[key+"/"+name] = err
+				mu.Unlock()
+			}
+		}(key, info)
+	}
+	wg.Wait()
+	return res
+}
@@ -0,0 +1,125 @@
+// Package idgen 基于数据库的 id 分配, 不依赖自增列, 适用于分库分表:
+// Allocator 按号段分配单调递增的序列, Workers 通过数据库协调 snowflake 的 worker id.
+//
+//	alloc := idgen.New(serviceName, database)
+//	repository.SetSequenceProvider(alloc.Next) // AUTOSEQ 的字段
+//
+//	lease, err := idgen.NewWorkers(db).Acquire(ctx, "")
+//	sf := lease.Snowflake()
+//	repository.RegisterIdGenerator("snowflake", sf.Generate) // AUTOID:snowflake 的字段
+package idgen
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/shaynewu/repository"
+)
+
+const (
+	defaultSequenceTable = "id_sequences"
+	defaultStep          = 1000
+)
+
+// Allocator 从序列表按号段分配 id: 每次在数据库中把序列增加 Step, 之后在内存中依次分配, 用完再取下一段.
+// 各实例取得的号段互不重叠, 因此 id 全局唯一, 单个实例内单调递增, 实例之间大致递增.
+// 进程退出时未用完的号段被丢弃, id 不连续
+type Allocator struct {
+	db *gorm.DB
+	// Table 序列表, 默认 id_sequences
+	Table string
+	// Step 每次取的号段大小, 默认 1000
+	Step int64
+
+	mu     sync.Mutex
+	blocks map[string]*block
+}
+
+type block struct {
+	next int64
+	max  int64
+}
+
+// New uses the connection registered for serviceName/database, see repository.SetServiceDBConfig
+func New(serviceName, database string) *Allocator {
+	return NewWithDB(repository.GetDB(database, serviceName))
+}
+
+// NewWithDB creates an Allocator on db. 号段在独立的事务中分配, 不受调用方事务的影响
+func NewWithDB(db *gorm.DB) *Allocator {
+	return &Allocator{
+		db:     db,
+		Table:  defaultSequenceTable,
+		Step:   defaultStep,
+		blocks: make(map[string]*block),
+	}
+}
+
+// EnsureTable 创建序列表
+func (a *Allocator) EnsureTable() error {
+	return a.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (name VARCHAR(128) PRIMARY KEY, next_id BIGINT NOT NULL)", a.Table)).Error
+}
+
+// Next 序列 name 的下一个值, 从 1 开始. 序列不存在时自动创建
+func (a *Allocator) Next(ctx context.Context, name string) (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b := a.blocks[name]
+	if b == nil || b.next > b.max {
+		var err error
+		if b, err = a.allocate(ctx, name); err != nil {
+			return 0, err
+		}
+		a.blocks[name] = b
+	}
+	id := b.next
+	b.next++
+	return id, nil
+}
+
+// allocate 取下一个号段, 序列不存在时插入; 并发插入冲突时重试一次
+func (a *Allocator) allocate(ctx context.Context, name string) (*block, error) {
+	b, err := a.allocateTx(ctx, name)
+	if err != nil {
+		b, err = a.allocateTx(ctx, name)
+	}
+	if err != nil {
+		repository.Error("[idgen] allocate block failed", name, err)
+	}
+	return b, err
+}
+
+func (a *Allocator) allocateTx(ctx context.Context, name string) (b *block, err error) {
+	step := a.Step
+	if step <= 0 {
+		step = defaultStep
+	}
+	tx := a.db.BeginTx(ctx, nil)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	res := tx.Exec(fmt.Sprintf("UPDATE %s SET next_id = next_id + ? WHERE name = ?", a.Table), step, name)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		if err = tx.Exec(fmt.Sprintf("INSERT INTO %s (name, next_id) VALUES (?, ?)", a.Table), name, 1+step).Error; err != nil {
+			return nil, err
+		}
+	}
+	var next int64
+	if err = tx.Raw(fmt.Sprintf("SELECT next_id FROM %s WHERE name = ?", a.Table), name).Row().Scan(&next); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return &block{next: next - step, max: next - 1}, nil
+}
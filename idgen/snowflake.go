@@ -0,0 +1,237 @@
+package idgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/shaynewu/repository"
+	"go.uber.org/zap"
+)
+
+const (
+	workerBits   = 10
+	sequenceBits = 12
+	// MaxWorkerId worker id 的最大值
+	MaxWorkerId = 1<<workerBits - 1
+	maxSequence = 1<<sequenceBits - 1
+
+	defaultWorkerTable = "id_workers"
+	defaultLease       = time.Minute
+)
+
+// Epoch snowflake 时间戳的起点 2020-01-01 UTC
+var Epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ErrNoWorker 所有的 worker id 都被占用
+var ErrNoWorker = errors.New("idgen: no free worker id")
+
+// ErrLeaseLost worker id 的租约已失效, 不能再用其生成 id
+var ErrLeaseLost = errors.New("idgen: worker lease lost")
+
+// Snowflake 64 位的 id: 41 位毫秒时间戳(相对 Epoch), 10 位 worker id, 12 位序号. 同一 worker id 不能同时被多个进程使用, 参见 Workers
+type Snowflake struct {
+	workerId int64
+	// lease 不为 nil 时租约失效后不再生成 id, 参见 WorkerLease.Snowflake
+	lease *WorkerLease
+
+	mu     sync.Mutex
+	lastMs int64
+	seq    int64
+}
+
+func NewSnowflake(workerId int64) (*Snowflake, error) {
+	if workerId < 0 || workerId > MaxWorkerId {
+		return nil, fmt.Errorf("idgen: worker id %d out of range [0, %d]", workerId, MaxWorkerId)
+	}
+	return &Snowflake{workerId: workerId}, nil
+}
+
+// Next 下一个 id. 同一毫秒内序号用完, 或时钟回拨时等待到下一个可用的毫秒; worker id 的租约失效后返回 ErrLeaseLost
+func (s *Snowflake) Next() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lease != nil && !s.lease.valid() {
+		return 0, ErrLeaseLost
+	}
+	now := time.Since(Epoch).Milliseconds()
+	if now < s.lastMs {
+		time.Sleep(time.Duration(s.lastMs-now) * time.Millisecond)
+		now = s.lastMs
+	}
+	if now == s.lastMs {
+		s.seq = (s.seq + 1) & maxSequence
+		if s.seq == 0 {
+			for now <= s.lastMs {
+				time.Sleep(100 * time.Microsecond)
+				now = time.Since(Epoch).Milliseconds()
+			}
+		}
+	} else {
+		s.seq = 0
+	}
+	s.lastMs = now
+	return now<<(workerBits+sequenceBits) | s.workerId<<sequenceBits | s.seq, nil
+}
+
+// Generate 同 Next, 用于 repository.RegisterIdGenerator
+func (s *Snowflake) Generate(ctx context.Context) (interface{}, error) {
+	return s.Next()
+}
+
+// Workers 通过数据库表租用 worker id, 租约由后台续期; 进程异常退出后租约过期, worker id 可被其他进程使用
+type Workers struct {
+	db *gorm.DB
+	// Table worker 表, 默认 id_workers
+	Table string
+	// Lease 租期, 默认 1 分钟, 每 1/3 租期续期一次. 超过 2/3 租期没有成功续期时停止生成 id,
+	// 为进程间的时钟偏差及续期的延迟留出余量
+	Lease time.Duration
+}
+
+func NewWorkers(db *gorm.DB) *Workers {
+	return &Workers{db: db, Table: defaultWorkerTable, Lease: defaultLease}
+}
+
+// EnsureTable 创建 worker 表
+func (w *Workers) EnsureTable() error {
+	return w.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (worker_id BIGINT PRIMARY KEY, owner VARCHAR(255) NOT NULL, expire_at BIGINT NOT NULL)", w.Table)).Error
+}
+
+// WorkerLease 租到的 worker id
+type WorkerLease struct {
+	Id       int64
+	owner    string
+	w        *Workers
+	stop     chan struct{}
+	once     sync.Once
+	lost     chan struct{}
+	lostOnce sync.Once
+	// validUntil UnixNano, 最近一次成功续期(或租用)开始时间 + 2/3 租期, 之后不能再生成 id
+	validUntil int64
+}
+
+// Lost 续期失败(租约可能已被其他进程取得), 超过 2/3 租期没有成功续期, 或 Acquire 的 ctx 结束时关闭,
+// 此时应停止使用该 worker id 生成 id
+func (l *WorkerLease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Snowflake 使用该 worker id 的 Snowflake, 租约失效或超过 2/3 租期没有成功续期后 Next 返回 ErrLeaseLost
+func (l *WorkerLease) Snowflake() *Snowflake {
+	return &Snowflake{workerId: l.Id, lease: l}
+}
+
+// valid 租约仍然有效, 不依赖续期的 goroutine 及时运行
+func (l *WorkerLease) valid() bool {
+	select {
+	case <-l.lost:
+		return false
+	default:
+	}
+	return time.Now().UnixNano() < atomic.LoadInt64(&l.validUntil)
+}
+
+// renewed 从 start 开始的续期(或租用)成功, 租约到期时间为 start + lease
+func (l *WorkerLease) renewed(start time.Time, lease time.Duration) {
+	atomic.StoreInt64(&l.validUntil, start.Add(lease*2/3).UnixNano())
+}
+
+// Release 停止续期并释放 worker id
+func (l *WorkerLease) Release() error {
+	l.once.Do(func() { close(l.stop) })
+	l.markLost()
+	return l.w.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE worker_id = ? AND owner = ?", l.w.Table), l.Id, l.owner).Error
+}
+
+func (l *WorkerLease) markLost() {
+	l.lostOnce.Do(func() { close(l.lost) })
+}
+
+// Acquire 租用一个空闲或租约已过期的 worker id, 直到 ctx 结束或 Release. owner 标识当前进程, 为空时随机生成
+func (w *Workers) Acquire(ctx context.Context, owner string) (*WorkerLease, error) {
+	if owner == "" {
+		owner = repository.NewUUID()
+	}
+	lease := w.Lease
+	if lease <= 0 {
+		lease = defaultLease
+	}
+	db := w.db.New()
+	rows, err := db.Raw(fmt.Sprintf("SELECT worker_id, expire_at FROM %s", w.Table)).Rows()
+	if err != nil {
+		return nil, err
+	}
+	expireAt := make(map[int64]int64)
+	for rows.Next() {
+		var id, exp int64
+		if err = rows.Scan(&id, &exp); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expireAt[id] = exp
+	}
+	rows.Close()
+
+	start := time.Now()
+	now := start.UnixNano() / 1e6
+	for id := int64(0); id <= MaxWorkerId; id++ {
+		exp, used := expireAt[id]
+		var acquired bool
+		switch {
+		case !used:
+			// 并发插入同一 id 时主键冲突, 尝试下一个
+			acquired = db.Exec(fmt.Sprintf("INSERT INTO %s (worker_id, owner, expire_at) VALUES (?, ?, ?)", w.Table),
+				id, owner, now+lease.Milliseconds()).Error == nil
+		case exp < now:
+			res := db.Exec(fmt.Sprintf("UPDATE %s SET owner = ?, expire_at = ? WHERE worker_id = ? AND expire_at = ?", w.Table),
+				owner, now+lease.Milliseconds(), id, exp)
+			if res.Error != nil {
+				return nil, res.Error
+			}
+			acquired = res.RowsAffected == 1
+		}
+		if acquired {
+			l := &WorkerLease{Id: id, owner: owner, w: w, stop: make(chan struct{}), lost: make(chan struct{})}
+			l.renewed(start, lease)
+			go l.renew(ctx, lease)
+			return l, nil
+		}
+	}
+	return nil, ErrNoWorker
+}
+
+// renew 续期失败, 或超过 2/3 租期没有成功续期时关闭 lost; ctx 结束时释放 worker id
+func (l *WorkerLease) renew(ctx context.Context, lease time.Duration) {
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := l.Release(); err != nil {
+				repository.Warn("[idgen] release worker lease failed", zap.Int64("worker_id", l.Id), zap.Error(err))
+			}
+			return
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		res := l.w.db.Exec(fmt.Sprintf("UPDATE %s SET expire_at = ? WHERE worker_id = ? AND owner = ?", l.w.Table),
+			start.UnixNano()/1e6+lease.Milliseconds(), l.Id, l.owner)
+		if res.Error == nil && res.RowsAffected == 1 {
+			l.renewed(start, lease)
+			continue
+		}
+		if res.Error == nil || !l.valid() {
+			repository.Error("[idgen] worker lease lost", zap.Int64("worker_id", l.Id), zap.Error(res.Error))
+			l.markLost()
+			return
+		}
+		repository.Warn("[idgen] renew worker lease failed", zap.Int64("worker_id", l.Id), zap.Error(res.Error))
+	}
+}
@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+)
+
+const (
+	txTrackKey           = "repository:tx_track"
+	idleTxReportInterval = 10 * time.Second
+)
+
+// IdleTransaction 一个开启后超过阈值没有执行语句的事务
+type IdleTransaction struct {
+	Service  string
+	Database string
+	Begin    time.Time
+	// LastActivity 最后一条语句开始或结束的时间, 没有执行过语句时等于 Begin
+	LastActivity time.Time
+	Idle         time.Duration
+	// Stack 开启事务时的 goroutine 调用栈
+	Stack string
+}
+
+type trackedTx struct {
+	id        uint64
+	service   string
+	database  string
+	begin     time.Time
+	threshold time.Duration
+	stack     string
+	// 纳秒时间戳
+	lastActivity int64
+	reported     int32
+}
+
+func (t *trackedTx) touch() {
+	atomic.StoreInt64(&t.lastActivity, time.Now().UnixNano())
+	atomic.StoreInt32(&t.reported, 0)
+}
+
+func (t *trackedTx) idle(now time.Time) (IdleTransaction, bool) {
+	last := time.Unix(0, atomic.LoadInt64(&t.lastActivity))
+	it := IdleTransaction{
+		Service:      t.service,
+		Database:     t.database,
+		Begin:        t.begin,
+		LastActivity: last,
+		Idle:         now.Sub(last),
+		Stack:        t.stack,
+	}
+	return it, it.Idle >= t.threshold
+}
+
+var (
+	trackedTxs       = make(map[uint64]*trackedTx)
+	trackedTxLock    sync.Mutex
+	trackedTxSeq     uint64
+	idleReporterOnce sync.Once
+)
+
+// trackTx 记录开启的事务及调用栈, DBConfig.IdleTxThreshold 为 0 时不记录, 返回 nil
+func (tm *transactionManager) trackTx() *trackedTx {
+	conf := tm.DBConfig()
+	if conf == nil || conf.IdleTxThreshold <= 0 {
+		return nil
+	}
+	buf := make([]byte, 8<<10)
+	buf = buf[:runtime.Stack(buf, false)]
+	now := time.Now()
+	t := &trackedTx{
+		id:           atomic.AddUint64(&trackedTxSeq, 1),
+		service:      tm.serviceName,
+		database:     tm.database,
+		begin:        now,
+		threshold:    conf.IdleTxThreshold,
+		stack:        string(buf),
+		lastActivity: now.UnixNano(),
+	}
+	trackedTxLock.Lock()
+	trackedTxs[t.id] = t
+	trackedTxLock.Unlock()
+	idleReporterOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(idleTxReportInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				reportIdleTransactions()
+			}
+		}()
+	})
+	return t
+}
+
+func untrackTx(t *trackedTx) {
+	trackedTxLock.Lock()
+	delete(trackedTxs, t.id)
+	trackedTxLock.Unlock()
+}
+
+// touchTx 在语句开始和结束时调用
+func touchTx(scope *gorm.Scope) {
+	if v, ok := scope.Get(txTrackKey); ok {
+		v.(*trackedTx).touch()
+	}
+}
+
+// IdleTransactions 返回当前超过 DBConfig.IdleTxThreshold 没有执行语句的事务, 按空闲时间倒序.
+// 通过 db.Exec 执行的原生 sql 不经过 gorm callback, 不计入活动
+func IdleTransactions() []IdleTransaction {
+	now := time.Now()
+	var list []IdleTransaction
+	trackedTxLock.Lock()
+	for _, t := range trackedTxs {
+		if it, ok := t.idle(now); ok {
+			list = append(list, it)
+		}
+	}
+	trackedTxLock.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Idle > list[j].Idle
+	})
+	return list
+}
+
+// reportIdleTransactions 定期执行, 每个事务每次空闲只报告一次(执行语句后重新计算)
+func reportIdleTransactions() {
+	now := time.Now()
+	trackedTxLock.Lock()
+	var report []*trackedTx
+	for _, t := range trackedTxs {
+		if _, ok := t.idle(now); ok && atomic.CompareAndSwapInt32(&t.reported, 0, 1) {
+			report = append(report, t)
+		}
+	}
+	trackedTxLock.Unlock()
+	for _, t := range report {
+		it, _ := t.idle(now)
+		Warn("[repository] idle in transaction", zap.String("service", it.Service), zap.String("database", it.Database),
+			zap.Time("begin", it.Begin), zap.Duration("idle", it.Idle), zap.String("stack", it.Stack))
+		labels := map[string]string{"service": it.Service, "database": it.Database}
+		getMetrics().IncCounter("repository_idle_transaction_total", labels)
+		getMetrics().ObserveDuration("repository_idle_transaction_seconds", it.Idle, labels)
+	}
+}
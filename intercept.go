@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+)
+
+// StatementInfo.Op 的取值
+const (
+	StmtFind        = "Find"
+	StmtFindOne     = "FindOne"
+	StmtCount       = "Count"
+	StmtExists      = "Exists"
+	StmtCreate      = "Create"
+	StmtBatchCreate = "BatchCreate"
+	StmtBatchUpsert = "BatchUpsert"
+	StmtSave        = "Save"
+	StmtUpdate      = "Update"
+	StmtBulkUpdate  = "BulkUpdate"
+	StmtDelete      = "Delete"
+	StmtExplain     = "Explain"
+)
+
+// StatementInfo 描述一次 repository 操作. 拦截器可以修改 Table, Condition, Options, 以及 Update 的 Model,
+// 修改后的值会用于生成 sql
+type StatementInfo struct {
+	Op        string
+	Table     string
+	Condition Condition
+	Options   []Option
+	// Model Create/Save 的 model, Update 的 update, 软删除时的 model
+	Model interface{}
+	// PrimaryKey 主键列, 参见 Repository.PrimaryField
+	PrimaryKey string
+}
+
+// isWriteOp op 是否为写操作
+func isWriteOp(op string) bool {
+	switch op {
+	case StmtCreate, StmtBatchCreate, StmtBatchUpsert, StmtSave, StmtUpdate, StmtBulkUpdate, StmtDelete:
+		return true
+	}
+	return false
+}
+
+// Invoker 执行(剩余的)拦截器链及实际的操作
+type Invoker func(ctx context.Context, stmt *StatementInfo) error
+
+// QueryInterceptor 类似 grpc 的 interceptor, 调用 next 继续执行, 不调用则中止操作.
+// 可用于自定义日志, 租户检查, 条件改写, 影子表路由等
+type QueryInterceptor func(ctx context.Context, stmt *StatementInfo, next Invoker) error
+
+var (
+	globalInterceptors []QueryInterceptor
+	interceptorLock    sync.RWMutex
+)
+
+// RegisterQueryInterceptor 注册全局拦截器, 对所有 Repository 生效, 先于 Repository.Interceptors 执行.
+// 应在 main 中初始化时调用
+func RegisterQueryInterceptor(interceptors ...QueryInterceptor) {
+	interceptorLock.Lock()
+	defer interceptorLock.Unlock()
+	globalInterceptors = append(globalInterceptors, interceptors...)
+}
+
+// Use appends interceptors to the repository
+func (e *Repository) Use(interceptors ...QueryInterceptor) {
+	e.Interceptors = append(e.Interceptors, interceptors...)
+}
+
+type tableOverrideKey string
+
+type tableOption struct {
+	table string
+}
+
+// Sql intercept 中处理, 这里不修改查询
+func (to *tableOption) Sql(db *gorm.DB) *gorm.DB {
+	return db
+}
+
+// WithTable 本次查询使用表 table 代替 Model 的表, 例如按月分表的 events_2024_05 或归档表, Model 和条件不变
+func WithTable(table string) Option {
+	return &tableOption{table: table}
+}
+
+// ContextWithTable 同 WithTable, 用于没有 Option 参数的操作(Create, Update, Delete 等).
+// 只对 TableName() 与 model.TableName() 相同的 Repository 生效
+func ContextWithTable(ctx context.Context, model Model, table string) context.Context {
+	return context.WithValue(ctx, tableOverrideKey(model.TableName()), table)
+}
+
+// tableFor 拦截器修改了 Table 时, 通过 ctx 传给 getDb
+func (e *Repository) tableFor(ctx context.Context) string {
+	base := e.TableName()
+	if table, ok := ctx.Value(tableOverrideKey(base)).(string); ok && table != "" {
+		return table
+	}
+	return base
+}
+
+func (e *Repository) intercept(ctx context.Context, stmt *StatementInfo, final Invoker) error {
+	interceptorLock.RLock()
+	chain := make([]QueryInterceptor, 0, len(globalInterceptors)+len(e.Interceptors))
+	chain = append(chain, globalInterceptors...)
+	interceptorLock.RUnlock()
+	chain = append(chain, e.Interceptors...)
+
+	stmt.Table = e.tableFor(ctx)
+	stmt.PrimaryKey = e.PrimaryField().Column()
+	for _, opt := range stmt.Options {
+		if o, ok := opt.(*tableOption); ok {
+			stmt.Table = o.table
+		}
+	}
+	ctx = context.WithValue(ctx, stmtOpKey{}, stmt.Op)
+	invoker := func(ctx context.Context, stmt *StatementInfo) error {
+		if stmt.Table != e.tableFor(ctx) {
+			ctx = context.WithValue(ctx, tableOverrideKey(e.TableName()), stmt.Table)
+		}
+		next := final
+		if isWriteOp(stmt.Op) {
+			next = func(ctx context.Context, stmt *StatementInfo) error {
+				return e.withStatementTimeout(ctx, stmt.Options, func(ctx context.Context) error {
+					return final(ctx, stmt)
+				})
+			}
+		}
+		if err := e.guard(ctx, stmt, next); err != nil {
+			return err
+		}
+		e.markWrite(ctx, stmt.Op)
+		return nil
+	}
+	if len(chain) == 0 {
+		return invoker(ctx, stmt)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		interceptor, next := chain[i], invoker
+		invoker = func(ctx context.Context, stmt *StatementInfo) error {
+			return interceptor(ctx, stmt, next)
+		}
+	}
+	return invoker(ctx, stmt)
+}
@@ -0,0 +1,158 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	limiterKey        = "repository:limiter"
+	limiterReleaseKey = "repository:limiter_release"
+)
+
+// dbLimiter 每个连接(主库及每个从库)一个, 限制同时执行的语句数(信号量)以及每秒的语句数(令牌桶),
+// 避免某个热点接口占满 MaxOpen 的连接. 事务在 Begin 时获取一次, 持有到结束, 事务中的语句不再获取
+type dbLimiter struct {
+	name   string
+	sem    chan struct{}
+	bucket *tokenBucket
+}
+
+// registerLimiter DBConfig.MaxConcurrentQueries 或 QueryRateLimit > 0 时给 db 加上限流, 返回 nil 表示未开启.
+// perStatement 为 true 时通过 gorm callback 对每个语句生效, 用于从库; 主库在 intercept 及开启事务时获取, 参见 guardDb
+func registerLimiter(db *gorm.DB, dbConf *DBConfig, name string, perStatement bool) *dbLimiter {
+	if dbConf.MaxConcurrentQueries <= 0 && dbConf.QueryRateLimit <= 0 {
+		return nil
+	}
+	l := &dbLimiter{name: name}
+	if dbConf.MaxConcurrentQueries > 0 {
+		l.sem = make(chan struct{}, dbConf.MaxConcurrentQueries)
+	}
+	if dbConf.QueryRateLimit > 0 {
+		l.bucket = newTokenBucket(dbConf.QueryRateLimit, dbConf.QueryRateBurst)
+	}
+	db.InstantSet(limiterKey, l)
+	if !perStatement {
+		return l
+	}
+	callbacks := db.Callback()
+	for _, p := range []*gorm.CallbackProcessor{callbacks.Create(), callbacks.Query(), callbacks.Update(), callbacks.Delete(), callbacks.RowQuery()} {
+		p.Before("repository:statement_start").Register("repository:limiter", func(scope *gorm.Scope) {
+			if _, inTx := scope.SQLDB().(*sql.Tx); inTx {
+				return
+			}
+			ctx := context.Background()
+			if v, ok := scope.Get(statementCtxKey); ok {
+				ctx = v.(context.Context)
+			}
+			release, err := l.acquire(ctx)
+			if err != nil {
+				scope.Err(err)
+				return
+			}
+			scope.InstanceSet(limiterReleaseKey, release)
+		})
+		p.After("repository:statement_end").Register("repository:limiter_release", func(scope *gorm.Scope) {
+			if v, ok := scope.InstanceGet(limiterReleaseKey); ok {
+				v.(func())()
+			}
+		})
+	}
+	return l
+}
+
+// limiterOf db 上的限流, 没有开启时为 nil
+func limiterOf(db *gorm.DB) *dbLimiter {
+	if db == nil {
+		return nil
+	}
+	if v, ok := db.Get(limiterKey); ok {
+		return v.(*dbLimiter)
+	}
+	return nil
+}
+
+// acquire 等待令牌及信号量, ctx 结束时返回 error. 等待时间记录到 repository_limiter_wait_seconds
+func (l *dbLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	start := time.Now()
+	labels := map[string]string{"db": l.name}
+	defer func() {
+		getMetrics().ObserveDuration("repository_limiter_wait_seconds", time.Since(start), labels)
+		if err != nil {
+			getMetrics().IncCounter("repository_limiter_rejected_total", labels)
+		}
+	}()
+	if l.bucket != nil {
+		if err = l.bucket.wait(ctx); err != nil {
+			return nil, fmt.Errorf("wait for rate limit of %s: %w", l.name, err)
+		}
+	}
+	if l.sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("wait for connection slot of %s: %w", l.name, ctx.Err())
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.sem
+		})
+	}, nil
+}
+
+// tokenBucket 每秒补充 rate 个令牌, 最多 burst 个
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// wait 预留一个令牌, 不足时等待补充; ctx 结束时归还预留的令牌
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+
+	"github.com/jinzhu/gorm"
+)
+
+var errLockOutsideTransaction = errors.New("LockByIds must be called in a transaction")
+
+type lockOption struct{}
+
+// Sql 锁定读到的行, sqlite 的写事务本身是串行的, 不加锁
+func (lockOption) Sql(db *gorm.DB) *gorm.DB {
+	if db.Dialect().GetName() == DialectSqlite3 {
+		return db
+	}
+	return db.Set("gorm:query_option", "FOR UPDATE")
+}
+
+// LockByIds 在当前事务中按主键升序 SELECT ... FOR UPDATE 锁定 ids 对应的行, 返回锁定的 model 的 slice (按主键升序, 不存在的 id 被跳过).
+// 所有调用方以相同的顺序加锁, 同时锁定多行(如转账的两个账户)时不会互相死锁. 锁在事务结束时释放, 不在事务中时返回 error.
+// 同一事务中多次调用时, 应一次传入所有需要锁定的 id, 否则顺序只在每次调用内部有保证
+func LockByIds(ctx context.Context, repo *Repository, ids interface{}) (interface{}, error) {
+	db := repo.getDb(ctx)
+	if db == nil {
+		return nil, dbNilErr
+	}
+	if _, inTx := db.CommonDB().(*sql.Tx); !inTx {
+		return nil, errLockOutsideTransaction
+	}
+	sorted := sortedIds(ids)
+	if len(sorted) == 0 {
+		return repo.NewSlice(), nil
+	}
+	return repo.findNoCache(ctx, repo.PrimaryField().In(sorted), repo.PrimaryField().Asc(), lockOption{})
+}
+
+// sortedIds 去重并升序排列, 整数 id 精确比较, 保证各调用方的加锁顺序一致
+func sortedIds(ids interface{}) []interface{} {
+	sorted := uniqueIds(ids)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		c, _ := CompareValues(sorted[i], sorted[j])
+		return c < 0
+	})
+	return sorted
+}
@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Metrics 由使用方实现并通过 SetMetrics 注册(如对接 prometheus), 默认不记录
+type Metrics interface {
+	IncCounter(name string, labels map[string]string)
+	ObserveDuration(name string, d time.Duration, labels map[string]string)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncCounter(string, map[string]string) {}
+
+func (noopMetrics) ObserveDuration(string, time.Duration, map[string]string) {}
+
+var (
+	metrics     Metrics = noopMetrics{}
+	metricsLock sync.RWMutex
+)
+
+// SetMetrics 应在 main 中初始化时调用
+func SetMetrics(m Metrics) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	if m == nil {
+		m = noopMetrics{}
+	}
+	metrics = m
+}
+
+func getMetrics() Metrics {
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+	return metrics
+}
+
+const statementMetricsKey = "repository:statement_metrics"
+
+// metrics Repository.Metrics, 未设置时为全局的 Metrics
+func (e *Repository) metrics() Metrics {
+	if e.Metrics != nil {
+		return e.Metrics
+	}
+	return getMetrics()
+}
+
+// metricsOf 语句所属 Repository 的 Metrics, 参见 withStatementValues
+func metricsOf(db *gorm.DB) Metrics {
+	if db != nil {
+		if m, ok := db.Get(statementMetricsKey); ok {
+			return m.(Metrics)
+		}
+	}
+	return getMetrics()
+}
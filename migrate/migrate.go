@@ -0,0 +1,280 @@
+// Package migrate runs ordered schema migrations on databases registered in repository.ServiceConfigMap
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/shaynewu/repository"
+)
+
+const defaultTable = "schema_migrations"
+
+// Migration 一个版本的迁移, SQL 与 Go 函数二选一, 同时设置时先执行 SQL
+type Migration struct {
+	Version int64
+	Name    string
+	UpSQL   string
+	DownSQL string
+	Up      func(ctx context.Context, tx *gorm.DB) error
+	Down    func(ctx context.Context, tx *gorm.DB) error
+}
+
+// Migrator 按版本号顺序执行迁移, 每个迁移在单独的事务中执行, 已执行的版本记录在 Table 中.
+// 执行期间持有数据库锁(postgres advisory lock / mysql GET_LOCK), 多实例同时启动时只有一个会执行
+type Migrator struct {
+	db         *gorm.DB
+	migrations map[int64]*Migration
+	// Table 版本表, 默认 schema_migrations
+	Table string
+}
+
+// New uses the connection registered for serviceName/database, see repository.SetServiceDBConfig
+func New(serviceName, database string) *Migrator {
+	return NewWithDB(repository.GetDB(database, serviceName))
+}
+
+// NewWithDB creates a Migrator on db
+func NewWithDB(db *gorm.DB) *Migrator {
+	return &Migrator{
+		db:         db,
+		migrations: make(map[int64]*Migration),
+		Table:      defaultTable,
+	}
+}
+
+// Add registers migrations, versions must be unique
+func (m *Migrator) Add(migrations ...*Migration) error {
+	for _, mg := range migrations {
+		if _, ok := m.migrations[mg.Version]; ok {
+			return fmt.Errorf("migrate: duplicate version %d", mg.Version)
+		}
+		m.migrations[mg.Version] = mg
+	}
+	return nil
+}
+
+var fileRe = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// LoadDir loads sql files named like 0001_create_user.up.sql / 0001_create_user.down.sql
+func (m *Migrator) LoadDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	loaded := make(map[int64]*Migration)
+	for _, f := range files {
+		match := fileRe.FindStringSubmatch(f.Name())
+		if f.IsDir() || match == nil {
+			continue
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		content, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return err
+		}
+		mg, ok := loaded[version]
+		if !ok {
+			mg = &Migration{Version: version, Name: match[2]}
+			loaded[version] = mg
+		}
+		if match[3] == "up" {
+			mg.UpSQL = string(content)
+		} else {
+			mg.DownSQL = string(content)
+		}
+	}
+	for _, mg := range loaded {
+		if err := m.Add(mg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) sorted() []*Migration {
+	var list []*Migration
+	for _, mg := range m.migrations {
+		list = append(list, mg)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Version < list[j].Version
+	})
+	return list
+}
+
+func (m *Migrator) ensureTable() error {
+	return m.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version BIGINT PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at BIGINT NOT NULL)", m.Table)).Error
+}
+
+// Applied returns the applied versions in ascending order
+func (m *Migrator) Applied(ctx context.Context) ([]int64, error) {
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+	var versions []int64
+	err := m.db.Table(m.Table).Order("version").Pluck("version", &versions).Error
+	return versions, err
+}
+
+// Version returns the latest applied version, 0 if none
+func (m *Migrator) Version(ctx context.Context) (int64, error) {
+	versions, err := m.Applied(ctx)
+	if err != nil || len(versions) == 0 {
+		return 0, err
+	}
+	return versions[len(versions)-1], nil
+}
+
+// Up applies all pending migrations
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func() error {
+		versions, err := m.Applied(ctx)
+		if err != nil {
+			return err
+		}
+		applied := make(map[int64]bool, len(versions))
+		for _, v := range versions {
+			applied[v] = true
+		}
+		for _, mg := range m.sorted() {
+			if applied[mg.Version] {
+				continue
+			}
+			repository.Info("[migrate] up", mg.Version, mg.Name)
+			err := m.inTx(ctx, func(tx *gorm.DB) error {
+				if err := run(ctx, tx, mg.UpSQL, mg.Up); err != nil {
+					return err
+				}
+				return tx.Exec(fmt.Sprintf("INSERT INTO %s (version, name, applied_at) VALUES (?, ?, ?)", m.Table), mg.Version, mg.Name, time.Now().Unix()).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migrate: up %d_%s: %w", mg.Version, mg.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Down rolls back the latest steps applied migrations
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func() error {
+		versions, err := m.Applied(ctx)
+		if err != nil {
+			return err
+		}
+		for i := len(versions) - 1; i >= 0 && steps > 0; i, steps = i-1, steps-1 {
+			mg, ok := m.migrations[versions[i]]
+			if !ok {
+				return fmt.Errorf("migrate: version %d is applied but not registered", versions[i])
+			}
+			if mg.DownSQL == "" && mg.Down == nil {
+				return fmt.Errorf("migrate: version %d has no down migration", mg.Version)
+			}
+			repository.Info("[migrate] down", mg.Version, mg.Name)
+			err := m.inTx(ctx, func(tx *gorm.DB) error {
+				if err := run(ctx, tx, mg.DownSQL, mg.Down); err != nil {
+					return err
+				}
+				return tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE version = ?", m.Table), mg.Version).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migrate: down %d_%s: %w", mg.Version, mg.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+func run(ctx context.Context, tx *gorm.DB, sqlText string, fn func(ctx context.Context, tx *gorm.DB) error) error {
+	if sqlText != "" {
+		if err := tx.Exec(sqlText).Error; err != nil {
+			return err
+		}
+	}
+	if fn != nil {
+		return fn(ctx, tx)
+	}
+	return nil
+}
+
+func (m *Migrator) inTx(ctx context.Context, fn func(tx *gorm.DB) error) (err error) {
+	tx := m.db.BeginTx(ctx, &sql.TxOptions{})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// withLock 在独立的连接上持有锁, sqlite 等不支持的数据库不加锁
+func (m *Migrator) withLock(ctx context.Context, fn func() error) error {
+	lockId := int64(crc32.ChecksumIEEE([]byte(m.Table)))
+	var lockSQL, unlockSQL string
+	switch m.db.Dialect().GetName() {
+	case repository.DialectPostgres:
+		lockSQL, unlockSQL = "SELECT pg_advisory_lock($1)", "SELECT pg_advisory_unlock($1)"
+	case repository.DialectMysql:
+		lockSQL, unlockSQL = "SELECT GET_LOCK(CONCAT('migrate_', ?), -1)", "SELECT RELEASE_LOCK(CONCAT('migrate_', ?))"
+	default:
+		return fn()
+	}
+	conn, err := m.db.DB().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, lockSQL, lockId); err != nil {
+		return fmt.Errorf("migrate: acquire lock: %w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), unlockSQL, lockId); err != nil {
+			repository.Error("[migrate] release lock failed", err)
+		}
+	}()
+	return fn()
+}
+
+// ErrNoMigrations is returned by Pending when nothing is registered
+var ErrNoMigrations = errors.New("migrate: no migrations registered")
+
+// Pending returns migrations not applied yet
+func (m *Migrator) Pending(ctx context.Context) ([]*Migration, error) {
+	if len(m.migrations) == 0 {
+		return nil, ErrNoMigrations
+	}
+	versions, err := m.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]bool, len(versions))
+	for _, v := range versions {
+		applied[v] = true
+	}
+	var pending []*Migration
+	for _, mg := range m.sorted() {
+		if !applied[mg.Version] {
+			pending = append(pending, mg)
+		}
+	}
+	return pending, nil
+}
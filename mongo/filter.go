@@ -0,0 +1,149 @@
+package mongo
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/shaynewu/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// idColumn 是 repository 中主键的列名, 在 mongo 中对应 _id
+const idColumn = "id"
+
+func fieldName(column string) string {
+	if column == idColumn {
+		return "_id"
+	}
+	return column
+}
+
+// ParseFilter translates a Condition tree into a bson filter
+func ParseFilter(condition repository.Condition) (bson.M, error) {
+	node := repository.Inspect(condition)
+	if node == nil {
+		return bson.M{}, nil
+	}
+	return parseNode(node)
+}
+
+func parseNode(node *repository.ConditionNode) (bson.M, error) {
+	if !node.IsLeaf() {
+		var children bson.A
+		for _, c := range node.Children {
+			f, err := parseNode(c)
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, f)
+		}
+		if node.Logic == "OR" {
+			return bson.M{"$or": children}, nil
+		}
+		return bson.M{"$and": children}, nil
+	}
+
+	name := fieldName(node.Column)
+	switch node.Op {
+	case repository.OpEq:
+		return bson.M{name: node.Args[0]}, nil
+	case repository.OpNotEq:
+		return bson.M{name: bson.M{"$ne": node.Args[0]}}, nil
+	case repository.OpIsNull:
+		return bson.M{name: nil}, nil
+	case repository.OpNotNull:
+		return bson.M{name: bson.M{"$ne": nil}}, nil
+	case repository.OpEmpty:
+		return bson.M{name: ""}, nil
+	case repository.OpLt:
+		return bson.M{name: bson.M{"$lt": node.Args[0]}}, nil
+	case repository.OpLte:
+		return bson.M{name: bson.M{"$lte": node.Args[0]}}, nil
+	case repository.OpGt:
+		return bson.M{name: bson.M{"$gt": node.Args[0]}}, nil
+	case repository.OpGte:
+		return bson.M{name: bson.M{"$gte": node.Args[0]}}, nil
+	case repository.OpIn:
+		return bson.M{name: bson.M{"$in": node.Args[0]}}, nil
+	case repository.OpNotIn:
+		return bson.M{name: bson.M{"$nin": node.Args[0]}}, nil
+	case repository.OpArrayMatchAny:
+		// Args[0] 是 pq.Array 包装过的, 这里用原始值
+		return bson.M{name: bson.M{"$in": node.RawArgs[0]}}, nil
+	case repository.OpArrayContainsAll:
+		return bson.M{name: bson.M{"$all": node.RawArgs[0]}}, nil
+	case repository.OpArrayContainedBy:
+		// 没有不在 vals 中的元素
+		return bson.M{name: bson.M{"$not": bson.M{"$elemMatch": bson.M{"$nin": node.RawArgs[0]}}}}, nil
+	case repository.OpArrayAny:
+		return bson.M{name: node.RawArgs[0]}, nil
+	case repository.OpTruncEq:
+		from, to := repository.TimeUnitRange(node.Args[0].(string), node.Args[1].(time.Time))
+		return bson.M{name: bson.M{"$gte": from, "$lt": to}}, nil
+	case repository.OpBetween:
+		return bson.M{name: bson.M{"$gte": node.Args[0], "$lte": node.Args[1]}}, nil
+	case repository.OpLike:
+		return bson.M{name: likeRegex(node.Args[0], false)}, nil
+	case repository.OpILike:
+		return bson.M{name: likeRegex(node.Args[0], true)}, nil
+	case repository.OpNotLike:
+		return bson.M{name: bson.M{"$not": likeRegex(node.Args[0], false)}}, nil
+	case repository.OpNotILike:
+		return bson.M{name: bson.M{"$not": likeRegex(node.Args[0], true)}}, nil
+	default:
+		return nil, fmt.Errorf("mongo: unsupported operator %q on %s", node.Op, node.Column)
+	}
+}
+
+// likeRegex converts a sql LIKE pattern (% and _) to an anchored regex
+func likeRegex(pattern interface{}, ignoreCase bool) primitive.Regex {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range fmt.Sprint(pattern) {
+		switch r {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	re := primitive.Regex{Pattern: sb.String()}
+	if ignoreCase {
+		re.Options = "i"
+	}
+	return re
+}
+
+// ParseFindOptions translates repository Options into mongo find options
+func ParseFindOptions(opts ...repository.Option) *options.FindOptions {
+	spec := repository.InspectOptions(opts...)
+	fo := options.Find()
+	if spec.Offset > 0 {
+		fo.SetSkip(int64(spec.Offset))
+	}
+	if spec.Limit > 0 {
+		fo.SetLimit(int64(spec.Limit))
+	}
+	if len(spec.Orders) > 0 {
+		sort := bson.D{}
+		for _, o := range spec.Orders {
+			sort = append(sort, bson.E{Key: fieldName(o.Column), Value: int(o.Order)})
+		}
+		fo.SetSort(sort)
+	}
+	if len(spec.Columns) > 0 {
+		projection := bson.D{}
+		for _, c := range spec.Columns {
+			projection = append(projection, bson.E{Key: fieldName(c), Value: 1})
+		}
+		fo.SetProjection(projection)
+	}
+	return fo
+}
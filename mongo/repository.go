@@ -0,0 +1,320 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/shaynewu/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	mongodriver "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errNoId = errors.New("mongo: model has no id field")
+
+// Repository implements repository.RepositoryInterface over a mongo collection.
+//
+// Condition 中的列名即文档字段名(model 需要用 bson tag 与 gorm 列名保持一致), 其中 id 对应 _id
+type Repository struct {
+	Tm         repository.TransactionManager
+	Coll       *mongodriver.Collection
+	Value      repository.Model
+	CreateFunc func(ctx context.Context, model repository.Model) (err error)
+	SaveFunc   func(ctx context.Context, model repository.Model) (err error)
+	UpdateFunc func(ctx context.Context, update interface{}, condition repository.Condition) (err error)
+	DeleteFunc func(ctx context.Context, condition repository.Condition) (err error)
+	// MandatoryCondition 同 repository.Repository.MandatoryCondition
+	MandatoryCondition repository.Condition
+}
+
+// implements hint
+var _ repository.RepositoryInterface = (*Repository)(nil)
+
+// NewRepository uses model.TableName() as the collection name in db
+func NewRepository(db *mongodriver.Database, model repository.Model) *Repository {
+	repo0 := &Repository{
+		Tm:    NewTransactionManager(db.Client()),
+		Coll:  db.Collection(model.TableName()),
+		Value: model,
+	}
+	repo0.SetCreateFunc(func(ctx context.Context, data repository.Model) error {
+		if i0, ok := data.(interface {
+			BeforeRepoCreate(ctx context.Context) error
+		}); ok {
+			if err := i0.BeforeRepoCreate(ctx); err != nil {
+				return err
+			}
+		}
+		res, err := repo0.Coll.InsertOne(ctx, data)
+		if err != nil {
+			return err
+		}
+		setId(data, res.InsertedID)
+		if i0, ok := data.(interface {
+			AfterRepoCreate(ctx context.Context) error
+		}); ok {
+			return i0.AfterRepoCreate(ctx)
+		}
+		return nil
+	})
+
+	repo0.SetSaveFunc(func(ctx context.Context, data repository.Model) error {
+		id, ok := getId(data)
+		if !ok {
+			return errNoId
+		}
+		if reflect.ValueOf(id).IsZero() {
+			return repo0.CreateFunc(ctx, data)
+		}
+		if i0, ok := data.(interface {
+			BeforeRepoUpdate(ctx context.Context) error
+		}); ok {
+			if err := i0.BeforeRepoUpdate(ctx); err != nil {
+				return err
+			}
+		}
+		if _, err := repo0.Coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": data}); err != nil {
+			return err
+		}
+		if i0, ok := data.(interface {
+			AfterRepoUpdate(ctx context.Context) error
+		}); ok {
+			return i0.AfterRepoUpdate(ctx)
+		}
+		return nil
+	})
+
+	// update 为 struct 时按 bson tag 编码, 只想更新部分字段请使用 omitempty 或传入 map
+	repo0.SetUpdateFunc(func(ctx context.Context, update interface{}, condition repository.Condition) error {
+		filter, err := repo0.parseFilter(condition)
+		if err != nil {
+			return err
+		}
+		if i0, ok := update.(interface {
+			BeforeRepoUpdate(ctx context.Context) error
+		}); ok {
+			if err := i0.BeforeRepoUpdate(ctx); err != nil {
+				return err
+			}
+		}
+		_, err = repo0.Coll.UpdateMany(ctx, filter, bson.M{"$set": update})
+		return err
+	})
+
+	if _, ok := model.(repository.SoftDeleteHook); ok {
+		repo0.SetDeleteFunc(func(ctx context.Context, condition repository.Condition) error {
+			filter, err := repo0.parseFilter(condition)
+			if err != nil {
+				return err
+			}
+			val := repo0.NewStruct()
+			if err := (val.(repository.SoftDeleteHook)).BeforeSoftDelete(ctx); err != nil {
+				return err
+			}
+			_, err = repo0.Coll.UpdateMany(ctx, filter, bson.M{"$set": val})
+			return err
+		})
+	} else {
+		repo0.SetDeleteFunc(func(ctx context.Context, condition repository.Condition) error {
+			filter, err := repo0.parseFilter(condition)
+			if err != nil {
+				return err
+			}
+			_, err = repo0.Coll.DeleteMany(ctx, filter)
+			return err
+		})
+	}
+	return repo0
+}
+
+func (e *Repository) SetCreateFunc(fn func(context.Context, repository.Model) error) {
+	e.CreateFunc = fn
+}
+
+func (e *Repository) SetSaveFunc(fn func(context.Context, repository.Model) error) {
+	e.SaveFunc = fn
+}
+
+func (e *Repository) SetUpdateFunc(fn func(context.Context, interface{}, repository.Condition) error) {
+	e.UpdateFunc = fn
+}
+
+func (e *Repository) SetDeleteFunc(fn func(context.Context, repository.Condition) error) {
+	e.DeleteFunc = fn
+}
+
+func (e *Repository) GetTM() repository.TransactionManager {
+	return e.Tm
+}
+
+func (e *Repository) parseFilter(condition repository.Condition) (bson.M, error) {
+	if e.MandatoryCondition != nil {
+		if condition == nil {
+			condition = e.MandatoryCondition
+		} else {
+			condition = condition.And(e.MandatoryCondition)
+		}
+	}
+	return ParseFilter(condition)
+}
+
+func (e *Repository) FindOne(ctx context.Context, condition repository.Condition) (repository.Model, error) {
+	filter, err := e.parseFilter(condition)
+	if err != nil {
+		return nil, err
+	}
+	data := e.NewStruct().(repository.Model)
+	if err = e.Coll.FindOne(ctx, filter).Decode(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (e *Repository) FindById(ctx context.Context, id interface{}) (repository.Model, error) {
+	return e.FindOne(ctx, repository.SimpleField(idColumn).Eq(id))
+}
+
+func (e *Repository) FindByIds(ctx context.Context, ids interface{}, additional ...repository.Condition) (interface{}, error) {
+	if idv := reflect.ValueOf(ids); (idv.Kind() != reflect.Slice && idv.Kind() != reflect.Array) || idv.Len() == 0 {
+		return e.NewSlice(), nil
+	}
+	condition := repository.SimpleField(idColumn).In(ids)
+	if len(additional) > 0 {
+		condition = condition.And(repository.MatchAll(additional...))
+	}
+	return e.Find(ctx, condition)
+}
+
+func (e *Repository) Find(ctx context.Context, condition repository.Condition, options ...repository.Option) (interface{}, error) {
+	slice := e.NewSlice()
+	filter, err := e.parseFilter(condition)
+	if err != nil {
+		return slice, err
+	}
+	cur, err := e.Coll.Find(ctx, filter, ParseFindOptions(options...))
+	if err != nil {
+		return slice, err
+	}
+	err = cur.All(ctx, slice)
+	return slice, err
+}
+
+func (e *Repository) FindAndCount(ctx context.Context, condition repository.Condition, options ...repository.Option) (slice interface{}, total int, err error) {
+	total, err = e.Count(ctx, condition)
+	if err != nil {
+		return
+	}
+	if total == 0 {
+		slice = e.NewSlice()
+		return
+	}
+	slice, err = e.Find(ctx, condition, options...)
+	return
+}
+
+// Count 忽略 options
+func (e *Repository) Count(ctx context.Context, condition repository.Condition, options ...repository.Option) (int, error) {
+	filter, err := e.parseFilter(condition)
+	if err != nil {
+		return 0, err
+	}
+	n, err := e.Coll.CountDocuments(ctx, filter)
+	return int(n), err
+}
+
+// Exists 忽略 options
+func (e *Repository) Exists(ctx context.Context, condition repository.Condition, _ ...repository.Option) (bool, error) {
+	filter, err := e.parseFilter(condition)
+	if err != nil {
+		return false, err
+	}
+	n, err := e.Coll.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+func (e *Repository) Create(ctx context.Context, model repository.Model) error {
+	return e.CreateFunc(ctx, model)
+}
+
+func (e *Repository) Save(ctx context.Context, model repository.Model) error {
+	return e.SaveFunc(ctx, model)
+}
+
+func (e *Repository) Update(ctx context.Context, update interface{}, condition repository.Condition) error {
+	return e.UpdateFunc(ctx, update, condition)
+}
+
+func (e *Repository) Delete(ctx context.Context, condition repository.Condition) error {
+	return e.DeleteFunc(ctx, condition)
+}
+
+func (e *Repository) DeleteById(ctx context.Context, id interface{}) error {
+	val := e.NewStruct()
+	sdi, ok := val.(repository.SoftDeleteHook)
+	if !ok {
+		return e.DeleteFunc(ctx, repository.SimpleField(idColumn).Eq(id))
+	}
+	setId(val, id)
+	if err := sdi.BeforeSoftDelete(ctx); err != nil {
+		return err
+	}
+	if _, err := e.Coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": val}); err != nil {
+		return err
+	}
+	return sdi.AfterSoftDelete(ctx)
+}
+
+// NewStruct initialize a struct for the Model
+func (e *Repository) NewStruct() interface{} {
+	return repository.NewStruct(e.Value)
+}
+
+// NewSlice initialize a slice of struct for the Model
+func (e *Repository) NewSlice() interface{} {
+	return repository.NewSlice(e.Value)
+}
+
+// IsNotFound reports whether err means no document matched
+func IsNotFound(err error) bool {
+	return errors.Is(err, mongodriver.ErrNoDocuments)
+}
+
+// idField finds the struct field mapped to _id: bson tag "_id", or named Id/ID
+func idField(model interface{}) (reflect.Value, bool) {
+	v := repository.Indirect(reflect.ValueOf(model))
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := strings.Split(sf.Tag.Get("bson"), ",")[0]
+		if tag == "_id" || (tag == "" && strings.EqualFold(sf.Name, "id")) {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func getId(model interface{}) (interface{}, bool) {
+	f, ok := idField(model)
+	if !ok {
+		return nil, false
+	}
+	return f.Interface(), true
+}
+
+func setId(model interface{}, id interface{}) {
+	f, ok := idField(model)
+	if !ok || !f.CanSet() || id == nil {
+		return
+	}
+	iv := reflect.ValueOf(id)
+	if iv.Type().AssignableTo(f.Type()) {
+		f.Set(iv)
+	} else if iv.Type().ConvertibleTo(f.Type()) {
+		f.Set(iv.Convert(f.Type()))
+	}
+}
@@ -0,0 +1,90 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jinzhu/gorm"
+	"github.com/shaynewu/repository"
+	mongodriver "go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	errTempTable    = errors.New("mongo: temp table is not supported")
+	errAdvisoryLock = errors.New("mongo: advisory lock is not supported")
+)
+
+type transactionManager struct {
+	client *mongodriver.Client
+}
+
+// implements hint
+var _ repository.TransactionManager = (*transactionManager)(nil)
+var _ repository.TempTableCreator = (*transactionManager)(nil)
+
+// NewTransactionManager 基于 mongo session 的事务管理器, 要求 mongo 为副本集或分片集群
+func NewTransactionManager(client *mongodriver.Client) repository.TransactionManager {
+	return &transactionManager{client: client}
+}
+
+// GetDb always returns nil, mongo has no gorm connection
+func (tm *transactionManager) GetDb(ctx context.Context) *gorm.DB {
+	return nil
+}
+
+// Transaction 在 mongo 事务中执行 doTransaction, ctx 中已有 session 时直接复用(嵌套事务)
+func (tm *transactionManager) Transaction(ctx context.Context, doTransaction func(ctx context.Context) (res interface{}, err error)) (interface{}, error) {
+	if mongodriver.SessionFromContext(ctx) != nil {
+		return doTransaction(ctx)
+	}
+	session, err := tm.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+	var hooks *repository.TxHooks
+	res, err := session.WithTransaction(ctx, func(sc mongodriver.SessionContext) (interface{}, error) {
+		// 出现临时错误时 WithTransaction 会重试, 丢弃上一次注册的回调
+		hooks = &repository.TxHooks{}
+		return doTransaction(context.WithValue(sc, hooksKey{}, hooks))
+	})
+	if err != nil {
+		hooks.RolledBack()
+		return res, err
+	}
+	hooks.Committed()
+	return res, nil
+}
+
+type hooksKey struct{}
+
+// AfterCommit runs fn after the outermost mongo transaction commits, or immediately outside a transaction
+func (tm *transactionManager) AfterCommit(ctx context.Context, fn func()) {
+	if hooks, ok := ctx.Value(hooksKey{}).(*repository.TxHooks); ok {
+		hooks.AfterCommit(fn)
+		return
+	}
+	fn()
+}
+
+// AfterRollback runs fn after the outermost mongo transaction aborts
+func (tm *transactionManager) AfterRollback(ctx context.Context, fn func()) {
+	if hooks, ok := ctx.Value(hooksKey{}).(*repository.TxHooks); ok {
+		hooks.AfterRollback(fn)
+	}
+}
+
+// Suspend returns ctx without the mongo session and its transaction
+func (tm *transactionManager) Suspend(ctx context.Context) context.Context {
+	return context.WithValue(mongodriver.NewSessionContext(ctx, nil), hooksKey{}, nil)
+}
+
+// CreateTempTable is not supported by mongo
+func (tm *transactionManager) CreateTempTable(ctx context.Context, model repository.Model, fn func(ctx context.Context, repo repository.RepositoryInterface) error) error {
+	return errTempTable
+}
+
+// WithAdvisoryLock is not supported by mongo
+func (tm *transactionManager) WithAdvisoryLock(ctx context.Context, key int64, fn func(ctx context.Context) error) error {
+	return errAdvisoryLock
+}
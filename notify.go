@@ -0,0 +1,206 @@
+package repository
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+)
+
+// ChangeOp 数据变更的类型
+type ChangeOp string
+
+const (
+	ChangeCreate ChangeOp = "create"
+	ChangeUpdate ChangeOp = "update"
+	ChangeDelete ChangeOp = "delete"
+)
+
+// ChangeEvent Repository 写入成功(事务中为提交)后发布的变更
+type ChangeEvent struct {
+	Table string
+	Op    ChangeOp
+	// Ids 变更行的主键. Create/Save 为 model 的主键; Update/Delete 仅当条件为主键的 Eq/In 时有值, 否则为空, 参见 Condition.
+	// BatchCreate/BatchUpsert/BulkUpdate 每个 model 发布一个 ChangeEvent, BatchUpsert 及 BulkUpdate 的 Op 为 ChangeUpdate
+	Ids []interface{}
+	// Model Create/Save 写入的 model
+	Model Model
+	// Diff Update 更新的列及新的值(Save, BatchUpsert 及 BulkUpdate 为 model 所有的列)
+	Diff map[string]interface{}
+	// Condition Update/Delete 的条件
+	Condition Condition
+}
+
+// ChangeHandler 订阅方, 在发布方的 goroutine 中同步执行, 不应阻塞
+type ChangeHandler func(ctx context.Context, event ChangeEvent)
+
+type changeSubscriber struct {
+	table   string
+	handler ChangeHandler
+}
+
+// ChangeNotifier 进程内的变更通知, 配置到 Repository.ChangeNotifier 后, 每个写操作成功时发布 ChangeEvent,
+// 用于进程内缓存失效, websocket 推送等, 不需要轮询. 多个 Repository 可以共用一个 ChangeNotifier
+type ChangeNotifier struct {
+	mu     sync.RWMutex
+	nextId int
+	subs   map[int]changeSubscriber
+}
+
+func NewChangeNotifier() *ChangeNotifier {
+	return &ChangeNotifier{subs: make(map[int]changeSubscriber)}
+}
+
+// Subscribe 订阅 table 的变更, table 为空时订阅所有表. 返回取消订阅的函数
+func (n *ChangeNotifier) Subscribe(table string, handler ChangeHandler) (unsubscribe func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	id := n.nextId
+	n.nextId++
+	n.subs[id] = changeSubscriber{table: table, handler: handler}
+	return func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.subs, id)
+	}
+}
+
+// Publish 通知订阅了 event.Table 的订阅方, 订阅方的 panic 被记录, 不影响其他订阅方
+func (n *ChangeNotifier) Publish(ctx context.Context, event ChangeEvent) {
+	n.mu.RLock()
+	handlers := make([]ChangeHandler, 0, len(n.subs))
+	for _, s := range n.subs {
+		if s.table == "" || s.table == event.Table {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	n.mu.RUnlock()
+	for _, h := range handlers {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					Error("[repository] panic in change handler", zap.String("table", event.Table), zap.String("op", string(event.Op)), zap.Any("panic", r))
+				}
+			}()
+			h(ctx, event)
+		}()
+	}
+}
+
+// notifyChange 在事务提交后发布并写入审计, 不在事务中时立即执行
+func (e *Repository) notifyChange(ctx context.Context, event ChangeEvent) {
+	if !e.observed() {
+		return
+	}
+	event.Table = e.tableFor(ctx)
+	e.Tm.AfterCommit(ctx, func() {
+		if e.AuditSink != nil {
+			e.audit(ctx, event)
+		}
+		if e.ChangeNotifier != nil {
+			e.ChangeNotifier.Publish(ctx, event)
+		}
+	})
+}
+
+// observed 是否配置了 ChangeNotifier 或 AuditSink
+func (e *Repository) observed() bool {
+	return e.ChangeNotifier != nil || e.AuditSink != nil
+}
+
+// afterWrite 所有写操作(包括软删除, 批量写入, BulkUpdate 及 *Returning)成功后调用, 按 stmt 发布 ChangeEvent.
+// created 仅用于 Save, 表示写入的是新的行
+func (e *Repository) afterWrite(ctx context.Context, stmt *StatementInfo, created bool) {
+	switch stmt.Op {
+	case StmtCreate, StmtSave:
+		if m, ok := stmt.Model.(Model); ok {
+			e.notifyWrite(ctx, m, created || stmt.Op == StmtCreate)
+		}
+	case StmtBatchCreate, StmtBatchUpsert, StmtBulkUpdate:
+		list, _ := stmt.Model.([]Model)
+		for _, m := range list {
+			e.notifyWrite(ctx, m, stmt.Op == StmtBatchCreate)
+		}
+	case StmtUpdate:
+		e.notifyUpdate(ctx, stmt.Model, stmt.Condition)
+	case StmtDelete:
+		e.notifyChange(ctx, ChangeEvent{Op: ChangeDelete, Ids: e.conditionIds(stmt.Condition), Condition: stmt.Condition})
+	}
+}
+
+// notifyWrite Create/Save 后发布, created 为 false 时为 Save 更新已有的行
+func (e *Repository) notifyWrite(ctx context.Context, model Model, created bool) {
+	if !e.observed() {
+		return
+	}
+	event := ChangeEvent{Op: ChangeCreate, Model: model}
+	if id, ok := e.primaryValue(model); ok {
+		event.Ids = []interface{}{id}
+	}
+	if !created {
+		event.Op = ChangeUpdate
+		event.Diff = modelColumns(model)
+		delete(event.Diff, e.PrimaryField().Column())
+	}
+	e.notifyChange(ctx, event)
+}
+
+// notifyUpdate Update 后发布, Diff 与 gorm Updates 一致: map 的所有 key, struct 的非零值字段
+func (e *Repository) notifyUpdate(ctx context.Context, update interface{}, condition Condition) {
+	if !e.observed() {
+		return
+	}
+	e.notifyChange(ctx, ChangeEvent{Op: ChangeUpdate, Ids: e.conditionIds(condition), Diff: updateColumnMap(update), Condition: condition})
+}
+
+// updateColumnMap Update 更新的列及新的值
+func updateColumnMap(update interface{}) map[string]interface{} {
+	diff := make(map[string]interface{})
+	if m, ok := update.(map[string]interface{}); ok {
+		for k, v := range m {
+			diff[k] = v
+		}
+	} else if Indirect(reflect.ValueOf(update)).Kind() == reflect.Struct {
+		for _, f := range (&gorm.Scope{}).New(update).Fields() {
+			if f.IsNormal && !f.IsIgnored && !f.IsPrimaryKey && !f.IsBlank {
+				diff[f.DBName] = f.Field.Interface()
+			}
+		}
+	}
+	return diff
+}
+
+// conditionIds 条件为主键的 Eq/In (或以 AND 连接的其中一个)时返回主键
+func (e *Repository) conditionIds(condition Condition) []interface{} {
+	pk := e.PrimaryField().Column()
+	node := Inspect(condition)
+	if node != nil && node.Logic == string(and) {
+		for _, child := range node.Children {
+			if ids := leafIds(child, pk); ids != nil {
+				return ids
+			}
+		}
+		return nil
+	}
+	return leafIds(node, pk)
+}
+
+func leafIds(node *ConditionNode, pk string) []interface{} {
+	if node == nil || !node.IsLeaf() || node.Column != pk || (node.Op != OpEq && node.Op != OpIn) {
+		return nil
+	}
+	var ids []interface{}
+	for _, arg := range node.RawArgs {
+		if IsArray(arg) {
+			rv := reflect.ValueOf(arg)
+			for i := 0; i < rv.Len(); i++ {
+				ids = append(ids, rv.Index(i).Interface())
+			}
+		} else {
+			ids = append(ids, arg)
+		}
+	}
+	return ids
+}
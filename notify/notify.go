@@ -0,0 +1,186 @@
+// Package notify 通过 postgres LISTEN/NOTIFY 在进程间传递数据变更, 用于跨进程的缓存失效
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/shaynewu/repository"
+	"go.uber.org/zap"
+)
+
+// maxPayload postgres NOTIFY 的 payload 不能超过 8000 字节, 超过时不带 Ids
+const maxPayload = 7900
+
+const (
+	minReconnect = 100 * time.Millisecond
+	maxReconnect = 10 * time.Second
+	pingInterval = time.Minute
+)
+
+var errNotPostgres = errors.New("notify: only postgres supports NOTIFY")
+
+// Event NOTIFY 的 payload, json 编码
+type Event struct {
+	Table string `json:"table"`
+	// Op 为 repository.Stmt* 之一
+	Op string `json:"op"`
+	// Ids 变更行的主键, 无法确定(如按非主键条件 Update)或过多时为空, 此时订阅方应使整张表的缓存失效.
+	// 数字为 json.Number
+	Ids []interface{} `json:"ids,omitempty"`
+	// Reconnected 为 true 时监听的连接中断过, 期间的通知可能丢失, 不来自 payload
+	Reconnected bool `json:"-"`
+}
+
+// writeOps 会发送通知的操作
+var writeOps = map[string]bool{
+	repository.StmtCreate:      true,
+	repository.StmtBatchCreate: true,
+	repository.StmtBatchUpsert: true,
+	repository.StmtSave:        true,
+	repository.StmtUpdate:      true,
+	repository.StmtBulkUpdate:  true,
+	repository.StmtDelete:      true,
+}
+
+// Interceptor 返回的拦截器在写操作成功后, 用同一连接执行 pg_notify(channel, payload).
+// 在事务中时通知随事务提交才送达, 回滚则不送达. 通过 Repository.Use 添加:
+//
+//	repo.Use(notify.Interceptor(repo.Tm, "repository_changes"))
+func Interceptor(tm repository.TransactionManager, channel string) repository.QueryInterceptor {
+	return func(ctx context.Context, stmt *repository.StatementInfo, next repository.Invoker) error {
+		if err := next(ctx, stmt); err != nil || !writeOps[stmt.Op] {
+			return err
+		}
+		return Notify(ctx, tm, channel, Event{Table: stmt.Table, Op: stmt.Op, Ids: changedIds(stmt)})
+	}
+}
+
+// Notify 在 tm 的当前连接(事务)上发送 event
+func Notify(ctx context.Context, tm repository.TransactionManager, channel string, event Event) error {
+	db := tm.GetDb(ctx)
+	if db == nil {
+		return errors.New("notify: db is nil")
+	}
+	if db.Dialect().GetName() != repository.DialectPostgres {
+		return errNotPostgres
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxPayload {
+		event.Ids = nil
+		if payload, err = json.Marshal(event); err != nil {
+			return err
+		}
+	}
+	return db.Exec("SELECT pg_notify(?, ?)", channel, string(payload)).Error
+}
+
+// changedIds Create/Save 取 model 的主键, Update/Delete 取主键的 Eq/In 条件
+func changedIds(stmt *repository.StatementInfo) []interface{} {
+	switch stmt.Op {
+	case repository.StmtCreate, repository.StmtSave, repository.StmtBatchCreate, repository.StmtBatchUpsert, repository.StmtBulkUpdate:
+		var ids []interface{}
+		rv := reflect.ValueOf(stmt.Model)
+		if rv.Kind() != reflect.Slice {
+			rv = reflect.ValueOf([]interface{}{stmt.Model})
+		}
+		for i := 0; i < rv.Len(); i++ {
+			f, ok := (&gorm.Scope{}).New(rv.Index(i).Interface()).FieldByName(stmt.PrimaryKey)
+			if !ok || f.IsBlank {
+				return nil
+			}
+			ids = append(ids, f.Field.Interface())
+		}
+		return ids
+	case repository.StmtUpdate, repository.StmtDelete:
+		return conditionIds(repository.Inspect(stmt.Condition), stmt.PrimaryKey)
+	}
+	return nil
+}
+
+func conditionIds(node *repository.ConditionNode, pk string) []interface{} {
+	if node == nil {
+		return nil
+	}
+	if node.Logic == "AND" {
+		for _, child := range node.Children {
+			if ids := conditionIds(child, pk); ids != nil {
+				return ids
+			}
+		}
+		return nil
+	}
+	if !node.IsLeaf() || node.Column != pk || (node.Op != repository.OpEq && node.Op != repository.OpIn) {
+		return nil
+	}
+	var ids []interface{}
+	for _, arg := range node.RawArgs {
+		if repository.IsArray(arg) {
+			rv := reflect.ValueOf(arg)
+			for i := 0; i < rv.Len(); i++ {
+				ids = append(ids, rv.Index(i).Interface())
+			}
+		} else {
+			ids = append(ids, arg)
+		}
+	}
+	return ids
+}
+
+// Listen 使用单独的连接(dsn)监听 channel, 对每个通知调用 handler, 直到 ctx 结束.
+// 连接中断后自动重连, 重连成功时以 Reconnected 为 true 的 Event 调用 handler
+func Listen(ctx context.Context, dsn, channel string, handler func(ctx context.Context, event Event)) error {
+	listener := pq.NewListener(dsn, minReconnect, maxReconnect, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			repository.Warn("[repository] notify listener", zap.String("channel", channel), zap.Error(err))
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(channel); err != nil {
+		return fmt.Errorf("notify: listen %s: %w", channel, err)
+	}
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-listener.Notify:
+			if n == nil {
+				// 重新连接后 pq 发送 nil
+				dispatch(ctx, handler, Event{Reconnected: true})
+				continue
+			}
+			var event Event
+			dec := json.NewDecoder(strings.NewReader(n.Extra))
+			dec.UseNumber()
+			if err := dec.Decode(&event); err != nil {
+				repository.Warn("[repository] invalid notify payload", zap.String("channel", channel), zap.String("payload", n.Extra), zap.Error(err))
+				continue
+			}
+			dispatch(ctx, handler, event)
+		case <-ticker.C:
+			// 长时间没有通知时检查连接是否可用
+			go listener.Ping()
+		}
+	}
+}
+
+func dispatch(ctx context.Context, handler func(ctx context.Context, event Event), event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			repository.Error("[repository] panic in notify handler", zap.String("table", event.Table), zap.Any("panic", r))
+		}
+	}()
+	handler(ctx, event)
+}
@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Optimize 简化条件树, 不改变语义:
+//
+// 合并相同逻辑的嵌套分组 ((a AND b) AND c -> a AND b AND c);
+// 去掉重复的条件;
+// 去掉空分组(如 IgnoreZero 之后剩下的);
+// x IN (a) -> x = a, x NOT IN (a) -> x <> a.
+//
+// 运行时拼出来的条件往往有很多冗余, 简化后 sql 更短, 也更利于 plan cache
+func Optimize(condition Condition) Condition {
+	if c := optimize(condition); c != nil {
+		return c
+	}
+	return MatchAll()
+}
+
+// optimize 返回 nil 表示条件为空
+func optimize(condition Condition) Condition {
+	switch c := condition.(type) {
+	case nil:
+		return nil
+	case *singleCondition:
+		return optimizeSingle(c)
+	case *compoundCondition:
+		return optimizeGroup(c.logic, []Condition{c.condition1, c.condition2})
+	case *conditionGroup:
+		return optimizeGroup(c.logic, c.conditions)
+	default:
+		return condition
+	}
+}
+
+func optimizeSingle(sc *singleCondition) Condition {
+	if sc.op != c_In && sc.op != c_NotIn {
+		return sc
+	}
+	v := reflect.ValueOf(sc.rawVal1)
+	if (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) || v.Len() != 1 {
+		return sc
+	}
+	elem := v.Index(0).Interface()
+	op := operator(c_Eq)
+	if sc.op == c_NotIn {
+		op = c_NotEq
+	}
+	return &singleCondition{
+		field:   sc.field,
+		op:      op,
+		sqlArg1: inValues(sc.rawVal1)[0],
+		rawVal1: elem,
+	}
+}
+
+func optimizeGroup(l logic, conditions []Condition) Condition {
+	var children []Condition
+	seen := make(map[string]bool)
+	var add func(c Condition)
+	add = func(c Condition) {
+		c = optimize(c)
+		if c == nil {
+			return
+		}
+		// 已经优化过的子分组, 逻辑相同时展开
+		if cg, ok := c.(*conditionGroup); ok && cg.logic == l {
+			for _, child := range cg.conditions {
+				add(child)
+			}
+			return
+		}
+		sql, args := c.flatten()
+		key := sql + "|" + fmt.Sprint(args)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		children = append(children, c)
+	}
+	for _, c := range conditions {
+		add(c)
+	}
+	switch len(children) {
+	case 0:
+		return nil
+	case 1:
+		return children[0]
+	}
+	return &conditionGroup{
+		conditions: children,
+		logic:      l,
+	}
+}
@@ -1,8 +1,11 @@
 package repository
 
 import (
+	"context"
 	"fmt"
 	"github.com/jinzhu/gorm"
+	"math"
+	"reflect"
 	"strings"
 )
 
@@ -25,7 +28,11 @@ func Limit32(offset, limit int32) *limitOption {
 	return &limitOption{int(offset), int(limit)}
 }
 
+// Sql limit 小于 0 表示不限制. mysql, sqlite 的 OFFSET 必须与 LIMIT 一起使用, 此时以最大值代替
 func (lo *limitOption) Sql(db *gorm.DB) *gorm.DB {
+	if lo.limit < 0 && lo.offset > 0 && db.Dialect().GetName() != DialectPostgres {
+		return db.Offset(lo.offset).Limit(int64(math.MaxInt64))
+	}
 	return db.Offset(lo.offset).Limit(lo.limit)
 }
 
@@ -45,6 +52,8 @@ type orderOption struct {
 // CREATE_TIME_ASC -> create_time asc
 //
 // CREATE_TIME ASC -> create_time asc
+//
+// 不检查列名, 用户传入的参数请使用 ParseOrderOptionAllowed
 func ParseOrderOption(str string) Option {
 	str = strings.ToLower(str)
 	if strings.HasSuffix(str, "desc") {
@@ -55,12 +64,140 @@ func ParseOrderOption(str string) Option {
 	return SimpleField(str).Asc()
 }
 
+// ParseOrderOptionAllowed 同 ParseOrderOption, 但列必须在 allowed 中(不区分大小写), 否则返回 error.
+// 用于解析用户传入的排序参数, allowed 可以通过 FieldsOf 从 InitRepoFields 的 struct 中取得
+func ParseOrderOptionAllowed(str string, allowed ...FieldInterface) (Option, error) {
+	column, order := parseOrder(str)
+	for _, f := range allowed {
+		if strings.EqualFold(f.Column(), column) {
+			if order == DESC {
+				return f.Desc(), nil
+			}
+			return f.Asc(), nil
+		}
+	}
+	return nil, fmt.Errorf("can not order by %q", str)
+}
+
+// ParseOrder 同 ParseOrderOptionAllowed, allowed 为 model 的所有列
+func (e *Repository) ParseOrder(str string) (Option, error) {
+	var allowed []FieldInterface
+	for _, f := range (&gorm.Scope{}).New(e.Value).Fields() {
+		if f.IsNormal && !f.IsIgnored {
+			allowed = append(allowed, SimpleField(f.DBName))
+		}
+	}
+	return ParseOrderOptionAllowed(str, allowed...)
+}
+
+// FieldsOf 返回 struct 中所有 FieldInterface 类型且非空的字段, fieldsStruct 可以是 struct 或其指针
+func FieldsOf(fieldsStruct interface{}) []FieldInterface {
+	v := Indirect(reflect.ValueOf(fieldsStruct))
+	var list []FieldInterface
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).PkgPath != "" {
+			continue
+		}
+		if f, ok := v.Field(i).Interface().(FieldInterface); ok && f.Column() != "" {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+func parseOrder(str string) (string, ORDER) {
+	str = strings.ToLower(strings.TrimSpace(str))
+	for _, suffix := range []string{"_desc", " desc"} {
+		if strings.HasSuffix(str, suffix) {
+			return strings.TrimSpace(str[:len(str)-len(suffix)]), DESC
+		}
+	}
+	for _, suffix := range []string{"_asc", " asc"} {
+		if strings.HasSuffix(str, suffix) {
+			return strings.TrimSpace(str[:len(str)-len(suffix)]), ASC
+		}
+	}
+	return str, ASC
+}
+
 func (oo *orderOption) Sql(db *gorm.DB) *gorm.DB {
-	return db.Order(fmt.Sprintf("%s %s", oo.field, oo.order.String()))
+	return db.Order(fmt.Sprintf("%s %s", columnForDialect(oo.field.Column(), db.Dialect().GetName()), oo.order.String()))
+}
+
+// NullsOrder NULL 值在排序中的位置
+type NullsOrder int
+
+const (
+	// NullsDefault 使用数据库的默认行为
+	NullsDefault NullsOrder = iota
+	NullsFirst
+	NullsLast
+)
+
+// OrderPair 一个排序项. Expr 不为空时按表达式排序(忽略 Field), 例如
+//
+//	OrderPair{Expr: "CASE WHEN status = ? THEN 0 ELSE 1 END", Args: []interface{}{"pending"}}
+type OrderPair struct {
+	Field FieldInterface
+	Expr  string
+	Args  []interface{}
+	// Order 为 0 时按 ASC 处理
+	Order ORDER
+	Nulls NullsOrder
+}
+
+type orderByOption struct {
+	pairs []OrderPair
+}
+
+// OrderBy 按多个字段或表达式排序, 生成一个 ORDER BY, 支持 NULLS FIRST/LAST (mysql 通过 IS NULL 排序模拟)
+func OrderBy(pairs ...OrderPair) *orderByOption {
+	return &orderByOption{pairs: pairs}
+}
+
+func (ob *orderByOption) Sql(db *gorm.DB) *gorm.DB {
+	if len(ob.pairs) == 0 {
+		return db
+	}
+	dialect := db.Dialect().GetName()
+	mysql := dialect == DialectMysql
+	var items []string
+	var args []interface{}
+	for _, p := range ob.pairs {
+		target := p.Expr
+		if target == "" {
+			target = columnForDialect(p.Field.Column(), dialect)
+		}
+		order := ASC
+		if p.Order < 0 {
+			order = DESC
+		}
+		switch {
+		case p.Nulls == NullsDefault:
+		case mysql:
+			// false 排在 true 前面
+			if p.Nulls == NullsFirst {
+				items = append(items, fmt.Sprintf("(%s) IS NOT NULL", target))
+			} else {
+				items = append(items, fmt.Sprintf("(%s) IS NULL", target))
+			}
+			args = append(args, p.Args...)
+		}
+		item := target + " " + order.String()
+		if !mysql && p.Nulls == NullsFirst {
+			item += " NULLS FIRST"
+		} else if !mysql && p.Nulls == NullsLast {
+			item += " NULLS LAST"
+		}
+		items = append(items, item)
+		args = append(args, p.Args...)
+	}
+	return db.Order(gorm.Expr(strings.Join(items, ", "), args...))
 }
 
 type selectOption struct {
 	columns []FieldInterface
+	args    []interface{}
 }
 
 func (so *selectOption) Sql(db *gorm.DB) *gorm.DB {
@@ -68,11 +205,147 @@ func (so *selectOption) Sql(db *gorm.DB) *gorm.DB {
 	for _, c := range so.columns {
 		cols = append(cols, c.Column())
 	}
+	if len(so.args) > 0 {
+		return db.Select(strings.Join(cols, ", "), so.args...)
+	}
 	return db.Select(cols)
 }
 
+// Select 查询的列, 可以使用 As 设置别名, 以及 Sum, Max 等
 func Select(cols ...FieldInterface) *selectOption {
 	return &selectOption{
 		columns: cols,
 	}
 }
+
+// SelectExpr 以表达式作为查询的列, 如 SelectExpr("COALESCE(nickname, ?) AS name", "anonymous").
+// 与 Select 同时使用时, 后面的覆盖前面的; 结果通常使用 FindInto 读取
+func SelectExpr(expr string, args ...interface{}) *selectOption {
+	return &selectOption{
+		columns: []FieldInterface{SimpleField(expr)},
+		args:    args,
+	}
+}
+
+// OrderSpec is the exported view of an order Option
+type OrderSpec struct {
+	Column string
+	Order  ORDER
+	Nulls  NullsOrder
+}
+
+// OptionSpec 是 Option 的只读视图, 供非 gorm 的实现(如 mongo)使用
+type OptionSpec struct {
+	Offset int
+	// Limit <= 0 means no limit
+	Limit   int
+	Orders  []OrderSpec
+	Columns []string
+}
+
+// InspectOptions collects options into an OptionSpec, unknown options are ignored
+func InspectOptions(options ...Option) *OptionSpec {
+	spec := &OptionSpec{}
+	for _, opt := range options {
+		switch o := opt.(type) {
+		case *limitOption:
+			spec.Offset = o.offset
+			spec.Limit = o.limit
+		case *orderOption:
+			spec.Orders = append(spec.Orders, OrderSpec{Column: o.field.Column(), Order: o.order})
+		case *orderByOption:
+			// 表达式无法转换, 忽略
+			for _, p := range o.pairs {
+				if p.Expr == "" {
+					order := ASC
+					if p.Order < 0 {
+						order = DESC
+					}
+					spec.Orders = append(spec.Orders, OrderSpec{Column: p.Field.Column(), Order: order, Nulls: p.Nulls})
+				}
+			}
+		case *nearestOption:
+			// 距离排序无法转换, 只保留 Limit
+			spec.Limit = o.n
+		case *selectOption:
+			for _, c := range o.columns {
+				spec.Columns = append(spec.Columns, c.Column())
+			}
+		}
+	}
+	return spec
+}
+
+type hintOption struct {
+	hint string
+}
+
+// Sql parseOptions 中处理, 这里不修改查询
+func (ho *hintOption) Sql(db *gorm.DB) *gorm.DB {
+	return db
+}
+
+// Hint 在 SELECT 之后加上 /*+ hint */, 用于 mysql 的 optimizer hint 或 pg_hint_plan, 如 Hint("MAX_EXECUTION_TIME(1000)").
+// 只对 Find 及 Explain 生效
+func Hint(hint string) Option {
+	return &hintOption{hint: hint}
+}
+
+type useIndexOption struct {
+	indexes []string
+}
+
+// Sql parseOptions 中处理, 这里不修改查询
+func (uo *useIndexOption) Sql(db *gorm.DB) *gorm.DB {
+	return db
+}
+
+// UseIndex 让 Find 使用指定的索引: mysql 为 USE INDEX, sqlite 为 INDEXED BY (只使用第一个),
+// postgres 为 pg_hint_plan 的 IndexScan (需要安装 pg_hint_plan, 否则被忽略)
+func UseIndex(index ...string) Option {
+	return &useIndexOption{indexes: index}
+}
+
+type writeColumnsOption struct {
+	columns []FieldInterface
+	omit    bool
+}
+
+func (wo *writeColumnsOption) Sql(db *gorm.DB) *gorm.DB {
+	var cols []string
+	for _, c := range wo.columns {
+		cols = append(cols, c.Column())
+	}
+	if wo.omit {
+		return db.Omit(cols...)
+	}
+	return db.Select(cols)
+}
+
+// Omit 写入时跳过的列, 通过 WithWriteOptions 用于 Create/Save/Update
+func Omit(fields ...FieldInterface) Option {
+	return &writeColumnsOption{columns: fields, omit: true}
+}
+
+// SelectColumns 写入时只写这些列(AUTOUPDATETIME 的列需要一并指定), 通过 WithWriteOptions 用于 Create/Save/Update
+func SelectColumns(fields ...FieldInterface) Option {
+	return &writeColumnsOption{columns: fields}
+}
+
+type writeOptionsKey struct{}
+
+// WithWriteOptions 返回的 ctx 用于默认的 CreateFunc/SaveFunc/UpdateFunc, 控制写入的列, 例如
+//
+//	repo.Save(WithWriteOptions(ctx, Omit(fields.CreatedAt, fields.Content)), model)
+func WithWriteOptions(ctx context.Context, options ...Option) context.Context {
+	return context.WithValue(ctx, writeOptionsKey{}, options)
+}
+
+// writeColumns 应用 ctx 中的写入选项
+func writeColumns(ctx context.Context, db *gorm.DB) *gorm.DB {
+	options, _ := ctx.Value(writeOptionsKey{}).([]Option)
+	for _, opt := range options {
+		db = opt.Sql(db)
+	}
+	return db
+}
@@ -0,0 +1,212 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+)
+
+// OutboxTable outbox 表名, 表结构见 OutboxMessage, 可以通过 MigrateAll(&OutboxMessage{}) 创建
+const OutboxTable = "repository_outbox"
+
+const (
+	defaultOutboxInterval  = time.Second
+	defaultOutboxBatchSize = 100
+)
+
+// OutboxMessage outbox 表中的一条事件, 与业务数据在同一事务中写入, 由 OutboxPoller 发布
+type OutboxMessage struct {
+	Id    int64  `gorm:"primary_key"`
+	Topic string `gorm:"type:varchar(255);not null"`
+	// Key 消息的 key (如聚合 id), 同一 key 的消息按写入顺序发布. CreateWithOutbox 时为空则使用 model 的主键
+	Key     string `gorm:"type:varchar(255);not null;default:''"`
+	Payload []byte `gorm:"not null"`
+	// Attempts 发布失败的次数, LastError 最后一次失败的原因
+	Attempts    int    `gorm:"not null;default:0"`
+	LastError   string `gorm:"type:text"`
+	CreateTime  time.Time
+	PublishTime *time.Time `gorm:"index"`
+}
+
+func (OutboxMessage) TableName() string {
+	return OutboxTable
+}
+
+// NewOutboxMessage payload 以 json 编码
+func NewOutboxMessage(topic, key string, payload interface{}) (OutboxMessage, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return OutboxMessage{}, err
+	}
+	return OutboxMessage{Topic: topic, Key: key, Payload: data}, nil
+}
+
+// CreateWithOutbox 在一个事务中 Create model 并写入 event, 保证两者同时成功或失败
+func (e *Repository) CreateWithOutbox(ctx context.Context, model Model, event OutboxMessage) error {
+	_, err := e.Tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		if err := e.Create(ctx, model); err != nil {
+			return nil, err
+		}
+		return nil, e.appendOutbox(ctx, model, event)
+	})
+	return err
+}
+
+// SaveWithOutbox 同 CreateWithOutbox, 使用 Save
+func (e *Repository) SaveWithOutbox(ctx context.Context, model Model, event OutboxMessage) error {
+	_, err := e.Tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		if err := e.Save(ctx, model); err != nil {
+			return nil, err
+		}
+		return nil, e.appendOutbox(ctx, model, event)
+	})
+	return err
+}
+
+func (e *Repository) appendOutbox(ctx context.Context, model Model, event OutboxMessage) error {
+	db := e.Tm.GetDb(ctx)
+	if db == nil {
+		return dbNilErr
+	}
+	if event.Key == "" {
+		if pk := db.NewScope(model).PrimaryKeyValue(); pk != nil {
+			event.Key = fmt.Sprint(pk)
+		}
+	}
+	event.Id = 0
+	event.CreateTime = time.Now()
+	event.PublishTime = nil
+	return db.New().Create(&event).Error
+}
+
+// OutboxPublisher OutboxPoller 的发布端. 与 EventPublisher 不同, Deliver 必须在消息投递成功(如 mq 已确认)后才返回 nil,
+// 返回 nil 后消息被标记为已发布, 不会再次发布
+type OutboxPublisher interface {
+	Deliver(ctx context.Context, topic string, msg *OutboxMessage) error
+}
+
+// OutboxPoller 定期读取 outbox 中未发布的事件, 通过 Publisher 投递成功后标记为已发布(至少一次).
+// 多个进程同时运行时, postgres/mysql 8 通过 FOR UPDATE SKIP LOCKED 分摊; 同一 key 有更早的未发布事件
+// (被其他进程锁定, 或本批之前失败)时, 该 key 的事件本次不发布, 保证同一 key 按写入顺序发布
+type OutboxPoller struct {
+	Tm        TransactionManager
+	Publisher OutboxPublisher
+	// Interval 没有待发布事件时的轮询间隔, 默认 1s
+	Interval time.Duration
+	// BatchSize 每次读取的事件数, 默认 100
+	BatchSize int
+	// MaxAttempts 失败次数达到后不再发布, 0 表示一直重试
+	MaxAttempts int
+}
+
+// Run 持续发布直到 ctx 结束
+func (p *OutboxPoller) Run(ctx context.Context) error {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = defaultOutboxInterval
+	}
+	for {
+		n, err := p.Poll(ctx)
+		if err != nil {
+			Warn("[repository] poll outbox failed", zap.Error(err))
+		}
+		if n > 0 && err == nil {
+			// 可能还有待发布的事件
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Poll 发布一批事件, 返回成功发布的数量. 某个 key 的事件发布失败后, 本批中该 key 之后的事件不再发布, 保证顺序
+func (p *OutboxPoller) Poll(ctx context.Context) (int, error) {
+	size := p.BatchSize
+	if size <= 0 {
+		size = defaultOutboxBatchSize
+	}
+	res, err := p.Tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		db := p.Tm.GetDb(ctx)
+		if db == nil {
+			return 0, dbNilErr
+		}
+		query := db.New().Where("publish_time IS NULL")
+		if p.MaxAttempts > 0 {
+			query = query.Where("attempts < ?", p.MaxAttempts)
+		}
+		if dialect := db.Dialect().GetName(); dialect == DialectPostgres || dialect == DialectMysql {
+			query = query.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED")
+		}
+		var messages []*OutboxMessage
+		if err := query.Order("id").Limit(size).Find(&messages).Error; err != nil {
+			return 0, err
+		}
+		// blocked 有更早的未发布事件的 key
+		blocked := make(map[string]bool)
+		checked := make(map[string]bool)
+		published := 0
+		for _, m := range messages {
+			if !checked[m.Key] {
+				checked[m.Key] = true
+				earlier, err := p.hasEarlier(db, m)
+				if err != nil {
+					return published, err
+				}
+				blocked[m.Key] = earlier
+			}
+			if blocked[m.Key] {
+				continue
+			}
+			labels := map[string]string{"topic": m.Topic}
+			if pubErr := p.Publisher.Deliver(ctx, m.Topic, m); pubErr != nil {
+				blocked[m.Key] = true
+				getMetrics().IncCounter("repository_outbox_publish_failed_total", labels)
+				Warn("[repository] publish outbox message failed", zap.Int64("id", m.Id), zap.String("topic", m.Topic), zap.Error(pubErr))
+				update := map[string]interface{}{"attempts": Expr("attempts + 1"), "last_error": pubErr.Error()}
+				if err := db.New().Model(m).Updates(update).Error; err != nil {
+					return published, err
+				}
+				continue
+			}
+			if err := db.New().Model(m).Update("publish_time", time.Now()).Error; err != nil {
+				return published, err
+			}
+			getMetrics().IncCounter("repository_outbox_published_total", labels)
+			published++
+		}
+		return published, nil
+	})
+	n, _ := res.(int)
+	return n, err
+}
+
+// hasEarlier 是否有 id 小于 m 的同一 key 的未发布事件(不包括已达到 MaxAttempts 的)
+func (p *OutboxPoller) hasEarlier(db *gorm.DB, m *OutboxMessage) (bool, error) {
+	query := db.New().Model(&OutboxMessage{}).
+		Where(fmt.Sprintf("%s = ? AND id < ? AND publish_time IS NULL", db.Dialect().Quote("key")), m.Key, m.Id)
+	if p.MaxAttempts > 0 {
+		query = query.Where("attempts < ?", p.MaxAttempts)
+	}
+	var n int
+	if err := query.Count(&n).Error; err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// PurgeOutbox 删除 before 之前已发布的事件, 返回删除的数量
+func PurgeOutbox(ctx context.Context, tm TransactionManager, before time.Time) (int64, error) {
+	db := tm.GetDb(ctx)
+	if db == nil {
+		return 0, dbNilErr
+	}
+	res := db.New().Where("publish_time < ?", before).Delete(&OutboxMessage{})
+	return res.RowsAffected, res.Error
+}
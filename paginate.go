@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+)
+
+// Page 一页数据及分页信息
+type Page struct {
+	// Items 同 Find 的返回值
+	Items interface{} `json:"items"`
+	// Page 从 1 开始
+	Page       int  `json:"page"`
+	Size       int  `json:"size"`
+	Total      int  `json:"total"`
+	TotalPages int  `json:"total_pages"`
+	HasNext    bool `json:"has_next"`
+}
+
+// Paginate 查询第 page 页(从 1 开始, 小于 1 时按 1 处理), 每页 size 条. 先 Count 再 Find,
+// 超出总页数时不执行 Find, Items 为空 slice. options 中的 Limit 会被忽略
+func (e *Repository) Paginate(ctx context.Context, condition Condition, page, size int, options ...Option) (*Page, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid page size %d", size)
+	}
+	if page < 1 {
+		page = 1
+	}
+	total, err := e.Count(ctx, condition, options...)
+	if err != nil {
+		return nil, err
+	}
+	p := &Page{
+		Page:       page,
+		Size:       size,
+		Total:      total,
+		TotalPages: (total + size - 1) / size,
+		HasNext:    page*size < total,
+	}
+	offset := (page - 1) * size
+	if offset >= total {
+		p.Items = e.NewSlice()
+		return p, nil
+	}
+	p.Items, err = e.Find(ctx, condition, append(withoutLimit(options), Limit(offset, size))...)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func withoutLimit(options []Option) []Option {
+	list := make([]Option, 0, len(options)+1)
+	for _, opt := range options {
+		if _, ok := opt.(*limitOption); !ok {
+			list = append(list, opt)
+		}
+	}
+	return list
+}
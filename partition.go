@@ -0,0 +1,242 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PartitionInterval 分区的时间跨度
+type PartitionInterval int
+
+const (
+	PartitionDaily PartitionInterval = iota
+	PartitionMonthly
+)
+
+// PartitionSpec 按时间范围分区的表(postgres 声明式分区, 父表需以 PARTITION BY RANGE (Column) 创建;
+// Route 为 true 时由 Repository 路由, 参见 partitionroute.go).
+// 分区名为 <表名>_pYYYYMMDD (按天) 或 <表名>_pYYYYMM (按月), 时间按 UTC 计算
+type PartitionSpec struct {
+	// Column 分区键, 时间类型的列, 或整数的时间戳
+	Column FieldInterface
+	// Interval 每个分区的时间跨度
+	Interval PartitionInterval
+	// Retention 分区的保留时间, 分区的结束时间早于 now - Retention 时过期, 0 表示永久保留
+	Retention time.Duration
+	// Route 为 true 时每个分区是独立的表, 由 Repository 按 Column 路由 Create 和 Find, 支持 postgres 和 mysql
+	Route bool
+	// EpochUnit Column 为整数时的单位, 默认为秒
+	EpochUnit time.Duration
+}
+
+// Bounds 返回 t 所在分区的 [from, to)
+func (p *PartitionSpec) Bounds(t time.Time) (from, to time.Time) {
+	t = t.UTC()
+	if p.Interval == PartitionMonthly {
+		from = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return from, from.AddDate(0, 1, 0)
+	}
+	from = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return from, from.AddDate(0, 0, 1)
+}
+
+func (p *PartitionSpec) layout() string {
+	if p.Interval == PartitionMonthly {
+		return "200601"
+	}
+	return "20060102"
+}
+
+// Name 返回 table 中 t 所在分区的表名
+func (p *PartitionSpec) Name(table string, t time.Time) string {
+	from, _ := p.Bounds(t)
+	return table + "_p" + from.Format(p.layout())
+}
+
+// parse 从分区表名解析分区的起始时间
+func (p *PartitionSpec) parse(table, name string) (time.Time, bool) {
+	suffix := strings.TrimPrefix(name, table+"_p")
+	if suffix == name {
+		return time.Time{}, false
+	}
+	from, err := time.ParseInLocation(p.layout(), suffix, time.UTC)
+	return from, err == nil
+}
+
+func (e *Repository) partitionSpec() (*PartitionSpec, error) {
+	if e.Partition == nil || e.Partition.Column == nil {
+		return nil, fmt.Errorf("table %s is not partitioned", e.TableName())
+	}
+	return e.Partition, nil
+}
+
+// EnsurePartitions 提前创建从当前时间到 now + horizon 的分区(已存在的跳过), 返回新建的分区. 只支持 postgres,
+// Route 为 true 时也支持 mysql. 应定期执行(如每天), 保证写入时分区已经存在
+func (e *Repository) EnsurePartitions(ctx context.Context, horizon time.Duration) ([]string, error) {
+	spec, err := e.partitionSpec()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := e.Partitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		exists[name] = true
+	}
+	db := e.getDb(ctx)
+	table := e.TableName()
+	quote := db.Dialect().Quote
+	var created []string
+	now := time.Now()
+	for t := now; !t.After(now.Add(horizon)); {
+		from, to := spec.Bounds(t)
+		name := spec.Name(table, t)
+		t = to
+		if exists[name] {
+			continue
+		}
+		ddl := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+			quote(name), quote(table), from.Format(time.RFC3339), to.Format(time.RFC3339))
+		if spec.Route {
+			// 以 Model 的表为模板
+			ddl = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (LIKE %s INCLUDING ALL)", quote(name), quote(table))
+			if db.Dialect().GetName() == DialectMysql {
+				ddl = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s LIKE %s", quote(name), quote(table))
+			}
+		}
+		Info("[repository] EnsurePartitions", ddl)
+		if err = db.Exec(ddl).Error; err != nil {
+			return created, err
+		}
+		created = append(created, name)
+	}
+	return created, nil
+}
+
+// Partitions 返回按起始时间排序的, 已挂载的分区
+func (e *Repository) Partitions(ctx context.Context) ([]string, error) {
+	spec, err := e.partitionSpec()
+	if err != nil {
+		return nil, err
+	}
+	db := e.getDb(ctx)
+	if db == nil {
+		return nil, dbNilErr
+	}
+	dialect := db.Dialect().GetName()
+	var rows *sql.Rows
+	switch {
+	case spec.Route && (dialect == DialectPostgres || dialect == DialectMysql):
+		schema := "CURRENT_SCHEMA()"
+		if dialect == DialectMysql {
+			schema = "DATABASE()"
+		}
+		rows, err = db.New().Raw(`SELECT table_name FROM information_schema.tables
+		WHERE table_schema = `+schema+` AND table_name LIKE ?`, e.TableName()+"_p%").Rows()
+	case dialect == DialectPostgres:
+		rows, err = db.New().Raw(`SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relname = ?`, e.TableName()).Rows()
+	default:
+		return nil, fmt.Errorf("partition is not supported for %s", dialect)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if _, ok := spec.parse(e.TableName(), name); ok {
+			names = append(names, name)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// expiredPartitions 结束时间早于 now - Retention 的分区
+func (e *Repository) expiredPartitions(ctx context.Context) ([]string, error) {
+	spec, err := e.partitionSpec()
+	if err != nil {
+		return nil, err
+	}
+	if spec.Retention <= 0 {
+		return nil, nil
+	}
+	names, err := e.Partitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(-spec.Retention)
+	var expired []string
+	for _, name := range names {
+		from, _ := spec.parse(e.TableName(), name)
+		if _, to := spec.Bounds(from); !to.After(deadline) {
+			expired = append(expired, name)
+		}
+	}
+	return expired, nil
+}
+
+// DetachExpiredPartitions 卸载过期的分区, 卸载后的表保留(如归档后再删除), 返回卸载的分区. Route 为 true 时不支持
+func (e *Repository) DetachExpiredPartitions(ctx context.Context) ([]string, error) {
+	if e.Partition != nil && e.Partition.Route {
+		return nil, errors.New("routed partitions can not be detached")
+	}
+	return e.removeExpiredPartitions(ctx, false)
+}
+
+// DropExpiredPartitions 卸载并删除过期的分区, 返回删除的分区
+func (e *Repository) DropExpiredPartitions(ctx context.Context) ([]string, error) {
+	return e.removeExpiredPartitions(ctx, true)
+}
+
+func (e *Repository) removeExpiredPartitions(ctx context.Context, drop bool) ([]string, error) {
+	expired, err := e.expiredPartitions(ctx)
+	if err != nil || len(expired) == 0 {
+		return nil, err
+	}
+	var removed []string
+	for _, name := range expired {
+		_, err = e.Tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+			db := e.getDb(ctx)
+			if db == nil {
+				return nil, dbNilErr
+			}
+			quote := db.Dialect().Quote
+			if !e.Partition.Route {
+				ddl := fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", quote(e.TableName()), quote(name))
+				Info("[repository] DetachPartition", ddl)
+				if err := db.Exec(ddl).Error; err != nil {
+					return nil, err
+				}
+			}
+			if !drop {
+				return nil, nil
+			}
+			ddl := fmt.Sprintf("DROP TABLE %s", quote(name))
+			Info("[repository] DropPartition", ddl)
+			return nil, db.Exec(ddl).Error
+		})
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
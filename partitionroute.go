@@ -0,0 +1,356 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 以下用于 PartitionSpec.Route: 每个分区是一张独立的表(名称同 PartitionSpec.Name), 由 Repository 在应用层路由,
+// 不依赖数据库的声明式分区, mysql 也可以使用. Model 的表作为建表的模板
+//
+//   - Create/Save(新建)/CreateReturning 按 model 中 Column 的值写入对应的表
+//   - Find/Count 按条件中 Column 的范围(Eq, In, Between, Gt, Gte, Lt, Lte, 以 AND 连接)查询覆盖的表并合并结果,
+//     范围没有上下界时返回 error. 不存在的表被跳过
+//   - FindOne/Update/Delete(含软删除)同样按范围路由, 依次在覆盖的表中执行. FindById/DeleteById 等只有主键的条件
+//     无法路由, 返回 error, 需要改用带 Column 范围的条件
+//   - DeleteReturningIds 不支持路由, 返回 error
+//   - WithTable/ContextWithTable 指定了表时不路由
+
+// routed 是否需要路由, ctx 中已指定表时不路由
+func (e *Repository) routed(ctx context.Context) bool {
+	return e.Partition != nil && e.Partition.Route && e.Partition.Column != nil && e.tableFor(ctx) == e.TableName()
+}
+
+// routeCreate 返回写入 model 对应分区的 ctx
+func (e *Repository) routeCreate(ctx context.Context, model interface{}) (context.Context, error) {
+	if !e.routed(ctx) {
+		return ctx, nil
+	}
+	spec := e.Partition
+	f, ok := (&gorm.Scope{}).New(model).FieldByName(spec.Column.Column())
+	if !ok {
+		return ctx, fmt.Errorf("partition column %s not found in %T", spec.Column.Column(), model)
+	}
+	t, ok := spec.toTime(reflect.Indirect(f.Field).Interface())
+	if !ok || t.IsZero() {
+		return ctx, fmt.Errorf("partition column %s of %T is empty", spec.Column.Column(), model)
+	}
+	return context.WithValue(ctx, tableOverrideKey(e.TableName()), spec.Name(e.TableName(), t)), nil
+}
+
+// toTime 把列的值转换为时间, 整数按 EpochUnit 处理
+func (p *PartitionSpec) toTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case *time.Time:
+		if t == nil {
+			return time.Time{}, false
+		}
+		return *t, true
+	}
+	rv := reflect.ValueOf(v)
+	var n int64
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = int64(rv.Uint())
+	default:
+		return time.Time{}, false
+	}
+	unit := p.EpochUnit
+	if unit <= 0 {
+		unit = time.Second
+	}
+	return time.Unix(0, n*int64(unit)), true
+}
+
+// routeTables 返回 condition 覆盖的分区表, 按时间排序
+func (e *Repository) routeTables(condition Condition) ([]string, error) {
+	spec := e.Partition
+	from, to, ok := spec.timeRange(Inspect(condition))
+	if !ok || from.IsZero() || to.IsZero() {
+		return nil, fmt.Errorf("query on %s should limit %s in a range", e.TableName(), spec.Column.Column())
+	}
+	var tables []string
+	for t := from; !t.After(to); {
+		tables = append(tables, spec.Name(e.TableName(), t))
+		_, t = spec.Bounds(t)
+	}
+	return tables, nil
+}
+
+// timeRange 从条件中取出 Column 的范围 [from, to], 零值表示没有限制. ok 为 false 时条件矛盾或无法解析
+func (p *PartitionSpec) timeRange(node *ConditionNode) (from, to time.Time, ok bool) {
+	if node == nil {
+		return from, to, true
+	}
+	if node.Logic == string(and) {
+		ok = true
+		for _, child := range node.Children {
+			f, t, childOk := p.timeRange(child)
+			if !childOk {
+				return from, to, false
+			}
+			if !f.IsZero() && (from.IsZero() || f.After(from)) {
+				from = f
+			}
+			if !t.IsZero() && (to.IsZero() || t.Before(to)) {
+				to = t
+			}
+		}
+		return from, to, true
+	}
+	if !node.IsLeaf() || node.Column != p.Column.Column() {
+		// OR 中的范围无法合并, 视为没有限制
+		return from, to, true
+	}
+	var values []time.Time
+	for _, arg := range node.RawArgs {
+		if IsArray(arg) {
+			rv := reflect.ValueOf(arg)
+			for i := 0; i < rv.Len(); i++ {
+				if t, ok := p.toTime(rv.Index(i).Interface()); ok {
+					values = append(values, t)
+				}
+			}
+		} else if t, ok := p.toTime(arg); ok {
+			values = append(values, t)
+		}
+	}
+	if len(values) == 0 {
+		return from, to, true
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Before(values[j])
+	})
+	switch node.Op {
+	case OpEq, OpIn, OpBetween:
+		return values[0], values[len(values)-1], true
+	case OpGt, OpGte:
+		return values[0], to, true
+	case OpLt, OpLte:
+		return from, values[0], true
+	}
+	return from, to, true
+}
+
+// existingTables 去掉不存在的表
+func (e *Repository) existingTables(ctx context.Context, tables []string) ([]string, error) {
+	db := e.getDb(ctx)
+	if db == nil {
+		return nil, dbNilErr
+	}
+	var list []string
+	for _, t := range tables {
+		if db.New().HasTable(t) {
+			list = append(list, t)
+		}
+	}
+	return list, nil
+}
+
+// findRouted 在每个分区中查询后合并. 有 Limit 时每个分区查询 offset+limit 条, 合并排序后再取.
+// 排序无法在内存中合并时(参见 mergeableOrders)返回 error
+func (e *Repository) findRouted(ctx context.Context, condition Condition, options []Option) (interface{}, error) {
+	if !e.mergeableOrders(options) {
+		return nil, fmt.Errorf("orders of the query on %s can not be merged across partitions", e.TableName())
+	}
+	tables, err := e.routeTables(condition)
+	if err != nil {
+		return nil, err
+	}
+	if tables, err = e.existingTables(ctx, tables); err != nil {
+		return nil, err
+	}
+	return e.findMerged(ctx, options, len(tables), func(i int, options []Option) (interface{}, error) {
+		return e.findNoCache(context.WithValue(ctx, tableOverrideKey(e.TableName()), tables[i]), condition, options...)
+	})
+}
+
+// findMerged 执行 n 次查询并合并结果, 各次查询的结果不重叠. 有 Limit 时每次查询 offset+limit 条, 合并排序后再取.
+// 调用方应先以 mergeableOrders 检查排序
+func (e *Repository) findMerged(ctx context.Context, options []Option, n int, find func(i int, options []Option) (interface{}, error)) (interface{}, error) {
+	spec := InspectOptions(options...)
+	perPart := withoutLimit(options)
+	if spec.Limit > 0 {
+		perPart = append(perPart, Limit(0, spec.Offset+spec.Limit))
+	}
+	slice := e.NewSlice()
+	result := reflect.ValueOf(slice).Elem()
+	for i := 0; i < n; i++ {
+		part, err := find(i, perPart)
+		if err != nil {
+			return nil, err
+		}
+		result = reflect.AppendSlice(result, reflect.ValueOf(part).Elem())
+	}
+	if len(spec.Orders) > 0 && n > 1 {
+		var dialect string
+		if db := e.getDb(ctx); db != nil {
+			dialect = db.Dialect().GetName()
+		}
+		rows := result.Interface()
+		sort.SliceStable(rows, func(i, j int) bool {
+			for _, o := range spec.Orders {
+				a, b := columnValue(result.Index(i).Interface(), o.Column), columnValue(result.Index(j).Interface(), o.Column)
+				if a == nil || b == nil {
+					if a == b {
+						continue
+					}
+					return (a == nil) == nullsFirst(o, dialect)
+				}
+				if c, _ := CompareValues(a, b); c != 0 {
+					return c*int(o.Order) < 0
+				}
+			}
+			return false
+		})
+	}
+	if spec.Offset > 0 {
+		if spec.Offset >= result.Len() {
+			result = result.Slice(0, 0)
+		} else {
+			result = result.Slice(spec.Offset, result.Len())
+		}
+	}
+	if spec.Limit > 0 && spec.Limit < result.Len() {
+		result = result.Slice(0, spec.Limit)
+	}
+	reflect.ValueOf(slice).Elem().Set(result)
+	return slice, nil
+}
+
+// mergeableOrders 排序都能在内存中以 CompareValues 按数据库的顺序比较: 按 model 的数值及 time.Time (或其指针)字段排序.
+// 字符串的顺序取决于数据库的 collation, 表达式及 model 以外的列无法在内存中求值
+func (e *Repository) mergeableOrders(options []Option) bool {
+	for _, opt := range options {
+		if o, ok := opt.(*orderByOption); ok {
+			for _, p := range o.pairs {
+				if p.Expr != "" {
+					return false
+				}
+			}
+		}
+	}
+	scope := (&gorm.Scope{}).New(e.NewStruct())
+	for _, o := range InspectOptions(options...).Orders {
+		f, ok := scope.FieldByName(o.Column)
+		if !ok {
+			return false
+		}
+		t := f.Struct.Type
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t == reflect.TypeOf(time.Time{}) {
+			continue
+		}
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// nullsFirst NULL 是否排在前面. 没有指定 Nulls 时 postgres 的 NULL 最大, mysql 及 sqlite 的 NULL 最小
+func nullsFirst(o OrderSpec, dialect string) bool {
+	switch o.Nulls {
+	case NullsFirst:
+		return true
+	case NullsLast:
+		return false
+	}
+	if dialect == DialectPostgres {
+		return o.Order == DESC
+	}
+	return o.Order == ASC
+}
+
+// findOneRouted 依次在每个分区中查询, 返回第一个找到的行
+func (e *Repository) findOneRouted(ctx context.Context, condition Condition) (Model, error) {
+	var data Model
+	err := e.eachRoutedTable(ctx, condition, func(ctx context.Context) error {
+		if data != nil {
+			return nil
+		}
+		row, err := e.findOne(ctx, condition)
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+		data = row
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return data, nil
+}
+
+// routeWrite 不需要路由时直接执行 fn, 否则在 condition 覆盖的每个分区中执行
+func (e *Repository) routeWrite(ctx context.Context, condition Condition, fn func(ctx context.Context) error) error {
+	if !e.routed(ctx) {
+		return fn(ctx)
+	}
+	return e.eachRoutedTable(ctx, condition, fn)
+}
+
+// eachRoutedTable 以指定了分区表的 ctx 依次执行 fn
+func (e *Repository) eachRoutedTable(ctx context.Context, condition Condition, fn func(ctx context.Context) error) error {
+	tables, err := e.routeTables(condition)
+	if err != nil {
+		return err
+	}
+	if tables, err = e.existingTables(ctx, tables); err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if err = fn(context.WithValue(ctx, tableOverrideKey(e.TableName()), t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countRouted 每个分区 Count 的和
+func (e *Repository) countRouted(ctx context.Context, condition Condition, options ...Option) (int, error) {
+	tables, err := e.routeTables(condition)
+	if err != nil {
+		return 0, err
+	}
+	if tables, err = e.existingTables(ctx, tables); err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, t := range tables {
+		n, err := e.count(context.WithValue(ctx, tableOverrideKey(e.TableName()), t), condition, options...)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func compareOrdered(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrAccessDenied Policy 拒绝访问时可以返回(或 wrap)此错误
+var ErrAccessDenied = errors.New("access denied")
+
+// Policy 行级权限策略, 配置到 Repository.Policy 后集中校验:
+//
+//   - ReadFilter 返回的条件像 MandatoryCondition 一样加入每个查询, Update, Delete
+//   - CanRead 对 Find/FindOne/FindByIds 读到的每一行调用, 返回 error 时整个查询失败
+//   - CanWrite 在 Create/Save/CreateReturning, BatchCreate/BatchUpsert/BulkUpdate 的每个 model,
+//     Update/UpdateReturning (update) 及 Delete/DeleteById/DeleteByIds (nil) 执行 sql 前调用
+type Policy interface {
+	// ReadFilter 当前 ctx 可以访问的行, 返回 nil 表示不限制
+	ReadFilter(ctx context.Context) (Condition, error)
+	CanRead(ctx context.Context, model Model) error
+	CanWrite(ctx context.Context, model interface{}) error
+}
+
+// policyFilter 由 mandatory 调用
+func (e *Repository) policyFilter(ctx context.Context, condition Condition) (Condition, error) {
+	if e.Policy == nil {
+		return condition, nil
+	}
+	filter, err := e.Policy.ReadFilter(ctx)
+	if err != nil || filter == nil {
+		return condition, err
+	}
+	return condition.And(filter), nil
+}
+
+func (e *Repository) checkWrite(ctx context.Context, model interface{}) error {
+	if e.Policy == nil {
+		return nil
+	}
+	return e.Policy.CanWrite(ctx, model)
+}
+
+func (e *Repository) checkRead(ctx context.Context, row interface{}) error {
+	if e.Policy == nil {
+		return nil
+	}
+	if m, ok := row.(Model); ok {
+		return e.Policy.CanRead(ctx, m)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"context"
+	"errors"
+)
+
+var errSuspendNotSupported = errors.New("transaction manager does not support suspending transactions")
+
+// Suspender 由 TransactionManager 实现, 返回不带 ctx 中当前事务的 ctx (原 ctx 中的事务不受影响),
+// 用于 RequiresNew, NotSupported
+type Suspender interface {
+	Suspend(ctx context.Context) context.Context
+}
+
+func suspend(ctx context.Context, tm TransactionManager) (context.Context, error) {
+	s, ok := tm.(Suspender)
+	if !ok {
+		return nil, errSuspendNotSupported
+	}
+	return s.Suspend(ctx), nil
+}
+
+// RequiresNew 在新的独立事务中执行 fn, 即使 ctx 中已经开启了事务. fn 的提交与回滚和外层事务无关,
+// 如外层事务回滚时仍需保留的审计记录. 新事务使用另一个连接, 外层事务同时持有连接, 连接池较小时可能耗尽;
+// fn 不应修改外层事务已锁定的行, 否则会死锁
+func RequiresNew(ctx context.Context, tm TransactionManager, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	ctx, err := suspend(ctx, tm)
+	if err != nil {
+		return nil, err
+	}
+	return tm.Transaction(ctx, fn)
+}
+
+// NotSupported 挂起 ctx 中的事务, 在事务外执行 fn, fn 中的写入立即生效, 不随外层事务回滚
+func NotSupported(ctx context.Context, tm TransactionManager, fn func(ctx context.Context) error) error {
+	ctx, err := suspend(ctx, tm)
+	if err != nil {
+		return err
+	}
+	return fn(ctx)
+}
+
+// Suspend 参见 Suspender. 外层事务占用的限流名额(参见 DBConfig.MaxConcurrentQueries)由新的事务及事务外的操作共用,
+// 不再重复获取, 否则名额较少时会等待外层事务释放而死锁
+func (tm *transactionManager) Suspend(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, txIdKey{}, "")
+	return tm.setDbWrapper(ctx, nil)
+}
@@ -0,0 +1,222 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Query 一个 Repository 上的查询(不执行), 用于 Union 等组合查询, 也可以链式地构造并执行:
+//
+//	q := repo.Query(nil).Where(fields.Status.Eq(1))
+//	if keyword != "" {
+//		q = q.Where(fields.Name.Contains(keyword))
+//	}
+//	list, err := q.Order(fields.CreateTime.Desc()).Limit(10).Find(ctx)
+//
+// 链式方法返回新的 Query, 不修改原来的. 与 Find 相同, 带有 MandatoryCondition, 租户等条件
+type Query struct {
+	Repo *Repository
+	// Condition 为 nil 表示没有条件
+	Condition Condition
+	Options   []Option
+
+	offset int
+	limit  int
+	paged  bool
+}
+
+// Query 返回 condition, options 在当前 Repository 上的查询, condition 可以为 nil
+func (e *Repository) Query(condition Condition, options ...Option) Query {
+	return Query{Repo: e, Condition: condition, Options: options}
+}
+
+// Where 与已有的条件以 AND 连接
+func (q Query) Where(condition Condition) Query {
+	if q.Condition == nil {
+		q.Condition = condition
+	} else {
+		q.Condition = q.Condition.And(condition)
+	}
+	return q
+}
+
+// With 追加 options
+func (q Query) With(options ...Option) Query {
+	q.Options = append(append([]Option(nil), q.Options...), options...)
+	return q
+}
+
+// Order 追加排序, 如 fields.CreateTime.Desc()
+func (q Query) Order(orders ...Option) Query {
+	return q.With(orders...)
+}
+
+// Limit 代替之前的 Limit
+func (q Query) Limit(limit int) Query {
+	q.limit, q.paged = limit, true
+	return q
+}
+
+// Offset 代替之前的 Offset
+func (q Query) Offset(offset int) Query {
+	if !q.paged {
+		// 没有 Limit, 参见 limitOption.Sql
+		q.limit = -1
+	}
+	q.offset, q.paged = offset, true
+	return q
+}
+
+func (q Query) condition() Condition {
+	if q.Condition == nil {
+		return MatchAll()
+	}
+	return q.Condition
+}
+
+func (q Query) options() []Option {
+	if !q.paged {
+		return q.Options
+	}
+	return append(append([]Option(nil), q.Options...), Limit(q.offset, q.limit))
+}
+
+// Find 参见 Repository.Find
+func (q Query) Find(ctx context.Context) (interface{}, error) {
+	return q.Repo.Find(ctx, q.condition(), q.options()...)
+}
+
+// FindOne 参见 Repository.FindOne. 有 Options 时以 Options 查询第一行(不额外排序)
+func (q Query) FindOne(ctx context.Context) (Model, error) {
+	if len(q.Options) == 0 {
+		return q.Repo.FindOne(ctx, q.condition())
+	}
+	return q.Repo.firstOf(ctx, q.condition(), q.Options)
+}
+
+// Count 参见 Repository.Count
+func (q Query) Count(ctx context.Context) (int, error) {
+	return q.Repo.Count(ctx, q.condition(), q.options()...)
+}
+
+// First 参见 Repository.First, 使用 Options 中的排序
+func (q Query) First(ctx context.Context) (Model, error) {
+	return q.Repo.First(ctx, q.condition(), q.Options...)
+}
+
+// Last 参见 Repository.Last
+func (q Query) Last(ctx context.Context) (Model, error) {
+	return q.Repo.Last(ctx, q.condition(), q.Options...)
+}
+
+// Exists 参见 Repository.Exists
+func (q Query) Exists(ctx context.Context) (bool, error) {
+	return q.Repo.Exists(ctx, q.condition(), q.Options...)
+}
+
+// FindAndCount 参见 Repository.FindAndCount
+func (q Query) FindAndCount(ctx context.Context) (interface{}, int, error) {
+	return q.Repo.FindAndCount(ctx, q.condition(), q.options()...)
+}
+
+// sqlExpr 生成查询的 sql 及参数
+func (q Query) sqlExpr(ctx context.Context) (*gorm.SqlExpr, error) {
+	options := q.options()
+	query, err := q.Repo.parseReadWhere(ctx, q.condition(), options...)
+	if err != nil {
+		return nil, err
+	}
+	if query == nil {
+		return nil, dbNilErr
+	}
+	query = q.Repo.parseOptions(ctx, query.Model(q.Repo.NewStruct()), q.Repo.denySecretColumns(ctx, options)...)
+	return query.QueryExpr(), nil
+}
+
+// UnionQuery 以 UNION [ALL] 合并多个查询, 参见 Union
+type UnionQuery struct {
+	queries []Query
+	all     bool
+}
+
+// Union 以 UNION 合并(并去重)多个 Repository 或条件的查询, 如合并多张表的 feed. 各个查询应在同一数据库,
+// 列的数量及类型一致(表不同时通过 Select 对齐列)
+func Union(queries ...Query) *UnionQuery {
+	return &UnionQuery{queries: queries}
+}
+
+// UnionAll 同 Union, 但不去重
+func UnionAll(queries ...Query) *UnionQuery {
+	return &UnionQuery{queries: queries, all: true}
+}
+
+// Find 执行合并后的查询, 结果写入 dest (struct 的 slice 指针, 列按名称对应字段). options 作用于合并后的结果,
+// 只支持排序(列名为合并后的列)及 Limit
+func (u *UnionQuery) Find(ctx context.Context, dest interface{}, options ...Option) error {
+	if len(u.queries) == 0 {
+		return errors.New("union without query")
+	}
+	op := "UNION"
+	if u.all {
+		op = "UNION ALL"
+	}
+	parts := make([]string, len(u.queries))
+	exprs := make([]interface{}, len(u.queries))
+	for i, q := range u.queries {
+		expr, err := q.sqlExpr(ctx)
+		if err != nil {
+			return err
+		}
+		// sqlite 不支持括号包围的 SELECT, 以子查询的形式合并
+		parts[i] = fmt.Sprintf("SELECT * FROM (?) AS repository_union%d", i)
+		exprs[i] = expr
+	}
+	first := u.queries[0].Repo
+	db := first.getReadDb(ctx, u.queries[0].options()...)
+	if db == nil {
+		return dbNilErr
+	}
+	// gorm 的 Raw 查询会在 sql 之后拼接 ORDER BY, LIMIT, OFFSET
+	query := db.Raw("SELECT * FROM ("+strings.Join(parts, " "+op+" ")+") AS repository_union", exprs...)
+	for _, opt := range options {
+		query = opt.Sql(query)
+	}
+	if err := query.Scan(dest).Error; err != nil {
+		return wrapTimeout(ctx, query, first.TableName(), StmtFind, err)
+	}
+	return decryptFields(ctx, dest)
+}
+
+// FindInto 以 q 为子查询, 按 outer 过滤(可以引用 q 中 Select 的别名, 如窗口函数的结果), 结果写入 dest (struct 的 slice 指针,
+// 列按名称对应字段). options 作用于外层, 只支持排序及 Limit
+func (q Query) FindInto(ctx context.Context, dest interface{}, outer Condition, options ...Option) error {
+	expr, err := q.sqlExpr(ctx)
+	if err != nil {
+		return err
+	}
+	db := q.Repo.getReadDb(ctx, q.options()...)
+	if db == nil {
+		return dbNilErr
+	}
+	sql := "SELECT * FROM (?) AS repository_sub"
+	args := []interface{}{expr}
+	if outer != nil {
+		where, whereArgs := outer.flattenDialect(db.Dialect().GetName())
+		if where != "" {
+			sql += " WHERE " + where
+			args = append(args, whereArgs...)
+		}
+	}
+	query := db.Raw(sql, args...)
+	for _, opt := range options {
+		query = opt.Sql(query)
+	}
+	if err := query.Scan(dest).Error; err != nil {
+		return wrapTimeout(ctx, query, q.Repo.TableName(), "FindInto", err)
+	}
+	return decryptFields(ctx, dest)
+}
@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+	"reflect"
+	"time"
+)
+
+// TopicReadRepair 读修复事件的 topic
+const TopicReadRepair = "repository.read_repair"
+
+// EventPublisher 事件总线的发布端, Publish 应当是异步的(投递到 mq 等), 不应阻塞调用方
+type EventPublisher interface {
+	Publish(ctx context.Context, topic string, event interface{}) error
+}
+
+// ReadModel 数据库之外的读模型, 如缓存, ES
+type ReadModel interface {
+	Name() string
+	// Version 返回读模型中 id 对应数据的版本, found 为 false 表示读模型中没有这条数据
+	Version(ctx context.Context, id interface{}) (version interface{}, found bool, err error)
+}
+
+// RepairEvent 读模型与数据库不一致时发布的事件, 由订阅方负责重建读模型中的数据
+type RepairEvent struct {
+	Table string
+	Id    interface{}
+	Store string
+	// Reason 为 "miss" 或 "mismatch"
+	Reason       string
+	DbVersion    interface{}
+	StoreVersion interface{}
+}
+
+// ReadRepair 配置到 Repository.ReadRepair 后, FindById 读到数据库的数据时, 会异步比对各读模型中的版本,
+// 缺失或版本不一致时发布 RepairEvent
+type ReadRepair struct {
+	// VersionField 数据库中的版本列, 如 version, update_time
+	VersionField FieldInterface
+	Stores       []ReadModel
+	Publisher    EventPublisher
+	// Timeout 单次比对的超时时间, 默认 1s
+	Timeout time.Duration
+}
+
+func (rr *ReadRepair) check(table string, id interface{}, data Model) {
+	f, ok := (&gorm.Scope{}).New(data).FieldByName(rr.VersionField.Column())
+	if !ok {
+		Warn("[repository] read repair version field not found", zap.String("table", table), zap.String("field", rr.VersionField.Column()))
+		return
+	}
+	dbVersion := f.Field.Interface()
+	timeout := rr.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				Error("[repository] panic in read repair", zap.Any("panic", r))
+			}
+		}()
+		// 不使用调用方的 ctx, 请求结束后 ctx 会被 cancel
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		for _, store := range rr.Stores {
+			version, found, err := store.Version(ctx, id)
+			if err != nil {
+				Warn("[repository] read repair get version failed", zap.String("store", store.Name()), zap.Error(err))
+				continue
+			}
+			event := &RepairEvent{
+				Table:        table,
+				Id:           id,
+				Store:        store.Name(),
+				DbVersion:    dbVersion,
+				StoreVersion: version,
+			}
+			if !found {
+				event.Reason = "miss"
+			} else if !reflect.DeepEqual(version, dbVersion) {
+				event.Reason = "mismatch"
+			} else {
+				continue
+			}
+			if err = rr.Publisher.Publish(ctx, TopicReadRepair, event); err != nil {
+				Error("[repository] publish read repair event failed", zap.Any("event", event), zap.Error(err))
+			}
+		}
+	}()
+}
@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	registry     = make(map[reflect.Type]*Repository)
+	registryLock sync.RWMutex
+)
+
+func modelType(model Model) reflect.Type {
+	t := reflect.TypeOf(model)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// Register 以 model 的类型注册一个 NewRepository(model, opts...) 创建的 Repository, 之后通过 For 取得, 保证各处使用相同的选项. 应在初始化时调用, 重复注册时 panic
+func Register(model Model, opts ...RepoOption) *Repository {
+	repo := NewRepository(model, opts...)
+	t := modelType(model)
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[t]; ok {
+		panic(fmt.Sprintf("repository: %s registered twice", t))
+	}
+	registry[t] = repo
+	return repo
+}
+
+// Lookup 返回 model 的类型注册的 Repository
+func Lookup(model Model) (*Repository, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	repo, ok := registry[modelType(model)]
+	return repo, ok
+}
+
+// For 同 Lookup, 未注册时 panic. model 只用于指定类型, 可以是 nil 指针, 如 repository.For((*User)(nil))
+func For(model Model) *Repository {
+	repo, ok := Lookup(model)
+	if !ok {
+		panic(fmt.Sprintf("repository: %s is not registered", modelType(model)))
+	}
+	return repo
+}
@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/jinzhu/gorm"
+)
+
+// LoadRelated 批量加载 parents 的关联数据, 不依赖 gorm 的关联定义: 收集 parents 中 parentKey 的值,
+// 在 childRepo 上执行一条 childKey IN (...) 的查询, 再按 childKey = parentKey 写回 parents.
+//
+// parents 为 model 的 slice (或其指针). 写回的字段按类型确定, parent 中需要恰好有一个类型为
+// child 的 slice (一对多) 或 child 本身(一对一)的导出字段, 例如 Orders []*Order
+func LoadRelated(ctx context.Context, parents interface{}, parentKey FieldInterface, childRepo RepositoryInterface, childKey FieldInterface) error {
+	pv := Indirect(reflect.ValueOf(parents))
+	if pv.Kind() != reflect.Slice && pv.Kind() != reflect.Array {
+		return errors.New("parents should be array or slice")
+	}
+	if pv.Len() == 0 {
+		return nil
+	}
+	rows := make([]reflect.Value, 0, pv.Len())
+	var keys []interface{}
+	seen := make(map[string]bool)
+	for i := 0; i < pv.Len(); i++ {
+		row := pv.Index(i)
+		if row.Kind() != reflect.Ptr {
+			row = row.Addr()
+		}
+		if row.IsNil() {
+			continue
+		}
+		rows = append(rows, row)
+		key, ok := relationKey(row.Interface(), parentKey)
+		if !ok {
+			return fmt.Errorf("column %s not found in %s", parentKey.Column(), row.Type())
+		}
+		if key != nil && !seen[fmt.Sprint(key)] {
+			seen[fmt.Sprint(key)] = true
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	children, err := childRepo.Find(ctx, childKey.In(keys))
+	if err != nil {
+		return err
+	}
+	cv := Indirect(reflect.ValueOf(children))
+	target, many, err := relationTarget(Indirect(rows[0]).Type(), cv.Type().Elem())
+	if err != nil {
+		return err
+	}
+	grouped := make(map[string][]reflect.Value)
+	for i := 0; i < cv.Len(); i++ {
+		child := cv.Index(i)
+		ref := child
+		if ref.Kind() != reflect.Ptr {
+			ref = ref.Addr()
+		}
+		key, ok := relationKey(ref.Interface(), childKey)
+		if !ok {
+			return fmt.Errorf("column %s not found in %s", childKey.Column(), cv.Type().Elem())
+		}
+		if key != nil {
+			grouped[fmt.Sprint(key)] = append(grouped[fmt.Sprint(key)], child)
+		}
+	}
+	for _, row := range rows {
+		key, _ := relationKey(row.Interface(), parentKey)
+		list := grouped[fmt.Sprint(key)]
+		field := Indirect(row).Field(target)
+		if many {
+			slice := reflect.MakeSlice(field.Type(), 0, len(list))
+			slice = reflect.Append(slice, list...)
+			field.Set(slice)
+		} else if len(list) > 0 {
+			field.Set(list[0])
+		}
+	}
+	return nil
+}
+
+// relationKey 返回列的值, 指针为 nil 时返回 nil
+func relationKey(row interface{}, key FieldInterface) (interface{}, bool) {
+	f, ok := (&gorm.Scope{}).New(row).FieldByName(key.Column())
+	if !ok {
+		return nil, false
+	}
+	v := reflect.Indirect(f.Field)
+	if !v.IsValid() {
+		return nil, true
+	}
+	return v.Interface(), true
+}
+
+// relationTarget 在 parentType 中查找类型为 []childType 或 childType 的导出字段
+func relationTarget(parentType, childType reflect.Type) (index int, many bool, err error) {
+	index = -1
+	for i := 0; i < parentType.NumField(); i++ {
+		sf := parentType.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		switch {
+		case sf.Type == childType:
+		case sf.Type.Kind() == reflect.Slice && sf.Type.Elem() == childType:
+			many = true
+		default:
+			continue
+		}
+		if index >= 0 {
+			return 0, false, fmt.Errorf("%s has more than one field of %s", parentType, childType)
+		}
+		index = i
+	}
+	if index < 0 {
+		return 0, false, fmt.Errorf("%s has no field of %s", parentType, childType)
+	}
+	return index, many, nil
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ReloadDrainTimeout 热更新配置后, 等待旧连接池中正在进行的查询和事务结束的最长时间
+var ReloadDrainTimeout = 5 * time.Minute
+
+// ReloadServiceDBConfig 在运行时替换 serviceName 的配置(如轮换数据库密码).
+// 已经初始化的数据库会以新配置建立连接池并立即替换, 新的查询使用新连接池, 进行中的事务在旧连接池上继续,
+// 旧连接池在没有正在使用的连接(或超过 ReloadDrainTimeout)后关闭.
+// 新连接建立失败时返回 error, 配置及连接池都不变
+func ReloadServiceDBConfig(serviceName string, dbConf *DBConfig) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	fresh := make(map[string]*DBInfo)
+	for key, info := range dbRegister {
+		if info.ServiceName != serviceName {
+			continue
+		}
+		dbInfo := &DBInfo{
+			ServiceName: serviceName,
+			DbConfig:    dbConf,
+		}
+		if err := dbInfo.connect(); err != nil {
+			for _, opened := range fresh {
+				_ = opened.Close(context.Background())
+			}
+			return fmt.Errorf("reload %s: %w", key, err)
+		}
+		fresh[key] = dbInfo
+	}
+
+	ServiceConfigMap[serviceName] = dbConf
+	for key, dbInfo := range fresh {
+		old := dbRegister[key]
+		dbRegister[key] = dbInfo
+		go func(key string, old *DBInfo) {
+			ctx, cancel := context.WithTimeout(context.Background(), ReloadDrainTimeout)
+			defer cancel()
+			if err := old.Close(ctx); err != nil {
+				Error("[repository] close db after reload failed", zap.String("db", key), zap.Error(err))
+			}
+		}(key, old)
+	}
+	Info("[repository] reload db config", zap.String("service", serviceName), zap.Int("databases", len(fresh)))
+	return nil
+}
@@ -0,0 +1,202 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"time"
+)
+
+const defaultReplicaLagPollInterval = 5 * time.Second
+
+// LagProbe 在从库上测量复制延迟
+type LagProbe func(db *gorm.DB) (time.Duration, error)
+
+// PgReplayLagProbe 通过 pg_last_xact_replay_timestamp 测量 postgres 从库延迟.
+// 主库长时间没有写入时测得的延迟会偏大, 此时应使用 HeartbeatLagProbe
+func PgReplayLagProbe(db *gorm.DB) (time.Duration, error) {
+	var seconds sql.NullFloat64
+	err := db.Raw("SELECT EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())").Row().Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+	// 不是从库
+	if !seconds.Valid {
+		return 0, nil
+	}
+	return time.Duration(seconds.Float64 * float64(time.Second)), nil
+}
+
+// HeartbeatLagProbe 通过心跳表测量延迟, 主库需要定期写入 column(unix 毫秒时间戳)
+func HeartbeatLagProbe(table, column string) LagProbe {
+	query := fmt.Sprintf("SELECT MAX(%s) FROM %s", column, table)
+	return func(db *gorm.DB) (time.Duration, error) {
+		var ms sql.NullInt64
+		if err := db.Raw(query).Row().Scan(&ms); err != nil {
+			return 0, err
+		}
+		if !ms.Valid {
+			return 0, fmt.Errorf("no heartbeat in %s", table)
+		}
+		return time.Since(time.Unix(0, ms.Int64*int64(time.Millisecond))), nil
+	}
+}
+
+// DefaultLagProbe 用于 DBConfig.LagProbe 为空的情况
+var DefaultLagProbe LagProbe = PgReplayLagProbe
+
+type replica struct {
+	dsn  string
+	conn *gorm.DB
+	// 纳秒, 小于 0 表示未知(尚未测量成功)
+	lag int64
+	// breaker 为 nil 表示未开启熔断
+	breaker *circuitBreaker
+}
+
+func (r *replica) Lag() (time.Duration, bool) {
+	lag := atomic.LoadInt64(&r.lag)
+	return time.Duration(lag), lag >= 0
+}
+
+func (s *DBInfo) initReplicas() error {
+	dbConf := s.DbConfig
+	for _, dsn := range dbConf.Replicas {
+		resolved, _, err := resolveDsn(dbConf, dsn)
+		var db *gorm.DB
+		if err == nil {
+			db, err = gorm.Open(dbConf.Dialect, resolved)
+		}
+		if err != nil {
+			for _, r := range s.replicas {
+				r.conn.Close()
+			}
+			s.replicas = nil
+			return err
+		}
+		applyPoolConfig(db, dbConf)
+		registerStatementCallbacks(db, dbConf)
+		name := fmt.Sprintf("%s:replica%d", s.ServiceName, len(s.replicas))
+		breaker := registerCircuitBreaker(db, dbConf, name, true)
+		registerLimiter(db, dbConf, name, true)
+		s.replicas = append(s.replicas, &replica{dsn: dsn, conn: db, lag: -1, breaker: breaker})
+	}
+	if len(s.replicas) == 0 {
+		return nil
+	}
+	s.pollReplicaLag(nil)
+	interval := dbConf.ReplicaLagPollInterval
+	if interval <= 0 {
+		interval = defaultReplicaLagPollInterval
+	}
+	closed := s.closedChan()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.pollReplicaLag(closed)
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// pollReplicaLag 测量每个从库的延迟, closed 关闭后不再测量(从库连接正在或已经关闭)
+func (s *DBInfo) pollReplicaLag(closed <-chan struct{}) {
+	probe := s.DbConfig.LagProbe
+	if probe == nil {
+		probe = DefaultLagProbe
+	}
+	for _, r := range s.replicas {
+		select {
+		case <-closed:
+			return
+		default:
+		}
+		lag, err := probe(r.conn)
+		if err != nil {
+			Warn("[repository] probe replica lag failed", zap.String("service", s.ServiceName), zap.Error(err))
+			atomic.StoreInt64(&r.lag, -1)
+			continue
+		}
+		atomic.StoreInt64(&r.lag, int64(lag))
+	}
+}
+
+// ReadConn 轮询选择一个从库, 跳过已熔断的从库; maxStaleness > 0 时跳过延迟超过 maxStaleness 或延迟未知的从库, 都不满足时返回主库
+func (s *DBInfo) ReadConn(maxStaleness time.Duration) *gorm.DB {
+	n := len(s.replicas)
+	if n == 0 {
+		return s.Conn
+	}
+	start := atomic.AddUint64(&s.replicaCursor, 1)
+	for i := 0; i < n; i++ {
+		r := s.replicas[(start+uint64(i))%uint64(n)]
+		if r.breaker.isOpen() {
+			continue
+		}
+		if maxStaleness <= 0 {
+			return r.conn
+		}
+		if lag, ok := r.Lag(); ok && lag <= maxStaleness {
+			return r.conn
+		}
+	}
+	return s.Conn
+}
+
+type maxStalenessOption struct {
+	d time.Duration
+}
+
+// MaxStaleness 读从库时可容忍的最大复制延迟, 所有从库延迟都超过 d 时读主库
+func MaxStaleness(d time.Duration) *maxStalenessOption {
+	return &maxStalenessOption{d: d}
+}
+
+// Sql 路由在获取连接时已经处理, 这里不修改查询
+func (mo *maxStalenessOption) Sql(db *gorm.DB) *gorm.DB {
+	return db
+}
+
+// readDbGetter 可选接口, TransactionManager 实现后, Find 等读操作可以路由到从库
+type readDbGetter interface {
+	GetReadDb(ctx context.Context, maxStaleness time.Duration) *gorm.DB
+}
+
+// GetReadDb ctx 中已有连接(事务中)时使用该连接, 读己之写的会话中刚写入过时使用主库, 否则从从库中选择
+func (tm *transactionManager) GetReadDb(ctx context.Context, maxStaleness time.Duration) *gorm.DB {
+	if db := tm.txDb(ctx); db != nil {
+		return db
+	}
+	info := GetDBByDatabaseName(tm.database, tm.serviceName)
+	if stickyPrimary(ctx, tm.databaseKey(), info.DbConfig) {
+		return info.Conn
+	}
+	return info.ReadConn(maxStaleness)
+}
+
+// getReadDb 根据 options 中的 MaxStaleness 选择读连接
+func (e *Repository) getReadDb(ctx context.Context, options ...Option) *gorm.DB {
+	if _, ok := ctx.Value(timedReadKey{tm: e.Tm}).(*gorm.DB); ok {
+		return e.getDb(ctx)
+	}
+	rg, ok := e.Tm.(readDbGetter)
+	if !ok {
+		return e.getDb(ctx)
+	}
+	var maxStaleness time.Duration
+	for _, opt := range options {
+		if mo, ok := opt.(*maxStalenessOption); ok {
+			maxStaleness = mo.d
+		}
+	}
+	return e.withTable(ctx, rg.GetReadDb(ctx, maxStaleness))
+}
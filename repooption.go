@@ -0,0 +1,55 @@
+package repository
+
+// RepoOption NewRepository 的选项, 按顺序应用
+type RepoOption func(*Repository)
+
+// RepoTransactionManager 使用 tm, 默认为 NewTransactionManager("", "")
+func RepoTransactionManager(tm TransactionManager) RepoOption {
+	return func(e *Repository) {
+		e.Tm = tm
+	}
+}
+
+// RepoDatabase 使用 serviceName/database 的 TransactionManager, 参见 SetServiceDBConfig
+func RepoDatabase(serviceName, database string) RepoOption {
+	return func(e *Repository) {
+		e.Tm = NewTransactionManager(serviceName, database)
+	}
+}
+
+// RepoMandatoryCondition 与已有的 MandatoryCondition 以 AND 连接
+func RepoMandatoryCondition(condition Condition) RepoOption {
+	return func(e *Repository) {
+		if e.MandatoryCondition == nil {
+			e.MandatoryCondition = condition
+		} else {
+			e.MandatoryCondition = e.MandatoryCondition.And(condition)
+		}
+	}
+}
+
+// RepoSoftDelete 软删除, 只查询 field = 0 的行. 删除时写入的列由 model 的 SoftDeleteHook 决定
+func RepoSoftDelete(field FieldInterface) RepoOption {
+	return RepoMandatoryCondition(field.Eq(0))
+}
+
+// RepoPrimaryField 参见 Repository.SetPrimaryField
+func RepoPrimaryField(f FieldInterface) RepoOption {
+	return func(e *Repository) {
+		e.SetPrimaryField(f)
+	}
+}
+
+// RepoLogger 参见 Repository.SetLogger
+func RepoLogger(l QueryLogger) RepoOption {
+	return func(e *Repository) {
+		e.SetLogger(l)
+	}
+}
+
+// RepoMetrics 当前 Repository 的指标记录到 m, 代替 SetMetrics 设置的全局 Metrics
+func RepoMetrics(m Metrics) RepoOption {
+	return func(e *Repository) {
+		e.Metrics = m
+	}
+}
@@ -3,9 +3,11 @@ package repository
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/jinzhu/gorm"
-	"go.uber.org/zap"
 	"reflect"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -24,6 +26,52 @@ type Repository struct {
 	DeleteFunc func(ctx context.Context, condition Condition) (err error)
 	// MandatoryCondition 是固有的 where 条件, 通常用来过滤 is_delete=0 的数据(软删除逻辑, 外界可以不用感知, 且每个 where 条件都有)
 	MandatoryCondition Condition
+	// ReadRepair 可选, 配置后 FindById 会异步检查缓存/ES 等读模型的一致性
+	ReadRepair *ReadRepair
+
+	// TenantResolver 可选, 配置后每个查询都会加上 TenantField = 租户, Create 时写入租户.
+	// ctx 中没有租户(返回 error)时操作失败
+	TenantResolver func(ctx context.Context) (interface{}, error)
+	// TenantField 租户列, 默认 tenant_id
+	TenantField FieldInterface
+	// QueryCache 可选, 配置后 Find 优先读取缓存, 参见 PreloadCache
+	QueryCache QueryCache
+	// OptimizeConditions 为 true 时, 生成 sql 前先用 Optimize 简化条件
+	OptimizeConditions bool
+	// Interceptors 仅对当前 Repository 生效的拦截器, 参见 QueryInterceptor
+	Interceptors []QueryInterceptor
+	// SlowQueryThreshold 大于 0 时代替 DBConfig.SlowQueryThreshold, 参见 SetSlowQueryHandler
+	SlowQueryThreshold time.Duration
+	// QueryLogger 为空时使用 SetQueryLogger 设置的全局 logger, 设置为 NopQueryLogger 可关闭当前 Repository 的 sql 日志
+	QueryLogger QueryLogger
+	// BatchSize 批量写入每批的行数, 0 表示根据耗时自动调整(初始 500), 都不会超过 dialect 的参数个数限制
+	BatchSize int
+	// BatchTargetLatency 自动调整时每批的目标耗时, 默认 200ms
+	BatchTargetLatency time.Duration
+	// Partition 可选, 按时间范围分区的表, 参见 EnsurePartitions
+	Partition *PartitionSpec
+	// ChangeNotifier 可选, 配置后 Create/Save/Update/Delete 成功(事务提交)后发布 ChangeEvent
+	ChangeNotifier *ChangeNotifier
+	// AuditSink 可选, 配置后写操作成功(事务提交)后写入脱敏的 AuditRecord
+	AuditSink AuditSink
+	// Policy 可选, 行级权限策略, 参见 Policy
+	Policy Policy
+	// Shadow 可选, 把写操作镜像到影子表, 参见 ShadowWrite
+	Shadow *ShadowWrite
+	// Enums 可选, 写入时校验取值的列, 参见 EnumField
+	Enums []*EnumField
+	// Metrics 可选, 代替 SetMetrics 设置的全局 Metrics
+	Metrics Metrics
+	// InChunkSize FindByIds, 及 Find/Count 中以 AND 连接的 In 条件每条语句的值的个数, 超过时拆分为多条语句并合并结果,
+	// 0 表示 1000, 小于 0 表示不拆分. Find 有分组, 聚合等无法合并的 options 时不拆分; Update/Delete 不拆分
+	InChunkSize int
+
+	// table 不为空时代替 Value.TableName(), 如临时表
+	table string
+	// callbacks 参见 RegisterCallback
+	callbacks map[CallbackPhase][]callbackEntry
+	// primaryField 参见 SetPrimaryField
+	primaryField FieldInterface
 }
 
 // implements hint
@@ -81,7 +129,10 @@ type RepositoryInterface interface {
 	FindByIds(ctx context.Context, ids interface{}, additional ...Condition) (interface{}, error)
 	Find(ctx context.Context, condition Condition, options ...Option) (interface{}, error)
 	FindAndCount(ctx context.Context, condition Condition, options ...Option) (interface{}, int, error)
-	Count(ctx context.Context, condition Condition) (int, error)
+	// options 支持 Join, GroupBy (返回分组数)及 Select(Distinct(...)), 忽略排序及 Limit
+	Count(ctx context.Context, condition Condition, options ...Option) (int, error)
+	// 是否存在满足条件的行, options 同 Count
+	Exists(ctx context.Context, condition Condition, options ...Option) (bool, error)
 	Create(ctx context.Context, model Model) error
 
 	// update when PK has value, or create when PK is zero
@@ -99,13 +150,16 @@ type RepositoryInterface interface {
 	SetDeleteFunc(func(context.Context, Condition) error)
 }
 
-func NewRepository(model Model) *Repository {
+// NewRepository 创建 model 的 Repository, opts 在默认值之上按顺序应用, 如
+//
+//	repo := NewRepository(&User{}, RepoTransactionManager(tm), RepoSoftDelete(fields.IsDeleted), RepoLogger(logger))
+func NewRepository(model Model, opts ...RepoOption) *Repository {
 	repo0 := &Repository{
 		Value: model,
 	}
 	repo0.Tm = NewTransactionManager("", "")
 	repo0.SetCreateFunc(func(ctx context.Context, data Model) error {
-		db := repo0.Tm.GetDb(ctx)
+		db := repo0.getDb(ctx)
 		if db == nil {
 			return dbNilErr
 		}
@@ -117,15 +171,15 @@ func NewRepository(model Model) *Repository {
 		if err := es.beforeRepoCreateCallback(ctx, data); err != nil {
 			return err
 		}
-		err := db.Create(data).Error
+		err := writeColumns(ctx, db).Create(data).Error
 		if err != nil {
-			return err
+			return restorePlaintext(ctx, data, err)
 		}
 		return es.afterRepoCreateCallback(ctx, data)
 	})
 
 	repo0.SetSaveFunc(func(ctx context.Context, data Model) error {
-		db := repo0.Tm.GetDb(ctx)
+		db := repo0.getDb(ctx)
 		if db == nil {
 			return dbNilErr
 		}
@@ -138,8 +192,8 @@ func NewRepository(model Model) *Repository {
 			if err := es.beforeRepoCreateCallback(ctx, data); err != nil {
 				return err
 			}
-			if err := db.Create(data).Error; err != nil {
-				return err
+			if err := writeColumns(ctx, db).Create(data).Error; err != nil {
+				return restorePlaintext(ctx, data, err)
 			}
 			return es.afterRepoCreateCallback(ctx, data)
 		}
@@ -147,14 +201,21 @@ func NewRepository(model Model) *Repository {
 		if err := es.beforeRepoUpdateCallback(ctx, data); err != nil {
 			return err
 		}
-		if err := db.Model(repo0.NewStruct()).Updates(data).Error; err != nil {
-			return err
+		db, err := repo0.tenantScoped(ctx, db)
+		if err != nil {
+			return restorePlaintext(ctx, data, err)
+		}
+		if err := writeColumns(ctx, db).Model(repo0.NewStruct()).Updates(data).Error; err != nil {
+			return restorePlaintext(ctx, data, err)
 		}
 		return es.afterRepoUpdateCallback(ctx, data)
 	})
 
 	repo0.SetUpdateFunc(func(ctx context.Context, update interface{}, condition Condition) error {
-		query := repo0.parseWhere(ctx, condition)
+		query, err := repo0.parseWhere(ctx, condition)
+		if err != nil {
+			return err
+		}
 		if query == nil {
 			return dbNilErr
 		}
@@ -166,31 +227,50 @@ func NewRepository(model Model) *Repository {
 		if err := es.beforeRepoUpdateCallback(ctx, update); err != nil {
 			return err
 		}
-		return query.Model(repo0.NewStruct()).Updates(update).Error
+		res := writeColumns(ctx, query).Model(repo0.NewStruct()).Updates(update)
+		if res.Error != nil {
+			_ = decryptUpdate(ctx, repo0.Value, update)
+			return res.Error
+		}
+		recordRowsAffected(ctx, res.RowsAffected)
+		return decryptUpdate(ctx, repo0.Value, update)
 	})
 	if _, ok := model.(SoftDeleteHook); ok {
 		repo0.SetDeleteFunc(func(ctx context.Context, condition Condition) error {
-			query := repo0.parseWhere(ctx, condition)
+			query, err := repo0.parseWhere(ctx, condition)
+			if err != nil {
+				return err
+			}
 			if query == nil {
 				return dbNilErr
 			}
 			val := repo0.NewStruct()
-			err := (val.(SoftDeleteHook)).BeforeSoftDelete(ctx)
+			err = (val.(SoftDeleteHook)).BeforeSoftDelete(ctx)
 			if err != nil {
 				return err
 			}
-			return query.Model(val).Updates(val).Error
+			res := query.Model(val).Updates(val)
+			recordRowsAffected(ctx, res.RowsAffected)
+			return res.Error
 		})
 	} else {
 		repo0.SetDeleteFunc(func(ctx context.Context, condition Condition) error {
-			query := repo0.parseWhere(ctx, condition)
+			query, err := repo0.parseWhere(ctx, condition)
+			if err != nil {
+				return err
+			}
 			if query == nil {
 				return dbNilErr
 			}
-			return query.Delete(repo0.NewStruct()).Error
+			res := query.Delete(repo0.NewStruct())
+			recordRowsAffected(ctx, res.RowsAffected)
+			return res.Error
 		})
 	}
 
+	for _, opt := range opts {
+		opt(repo0)
+	}
 	return repo0
 }
 
@@ -198,7 +278,7 @@ func ParseWhere(condition Condition, db *gorm.DB) *gorm.DB {
 	if db == nil {
 		return nil
 	}
-	sql, args := condition.flatten()
+	sql, args := condition.flattenDialect(db.Dialect().GetName())
 	if sql == "" {
 		// no where clause
 		return db
@@ -206,17 +286,90 @@ func ParseWhere(condition Condition, db *gorm.DB) *gorm.DB {
 	return db.Where(sql, args...)
 }
 
-func (e *Repository) parseWhere(ctx context.Context, condition Condition) *gorm.DB {
+// mandatory 加上 MandatoryCondition, 租户条件及 Policy 的 ReadFilter
+func (e *Repository) mandatory(ctx context.Context, condition Condition) (Condition, error) {
+	if err := conditionErr(condition); err != nil {
+		return nil, err
+	}
 	if e.MandatoryCondition != nil {
 		condition = condition.And(e.MandatoryCondition)
 	}
-	return ParseWhere(condition, e.Tm.GetDb(ctx))
+	if e.TenantResolver != nil {
+		tc, err := e.tenantCondition(ctx)
+		if err != nil {
+			return nil, err
+		}
+		condition = condition.And(tc)
+	}
+	condition, err := e.policyFilter(ctx, condition)
+	if err != nil {
+		return nil, err
+	}
+	if e.OptimizeConditions {
+		condition = Optimize(condition)
+	}
+	return condition, nil
+}
+
+// parseWhere 返回的 db 为 nil (且 error 为 nil) 表示没有获取到连接
+func (e *Repository) parseWhere(ctx context.Context, condition Condition) (*gorm.DB, error) {
+	condition, err := e.mandatory(ctx, condition)
+	if err != nil {
+		return nil, err
+	}
+	return ParseWhere(condition, e.getDb(ctx)), nil
+}
+
+// parseReadWhere 同 parseWhere, 但事务外可能路由到从库
+func (e *Repository) parseReadWhere(ctx context.Context, condition Condition, options ...Option) (*gorm.DB, error) {
+	condition, err := e.mandatory(ctx, condition)
+	if err != nil {
+		return nil, err
+	}
+	return ParseWhere(condition, e.getReadDb(ctx, options...)), nil
 }
 
 func (e *Repository) parseOptions(ctx context.Context, db *gorm.DB, options ...Option) *gorm.DB {
+	var hints, indexes []string
+	var sel *selectOption
 	for _, opt := range options {
+		switch o := opt.(type) {
+		case *hintOption:
+			hints = append(hints, o.hint)
+		case *useIndexOption:
+			indexes = append(indexes, o.indexes...)
+		case *selectOption:
+			sel = o
+		}
 		db = opt.Sql(db)
 	}
+	if hint := maxExecutionTimeHint(ctx, db, options); hint != "" {
+		hints = append(hints, hint)
+	}
+	if len(indexes) > 0 {
+		table := e.tableFor(ctx)
+		switch db.Dialect().GetName() {
+		case DialectMysql:
+			db = db.Table(db.Dialect().Quote(table) + " USE INDEX (" + strings.Join(indexes, ", ") + ")")
+		case DialectSqlite3:
+			db = db.Table(db.Dialect().Quote(table) + " INDEXED BY " + indexes[0])
+		default:
+			hints = append(hints, fmt.Sprintf("IndexScan(%s %s)", table, strings.Join(indexes, " ")))
+		}
+	}
+	if len(hints) > 0 {
+		// mysql 的 optimizer hint 及 pg_hint_plan 都支持紧跟在 SELECT 之后的注释
+		cols := "*"
+		var args []interface{}
+		if sel != nil {
+			var list []string
+			for _, c := range sel.columns {
+				list = append(list, c.Column())
+			}
+			cols, args = strings.Join(list, ", "), sel.args
+		}
+		db = db.Select("/*+ "+strings.Join(hints, " ")+" */ "+cols, args...)
+	}
 	return db
 }
 
@@ -224,38 +377,122 @@ func (e *Repository) GetTM() TransactionManager {
 	return e.Tm
 }
 
+// getDb 获取连接, 并应用 table
+func (e *Repository) getDb(ctx context.Context) *gorm.DB {
+	if tx, ok := ctx.Value(timedReadKey{tm: e.Tm}).(*gorm.DB); ok {
+		return e.withTable(ctx, tx)
+	}
+	return e.withTable(ctx, e.Tm.GetDb(ctx))
+}
+
+// TableName 实际操作的表名
+func (e *Repository) TableName() string {
+	if e.table != "" {
+		return e.table
+	}
+	return e.Value.TableName()
+}
+
+func (e *Repository) withTable(ctx context.Context, db *gorm.DB) *gorm.DB {
+	if db == nil {
+		return db
+	}
+	db = e.withStatementValues(ctx, db)
+	if table := e.tableFor(ctx); table != e.Value.TableName() {
+		return db.Table(table)
+	}
+	return db
+}
+
 func (e *Repository) FindOne(ctx context.Context, condition Condition) (data Model, err error) {
+	err = e.intercept(ctx, &StatementInfo{Op: StmtFindOne, Condition: condition}, func(ctx context.Context, stmt *StatementInfo) error {
+		var err error
+		if e.routed(ctx) {
+			data, err = e.findOneRouted(ctx, stmt.Condition)
+			return err
+		}
+		data, err = e.findOne(ctx, stmt.Condition)
+		return err
+	})
+	return
+}
 
-	startTime := time.Now()
-	defer func() {
-		s, _ := condition.flatten()
-		Info("[loadlog][sql] FindOne", zap.Any("key", ctx.Value("key")), zap.String("table", e.Value.TableName()), zap.String("condition", s), zap.Int64("request_time", time.Since(startTime).Milliseconds()))
-	}()
+// FindOneOrNil 同 FindOne, 但不存在时返回 (nil, false, nil), 调用方不需要再判断 IsRecordNotFound
+func (e *Repository) FindOneOrNil(ctx context.Context, condition Condition) (Model, bool, error) {
+	data, err := e.FindOne(ctx, condition)
+	if IsRecordNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
 
+func (e *Repository) findOne(ctx context.Context, condition Condition) (data Model, err error) {
 	data = e.NewStruct().(Model)
-	db := e.parseWhere(ctx, condition)
+	db, err := e.parseWhere(ctx, condition)
+	if err != nil {
+		return nil, err
+	}
 	if db == nil {
 		return nil, dbNilErr
 	}
+	db = e.parseOptions(ctx, db, e.denySecretColumns(ctx, nil)...)
 
 	err = db.Take(data).Error
 	if err != nil {
+		return nil, wrapTimeout(ctx, db, e.TableName(), "FindOne", err)
+	}
+	if err = decryptFields(ctx, data); err != nil {
+		return nil, err
+	}
+	if err = e.afterFindCallback(ctx, data); err != nil {
 		return nil, err
 	}
 	return
 }
 
-func (e *Repository) Count(ctx context.Context, condition Condition) (total int, err error) {
-	query := e.parseWhere(ctx, condition)
-	if query == nil {
-		return 0, nil
-	}
-	err = query.Model(e.NewStruct()).Count(&total).Error
+func (e *Repository) Count(ctx context.Context, condition Condition, options ...Option) (total int, err error) {
+	err = e.intercept(ctx, &StatementInfo{Op: StmtCount, Condition: condition, Options: options}, func(ctx context.Context, stmt *StatementInfo) error {
+		if e.routed(ctx) {
+			var err error
+			total, err = e.countRouted(ctx, stmt.Condition, stmt.Options...)
+			return err
+		}
+		n, chunked, err := e.countInChunks(ctx, stmt.Condition, stmt.Options)
+		if !chunked {
+			n, err = e.count(ctx, stmt.Condition, stmt.Options...)
+		}
+		total = n
+		return err
+	})
+	return
+}
+
+func (e *Repository) count(ctx context.Context, condition Condition, options ...Option) (total int, err error) {
+	err = e.withStatementTimeout(ctx, options, func(ctx context.Context) error {
+		query, err := e.parseWhere(ctx, condition)
+		if err != nil || query == nil {
+			return err
+		}
+		if hint := maxExecutionTimeHint(ctx, query, options); hint != "" && !grouped(options) {
+			// gorm 的 Count 会把 Select 替换为 count(*), 丢掉 parseOptions 加上的 hint
+			query = e.parseOptions(ctx, query.Model(e.NewStruct()), countSelect(countOptions(options))...)
+			return wrapTimeout(ctx, query, e.TableName(), "Count", query.Row().Scan(&total))
+		}
+		query = e.parseOptions(ctx, query.Model(e.NewStruct()), countOptions(options)...)
+		return wrapTimeout(ctx, query, e.TableName(), "Count", query.Count(&total).Error)
+	})
 	return
 
 }
 func (e *Repository) FindAndCount(ctx context.Context, condition Condition, options ...Option) (slice interface{}, total int, err error) {
-	total, err = e.Count(ctx, condition)
+	if co := cachedOptionOf(options); co != nil && e.QueryCache != nil {
+		total, err = e.countResultCached(ctx, co, condition, options)
+	} else {
+		total, err = e.Count(ctx, condition, options...)
+	}
 	if err != nil {
 		return
 	}
@@ -268,42 +505,174 @@ func (e *Repository) FindAndCount(ctx context.Context, condition Condition, opti
 }
 
 func (e *Repository) Find(ctx context.Context, condition Condition, options ...Option) (slice interface{}, err error) {
+	err = e.intercept(ctx, &StatementInfo{Op: StmtFind, Condition: condition, Options: options}, func(ctx context.Context, stmt *StatementInfo) error {
+		var err error
+		if co := cachedOptionOf(stmt.Options); co != nil && e.QueryCache != nil {
+			slice, err = e.findResultCached(ctx, co, stmt.Condition, stmt.Options)
+			return err
+		}
+		if cached, ok, err := e.cachedFind(ctx, stmt.Condition, stmt.Options...); ok {
+			slice = cached
+			return err
+		}
+		if e.routed(ctx) {
+			slice, err = e.findRouted(ctx, stmt.Condition, stmt.Options)
+			return err
+		}
+		var chunked bool
+		if slice, chunked, err = e.findInChunks(ctx, stmt.Condition, stmt.Options); !chunked {
+			slice, err = e.findNoCache(ctx, stmt.Condition, stmt.Options...)
+		}
+		return err
+	})
+	if slice == nil {
+		slice = e.NewSlice()
+	}
+	return
+}
 
-	startTime := time.Now()
-	defer func() {
-		s, _ := condition.flatten()
-		Info("[loadlog][sql] Find", zap.Any("key", ctx.Value("key")), zap.String("table", e.Value.TableName()), zap.String("condition", s), zap.Int64("request_time", time.Since(startTime).Milliseconds()))
-	}()
-
+func (e *Repository) findNoCache(ctx context.Context, condition Condition, options ...Option) (slice interface{}, err error) {
 	slice = e.NewSlice()
-	query := e.parseWhere(ctx, condition)
-	if query == nil {
+	err = e.withStatementTimeout(ctx, options, func(ctx context.Context) error {
+		query, err := e.parseReadWhere(ctx, condition, options...)
+		if err != nil || query == nil {
+			return err
+		}
+		query = e.parseOptions(ctx, query, e.denySecretColumns(ctx, options)...)
+		if cte, err := e.findWithCTE(ctx, query, options, slice); cte || err != nil {
+			return wrapTimeout(ctx, query, e.TableName(), "Find", err)
+		}
+		if err = query.Find(slice).Error; err != nil {
+			return wrapTimeout(ctx, query, e.TableName(), "Find", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if err = decryptFields(ctx, slice); err != nil {
 		return
 	}
-	query = e.parseOptions(ctx, query, options...)
-	err = query.Find(slice).Error
+	if raw, _ := ctx.Value(rawFindKey{}).(bool); raw {
+		return
+	}
+	err = e.afterFindCallback(ctx, slice)
 	return
 }
 
+// FindInto 同 Find, 但把结果写入 dest (任意 struct 的 slice 指针, 或 struct 指针), 列按名称对应字段,
+// 用于 Select/SelectExpr 的结果与 Model 不一致的场景, 例如统计报表. 不使用 QueryCache
+func (e *Repository) FindInto(ctx context.Context, dest interface{}, condition Condition, options ...Option) error {
+	return e.intercept(ctx, &StatementInfo{Op: StmtFind, Condition: condition, Options: options}, func(ctx context.Context, stmt *StatementInfo) error {
+		return e.withStatementTimeout(ctx, stmt.Options, func(ctx context.Context) error {
+			query, err := e.parseReadWhere(ctx, stmt.Condition, stmt.Options...)
+			if err != nil || query == nil {
+				return err
+			}
+			query = e.parseOptions(ctx, query.Model(e.NewStruct()), e.denySecretColumns(ctx, stmt.Options)...)
+			if err = query.Scan(dest).Error; err != nil {
+				return wrapTimeout(ctx, query, e.TableName(), "FindInto", err)
+			}
+			return decryptFields(ctx, dest)
+		})
+	})
+}
+
+// FindProjected 只查询 mapping 中的列, 以 mapping 的值为别名写入 dest (任意 struct 的 slice 指针, 或 struct 指针),
+// 别名为 dest 字段的列名(gorm 的命名, 如 UserName -> user_name). 用于列表接口只需要少量列的场景, 例如
+//
+//	var items []OrderItem
+//	err := repo.FindProjected(ctx, &items, map[FieldInterface]string{fields.Id: "id", fields.Amount: "total"}, cond, Limit(0, 20))
+//
+// options 中的 Select 会被覆盖
+func (e *Repository) FindProjected(ctx context.Context, dest interface{}, mapping map[FieldInterface]string, condition Condition, options ...Option) error {
+	if len(mapping) == 0 {
+		return errors.New("FindProjected without columns")
+	}
+	cols := make([]FieldInterface, 0, len(mapping))
+	for f, alias := range mapping {
+		cols = append(cols, As(f, alias))
+	}
+	// map 的顺序不固定, 按列排序以生成稳定的 sql
+	sort.Slice(cols, func(i, j int) bool {
+		return cols[i].Column() < cols[j].Column()
+	})
+	return e.FindInto(ctx, dest, condition, append(append([]Option(nil), options...), Select(cols...))...)
+}
+
 func (e *Repository) FindById(ctx context.Context, id interface{}) (data Model, err error) {
-	data, err = e.FindOne(ctx, _Id.Eq(id))
+	data, err = e.FindOne(ctx, e.PrimaryField().Eq(id))
+	if err == nil && e.ReadRepair != nil {
+		e.ReadRepair.check(e.TableName(), id, data)
+	}
 	return
 }
 
 func (e *Repository) Save(ctx context.Context, model Model) error {
-	return e.SaveFunc(ctx, model)
+	if err := e.validate(ctx, model); err != nil {
+		return err
+	}
+	if err := e.checkWrite(ctx, model); err != nil {
+		return err
+	}
+	ctx, err := e.routeCreate(ctx, model)
+	if err != nil {
+		return err
+	}
+	created := (&gorm.Scope{}).New(model).PrimaryKeyZero()
+	return e.intercept(ctx, &StatementInfo{Op: StmtSave, Model: model}, func(ctx context.Context, stmt *StatementInfo) error {
+		if err := e.wrapTimeout(ctx, StmtSave, e.SaveFunc(ctx, model)); err != nil {
+			return err
+		}
+		e.afterWrite(ctx, stmt, created)
+		e.shadowSave(ctx, model, created)
+		return nil
+	})
 }
 
 func (e Repository) Create(ctx context.Context, model Model) error {
-	startTime := time.Now()
-	defer func() {
-		Info("[loadlog][sql] Create", zap.Any("key", ctx.Value("key")), zap.String("table", e.Value.TableName()), zap.Any("model", model), zap.Int64("request_time", time.Since(startTime).Milliseconds()))
-	}()
-	return e.CreateFunc(ctx, model)
+	if err := e.validate(ctx, model); err != nil {
+		return err
+	}
+	if err := e.checkWrite(ctx, model); err != nil {
+		return err
+	}
+	ctx, err := e.routeCreate(ctx, model)
+	if err != nil {
+		return err
+	}
+	return e.intercept(ctx, &StatementInfo{Op: StmtCreate, Model: model}, func(ctx context.Context, stmt *StatementInfo) error {
+		if err := e.wrapTimeout(ctx, StmtCreate, e.CreateFunc(ctx, model)); err != nil {
+			return err
+		}
+		e.afterWrite(ctx, stmt, true)
+		e.shadowCreate(ctx, model)
+		return nil
+	})
 }
 
 func (e *Repository) Update(ctx context.Context, update interface{}, condition Condition) error {
-	return e.UpdateFunc(ctx, update, condition)
+	if err := e.validateEnums(updateColumnMap(update)); err != nil {
+		return err
+	}
+	if err := e.checkWrite(ctx, update); err != nil {
+		return err
+	}
+	return e.intercept(ctx, &StatementInfo{Op: StmtUpdate, Condition: condition, Model: update}, func(ctx context.Context, stmt *StatementInfo) error {
+		rows := func() int64 { return -1 }
+		if e.Shadow != nil {
+			ctx, rows = trackRows(ctx)
+		}
+		err := e.routeWrite(ctx, stmt.Condition, func(ctx context.Context) error {
+			return e.UpdateFunc(ctx, stmt.Model, stmt.Condition)
+		})
+		if err := e.wrapTimeout(ctx, StmtUpdate, err); err != nil {
+			return err
+		}
+		e.afterWrite(ctx, stmt, false)
+		e.shadowUpdate(ctx, stmt.Model, stmt.Condition, rows())
+		return nil
+	})
 }
 
 func (e *Repository) Delete(ctx context.Context, condition Condition) error {
@@ -312,44 +681,180 @@ func (e *Repository) Delete(ctx context.Context, condition Condition) error {
 	// return errors.New("delete without condition is not allowed")
 	// }
 	// gorm 默认会阻止 没有 where 条件的 update 和 delete
-	return e.DeleteFunc(ctx, condition)
+	if err := e.checkWrite(ctx, nil); err != nil {
+		return err
+	}
+	return e.intercept(ctx, &StatementInfo{Op: StmtDelete, Condition: condition}, func(ctx context.Context, stmt *StatementInfo) error {
+		rows := func() int64 { return -1 }
+		if e.Shadow != nil {
+			ctx, rows = trackRows(ctx)
+		}
+		err := e.routeWrite(ctx, stmt.Condition, func(ctx context.Context) error {
+			return e.DeleteFunc(ctx, stmt.Condition)
+		})
+		if err := e.wrapTimeout(ctx, StmtDelete, err); err != nil {
+			return err
+		}
+		e.afterWrite(ctx, stmt, false)
+		e.shadowDelete(ctx, stmt.Condition, rows())
+		return nil
+	})
+}
+
+// DeleteReturningIds 同 Delete, 返回被删除的行的主键.
+// 在事务中先锁定(sqlite 除外)并查出命中的主键, 再按主键删除, 软删除和 DeleteFunc 照常生效
+func (e *Repository) DeleteReturningIds(ctx context.Context, condition Condition) (ids []interface{}, err error) {
+	if e.routed(ctx) {
+		return nil, fmt.Errorf("DeleteReturningIds on partitioned %s is not supported", e.TableName())
+	}
+	_, err = e.Tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		query, err := e.parseWhere(ctx, condition)
+		if err != nil {
+			return nil, err
+		}
+		if query == nil {
+			return nil, dbNilErr
+		}
+		if query.Dialect().GetName() != DialectSqlite3 {
+			query = query.Set("gorm:query_option", "FOR UPDATE")
+		}
+		ids = nil
+		if err = query.Model(e.NewStruct()).Pluck(e.PrimaryField().Column(), &ids).Error; err != nil {
+			return nil, wrapTimeout(ctx, query, e.TableName(), StmtDelete, err)
+		}
+		if len(ids) == 0 {
+			return nil, nil
+		}
+		return nil, e.Delete(ctx, e.PrimaryField().In(ids))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// SetPrimaryField 设置主键列, 如 uuid, order_no. FindById/FindByIds/DeleteById/DeleteByIds 等按主键的操作使用该列
+func (e *Repository) SetPrimaryField(f FieldInterface) {
+	e.primaryField = f
+}
+
+// PrimaryField 主键列: SetPrimaryField 设置的列, 否则为 gorm 识别的主键(primary_key tag 或 Id 字段), 都没有时为 id
+func (e *Repository) PrimaryField() FieldInterface {
+	if e.primaryField != nil {
+		return e.primaryField
+	}
+	if key := (&gorm.Scope{}).New(e.NewStruct()).PrimaryKey(); key != "" {
+		return SimpleField(key)
+	}
+	return _Id
+}
+
+// primaryValue model 的主键值, 主键为零值时 ok 为 false
+func (e *Repository) primaryValue(model interface{}) (id interface{}, ok bool) {
+	f, found := (&gorm.Scope{}).New(model).FieldByName(e.PrimaryField().Column())
+	if !found || f.IsBlank {
+		return nil, false
+	}
+	return f.Field.Interface(), true
 }
 
 func (e *Repository) DeleteById(ctx context.Context, id interface{}) (err error) {
 	val := e.NewStruct()
-	if sdi, ok := val.(SoftDeleteHook); ok {
-		return e.softDeleteById(ctx, id, sdi)
+	sdi, ok := val.(SoftDeleteHook)
+	if !ok {
+		return e.Delete(ctx, e.PrimaryField().Eq(id))
+	}
+	if err = e.checkWrite(ctx, nil); err != nil {
+		return err
 	}
-	return e.DeleteFunc(ctx, _Id.Eq(id))
+	return e.intercept(ctx, &StatementInfo{Op: StmtDelete, Condition: e.PrimaryField().Eq(id), Model: val}, func(ctx context.Context, stmt *StatementInfo) error {
+		rows := func() int64 { return -1 }
+		if e.Shadow != nil {
+			ctx, rows = trackRows(ctx)
+		}
+		err := e.routeWrite(ctx, stmt.Condition, func(ctx context.Context) error {
+			return e.softDeleteById(ctx, id, stmt.Condition, sdi)
+		})
+		if err := e.wrapTimeout(ctx, StmtDelete, err); err != nil {
+			return err
+		}
+		e.afterWrite(ctx, stmt, false)
+		e.shadowDelete(ctx, stmt.Condition, rows())
+		return nil
+	})
 }
 
-func (e *Repository) softDeleteById(ctx context.Context, id interface{}, model SoftDeleteHook) (err error) {
-	db := e.Tm.GetDb(ctx)
-	if f, ok := db.NewScope(model).FieldByName("id"); ok {
-		err = f.Set(id)
-		if err != nil {
-			return
+// DeleteByIds 删除 ids 对应的行, 只执行一条语句. 软删除时 BeforeSoftDelete/AfterSoftDelete 只调用一次.
+// ids 为 nil 或不是 slice 时不删除
+func (e *Repository) DeleteByIds(ctx context.Context, ids interface{}) error {
+	if idsLen(ids) == 0 {
+		return nil
+	}
+	val := e.NewStruct()
+	sdi, ok := val.(SoftDeleteHook)
+	if !ok {
+		return e.Delete(ctx, e.PrimaryField().In(ids))
+	}
+	if err := e.checkWrite(ctx, nil); err != nil {
+		return err
+	}
+	return e.intercept(ctx, &StatementInfo{Op: StmtDelete, Condition: e.PrimaryField().In(ids), Model: val}, func(ctx context.Context, stmt *StatementInfo) error {
+		rows := func() int64 { return -1 }
+		if e.Shadow != nil {
+			ctx, rows = trackRows(ctx)
+		}
+		err := e.routeWrite(ctx, stmt.Condition, func(ctx context.Context) error {
+			return e.softDeleteByIds(ctx, stmt.Condition, sdi)
+		})
+		if err := e.wrapTimeout(ctx, StmtDelete, err); err != nil {
+			return err
 		}
+		e.afterWrite(ctx, stmt, false)
+		e.shadowDelete(ctx, stmt.Condition, rows())
+		return nil
+	})
+}
+
+func (e *Repository) softDeleteByIds(ctx context.Context, condition Condition, model SoftDeleteHook) error {
+	if err := model.BeforeSoftDelete(ctx); err != nil {
+		return err
 	}
-	err = model.BeforeSoftDelete(ctx)
+	query, err := e.parseWhere(ctx, condition)
 	if err != nil {
-		return
+		return err
 	}
-	err = db.Model(e.NewStruct()).Where("id=?", id).Updates(model).Error
-	if err != nil {
-		return
+	if query == nil {
+		return dbNilErr
+	}
+	res := query.Model(e.NewStruct()).Updates(model)
+	if res.Error != nil {
+		return res.Error
 	}
+	recordRowsAffected(ctx, res.RowsAffected)
 	return model.AfterSoftDelete(ctx)
 }
 
+// softDeleteById 把 id 写入 model 的主键后同 softDeleteByIds, MandatoryCondition, 租户条件及 Policy 照常生效
+func (e *Repository) softDeleteById(ctx context.Context, id interface{}, condition Condition, model SoftDeleteHook) error {
+	if f, ok := (&gorm.Scope{}).New(model).FieldByName(e.PrimaryField().Column()); ok {
+		if err := f.Set(id); err != nil {
+			return err
+		}
+	}
+	return e.softDeleteByIds(ctx, condition, model)
+}
+
 func (e *Repository) FindByIds(ctx context.Context, ids interface{}, additional ...Condition) (data interface{}, err error) {
-	if reflect.ValueOf(ids).Len() == 0 {
+	if idsLen(ids) == 0 {
 		return e.NewSlice(), nil
 	}
+	if size := e.inChunkSize(); size > 0 && idsLen(ids) > size {
+		return e.findByIdChunks(ctx, uniqueIds(ids), size, additional, false)
+	}
 	if len(additional) > 0 {
-		data, err = e.Find(ctx, _Id.In(ids).And(MatchAll(additional...)))
+		data, err = e.Find(ctx, e.PrimaryField().In(ids).And(MatchAll(additional...)))
 	} else {
-		data, err = e.Find(ctx, _Id.In(ids))
+		data, err = e.Find(ctx, e.PrimaryField().In(ids))
 	}
 	return
 }
@@ -0,0 +1,257 @@
+package repotest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/shaynewu/repository"
+)
+
+const recordDriverName = "repotest-record"
+
+func init() {
+	sql.Register(recordDriverName, recordDriver{})
+}
+
+// Recorder 一个接受任何 sql 的后端, 不做断言, 只记录执行过的语句(供 CaptureSQL 返回).
+// 查询默认返回空结果, count 返回 0, RETURNING 返回 1; 需要其他结果时设置 Respond
+type Recorder struct {
+	*MockTransactionManager
+	// Respond 可选, 返回查询的列及结果行, 返回 nil 时使用默认结果
+	Respond func(stmt Statement) (columns []string, rows [][]driver.Value)
+}
+
+// implements hint
+var _ repository.TransactionManager = (*Recorder)(nil)
+
+var (
+	recorders     = make(map[string]*Recorder)
+	recordersLock sync.RWMutex
+	recorderSeq   int64
+)
+
+// NewRecorder opens a gorm DB of dialect over a new recording backend, Mock of the returned manager is nil
+func NewRecorder(dialect string) (*Recorder, error) {
+	name := fmt.Sprintf("recorder-%d", atomic.AddInt64(&recorderSeq, 1))
+	r := &Recorder{}
+	recordersLock.Lock()
+	recorders[name] = r
+	recordersLock.Unlock()
+
+	db, err := sql.Open(recordDriverName, name)
+	if err != nil {
+		return nil, err
+	}
+	gdb, err := gorm.Open(dialect, db)
+	if err != nil {
+		return nil, err
+	}
+	r.MockTransactionManager = &MockTransactionManager{DB: gdb}
+	return r, nil
+}
+
+// BindRecorder replaces the TransactionManager of repos with a new recorder, and returns it
+func BindRecorder(dialect string, repos ...*repository.Repository) (*Recorder, error) {
+	r, err := NewRecorder(dialect)
+	if err != nil {
+		return nil, err
+	}
+	for _, repo := range repos {
+		repo.Tm = r
+	}
+	return r, nil
+}
+
+func (r *Recorder) respond(stmt Statement) ([]string, [][]driver.Value) {
+	if r.Respond != nil {
+		if cols, rows := r.Respond(stmt); cols != nil {
+			return cols, rows
+		}
+	}
+	upper := strings.ToUpper(stmt.SQL)
+	if i := strings.LastIndex(upper, " RETURNING "); i >= 0 {
+		var cols []string
+		var row []driver.Value
+		for _, c := range strings.Split(stmt.SQL[i+len(" RETURNING "):], ",") {
+			cols = append(cols, strings.Trim(strings.TrimSpace(c), "\"`"))
+			row = append(row, int64(1))
+		}
+		return cols, [][]driver.Value{row}
+	}
+	if strings.HasPrefix(upper, "SELECT COUNT(") {
+		return []string{"count"}, [][]driver.Value{{int64(0)}}
+	}
+	return nil, nil
+}
+
+type capture struct {
+	mu    sync.Mutex
+	stmts []Statement
+}
+
+var (
+	activeCapture     *capture
+	activeCaptureLock sync.Mutex
+)
+
+// CaptureSQL 执行 fn 并按顺序返回其间所有 Recorder 上执行的语句(包括 BEGIN/COMMIT/ROLLBACK),
+// 用于断言 MandatoryCondition, 租户条件, Option 等确实生效. fn 中使用的 repo 需要已经 BindRecorder.
+//
+// 捕获是全局的, 使用 CaptureSQL 的测试不能 t.Parallel
+func CaptureSQL(t testing.TB, fn func()) []Statement {
+	t.Helper()
+	c := &capture{}
+	activeCaptureLock.Lock()
+	if activeCapture != nil {
+		activeCaptureLock.Unlock()
+		t.Fatal("repotest: CaptureSQL can not be nested or run in parallel")
+	}
+	activeCapture = c
+	activeCaptureLock.Unlock()
+	defer func() {
+		activeCaptureLock.Lock()
+		activeCapture = nil
+		activeCaptureLock.Unlock()
+	}()
+
+	fn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Statement(nil), c.stmts...)
+}
+
+func record(query string, args []driver.NamedValue) Statement {
+	stmt := Statement{SQL: query}
+	for _, a := range args {
+		stmt.Args = append(stmt.Args, a.Value)
+	}
+	activeCaptureLock.Lock()
+	c := activeCapture
+	activeCaptureLock.Unlock()
+	if c != nil {
+		c.mu.Lock()
+		c.stmts = append(c.stmts, stmt)
+		c.mu.Unlock()
+	}
+	return stmt
+}
+
+type recordDriver struct{}
+
+func (recordDriver) Open(name string) (driver.Conn, error) {
+	recordersLock.RLock()
+	r, ok := recorders[name]
+	recordersLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("repotest: unknown recorder %s", name)
+	}
+	return &recordConn{recorder: r}, nil
+}
+
+type recordConn struct {
+	recorder *Recorder
+}
+
+func (c *recordConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordStmt{conn: c, query: query}, nil
+}
+
+func (c *recordConn) Close() error {
+	return nil
+}
+
+func (c *recordConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *recordConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	record("BEGIN", nil)
+	return recordTx{}, nil
+}
+
+// CheckNamedValue 保留参数的原始类型, 便于断言
+func (c *recordConn) CheckNamedValue(*driver.NamedValue) error {
+	return nil
+}
+
+func (c *recordConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	record(query, args)
+	return driver.RowsAffected(0), nil
+}
+
+func (c *recordConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	cols, rows := c.recorder.respond(record(query, args))
+	return &recordRows{columns: cols, rows: rows}, nil
+}
+
+type recordTx struct{}
+
+func (recordTx) Commit() error {
+	record("COMMIT", nil)
+	return nil
+}
+
+func (recordTx) Rollback() error {
+	record("ROLLBACK", nil)
+	return nil
+}
+
+type recordStmt struct {
+	conn  *recordConn
+	query string
+}
+
+func (s *recordStmt) Close() error {
+	return nil
+}
+
+func (s *recordStmt) NumInput() int {
+	return -1
+}
+
+func (s *recordStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, named(args))
+}
+
+func (s *recordStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, named(args))
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	nv := make([]driver.NamedValue, 0, len(args))
+	for i, a := range args {
+		nv = append(nv, driver.NamedValue{Ordinal: i + 1, Value: a})
+	}
+	return nv
+}
+
+type recordRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (r *recordRows) Columns() []string {
+	return r.columns
+}
+
+func (r *recordRows) Close() error {
+	return nil
+}
+
+func (r *recordRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,449 @@
+// Package repotest provides an in-memory RepositoryInterface for service layer unit tests
+package repotest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/shaynewu/repository"
+)
+
+// FakeRepository 基于内存 map 的 RepositoryInterface 实现, 在 Go 中计算 Condition.
+//
+// 不支持 Raw 条件及聚合字段; Update 的 update 可以是 struct (只更新非零字段, 同 gorm) 或 map[string]interface{}
+type FakeRepository struct {
+	Tm    *FakeTransactionManager
+	Value repository.Model
+	// MandatoryCondition 同 repository.Repository.MandatoryCondition
+	MandatoryCondition repository.Condition
+	CreateFunc         func(ctx context.Context, model repository.Model) (err error)
+	SaveFunc           func(ctx context.Context, model repository.Model) (err error)
+	UpdateFunc         func(ctx context.Context, update interface{}, condition repository.Condition) (err error)
+	DeleteFunc         func(ctx context.Context, condition repository.Condition) (err error)
+
+	mu     sync.Mutex
+	rows   map[interface{}]interface{}
+	nextId int64
+}
+
+// implements hint
+var _ repository.RepositoryInterface = (*FakeRepository)(nil)
+
+// NewFakeRepository creates an empty in-memory repository for model
+func NewFakeRepository(model repository.Model) *FakeRepository {
+	repo0 := &FakeRepository{
+		Value: model,
+		rows:  make(map[interface{}]interface{}),
+	}
+	repo0.Tm = &FakeTransactionManager{repos: []*FakeRepository{repo0}}
+	repo0.CreateFunc = repo0.create
+	repo0.SaveFunc = repo0.save
+	repo0.UpdateFunc = repo0.update
+	repo0.DeleteFunc = repo0.delete
+	return repo0
+}
+
+// Seed inserts models directly, without hooks
+func (e *FakeRepository) Seed(models ...repository.Model) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, m := range models {
+		if err := e.insert(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rows returns a copy of all stored rows (including soft deleted ones), as *[]*T
+func (e *FakeRepository) Rows() interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	slice := repository.NewSlice(e.Value)
+	sv := reflect.ValueOf(slice).Elem()
+	for _, id := range e.sortedIds() {
+		sv.Set(reflect.Append(sv, reflect.ValueOf(clone(e.rows[id]))))
+	}
+	return slice
+}
+
+func (e *FakeRepository) SetCreateFunc(fn func(context.Context, repository.Model) error) {
+	e.CreateFunc = fn
+}
+
+func (e *FakeRepository) SetSaveFunc(fn func(context.Context, repository.Model) error) {
+	e.SaveFunc = fn
+}
+
+func (e *FakeRepository) SetUpdateFunc(fn func(context.Context, interface{}, repository.Condition) error) {
+	e.UpdateFunc = fn
+}
+
+func (e *FakeRepository) SetDeleteFunc(fn func(context.Context, repository.Condition) error) {
+	e.DeleteFunc = fn
+}
+
+func (e *FakeRepository) GetTM() repository.TransactionManager {
+	return e.Tm
+}
+
+func (e *FakeRepository) FindOne(ctx context.Context, condition repository.Condition) (repository.Model, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids, err := e.match(condition)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return clone(e.rows[ids[0]]).(repository.Model), nil
+}
+
+func (e *FakeRepository) FindById(ctx context.Context, id interface{}) (repository.Model, error) {
+	return e.FindOne(ctx, repository.SimpleField("id").Eq(id))
+}
+
+func (e *FakeRepository) FindByIds(ctx context.Context, ids interface{}, additional ...repository.Condition) (interface{}, error) {
+	if idv := reflect.ValueOf(ids); (idv.Kind() != reflect.Slice && idv.Kind() != reflect.Array) || idv.Len() == 0 {
+		return repository.NewSlice(e.Value), nil
+	}
+	condition := repository.SimpleField("id").In(ids)
+	if len(additional) > 0 {
+		condition = condition.And(repository.MatchAll(additional...))
+	}
+	return e.Find(ctx, condition)
+}
+
+// FindByIdsOrdered 同 repository.Repository.FindByIdsOrdered: 去掉重复的 id, 结果按 ids 的顺序, 不存在的 id 被跳过
+func (e *FakeRepository) FindByIdsOrdered(ctx context.Context, ids interface{}, additional ...repository.Condition) (interface{}, error) {
+	slice := repository.NewSlice(e.Value)
+	idv := reflect.ValueOf(ids)
+	if idv.Kind() != reflect.Slice && idv.Kind() != reflect.Array {
+		return slice, nil
+	}
+	found, err := e.FindByIds(ctx, ids, additional...)
+	if err != nil {
+		return slice, err
+	}
+	fv := reflect.ValueOf(found).Elem()
+	byId := make(map[interface{}]reflect.Value, fv.Len())
+	for i := 0; i < fv.Len(); i++ {
+		byId[key(column(fv.Index(i).Interface(), "id"))] = fv.Index(i)
+	}
+	sv := reflect.ValueOf(slice).Elem()
+	seen := make(map[interface{}]bool, idv.Len())
+	for i := 0; i < idv.Len(); i++ {
+		k := key(idv.Index(i).Interface())
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if row, ok := byId[k]; ok {
+			sv = reflect.Append(sv, row)
+		}
+	}
+	reflect.ValueOf(slice).Elem().Set(sv)
+	return slice, nil
+}
+
+func (e *FakeRepository) Find(ctx context.Context, condition repository.Condition, options ...repository.Option) (interface{}, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	slice := repository.NewSlice(e.Value)
+	ids, err := e.match(condition)
+	if err != nil {
+		return slice, err
+	}
+	spec := repository.InspectOptions(options...)
+	rows := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		rows = append(rows, e.rows[id])
+	}
+	if len(spec.Orders) > 0 {
+		sort.SliceStable(rows, func(i, j int) bool {
+			for _, o := range spec.Orders {
+				c, _ := repository.CompareValues(column(rows[i], o.Column), column(rows[j], o.Column))
+				if c != 0 {
+					return c*int(o.Order) < 0
+				}
+			}
+			return false
+		})
+	}
+	if spec.Offset > 0 {
+		if spec.Offset >= len(rows) {
+			rows = nil
+		} else {
+			rows = rows[spec.Offset:]
+		}
+	}
+	if spec.Limit > 0 && spec.Limit < len(rows) {
+		rows = rows[:spec.Limit]
+	}
+	sv := reflect.ValueOf(slice).Elem()
+	for _, r := range rows {
+		sv.Set(reflect.Append(sv, reflect.ValueOf(clone(r))))
+	}
+	return slice, nil
+}
+
+func (e *FakeRepository) FindAndCount(ctx context.Context, condition repository.Condition, options ...repository.Option) (interface{}, int, error) {
+	total, err := e.Count(ctx, condition)
+	if err != nil {
+		return nil, 0, err
+	}
+	slice, err := e.Find(ctx, condition, options...)
+	return slice, total, err
+}
+
+// Count 忽略 options
+func (e *FakeRepository) Count(ctx context.Context, condition repository.Condition, options ...repository.Option) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids, err := e.match(condition)
+	return len(ids), err
+}
+
+// Exists 忽略 options
+func (e *FakeRepository) Exists(ctx context.Context, condition repository.Condition, options ...repository.Option) (bool, error) {
+	n, err := e.Count(ctx, condition)
+	return n > 0, err
+}
+
+func (e *FakeRepository) Create(ctx context.Context, model repository.Model) error {
+	return e.CreateFunc(ctx, model)
+}
+
+func (e *FakeRepository) Save(ctx context.Context, model repository.Model) error {
+	return e.SaveFunc(ctx, model)
+}
+
+func (e *FakeRepository) Update(ctx context.Context, update interface{}, condition repository.Condition) error {
+	return e.UpdateFunc(ctx, update, condition)
+}
+
+func (e *FakeRepository) Delete(ctx context.Context, condition repository.Condition) error {
+	return e.DeleteFunc(ctx, condition)
+}
+
+func (e *FakeRepository) DeleteById(ctx context.Context, id interface{}) error {
+	val := repository.NewStruct(e.Value)
+	sdi, ok := val.(repository.SoftDeleteHook)
+	if !ok {
+		return e.DeleteFunc(ctx, repository.SimpleField("id").Eq(id))
+	}
+	if err := sdi.BeforeSoftDelete(ctx); err != nil {
+		return err
+	}
+	if err := e.UpdateFunc(ctx, val, repository.SimpleField("id").Eq(id)); err != nil {
+		return err
+	}
+	return sdi.AfterSoftDelete(ctx)
+}
+
+func (e *FakeRepository) create(ctx context.Context, data repository.Model) error {
+	if i0, ok := data.(interface {
+		BeforeRepoCreate(ctx context.Context) error
+	}); ok {
+		if err := i0.BeforeRepoCreate(ctx); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	err := e.insert(data)
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if i0, ok := data.(interface {
+		AfterRepoCreate(ctx context.Context) error
+	}); ok {
+		return i0.AfterRepoCreate(ctx)
+	}
+	return nil
+}
+
+func (e *FakeRepository) save(ctx context.Context, data repository.Model) error {
+	scope := (&gorm.Scope{}).New(data)
+	if scope.PrimaryKeyZero() {
+		return e.create(ctx, data)
+	}
+	if i0, ok := data.(interface {
+		BeforeRepoUpdate(ctx context.Context) error
+	}); ok {
+		if err := i0.BeforeRepoUpdate(ctx); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	if row, ok := e.rows[key(scope.PrimaryKeyValue())]; ok {
+		assign(row, data)
+	}
+	e.mu.Unlock()
+	if i0, ok := data.(interface {
+		AfterRepoUpdate(ctx context.Context) error
+	}); ok {
+		return i0.AfterRepoUpdate(ctx)
+	}
+	return nil
+}
+
+func (e *FakeRepository) update(ctx context.Context, update interface{}, condition repository.Condition) error {
+	if i0, ok := update.(interface {
+		BeforeRepoUpdate(ctx context.Context) error
+	}); ok {
+		if err := i0.BeforeRepoUpdate(ctx); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids, err := e.match(condition)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		assign(e.rows[id], update)
+	}
+	return nil
+}
+
+func (e *FakeRepository) delete(ctx context.Context, condition repository.Condition) error {
+	if _, ok := e.Value.(repository.SoftDeleteHook); ok {
+		val := repository.NewStruct(e.Value)
+		if err := (val.(repository.SoftDeleteHook)).BeforeSoftDelete(ctx); err != nil {
+			return err
+		}
+		return e.update(ctx, val, condition)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids, err := e.match(condition)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		delete(e.rows, id)
+	}
+	return nil
+}
+
+// insert 需要持有 e.mu; 主键为零的整数主键会自增, 其他类型的主键不能为零
+func (e *FakeRepository) insert(data interface{}) error {
+	scope := (&gorm.Scope{}).New(data)
+	if scope.PrimaryKeyZero() {
+		if _, ok := key(scope.PrimaryKeyValue()).(int64); !ok {
+			return fmt.Errorf("repotest: primary key of %T is empty", data)
+		}
+		e.nextId++
+		if err := scope.PrimaryField().Set(e.nextId); err != nil {
+			return err
+		}
+	} else if id, ok := key(scope.PrimaryKeyValue()).(int64); ok && id > e.nextId {
+		e.nextId = id
+	}
+	e.rows[key(scope.PrimaryKeyValue())] = clone(data)
+	return nil
+}
+
+// match 需要持有 e.mu, 返回按主键排序的匹配行
+func (e *FakeRepository) match(condition repository.Condition) ([]interface{}, error) {
+	if e.MandatoryCondition != nil {
+		if condition == nil {
+			condition = e.MandatoryCondition
+		} else {
+			condition = condition.And(e.MandatoryCondition)
+		}
+	}
+	node := repository.Inspect(condition)
+	var ids []interface{}
+	for _, id := range e.sortedIds() {
+		ok, err := node.Match(e.rows[id])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (e *FakeRepository) sortedIds() []interface{} {
+	ids := make([]interface{}, 0, len(e.rows))
+	for id := range e.rows {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		c, _ := repository.CompareValues(ids[i], ids[j])
+		return c < 0
+	})
+	return ids
+}
+
+// key 统一数值类型的主键, 避免 int 与 int64 不相等. 整数统一为 int64 (超出 int64 的 uint64 保持 uint64),
+// 浮点数只有能精确表示为 int64 时才与整数相同, 不经过 float64 以免大的 id 相互覆盖
+func key(id interface{}) interface{} {
+	rv := reflect.ValueOf(id)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if u := rv.Uint(); u <= math.MaxInt64 {
+			return int64(u)
+		}
+		return rv.Uint()
+	case reflect.Float32, reflect.Float64:
+		if f := rv.Float(); f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+			return int64(f)
+		}
+		return rv.Float()
+	}
+	return id
+}
+
+func clone(v interface{}) interface{} {
+	src := reflect.Indirect(reflect.ValueOf(v))
+	dst := reflect.New(src.Type())
+	dst.Elem().Set(src)
+	return dst.Interface()
+}
+
+func column(row interface{}, col string) interface{} {
+	f, ok := (&gorm.Scope{}).New(row).FieldByName(col)
+	if !ok {
+		return nil
+	}
+	fv := reflect.Indirect(f.Field)
+	if !fv.IsValid() {
+		return nil
+	}
+	return fv.Interface()
+}
+
+// assign 把 update 写入 row: map 按列名写入, struct 只写入非零字段
+func assign(row interface{}, update interface{}) {
+	scope := (&gorm.Scope{}).New(row)
+	if m, ok := update.(map[string]interface{}); ok {
+		for col, val := range m {
+			if f, ok := scope.FieldByName(col); ok {
+				_ = f.Set(val)
+			}
+		}
+		return
+	}
+	for _, uf := range (&gorm.Scope{}).New(update).Fields() {
+		if !uf.IsNormal || uf.IsBlank {
+			continue
+		}
+		if f, ok := scope.FieldByName(uf.Name); ok {
+			_ = f.Set(uf.Field.Interface())
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package repotest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/shaynewu/repository"
+)
+
+// UpdateGoldenEnv 设置为 1 时 AssertGoldenSQL 会重写 golden 文件
+const UpdateGoldenEnv = "REPOTEST_UPDATE_GOLDEN"
+
+type mockTxKey struct{}
+
+// MockTransactionManager 把 repository 绑定到 sqlmock 上
+type MockTransactionManager struct {
+	DB   *gorm.DB
+	Mock sqlmock.Sqlmock
+}
+
+// implements hint
+var _ repository.TransactionManager = (*MockTransactionManager)(nil)
+
+// NewMockTransactionManager opens a gorm DB of dialect over a new sqlmock, matching sql exactly
+func NewMockTransactionManager(dialect string) (*MockTransactionManager, error) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		return nil, err
+	}
+	gdb, err := gorm.Open(dialect, db)
+	if err != nil {
+		return nil, err
+	}
+	return &MockTransactionManager{DB: gdb, Mock: mock}, nil
+}
+
+// Bind replaces the TransactionManager of repos with a new mock one, and returns it
+func Bind(dialect string, repos ...*repository.Repository) (*MockTransactionManager, error) {
+	tm, err := NewMockTransactionManager(dialect)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range repos {
+		r.Tm = tm
+	}
+	return tm, nil
+}
+
+func (tm *MockTransactionManager) GetDb(ctx context.Context) *gorm.DB {
+	if tx, ok := ctx.Value(mockTxKey{}).(*gorm.DB); ok {
+		return tx
+	}
+	return tm.DB
+}
+
+func (tm *MockTransactionManager) Transaction(ctx context.Context, doTransaction func(ctx context.Context) (res interface{}, err error)) (res interface{}, err error) {
+	if _, ok := ctx.Value(mockTxKey{}).(*gorm.DB); ok {
+		return doTransaction(ctx)
+	}
+	tx := tm.DB.BeginTx(ctx, &sql.TxOptions{})
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	hooks := &repository.TxHooks{}
+	ctx = context.WithValue(context.WithValue(ctx, mockTxKey{}, tx), mockHooksKey{}, hooks)
+	res, err = doTransaction(ctx)
+	if err != nil {
+		tx.Rollback()
+		hooks.RolledBack()
+		return res, err
+	}
+	if err = tx.Commit().Error; err != nil {
+		hooks.RolledBack()
+		return res, err
+	}
+	hooks.Committed()
+	return res, nil
+}
+
+type mockHooksKey struct{}
+
+// AfterCommit runs fn after the outermost mock transaction commits, or immediately outside a transaction
+func (tm *MockTransactionManager) AfterCommit(ctx context.Context, fn func()) {
+	if hooks, ok := ctx.Value(mockHooksKey{}).(*repository.TxHooks); ok {
+		hooks.AfterCommit(fn)
+		return
+	}
+	fn()
+}
+
+// AfterRollback runs fn after the outermost mock transaction rolls back
+func (tm *MockTransactionManager) AfterRollback(ctx context.Context, fn func()) {
+	if hooks, ok := ctx.Value(mockHooksKey{}).(*repository.TxHooks); ok {
+		hooks.AfterRollback(fn)
+	}
+}
+
+// Suspend returns ctx outside the mock transaction
+func (tm *MockTransactionManager) Suspend(ctx context.Context) context.Context {
+	return context.WithValue(context.WithValue(ctx, mockTxKey{}, nil), mockHooksKey{}, nil)
+}
+
+// Statement 一条 repository 生成的 sql 及参数
+type Statement struct {
+	SQL  string
+	Args []driver.Value
+}
+
+// Render 执行 fn 并返回其中第一条查询的 sql, fn 中使用的 repo 需要已经 Bind.
+// 查询在一个独立的 sqlmock 上执行(返回空结果), 不会消耗 repo 上的 expectation
+func Render(repo *repository.Repository, fn func(ctx context.Context) error) (*Statement, error) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherFunc(func(string, string) error {
+		return nil
+	})))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectQuery("").WillReturnRows(sqlmock.NewRows(nil))
+
+	dialect := repository.DialectPostgres
+	if tm, ok := repo.Tm.(*MockTransactionManager); ok {
+		dialect = tm.DB.Dialect().GetName()
+	}
+	gdb, err := gorm.Open(dialect, db)
+	if err != nil {
+		return nil, err
+	}
+	var stmt *Statement
+	capture := func(scope *gorm.Scope) {
+		if stmt != nil || scope.SQL == "" {
+			return
+		}
+		stmt = &Statement{SQL: scope.SQL}
+		for _, v := range scope.SQLVars {
+			stmt.Args = append(stmt.Args, v)
+		}
+	}
+	gdb.Callback().Query().After("gorm:query").Register("repotest:capture", capture)
+	gdb.Callback().RowQuery().After("gorm:row_query").Register("repotest:capture_row", capture)
+
+	origin := repo.Tm
+	repo.Tm = &MockTransactionManager{DB: gdb, Mock: mock}
+	defer func() {
+		repo.Tm = origin
+	}()
+	_ = fn(context.Background())
+	if stmt == nil {
+		return nil, fmt.Errorf("repotest: no query executed")
+	}
+	return stmt, nil
+}
+
+func mockOf(repo *repository.Repository) (sqlmock.Sqlmock, error) {
+	tm, ok := repo.Tm.(*MockTransactionManager)
+	if !ok {
+		return nil, fmt.Errorf("repotest: repository of %s is not bound to sqlmock", repo.Value.TableName())
+	}
+	return tm.Mock, nil
+}
+
+func expect(repo *repository.Repository, rows *sqlmock.Rows, fn func(ctx context.Context) error) (*Statement, error) {
+	mock, err := mockOf(repo)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := Render(repo, fn)
+	if err != nil {
+		return nil, err
+	}
+	mock.ExpectQuery(stmt.SQL).WithArgs(stmt.Args...).WillReturnRows(rows)
+	return stmt, nil
+}
+
+// ExpectFind 期望 repo.Find(condition, options...) 生成的 sql (包含 MandatoryCondition), 并返回 rows
+func ExpectFind(repo *repository.Repository, condition repository.Condition, rows *sqlmock.Rows, options ...repository.Option) (*Statement, error) {
+	return expect(repo, rows, func(ctx context.Context) error {
+		_, err := repo.Find(ctx, condition, options...)
+		return err
+	})
+}
+
+// ExpectFindOne 期望 repo.FindOne(condition) 生成的 sql, 并返回 rows
+func ExpectFindOne(repo *repository.Repository, condition repository.Condition, rows *sqlmock.Rows) (*Statement, error) {
+	return expect(repo, rows, func(ctx context.Context) error {
+		_, err := repo.FindOne(ctx, condition)
+		return err
+	})
+}
+
+// ExpectCount 期望 repo.Count(condition) 生成的 sql, 并返回 total
+func ExpectCount(repo *repository.Repository, condition repository.Condition, total int) (*Statement, error) {
+	return expect(repo, sqlmock.NewRows([]string{"count"}).AddRow(total), func(ctx context.Context) error {
+		_, err := repo.Count(ctx, condition)
+		return err
+	})
+}
+
+var goldenNameRe = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// AssertGoldenSQL 比较 stmt 与 testdata/<name>.golden, 设置环境变量 REPOTEST_UPDATE_GOLDEN=1 时重写 golden 文件
+func AssertGoldenSQL(t testing.TB, name string, stmt *Statement) {
+	t.Helper()
+	got := stmt.SQL + "\n" + fmt.Sprint(stmt.Args) + "\n"
+	path := filepath.Join("testdata", goldenNameRe.ReplaceAllString(name, "_")+".golden")
+	if os.Getenv(UpdateGoldenEnv) == "1" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read golden %s: %v (run with %s=1 to create)", path, err, UpdateGoldenEnv)
+	}
+	if strings.TrimSpace(string(want)) != strings.TrimSpace(got) {
+		t.Errorf("sql mismatch for %s\nwant:\n%s\ngot:\n%s", name, want, got)
+	}
+}
+
+// WithAdvisoryLock see repository.WithAdvisoryLock
+func (tm *MockTransactionManager) WithAdvisoryLock(ctx context.Context, key int64, fn func(ctx context.Context) error) error {
+	return repository.WithAdvisoryLock(ctx, tm, key, fn)
+}
@@ -0,0 +1,132 @@
+package repotest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/shaynewu/repository"
+)
+
+type fakeTxKey struct{}
+
+// FakeTransactionManager 事务开始时对所属 FakeRepository 做快照, doTransaction 返回 error 或 panic 时恢复
+type FakeTransactionManager struct {
+	repos []*FakeRepository
+
+	locksMu sync.Mutex
+	locks   map[int64]*sync.Mutex
+}
+
+// implements hint
+var _ repository.TransactionManager = (*FakeTransactionManager)(nil)
+var _ repository.TempTableCreator = (*FakeTransactionManager)(nil)
+
+// Share makes repos roll back together with the repositories already managed by tm
+func (tm *FakeTransactionManager) Share(repos ...*FakeRepository) {
+	for _, r := range repos {
+		r.Tm = tm
+		tm.repos = append(tm.repos, r)
+	}
+}
+
+// GetDb always returns nil
+func (tm *FakeTransactionManager) GetDb(ctx context.Context) *gorm.DB {
+	return nil
+}
+
+func (tm *FakeTransactionManager) Transaction(ctx context.Context, doTransaction func(ctx context.Context) (res interface{}, err error)) (res interface{}, err error) {
+	if ctx.Value(fakeTxKey{}) != nil {
+		return doTransaction(ctx)
+	}
+	snapshots := make([]map[interface{}]interface{}, len(tm.repos))
+	for i, r := range tm.repos {
+		snapshots[i] = r.snapshot()
+	}
+	hooks := &repository.TxHooks{}
+	defer func() {
+		if p := recover(); p != nil {
+			tm.restore(snapshots)
+			hooks.RolledBack()
+			panic(p)
+		}
+	}()
+	res, err = doTransaction(context.WithValue(ctx, fakeTxKey{}, hooks))
+	if err != nil {
+		tm.restore(snapshots)
+		hooks.RolledBack()
+		return res, err
+	}
+	hooks.Committed()
+	return res, nil
+}
+
+// AfterCommit runs fn after the outermost fake transaction succeeds, or immediately outside a transaction
+func (tm *FakeTransactionManager) AfterCommit(ctx context.Context, fn func()) {
+	if hooks, ok := ctx.Value(fakeTxKey{}).(*repository.TxHooks); ok {
+		hooks.AfterCommit(fn)
+		return
+	}
+	fn()
+}
+
+// AfterRollback runs fn after the outermost fake transaction is rolled back
+func (tm *FakeTransactionManager) AfterRollback(ctx context.Context, fn func()) {
+	if hooks, ok := ctx.Value(fakeTxKey{}).(*repository.TxHooks); ok {
+		hooks.AfterRollback(fn)
+	}
+}
+
+// Suspend returns ctx outside the fake transaction. Writes made with it are still
+// reverted if the suspended transaction rolls back, as rollback restores a snapshot
+func (tm *FakeTransactionManager) Suspend(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fakeTxKey{}, nil)
+}
+
+func (tm *FakeTransactionManager) restore(snapshots []map[interface{}]interface{}) {
+	for i, r := range tm.repos {
+		r.mu.Lock()
+		r.rows = snapshots[i]
+		r.mu.Unlock()
+	}
+}
+
+func (e *FakeRepository) snapshot() map[interface{}]interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rows := make(map[interface{}]interface{}, len(e.rows))
+	for id, row := range e.rows {
+		rows[id] = clone(row)
+	}
+	return rows
+}
+
+// CreateTempTable runs fn with an empty FakeRepository of model, which is discarded afterwards
+func (tm *FakeTransactionManager) CreateTempTable(ctx context.Context, model repository.Model, fn func(ctx context.Context, repo repository.RepositoryInterface) error) error {
+	_, err := tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		repo := NewFakeRepository(model)
+		repo.Tm = tm
+		return nil, fn(ctx, repo)
+	})
+	return err
+}
+
+// WithAdvisoryLock holds a process local lock of key while running fn in a transaction
+func (tm *FakeTransactionManager) WithAdvisoryLock(ctx context.Context, key int64, fn func(ctx context.Context) error) error {
+	tm.locksMu.Lock()
+	if tm.locks == nil {
+		tm.locks = make(map[int64]*sync.Mutex)
+	}
+	l, ok := tm.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		tm.locks[key] = l
+	}
+	tm.locksMu.Unlock()
+	l.Lock()
+	defer l.Unlock()
+	_, err := tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
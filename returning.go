@@ -0,0 +1,269 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+type rowsAffectedKey struct{}
+
+// recordRowsAffected 由默认的 UpdateFunc/DeleteFunc 调用, 把影响的行数写入 UpdateN/DeleteN 放在 ctx 中的计数
+func recordRowsAffected(ctx context.Context, n int64) {
+	if p, ok := ctx.Value(rowsAffectedKey{}).(*int64); ok {
+		*p += n
+	}
+}
+
+// UpdateN 同 Update, 并返回影响的行数. 自定义的 UpdateFunc 需要调用 db 的 RowsAffected 才能统计, 否则返回 0
+func (e *Repository) UpdateN(ctx context.Context, update interface{}, condition Condition) (rowsAffected int64, err error) {
+	err = e.Update(context.WithValue(ctx, rowsAffectedKey{}, &rowsAffected), update, condition)
+	return
+}
+
+// DeleteN 同 Delete, 并返回影响的行数(软删除时为更新的行数)
+func (e *Repository) DeleteN(ctx context.Context, condition Condition) (rowsAffected int64, err error) {
+	err = e.Delete(context.WithValue(ctx, rowsAffectedKey{}, &rowsAffected), condition)
+	return
+}
+
+// UpdateReturning 同 Update, 并把更新后的行写入 dest (model 的 slice 指针).
+// postgres 使用 UPDATE ... RETURNING 一次完成; 其他 dialect 在事务中先锁定命中的主键, 更新后再按主键查询.
+// postgres 下不经过 UpdateFunc, 但 BeforeRepoUpdate, AUTOUPDATETIME 及加密照常处理
+func (e *Repository) UpdateReturning(ctx context.Context, update interface{}, condition Condition, dest interface{}) error {
+	if err := e.validateEnums(updateColumnMap(update)); err != nil {
+		return err
+	}
+	if err := e.checkWrite(ctx, update); err != nil {
+		return err
+	}
+	return e.intercept(ctx, &StatementInfo{Op: StmtUpdate, Condition: condition, Model: update}, func(ctx context.Context, stmt *StatementInfo) error {
+		if err := e.wrapTimeout(ctx, StmtUpdate, e.updateReturning(ctx, stmt.Model, stmt.Condition, dest)); err != nil {
+			return err
+		}
+		e.afterWrite(ctx, stmt, false)
+		// postgres 下不统计影响的行数, 不比较
+		e.shadowUpdate(ctx, stmt.Model, stmt.Condition, -1)
+		return nil
+	})
+}
+
+func (e *Repository) updateReturning(ctx context.Context, update interface{}, condition Condition, dest interface{}) error {
+	db := e.getDb(ctx)
+	if db == nil {
+		return dbNilErr
+	}
+	if db.Dialect().GetName() != DialectPostgres {
+		_, err := e.Tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+			query, err := e.parseWhere(ctx, condition)
+			if err != nil {
+				return nil, err
+			}
+			if query.Dialect().GetName() != DialectSqlite3 {
+				query = query.Set("gorm:query_option", "FOR UPDATE")
+			}
+			var ids []interface{}
+			if err = query.Model(e.NewStruct()).Pluck(e.PrimaryField().Column(), &ids).Error; err != nil {
+				return nil, err
+			}
+			if len(ids) == 0 {
+				return nil, nil
+			}
+			if err = e.UpdateFunc(ctx, update, e.PrimaryField().In(ids)); err != nil {
+				return nil, err
+			}
+			if err = e.getDb(ctx).Where(fmt.Sprintf("%s IN (?)", e.PrimaryField().Column()), ids).Find(dest).Error; err != nil {
+				return nil, err
+			}
+			return nil, decryptFields(ctx, dest)
+		})
+		return err
+	}
+
+	es := &execScope{
+		model: update,
+		scope: (&gorm.Scope{}).New(update),
+		rep:   e,
+	}
+	if err := es.beforeRepoUpdateCallback(ctx, update); err != nil {
+		return err
+	}
+	sets, vars, err := updateColumns(db, update)
+	if decErr := decryptUpdate(ctx, e.Value, update); err == nil {
+		err = decErr
+	}
+	if err != nil {
+		return err
+	}
+	condition, err = e.mandatory(ctx, condition)
+	if err != nil {
+		return err
+	}
+	sql := fmt.Sprintf("UPDATE %s SET %s", db.NewScope(e.NewStruct()).QuotedTableName(), strings.Join(sets, ", "))
+	if where, args := condition.flattenDialect(DialectPostgres); where != "" {
+		sql += " WHERE " + where
+		vars = append(vars, args...)
+	}
+	if err = db.Raw(sql+" RETURNING *", vars...).Scan(dest).Error; err != nil {
+		return err
+	}
+	return decryptFields(ctx, dest)
+}
+
+// updateColumns 与 gorm Updates 一致: map 更新所有 key, struct 更新非零值的字段(不含主键)
+func updateColumns(db *gorm.DB, update interface{}) (sets []string, vars []interface{}, err error) {
+	scope := db.NewScope(update)
+	if m, ok := update.(map[string]interface{}); ok {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sets = append(sets, scope.Quote(k)+" = ?")
+			vars = append(vars, m[k])
+		}
+	} else if Indirect(reflect.ValueOf(update)).Kind() == reflect.Struct {
+		for _, f := range scope.Fields() {
+			if f.IsNormal && !f.IsIgnored && !f.IsPrimaryKey && !f.IsBlank {
+				sets = append(sets, scope.Quote(f.DBName)+" = ?")
+				vars = append(vars, f.Field.Interface())
+			}
+		}
+	}
+	if len(sets) == 0 {
+		return nil, nil, fmt.Errorf("nothing to update in %T", update)
+	}
+	return sets, vars, nil
+}
+
+// CreateReturning 同 Create, 并把数据库生成的列(自增主键, 默认值, 触发器写入的值)回填到 model, 不需要再 FindById.
+// fields 为需要回填的列, 为空时回填主键以及 insert 中省略的列(零值且有默认值的列).
+// postgres/sqlite 通过 INSERT ... RETURNING 一次完成, mysql 通过 LastInsertId 再按主键查询.
+// 不经过 CreateFunc, 但 BeforeRepoCreate/AfterRepoCreate, AUTOCREATETIME, 租户及加密照常处理
+func (e *Repository) CreateReturning(ctx context.Context, model Model, fields ...FieldInterface) error {
+	if err := e.validate(ctx, model); err != nil {
+		return err
+	}
+	if err := e.checkWrite(ctx, model); err != nil {
+		return err
+	}
+	ctx, err := e.routeCreate(ctx, model)
+	if err != nil {
+		return err
+	}
+	return e.intercept(ctx, &StatementInfo{Op: StmtCreate, Model: model}, func(ctx context.Context, stmt *StatementInfo) error {
+		if err := e.wrapTimeout(ctx, StmtCreate, e.createReturning(ctx, model, fields)); err != nil {
+			return err
+		}
+		e.afterWrite(ctx, stmt, true)
+		e.shadowCreate(ctx, model)
+		return nil
+	})
+}
+
+func (e *Repository) createReturning(ctx context.Context, model Model, fields []FieldInterface) error {
+	_, err := e.Tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		db := e.getDb(ctx)
+		if db == nil {
+			return nil, dbNilErr
+		}
+		es := &execScope{
+			model: model,
+			scope: db.NewScope(model),
+			rep:   e,
+		}
+		if err := es.beforeRepoCreateCallback(ctx, model); err != nil {
+			return nil, err
+		}
+		scopes := []*execScope{es}
+		inserted := insertColumns(scopes)
+		if len(inserted) == 0 {
+			return nil, restorePlaintext(ctx, model, errors.New("create without columns"))
+		}
+		returning, err := returningColumns(es.scope, inserted, fields)
+		if err != nil {
+			return nil, restorePlaintext(ctx, model, err)
+		}
+		sql, vars := insertStatement(scopes, inserted)
+
+		switch dialect := db.Dialect().GetName(); {
+		case dialect == DialectPostgres || dialect == DialectSqlite3:
+			if len(returning) == 0 {
+				err = execRaw(ctx, db, sql, vars...).Error
+			} else {
+				err = db.Raw(sql+" RETURNING "+strings.Join(returning, ","), vars...).Scan(model).Error
+			}
+		case dialect == DialectMysql:
+			err = e.createMysql(ctx, db, es, sql, vars, returning)
+		default:
+			err = fmt.Errorf("create returning is not supported for %s", dialect)
+		}
+		if err != nil {
+			return nil, restorePlaintext(ctx, model, err)
+		}
+		return nil, es.afterRepoCreateCallback(ctx, model)
+	})
+	return err
+}
+
+// createMysql 通过 LastInsertId 回填自增主键, 再按主键查询 returning 的列
+func (e *Repository) createMysql(ctx context.Context, db *gorm.DB, es *execScope, sql string, vars []interface{}, returning []string) error {
+	res, err := execRawResult(ctx, db, sql, vars...)
+	if err != nil {
+		return err
+	}
+	pk := es.scope.PrimaryField()
+	if pk == nil || len(returning) == 0 {
+		return nil
+	}
+	if pk.IsBlank {
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if err = pk.Set(id); err != nil {
+			return err
+		}
+	}
+	return db.Raw(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", strings.Join(returning, ","), es.scope.QuotedTableName(), es.scope.Quote(pk.DBName)),
+		pk.Field.Interface()).Scan(es.model).Error
+}
+
+// returningColumns 需要回填的列: 主键加上 fields, fields 为空时加上 insert 中省略的列
+func returningColumns(scope *gorm.Scope, inserted []*gorm.Field, fields []FieldInterface) ([]string, error) {
+	seen := make(map[string]bool)
+	var cols []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			cols = append(cols, scope.Quote(name))
+		}
+	}
+	if pk := scope.PrimaryField(); pk != nil {
+		add(pk.DBName)
+	}
+	if len(fields) > 0 {
+		for _, f := range fields {
+			if gf, ok := scope.FieldByName(f.Column()); !ok || !gf.IsNormal {
+				return nil, fmt.Errorf("unknown column %s", f.Column())
+			}
+			add(f.Column())
+		}
+		return cols, nil
+	}
+	for _, f := range inserted {
+		seen[f.DBName] = true
+	}
+	for _, f := range scope.Fields() {
+		if f.IsNormal && !f.IsIgnored {
+			add(f.DBName)
+		}
+	}
+	return cols, nil
+}
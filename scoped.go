@@ -0,0 +1,25 @@
+package repository
+
+import "context"
+
+// Scoped 返回浅拷贝的 Repository, MandatoryCondition 为当前的 MandatoryCondition AND condition, 用于按租户, 状态等划分的视图,
+// 不修改共享的 Repository. 查询, Update 及 Delete (包括 DeleteById/DeleteByIds 的软删除) 都受 condition 约束;
+// Create/Save 不校验 condition.
+// 其余配置(TransactionManager, 回调, 缓存等)与当前 Repository 共享
+func (e *Repository) Scoped(condition Condition) RepositoryInterface {
+	clone := *e
+	if e.MandatoryCondition == nil {
+		clone.MandatoryCondition = condition
+	} else {
+		clone.MandatoryCondition = e.MandatoryCondition.And(condition)
+	}
+	// NewRepository 设置的写函数绑定在原 Repository 上, 只会加上原来的 MandatoryCondition
+	update, del := e.UpdateFunc, e.DeleteFunc
+	clone.UpdateFunc = func(ctx context.Context, data interface{}, cond Condition) error {
+		return update(ctx, data, cond.And(condition))
+	}
+	clone.DeleteFunc = func(ctx context.Context, cond Condition) error {
+		return del(ctx, cond.And(condition))
+	}
+	return &clone
+}
@@ -0,0 +1,285 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultShadowTimeout = 10 * time.Second
+
+// ShadowWrite 把所有写操作(包括批量写入, BulkUpdate, 软删除及 *Returning)镜像到另一张表或另一个数据库, 用于在线变更表结构, 迁移数据库.
+// 镜像是尽力而为的: 影子表写入失败或影响的行数与主表不一致时, 记录 WARN 日志及
+// repository_shadow_divergence_total 指标, 不影响主表的写入. Create/Save/Update 把主表已经处理过的行(或 update)的副本
+// 直接写入影子表, 不再生成自动时间及 id, 也不再执行回调; 其他写操作使用影子表默认的实现.
+// 影子表带有主表 Repository 的 MandatoryCondition 及租户配置
+type ShadowWrite struct {
+	// Table 影子表, 为空时与主表同名(此时 Tm 应指向另一个数据库)
+	Table string
+	// Tm 影子表所在的数据库, 为空时与主表同库
+	Tm TransactionManager
+	// Async 为 true 时在主表提交后异步写入; 否则同步写入, 同库时在同一事务中(通过 SAVEPOINT 隔离失败)
+	Async bool
+	// Timeout 异步写入的超时时间, 默认 10s
+	Timeout time.Duration
+
+	once sync.Once
+	repo *Repository
+}
+
+// shadowRepo 影子表的 Repository
+func (e *Repository) shadowRepo() *Repository {
+	s := e.Shadow
+	s.once.Do(func() {
+		repo := NewRepository(e.Value)
+		repo.Tm = e.Tm
+		if s.Tm != nil {
+			repo.Tm = s.Tm
+		}
+		repo.table = s.Table
+		repo.primaryField = e.primaryField
+		repo.MandatoryCondition = e.MandatoryCondition
+		repo.TenantResolver = e.TenantResolver
+		repo.TenantField = e.TenantField
+		s.repo = repo
+	})
+	return s.repo
+}
+
+// trackRows 返回记录本次操作影响的行数的 ctx, 用于比较主表与影子表
+func trackRows(ctx context.Context) (context.Context, func() int64) {
+	if p, ok := ctx.Value(rowsAffectedKey{}).(*int64); ok {
+		start := *p
+		return ctx, func() int64 {
+			return *p - start
+		}
+	}
+	var n int64
+	return context.WithValue(ctx, rowsAffectedKey{}, &n), func() int64 {
+		return n
+	}
+}
+
+// shadowWrite 主表写入成功后调用, primaryRows < 0 表示不比较行数
+func (e *Repository) shadowWrite(ctx context.Context, op string, primaryRows int64, fn func(ctx context.Context, shadow *Repository) (int64, error)) {
+	s := e.Shadow
+	shadow := e.shadowRepo()
+	write := func(ctx context.Context) (ok bool) {
+		rows, err := fn(ctx, shadow)
+		if err == nil && (primaryRows < 0 || rows == primaryRows) {
+			return true
+		}
+		e.metrics().IncCounter("repository_shadow_divergence_total", map[string]string{"table": e.TableName(), "op": op})
+		Warn("[repository] shadow write diverged", zap.String("table", e.TableName()), zap.String("shadow", shadow.TableName()), zap.String("op", op),
+			zap.Int64("rows", primaryRows), zap.Int64("shadow_rows", rows), zap.Error(err))
+		return err == nil
+	}
+	if s.Async {
+		e.Tm.AfterCommit(ctx, func() {
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						Error("[repository] panic in shadow write", zap.String("table", e.TableName()), zap.Any("panic", r))
+					}
+				}()
+				timeout := s.Timeout
+				if timeout <= 0 {
+					timeout = defaultShadowTimeout
+				}
+				// 不使用调用方的 ctx, 请求结束后 ctx 会被 cancel
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				write(ctx)
+			}()
+		})
+		return
+	}
+	if s.Tm != nil {
+		write(ctx)
+		return
+	}
+	// 同库同事务: 失败时回滚到 savepoint, 避免 postgres 中整个事务失效
+	db := e.Tm.GetDb(ctx)
+	if db == nil {
+		return
+	}
+	if _, inTx := db.CommonDB().(*sql.Tx); !inTx {
+		write(ctx)
+		return
+	}
+	if err := execRaw(ctx, db, "SAVEPOINT repository_shadow").Error; err != nil {
+		Warn("[repository] shadow write savepoint failed", zap.String("table", e.TableName()), zap.Error(err))
+		return
+	}
+	end := "RELEASE SAVEPOINT repository_shadow"
+	if !write(ctx) {
+		end = "ROLLBACK TO SAVEPOINT repository_shadow"
+	}
+	if err := execRaw(ctx, db, end).Error; err != nil {
+		Warn("[repository] shadow write release savepoint failed", zap.String("table", e.TableName()), zap.Error(err))
+	}
+}
+
+// shadowModel 复制 model, 影子表的写入与调用方之后的修改互不影响
+func (e *Repository) shadowModel(model Model) Model {
+	return deepCopy(reflect.ValueOf(model), map[uintptr]reflect.Value{}).Interface().(Model)
+}
+
+// deepCopy 递归复制指针, slice, map 及 struct 的导出字段, seen 处理指针的循环引用
+func deepCopy(v reflect.Value, seen map[uintptr]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		if cp, ok := seen[v.Pointer()]; ok {
+			return cp
+		}
+		cp := reflect.New(v.Elem().Type())
+		seen[v.Pointer()] = cp
+		cp.Elem().Set(deepCopy(v.Elem(), seen))
+		return cp
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		cp := reflect.New(v.Type()).Elem()
+		cp.Set(deepCopy(v.Elem(), seen))
+		return cp
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		cp := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			cp.Index(i).Set(deepCopy(v.Index(i), seen))
+		}
+		return cp
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		cp := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			cp.SetMapIndex(iter.Key(), deepCopy(iter.Value(), seen))
+		}
+		return cp
+	case reflect.Struct:
+		cp := reflect.New(v.Type()).Elem()
+		cp.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if cp.Field(i).CanSet() {
+				cp.Field(i).Set(deepCopy(v.Field(i), seen))
+			}
+		}
+		return cp
+	}
+	return v
+}
+
+// writeShadowRow 把主表已经处理过(自动时间, 自动 id, 租户, BeforeRepoCreate 等)的 row 直接写入影子表,
+// 不再执行 CreateFunc/SaveFunc 及回调. row 是副本, 加密后不需要恢复
+func (e *Repository) writeShadowRow(ctx context.Context, row Model, created bool) error {
+	db := e.getDb(ctx)
+	if db == nil {
+		return dbNilErr
+	}
+	if err := encryptFields(ctx, row); err != nil {
+		return err
+	}
+	if created {
+		return writeColumns(ctx, db).Create(row).Error
+	}
+	db, err := e.tenantScoped(ctx, db)
+	if err != nil {
+		return err
+	}
+	return writeColumns(ctx, db).Model(e.NewStruct()).Updates(row).Error
+}
+
+func (e *Repository) shadowCreate(ctx context.Context, model Model) {
+	if e.Shadow == nil {
+		return
+	}
+	row := e.shadowModel(model)
+	e.shadowWrite(ctx, StmtCreate, -1, func(ctx context.Context, shadow *Repository) (int64, error) {
+		return 0, shadow.writeShadowRow(ctx, row, true)
+	})
+}
+
+// shadowSave Save 新建的行在影子表中同样新建(主键与主表一致)
+func (e *Repository) shadowSave(ctx context.Context, model Model, created bool) {
+	if e.Shadow == nil {
+		return
+	}
+	row := e.shadowModel(model)
+	e.shadowWrite(ctx, StmtSave, -1, func(ctx context.Context, shadow *Repository) (int64, error) {
+		return 0, shadow.writeShadowRow(ctx, row, created)
+	})
+}
+
+// shadowBatch BatchCreate/BatchUpsert 写入影子表, 主键与主表一致
+func (e *Repository) shadowBatch(ctx context.Context, op string, list []Model, conflict []FieldInterface) {
+	if e.Shadow == nil {
+		return
+	}
+	models := make([]Model, 0, len(list))
+	for _, m := range list {
+		models = append(models, e.shadowModel(m))
+	}
+	e.shadowWrite(ctx, op, -1, func(ctx context.Context, shadow *Repository) (int64, error) {
+		if len(conflict) > 0 {
+			return 0, shadow.BatchUpsert(ctx, models, conflict...)
+		}
+		return 0, shadow.BatchCreate(ctx, models)
+	})
+}
+
+func (e *Repository) shadowBulkUpdate(ctx context.Context, list []Model, updateFields []FieldInterface) {
+	if e.Shadow == nil {
+		return
+	}
+	models := make([]Model, 0, len(list))
+	for _, m := range list {
+		models = append(models, e.shadowModel(m))
+	}
+	e.shadowWrite(ctx, StmtBulkUpdate, -1, func(ctx context.Context, shadow *Repository) (int64, error) {
+		return 0, shadow.BulkUpdate(ctx, models, updateFields)
+	})
+}
+
+// shadowUpdate 以主表处理过(AUTOUPDATETIME, BeforeRepoUpdate)的 update 的副本直接更新影子表, 不再执行 UpdateFunc 及回调
+func (e *Repository) shadowUpdate(ctx context.Context, update interface{}, condition Condition, primaryRows int64) {
+	if e.Shadow == nil {
+		return
+	}
+	update = deepCopy(reflect.ValueOf(update), map[uintptr]reflect.Value{}).Interface()
+	e.shadowWrite(ctx, StmtUpdate, primaryRows, func(ctx context.Context, shadow *Repository) (int64, error) {
+		query, err := shadow.parseWhere(ctx, condition)
+		if err != nil {
+			return 0, err
+		}
+		if query == nil {
+			return 0, dbNilErr
+		}
+		if err = encryptUpdate(ctx, shadow.Value, update); err != nil {
+			return 0, err
+		}
+		res := writeColumns(ctx, query).Model(shadow.NewStruct()).Updates(update)
+		return res.RowsAffected, res.Error
+	})
+}
+
+func (e *Repository) shadowDelete(ctx context.Context, condition Condition, primaryRows int64) {
+	if e.Shadow == nil {
+		return
+	}
+	e.shadowWrite(ctx, StmtDelete, primaryRows, func(ctx context.Context, shadow *Repository) (int64, error) {
+		return shadow.DeleteN(ctx, condition)
+	})
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+)
+
+const slowQueryThresholdKey = "repository:slow_query_threshold"
+
+// SlowQuery 一次超过阈值的 sql
+type SlowQuery struct {
+	Table    string
+	SQL      string
+	Args     []interface{}
+	Duration time.Duration
+	// Threshold 触发时使用的阈值
+	Threshold time.Duration
+	// Explain 开启 DBConfig.SlowQueryExplain 时为执行计划, 否则为空
+	Explain string
+	Err     error
+}
+
+// SlowQueryHandler 在慢查询完成后同步调用, 不应阻塞
+type SlowQueryHandler func(ctx context.Context, q SlowQuery)
+
+var (
+	slowQueryHandler     SlowQueryHandler
+	slowQueryHandlerLock sync.RWMutex
+)
+
+// SetSlowQueryHandler 注册慢查询回调(如告警, 上报 metrics), 应在 main 中初始化时调用.
+// 无论是否注册, 慢查询都会以 WARN 级别记录完整的 sql 和(脱敏后的)参数
+func SetSlowQueryHandler(h SlowQueryHandler) {
+	slowQueryHandlerLock.Lock()
+	defer slowQueryHandlerLock.Unlock()
+	slowQueryHandler = h
+}
+
+func getSlowQueryHandler() SlowQueryHandler {
+	slowQueryHandlerLock.RLock()
+	defer slowQueryHandlerLock.RUnlock()
+	return slowQueryHandler
+}
+
+// reportSlowQuery 在 afterStatement 中调用
+func reportSlowQuery(ctx context.Context, scope *gorm.Scope, dbConf *DBConfig, elapsed time.Duration, explain bool) {
+	threshold := dbConf.SlowQueryThreshold
+	if v, ok := scope.Get(slowQueryThresholdKey); ok {
+		threshold = v.(time.Duration)
+	}
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+
+	q := SlowQuery{
+		Table:     scope.TableName(),
+		SQL:       scope.SQL,
+		Args:      scope.SQLVars,
+		Duration:  elapsed,
+		Threshold: threshold,
+		Err:       scope.DB().Error,
+	}
+	if explain && dbConf.SlowQueryExplain {
+		q.Explain = explainSlowQuery(scope, dbConf.Dialect)
+	}
+	Warn("[repository] slow query", zap.Any("key", ctx.Value("key")), zap.String("tx_id", TxIdFrom(ctx)), zap.String("table", q.Table), zap.String("sql", q.SQL),
+		zap.Any("args", redactArgs(scope, q.SQL, q.Args)), zap.Int64("request_time", elapsed.Milliseconds()), zap.String("explain", q.Explain))
+	metricsOf(scope.DB()).IncCounter("repository_slow_query_total", map[string]string{"table": q.Table})
+	if h := getSlowQueryHandler(); h != nil {
+		h(ctx, q)
+	}
+}
+
+// explainSlowQuery 在同一连接(事务)上执行 EXPLAIN, 直接使用 database/sql 以免再次触发 callback.
+// 失败时返回错误信息, 不影响原查询
+func explainSlowQuery(scope *gorm.Scope, dialect string) string {
+	prefix, _ := explainPrefix(dialect, false)
+	rows, err := scope.SQLDB().Query(prefix+scope.SQL, scope.SQLVars...)
+	if err != nil {
+		return fmt.Sprintf("explain failed: %v", err)
+	}
+	defer rows.Close()
+	plan, err := formatPlan(rows)
+	if err != nil {
+		return fmt.Sprintf("explain failed: %v", err)
+	}
+	return plan
+}
@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SQLCommentFunc 从 ctx 中取出需要写入 sql 注释的 tag, 例如 trace id
+type SQLCommentFunc func(ctx context.Context) map[string]string
+
+var (
+	sqlCommentFunc     SQLCommentFunc
+	sqlCommentFuncLock sync.RWMutex
+)
+
+// SetSQLCommentFunc 注册 SQLCommentFunc, 通常用来把 tracing 的 traceparent 写入注释, 应在 main 中初始化时调用
+func SetSQLCommentFunc(fn SQLCommentFunc) {
+	sqlCommentFuncLock.Lock()
+	defer sqlCommentFuncLock.Unlock()
+	sqlCommentFunc = fn
+}
+
+func getSQLCommentFunc() SQLCommentFunc {
+	sqlCommentFuncLock.RLock()
+	defer sqlCommentFuncLock.RUnlock()
+	return sqlCommentFunc
+}
+
+type sqlCommentKey struct{}
+
+// WithSQLComment 返回的 ctx 中的语句会带上 kv (key1, value1, key2, value2...) 作为注释, 例如接口名
+//
+//	ctx = WithSQLComment(ctx, "endpoint", "POST /orders")
+func WithSQLComment(ctx context.Context, kv ...string) context.Context {
+	tags := make(map[string]string)
+	if parent, ok := ctx.Value(sqlCommentKey{}).(map[string]string); ok {
+		for k, v := range parent {
+			tags[k] = v
+		}
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		tags[kv[i]] = kv[i+1]
+	}
+	return context.WithValue(ctx, sqlCommentKey{}, tags)
+}
+
+// registerSQLComment DBConfig.SQLComment 开启时, 在每条语句末尾加上 sqlcommenter 格式的注释:
+// caller (调用 Repository 的函数及行号), WithSQLComment 及 SetSQLCommentFunc 提供的 tag
+func registerSQLComment(cb *gorm.Callback) {
+	register := func(p *gorm.CallbackProcessor, before, option string) {
+		p.Before(before).Register("repository:sql_comment", func(scope *gorm.Scope) {
+			ctx := context.Background()
+			if v, ok := scope.Get(statementCtxKey); ok {
+				ctx = v.(context.Context)
+			}
+			comment := sqlComment(ctx)
+			if v, ok := scope.Get(option); ok {
+				comment = fmt.Sprint(v) + " " + comment
+			}
+			scope.Set(option, comment)
+		})
+	}
+	register(cb.Create(), "gorm:create", "gorm:insert_option")
+	register(cb.Query(), "gorm:query", "gorm:query_option")
+	register(cb.Update(), "gorm:update", "gorm:update_option")
+	register(cb.Delete(), "gorm:delete", "gorm:delete_option")
+	register(cb.RowQuery(), "gorm:row_query", "gorm:query_option")
+}
+
+func sqlComment(ctx context.Context) string {
+	tags := make(map[string]string)
+	if fn := getSQLCommentFunc(); fn != nil {
+		for k, v := range fn(ctx) {
+			tags[k] = v
+		}
+	}
+	if m, ok := ctx.Value(sqlCommentKey{}).(map[string]string); ok {
+		for k, v := range m {
+			tags[k] = v
+		}
+	}
+	if caller := sqlCaller(); caller != "" {
+		tags["caller"] = caller
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		// url 编码后不会出现 */ 和 '
+		pairs = append(pairs, fmt.Sprintf("%s='%s'", url.QueryEscape(k), url.QueryEscape(tags[k])))
+	}
+	return "/*" + strings.Join(pairs, ",") + "*/"
+}
+
+var pkgPath = reflect.TypeOf(Repository{}).PkgPath()
+
+// sqlCaller 调用栈中第一个不属于本包及 gorm 的函数, 如 service.(*OrderService).Create:42
+func sqlCaller() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		fn := frame.Function
+		if !strings.HasPrefix(fn, pkgPath+".") && !strings.HasPrefix(fn, "github.com/jinzhu/gorm") && !strings.HasPrefix(fn, "runtime.") {
+			return fmt.Sprintf("%s:%d", fn[strings.LastIndex(fn, "/")+1:], frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	statementStartKey  = "repository:statement_start"
+	statementCtxKey    = "repository:statement_ctx"
+	statementModelKey  = "repository:statement_model"
+	statementLoggerKey = "repository:statement_logger"
+	// sqlCommentEnabledKey 设置在根连接上, 表示 DBConfig.SQLComment 已开启, 供 execRaw 判断
+	sqlCommentEnabledKey = "repository:sql_comment_enabled"
+)
+
+type stmtOpKey struct{}
+
+// QueryLog 一条执行完成的 sql
+type QueryLog struct {
+	// Op repository 的操作(StatementInfo.Op), 不经过 Repository 时为 gorm 的 callback 类型(create/query/update/delete/row_query)
+	Op    string
+	Table string
+	// TxId 所在事务的 ID, 不在事务中时为空, 参见 TxIdFrom
+	TxId string
+	SQL  string
+	// Args 已按 RedactArgs 的规则脱敏
+	Args     []interface{}
+	Rows     int64
+	Duration time.Duration
+	Err      error
+}
+
+// QueryLogger 接收每条 sql 的执行结果. 本包内通过 db.Exec 执行的原生 sql 经由 execRaw 记录, Op 为 "exec"
+type QueryLogger interface {
+	LogQuery(ctx context.Context, q QueryLog)
+}
+
+// QueryLoggerFunc adapts a func to QueryLogger
+type QueryLoggerFunc func(ctx context.Context, q QueryLog)
+
+func (f QueryLoggerFunc) LogQuery(ctx context.Context, q QueryLog) {
+	f(ctx, q)
+}
+
+type nopQueryLogger struct{}
+
+func (nopQueryLogger) LogQuery(context.Context, QueryLog) {}
+
+// NopQueryLogger 不记录任何 sql
+var NopQueryLogger QueryLogger = nopQueryLogger{}
+
+type zapQueryLogger struct {
+	level zapcore.Level
+}
+
+// ZapQueryLogger 默认的 logger, 以 INFO 级别记录, 执行出错时为 WARN
+var ZapQueryLogger QueryLogger = zapQueryLogger{level: zapcore.InfoLevel}
+
+// ZapQueryLoggerAt 以 level 记录的 ZapQueryLogger, 执行出错时仍为 WARN(level 更高时为 level)
+func ZapQueryLoggerAt(level zapcore.Level) QueryLogger {
+	return zapQueryLogger{level: level}
+}
+
+func (l zapQueryLogger) LogQuery(ctx context.Context, q QueryLog) {
+	level := l.level
+	args := []interface{}{"[loadlog][sql] " + q.Op, zap.Any("key", ctx.Value("key")), zap.String("table", q.Table), zap.String("sql", q.SQL), zap.Any("args", q.Args),
+		zap.Int64("rows", q.Rows), zap.Int64("request_time", q.Duration.Milliseconds())}
+	if q.TxId != "" {
+		args = append(args, zap.String("tx_id", q.TxId))
+	}
+	if q.Err != nil && !gorm.IsRecordNotFoundError(q.Err) {
+		args = append(args, zap.Error(q.Err))
+		if level < zapcore.WarnLevel {
+			level = zapcore.WarnLevel
+		}
+	}
+	switch level {
+	case zapcore.DebugLevel:
+		Debug(args...)
+	case zapcore.InfoLevel:
+		Info(args...)
+	case zapcore.WarnLevel:
+		Warn(args...)
+	default:
+		Error(args...)
+	}
+}
+
+// SetLogger 设置当前 Repository 的 sql logger, nil 表示使用全局 logger
+func (e *Repository) SetLogger(l QueryLogger) {
+	e.QueryLogger = l
+}
+
+// SetLogLevel 设置当前 Repository 的 sql 日志级别(debug, info, warn, error), "off" 关闭日志
+func (e *Repository) SetLogLevel(level string) {
+	if strings.ToLower(level) == "off" {
+		e.QueryLogger = NopQueryLogger
+		return
+	}
+	e.QueryLogger = ZapQueryLoggerAt(getLoggerLevel(strings.ToLower(level)))
+}
+
+var (
+	queryLogger     = ZapQueryLogger
+	queryLoggerLock sync.RWMutex
+)
+
+// SetQueryLogger 设置全局的 sql logger, 应在 main 中初始化时调用. 为 nil 时关闭 sql 日志
+func SetQueryLogger(l QueryLogger) {
+	queryLoggerLock.Lock()
+	defer queryLoggerLock.Unlock()
+	if l == nil {
+		l = NopQueryLogger
+	}
+	queryLogger = l
+}
+
+func getQueryLogger() QueryLogger {
+	queryLoggerLock.RLock()
+	defer queryLoggerLock.RUnlock()
+	return queryLogger
+}
+
+var (
+	redactColumns     = map[string]string{"password": "", "passwd": "", "token": "", "secret": ""}
+	redactColumnsLock sync.RWMutex
+)
+
+// RedactColumn 注册需要脱敏的列名(不区分表), profile 为 mask profile, 为空时完全隐藏.
+// 默认包含 password, passwd, token, secret; model 中带 pii/secret tag 的字段总是会脱敏
+func RedactColumn(column string, profile string) {
+	redactColumnsLock.Lock()
+	defer redactColumnsLock.Unlock()
+	redactColumns[strings.ToLower(column)] = profile
+}
+
+// registerStatementCallbacks 在 gorm 的 create/query/update/delete/row_query 前后计时, 记录 sql 日志并检测慢查询
+func registerStatementCallbacks(db *gorm.DB, dbConf *DBConfig) {
+	cb := db.Callback()
+	register := func(p *gorm.CallbackProcessor, before, after, kind string, explain bool) {
+		p.Before(before).Register("repository:statement_start", func(scope *gorm.Scope) {
+			scope.InstanceSet(statementStartKey, time.Now())
+			touchTx(scope)
+		})
+		p.After(after).Register("repository:statement_end", func(scope *gorm.Scope) {
+			touchTx(scope)
+			countTxStatement(scope)
+			afterStatement(scope, dbConf, kind, explain)
+		})
+	}
+	register(cb.Create(), "gorm:begin_transaction", "gorm:commit_or_rollback_transaction", "create", true)
+	register(cb.Query(), "gorm:query", "gorm:query", "query", true)
+	register(cb.Update(), "gorm:begin_transaction", "gorm:commit_or_rollback_transaction", "update", true)
+	register(cb.Delete(), "gorm:begin_transaction", "gorm:commit_or_rollback_transaction", "delete", true)
+	// Row/Rows 返回时结果集还未读取, 同一连接上不能再执行 EXPLAIN
+	register(cb.RowQuery(), "gorm:row_query", "gorm:row_query", "row_query", false)
+	if dbConf.SQLComment {
+		registerSQLComment(cb)
+		db.InstantSet(sqlCommentEnabledKey, true)
+	}
+}
+
+func afterStatement(scope *gorm.Scope, dbConf *DBConfig, kind string, explain bool) {
+	v, ok := scope.InstanceGet(statementStartKey)
+	if !ok || scope.SQL == "" {
+		return
+	}
+	elapsed := time.Since(v.(time.Time))
+
+	ctx := context.Background()
+	if v, ok := scope.Get(statementCtxKey); ok {
+		ctx = v.(context.Context)
+	}
+	logger := getQueryLogger()
+	if v, ok := scope.Get(statementLoggerKey); ok {
+		logger = v.(QueryLogger)
+	}
+	if _, nop := logger.(nopQueryLogger); !nop {
+		op, ok := ctx.Value(stmtOpKey{}).(string)
+		if !ok {
+			op = kind
+		}
+		logger.LogQuery(ctx, QueryLog{
+			Op:       op,
+			Table:    scope.TableName(),
+			TxId:     TxIdFrom(ctx),
+			SQL:      scope.SQL,
+			Args:     redactArgs(scope, scope.SQL, scope.SQLVars),
+			Rows:     scope.DB().RowsAffected,
+			Duration: elapsed,
+			Err:      scope.DB().Error,
+		})
+	}
+	reportSlowQuery(ctx, scope, dbConf, elapsed, explain)
+}
+
+// execRaw 执行原生 sql. db.Exec 不经过 gorm callback, 这里补上 sql 注释(DBConfig.SQLComment 开启时)及 QueryLogger 的记录
+func execRaw(ctx context.Context, db *gorm.DB, query string, vars ...interface{}) *gorm.DB {
+	query = withRawComment(ctx, db, query)
+	start := time.Now()
+	res := db.Exec(query, vars...)
+	logRaw(ctx, db, query, vars, res.RowsAffected, time.Since(start), res.Error)
+	return res
+}
+
+// execRawResult 同 execRaw, 但直接在 CommonDB 上执行(不展开 gorm 的占位符), 返回的 sql.Result 可以读取 LastInsertId
+func execRawResult(ctx context.Context, db *gorm.DB, query string, vars ...interface{}) (sql.Result, error) {
+	query = withRawComment(ctx, db, query)
+	start := time.Now()
+	res, err := db.CommonDB().Exec(query, vars...)
+	var rows int64
+	if err == nil {
+		rows, _ = res.RowsAffected()
+	}
+	logRaw(ctx, db, query, vars, rows, time.Since(start), err)
+	return res, err
+}
+
+func withRawComment(ctx context.Context, db *gorm.DB, query string) string {
+	if enabled, _ := db.Get(sqlCommentEnabledKey); enabled == true {
+		query += " " + sqlComment(ctx)
+	}
+	return query
+}
+
+// logRaw 按 withStatementValues 设置的 logger 及 model 记录原生 sql
+func logRaw(ctx context.Context, db *gorm.DB, query string, vars []interface{}, rows int64, elapsed time.Duration, err error) {
+	logger := getQueryLogger()
+	if v, ok := db.Get(statementLoggerKey); ok {
+		logger = v.(QueryLogger)
+	}
+	if _, nop := logger.(nopQueryLogger); nop {
+		return
+	}
+	op, ok := ctx.Value(stmtOpKey{}).(string)
+	if !ok {
+		op = "exec"
+	}
+	model, _ := db.Get(statementModelKey)
+	var table string
+	if m, ok := model.(Model); ok {
+		table = m.TableName()
+	}
+	logger.LogQuery(ctx, QueryLog{
+		Op:       op,
+		Table:    table,
+		TxId:     TxIdFrom(ctx),
+		SQL:      query,
+		Args:     RedactArgs(model, query, vars),
+		Rows:     rows,
+		Duration: elapsed,
+		Err:      err,
+	})
+}
+
+// withStatementValues 让 callback 能拿到 ctx, model, 以及当前 Repository 的 logger 和慢查询阈值
+func (e *Repository) withStatementValues(ctx context.Context, db *gorm.DB) *gorm.DB {
+	db = db.Set(statementCtxKey, ctx).Set(statementModelKey, e.Value)
+	if e.QueryLogger != nil {
+		db = db.Set(statementLoggerKey, e.QueryLogger)
+	}
+	if e.SlowQueryThreshold > 0 {
+		db = db.Set(slowQueryThresholdKey, e.SlowQueryThreshold)
+	}
+	if e.Metrics != nil {
+		db = db.Set(statementMetricsKey, e.Metrics)
+	}
+	return db
+}
+
+// RedactArgs 按 args 在 sql 中对应的列脱敏: model 中 pii 字段按 mask profile 处理, secret 字段及 RedactColumn 注册的列隐藏.
+// 列根据占位符前的 "列 操作符" 及 INSERT 的列清单推断, 推断不出的参数原样返回
+func RedactArgs(model interface{}, sql string, args []interface{}) []interface{} {
+	rules := redactRules(model)
+	out := make([]interface{}, len(args))
+	copy(out, args)
+	for i, col := range argColumns(sql, len(args)) {
+		if fc, ok := rules[strings.ToLower(col)]; ok {
+			out[i] = redactValue(fc, out[i])
+		}
+	}
+	return out
+}
+
+// redactRules 小写列名 -> 分级, 包括 RedactColumn 注册的列及 model 中带 tag 的字段
+func redactRules(model interface{}) map[string]FieldClass {
+	rules := make(map[string]FieldClass)
+	redactColumnsLock.RLock()
+	for col, profile := range redactColumns {
+		rules[col] = FieldClass{Column: col, Class: ClassSecret, Mask: profile}
+		if profile != "" {
+			rules[col] = FieldClass{Column: col, Class: ClassPII, Mask: profile}
+		}
+	}
+	redactColumnsLock.RUnlock()
+	if model != nil && Indirect(reflect.ValueOf(model)).Kind() == reflect.Struct {
+		for _, fc := range ClassifiedFields(model) {
+			rules[strings.ToLower(fc.Column)] = fc
+		}
+	}
+	return rules
+}
+
+func redactValue(fc FieldClass, val interface{}) interface{} {
+	if fc.Class == ClassSecret {
+		return "***"
+	}
+	if fv := reflect.Indirect(reflect.ValueOf(val)); fv.IsValid() {
+		return MaskValue(fc.Mask, fmt.Sprint(fv.Interface()))
+	}
+	return val
+}
+
+// RedactColumns 返回 values (列名 -> 值, 如 Update 的 map) 的脱敏副本, 规则同 RedactArgs
+func RedactColumns(model interface{}, values map[string]interface{}) map[string]interface{} {
+	rules := redactRules(model)
+	out := make(map[string]interface{}, len(values))
+	for col, val := range values {
+		if fc, ok := rules[strings.ToLower(col)]; ok {
+			val = redactValue(fc, val)
+		}
+		out[col] = val
+	}
+	return out
+}
+
+func redactArgs(scope *gorm.Scope, sql string, args []interface{}) []interface{} {
+	model := scope.Value
+	if v, ok := scope.Get(statementModelKey); ok {
+		model = v
+	}
+	return RedactArgs(model, sql, args)
+}
+
+var (
+	placeholderRe   = regexp.MustCompile(`\$\d+|\?`)
+	argColumnRe     = regexp.MustCompile(`(?i)([\w"` + "`" + `.]+)\s*(?:=|<>|!=|<=|>=|<|>|@>|<@|&&|\bNOT\s+LIKE|\bLIKE|\bNOT\s+ILIKE|\bILIKE|\bNOT\s+IN\s*\(|\bIN\s*\(|=\s*ANY\s*\(|\bBETWEEN)\s*(?:(?:\$\d+|\?)\s*(?:,|\bAND\b)\s*)*$`)
+	insertColumnsRe = regexp.MustCompile(`(?is)^\s*INSERT\s+INTO\s+\S+\s*\(([^)]*)\)\s*VALUES`)
+)
+
+// argColumns 第 i 个参数对应的列, 推断不出时为空. 不处理字符串字面量中的 ? 等极端情况
+func argColumns(sql string, n int) []string {
+	cols := make([]string, n)
+	locs := placeholderRe.FindAllStringIndex(sql, -1)
+	var insertCols []string
+	valuesAt := 0
+	if m := insertColumnsRe.FindStringSubmatchIndex(sql); m != nil {
+		for _, c := range strings.Split(sql[m[2]:m[3]], ",") {
+			insertCols = append(insertCols, unquoteColumn(c))
+		}
+		valuesAt = m[1]
+	}
+	inserted := 0
+	for i, loc := range locs {
+		if i >= n {
+			break
+		}
+		if len(insertCols) > 0 && loc[0] > valuesAt && !strings.Contains(strings.ToUpper(sql[valuesAt:loc[0]]), " ON ") {
+			// 多行 insert 中所有值都是占位符, 按位置对应列
+			cols[i] = insertCols[inserted%len(insertCols)]
+			inserted++
+			continue
+		}
+		start := loc[0] - 200
+		if start < 0 {
+			start = 0
+		}
+		if m := argColumnRe.FindStringSubmatch(sql[start:loc[0]]); m != nil {
+			cols[i] = unquoteColumn(m[1])
+		}
+	}
+	return cols
+}
+
+// unquoteColumn "t"."col" -> col
+func unquoteColumn(c string) string {
+	c = strings.TrimSpace(c)
+	if i := strings.LastIndex(c, "."); i >= 0 {
+		c = c[i+1:]
+	}
+	return strings.Trim(c, "\"`")
+}
@@ -0,0 +1,269 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+)
+
+// StaticRepository 把一张小表(如国家, 配置, 枚举表)整体加载到内存, FindOne/FindById/FindByIds/Find/Count/FindAndCount
+// 在内存中计算(条件参见 ConditionNode.Match, Options 只支持按列排序及 Limit), 返回的是副本.
+// 写操作仍由 Repository 写入数据库, 之后通过 Refresh 定期刷新, 或 Repository.ChangeNotifier 的事件触发刷新.
+// 不支持 TenantResolver 及 Policy
+type StaticRepository struct {
+	*Repository
+	// Refresh 刷新间隔, <= 0 表示不定期刷新
+	Refresh time.Duration
+
+	mu   sync.RWMutex
+	rows []interface{}
+	byId map[interface{}]interface{}
+}
+
+// implements hint
+var _ RepositoryInterface = (*StaticRepository)(nil)
+
+func NewStaticRepository(repo *Repository, refresh time.Duration) *StaticRepository {
+	return &StaticRepository{Repository: repo, Refresh: refresh}
+}
+
+// Load 从数据库读取整张表(带 MandatoryCondition), 替换内存中的数据
+func (s *StaticRepository) Load(ctx context.Context) error {
+	if s.TenantResolver != nil || s.Policy != nil {
+		return errors.New("static repository does not support TenantResolver or Policy")
+	}
+	slice, err := s.findNoCache(ctx, MatchAll())
+	if err != nil {
+		return err
+	}
+	sv := reflect.ValueOf(slice).Elem()
+	rows := make([]interface{}, 0, sv.Len())
+	byId := make(map[interface{}]interface{}, sv.Len())
+	for i := 0; i < sv.Len(); i++ {
+		row := sv.Index(i)
+		if row.Kind() != reflect.Ptr {
+			row = row.Addr()
+		}
+		rows = append(rows, row.Interface())
+		if pk, ok := s.primaryValue(row.Interface()); ok {
+			byId[staticKey(pk)] = row.Interface()
+		}
+	}
+	s.mu.Lock()
+	s.rows, s.byId = rows, byId
+	s.mu.Unlock()
+	return nil
+}
+
+// Start 加载数据, 之后按 Refresh 以及 ChangeNotifier 的事件在后台刷新, 直到 ctx 结束. 刷新失败时保留旧数据
+func (s *StaticRepository) Start(ctx context.Context) error {
+	if err := s.Load(ctx); err != nil {
+		return err
+	}
+	changed := make(chan struct{}, 1)
+	if s.ChangeNotifier != nil {
+		unsubscribe := s.ChangeNotifier.Subscribe(s.TableName(), func(ctx context.Context, event ChangeEvent) {
+			select {
+			case changed <- struct{}{}:
+			default:
+				// 已经有待执行的刷新
+			}
+		})
+		go func() {
+			<-ctx.Done()
+			unsubscribe()
+		}()
+	}
+	var tick <-chan time.Time
+	if s.Refresh > 0 {
+		ticker := time.NewTicker(s.Refresh)
+		tick = ticker.C
+		go func() {
+			<-ctx.Done()
+			ticker.Stop()
+		}()
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			case <-changed:
+			}
+			if err := s.Load(ctx); err != nil {
+				Warn("[repository] refresh static table failed", zap.String("table", s.TableName()), zap.Error(err))
+			}
+		}
+	}()
+	return nil
+}
+
+// staticKey 统一数值类型的主键, 避免 int 与 int64 不相等. 整数统一为 int64 (超出 int64 的 uint64 保持 uint64),
+// 浮点数只有能精确表示为 int64 时才与整数相同, 不经过 float64 以免大的 id 相互覆盖
+func staticKey(id interface{}) interface{} {
+	rv := reflect.ValueOf(id)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if u := rv.Uint(); u <= math.MaxInt64 {
+			return int64(u)
+		}
+		return rv.Uint()
+	case reflect.Float32, reflect.Float64:
+		if f := rv.Float(); f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+			return int64(f)
+		}
+		return rv.Float()
+	}
+	return id
+}
+
+func cloneRow(row interface{}) reflect.Value {
+	src := reflect.Indirect(reflect.ValueOf(row))
+	dst := reflect.New(src.Type())
+	dst.Elem().Set(src)
+	return dst
+}
+
+// appendRow 按 slice 元素的类型(struct 或指针)追加 row 的副本
+func appendRow(slice reflect.Value, row interface{}) reflect.Value {
+	cp := cloneRow(row)
+	if slice.Type().Elem().Kind() != reflect.Ptr {
+		cp = cp.Elem()
+	}
+	return reflect.Append(slice, cp)
+}
+
+func (s *StaticRepository) match(condition Condition) ([]interface{}, error) {
+	node := Inspect(condition)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var rows []interface{}
+	for _, row := range s.rows {
+		ok, err := node.Match(row)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+func (s *StaticRepository) FindOne(ctx context.Context, condition Condition) (Model, error) {
+	rows, err := s.match(condition)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return cloneRow(rows[0]).Interface().(Model), nil
+}
+
+func (s *StaticRepository) FindById(ctx context.Context, id interface{}) (Model, error) {
+	s.mu.RLock()
+	row, ok := s.byId[staticKey(id)]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return cloneRow(row).Interface().(Model), nil
+}
+
+// FindByIds 结果按 ids 的顺序, 不存在的 id 被跳过
+func (s *StaticRepository) FindByIds(ctx context.Context, ids interface{}, additional ...Condition) (interface{}, error) {
+	slice := s.NewSlice()
+	sv := reflect.ValueOf(slice).Elem()
+	node := Inspect(MatchAll(additional...))
+	idv := reflect.ValueOf(ids)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := 0; i < idsLen(ids); i++ {
+		row, ok := s.byId[staticKey(idv.Index(i).Interface())]
+		if !ok {
+			continue
+		}
+		matched, err := node.Match(row)
+		if err != nil {
+			return s.NewSlice(), err
+		}
+		if matched {
+			sv = appendRow(sv, row)
+		}
+	}
+	reflect.ValueOf(slice).Elem().Set(sv)
+	return slice, nil
+}
+
+// FindByIdsOrdered 同 FindByIds, 去掉重复的 id
+func (s *StaticRepository) FindByIdsOrdered(ctx context.Context, ids interface{}, additional ...Condition) (interface{}, error) {
+	return s.FindByIds(ctx, uniqueIds(ids), additional...)
+}
+
+func (s *StaticRepository) Find(ctx context.Context, condition Condition, options ...Option) (interface{}, error) {
+	slice := s.NewSlice()
+	rows, err := s.match(condition)
+	if err != nil {
+		return slice, err
+	}
+	spec := InspectOptions(options...)
+	if len(spec.Orders) > 0 {
+		sort.SliceStable(rows, func(i, j int) bool {
+			for _, o := range spec.Orders {
+				c, _ := CompareValues(columnValue(rows[i], o.Column), columnValue(rows[j], o.Column))
+				if c != 0 {
+					return c*int(o.Order) < 0
+				}
+			}
+			return false
+		})
+	}
+	if spec.Offset > 0 {
+		if spec.Offset >= len(rows) {
+			rows = nil
+		} else {
+			rows = rows[spec.Offset:]
+		}
+	}
+	if spec.Limit > 0 && spec.Limit < len(rows) {
+		rows = rows[:spec.Limit]
+	}
+	sv := reflect.ValueOf(slice).Elem()
+	for _, row := range rows {
+		sv = appendRow(sv, row)
+	}
+	reflect.ValueOf(slice).Elem().Set(sv)
+	return slice, nil
+}
+
+// Exists 忽略 options
+func (s *StaticRepository) Exists(ctx context.Context, condition Condition, options ...Option) (bool, error) {
+	rows, err := s.match(condition)
+	return len(rows) > 0, err
+}
+
+// Count 忽略 options
+func (s *StaticRepository) Count(ctx context.Context, condition Condition, options ...Option) (int, error) {
+	rows, err := s.match(condition)
+	return len(rows), err
+}
+
+func (s *StaticRepository) FindAndCount(ctx context.Context, condition Condition, options ...Option) (interface{}, int, error) {
+	total, err := s.Count(ctx, condition)
+	if err != nil {
+		return s.NewSlice(), 0, err
+	}
+	slice, err := s.Find(ctx, condition, options...)
+	return slice, total, err
+}
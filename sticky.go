@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultStickyPrimaryWindow = 2 * time.Second
+
+type readSessionKey struct{}
+
+// readSession 记录会话中每个数据库最后一次写入的时间, key 参见 databaseKeyer
+type readSession struct {
+	mu     sync.Mutex
+	writes map[string]time.Time
+}
+
+// WithReadSession 开启一个读己之写的会话(通常在每个请求的入口调用): 会话中对某个数据库写入后,
+// DBConfig.StickyPrimaryWindow 内同一会话的读操作都读主库, 避免 Create 后立即读从库读不到.
+// 事务中的写入在提交后才计入. 没有配置从库时没有影响
+func WithReadSession(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(readSessionKey{}).(*readSession); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, readSessionKey{}, &readSession{writes: make(map[string]time.Time)})
+}
+
+// databaseKeyer 可选接口, TransactionManager 实现后其写操作计入读己之写的会话.
+// key 在配置重新加载(DBConfig 被替换)后保持不变
+type databaseKeyer interface {
+	databaseKey() string
+}
+
+func (tm *transactionManager) databaseKey() string {
+	return tm.serviceName + "#" + tm.database
+}
+
+// markWrite 写操作成功后调用, 在事务提交后记录写入时间
+func (e *Repository) markWrite(ctx context.Context, op string) {
+	if !isWriteOp(op) {
+		return
+	}
+	rs, ok := ctx.Value(readSessionKey{}).(*readSession)
+	if !ok {
+		return
+	}
+	dk, ok := e.Tm.(databaseKeyer)
+	if !ok {
+		return
+	}
+	key := dk.databaseKey()
+	e.Tm.AfterCommit(ctx, func() {
+		rs.mu.Lock()
+		rs.writes[key] = time.Now()
+		rs.mu.Unlock()
+	})
+}
+
+// stickyPrimary 会话中最近写入过 key 对应的数据库
+func stickyPrimary(ctx context.Context, key string, dbConf *DBConfig) bool {
+	rs, ok := ctx.Value(readSessionKey{}).(*readSession)
+	if !ok {
+		return false
+	}
+	rs.mu.Lock()
+	last, ok := rs.writes[key]
+	rs.mu.Unlock()
+	if !ok {
+		return false
+	}
+	window := dbConf.StickyPrimaryWindow
+	if window <= 0 {
+		window = defaultStickyPrimaryWindow
+	}
+	return time.Since(last) < window
+}
@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+var tempTableSeq uint64
+
+// TempTableCreator 可选接口, TransactionManager 实现后 CreateTempTable 使用其实现(如 repotest 中基于内存的临时表)
+type TempTableCreator interface {
+	// CreateTempTable 在事务中创建 model 的临时表(事务结束时删除), 并以绑定到临时表的 Repository 执行 fn
+	CreateTempTable(ctx context.Context, model Model, fn func(ctx context.Context, repo RepositoryInterface) error) error
+}
+
+// CreateTempTable 在 tm 的事务中创建与 model 表结构相同的临时表, 并以绑定到临时表的 Repository 执行 fn.
+// tm 实现了 TempTableCreator 时使用其实现; 否则临时表使用 ON COMMIT DROP, 提交或回滚后自动删除, 目前只支持 postgres
+//
+// 常见用法是先把数据批量写入临时表, 再通过 insert ... select / delete ... using 与正式表合并
+func CreateTempTable(ctx context.Context, tm TransactionManager, model Model, fn func(ctx context.Context, repo RepositoryInterface) error) error {
+	if tc, ok := tm.(TempTableCreator); ok {
+		return tc.CreateTempTable(ctx, model, fn)
+	}
+	_, err := tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		db := tm.GetDb(ctx)
+		if db == nil {
+			return nil, dbNilErr
+		}
+		if dialect := db.Dialect().GetName(); dialect != DialectPostgres {
+			return nil, fmt.Errorf("temp table is not supported for %s", dialect)
+		}
+		name := fmt.Sprintf("tmp_%s_%d", model.TableName(), atomic.AddUint64(&tempTableSeq, 1))
+		ddl := fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP", name, model.TableName())
+		if err := db.Exec(ddl).Error; err != nil {
+			return nil, err
+		}
+		repo := NewRepository(model)
+		repo.Tm = tm
+		repo.table = name
+		return nil, fn(ctx, repo)
+	})
+	return err
+}
@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"reflect"
+)
+
+// ErrNoTenant TenantResolver 没有从 ctx 中解析出租户
+var ErrNoTenant = errors.New("no tenant in context")
+
+const defaultTenantField = SimpleField("tenant_id")
+
+func (e *Repository) tenantField() FieldInterface {
+	if e.TenantField != nil {
+		return e.TenantField
+	}
+	return defaultTenantField
+}
+
+// resolveTenant 租户为 nil 或零值同样视为没有租户
+func (e *Repository) resolveTenant(ctx context.Context) (interface{}, error) {
+	tenant, err := e.TenantResolver(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoTenant, err)
+	}
+	if tenant == nil || reflect.ValueOf(tenant).IsZero() {
+		return nil, ErrNoTenant
+	}
+	return tenant, nil
+}
+
+func (e *Repository) tenantCondition(ctx context.Context) (Condition, error) {
+	tenant, err := e.resolveTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return e.tenantField().Eq(tenant), nil
+}
+
+// tenantScoped 给不经过 parseWhere 的语句加上租户条件
+func (e *Repository) tenantScoped(ctx context.Context, db *gorm.DB) (*gorm.DB, error) {
+	if e.TenantResolver == nil {
+		return db, nil
+	}
+	tc, err := e.tenantCondition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ParseWhere(tc, db), nil
+}
+
+// stampTenant Create 前写入租户, model 中已有其他租户时拒绝写入
+func (e *Repository) stampTenant(ctx context.Context, scope *gorm.Scope) error {
+	if e.TenantResolver == nil {
+		return nil
+	}
+	tenant, err := e.resolveTenant(ctx)
+	if err != nil {
+		return err
+	}
+	column := e.tenantField().Column()
+	f, ok := scope.FieldByName(column)
+	if !ok {
+		return fmt.Errorf("tenant field %s not found in %s", column, e.TableName())
+	}
+	// 用字符串比较, 避免 int 与 int64 等类型不同但值相同的情况
+	if !f.IsBlank && fmt.Sprint(f.Field.Interface()) != fmt.Sprint(tenant) {
+		return fmt.Errorf("can not create %s for tenant %v in tenant %v", e.TableName(), f.Field.Interface(), tenant)
+	}
+	return f.Set(tenant)
+}
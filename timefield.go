@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	c_TruncEq = "DATE_TRUNC = ?"
+
+	// OpTruncEq 的 Args[0] 为单位(TimeUnit*), Args[1] 为截断后的时间
+	OpTruncEq = c_TruncEq
+)
+
+// TimeField.TruncEq 支持的单位
+const (
+	TimeUnitYear   = "year"
+	TimeUnitMonth  = "month"
+	TimeUnitDay    = "day"
+	TimeUnitHour   = "hour"
+	TimeUnitMinute = "minute"
+)
+
+// TimeField 时间列. OnDate/InLastDays/BetweenTimes 生成范围条件(可以使用索引), TruncEq 按 dialect 生成截断函数
+type TimeField string
+
+func (t TimeField) Column() string {
+	return string(t)
+}
+
+// OnDate d 所在的自然日(d 的时区), field >= 当天 0 点 AND field < 次日 0 点
+func (t TimeField) OnDate(d time.Time) Condition {
+	from, to := TimeUnitRange(TimeUnitDay, d)
+	return t.BetweenTimes(from, to)
+}
+
+// InLastDays 最近 n 天, field >= 当前时间减 n 天. 时间在构造条件时计算
+func (t TimeField) InLastDays(n int) Condition {
+	return SimpleField(t).Gte(time.Now().AddDate(0, 0, -n))
+}
+
+// BetweenTimes field >= from AND field < to, 与 Between 不同, 不包含 to
+func (t TimeField) BetweenTimes(from, to time.Time) Condition {
+	return SimpleField(t).Gte(from).And(SimpleField(t).Lt(to))
+}
+
+// TruncEq 把 field 按 unit 截断后与截断后的 v 比较, 如 TruncEq(TimeUnitMonth, v) 为与 v 同月.
+// postgres 使用 DATE_TRUNC, mysql 使用 DATE_FORMAT, sqlite 使用 strftime. 不能使用 field 上的索引, 需要索引时使用 BetweenTimes.
+// unit 不是 TimeUnit* 之一时 panic
+func (t TimeField) TruncEq(unit string, v time.Time) Condition {
+	from, _ := TimeUnitRange(unit, v)
+	return &singleCondition{
+		field:   SimpleField(t),
+		op:      c_TruncEq,
+		sqlArg1: unit,
+		sqlArg2: from,
+		rawVal1: unit,
+		rawVal2: v,
+	}
+}
+
+// TimeUnitRange v 所在的 unit 的区间 [from, to), 使用 v 的时区. unit 不是 TimeUnit* 之一时 panic
+func TimeUnitRange(unit string, v time.Time) (from, to time.Time) {
+	y, m, d := v.Date()
+	switch unit {
+	case TimeUnitYear:
+		from = time.Date(y, 1, 1, 0, 0, 0, 0, v.Location())
+		return from, from.AddDate(1, 0, 0)
+	case TimeUnitMonth:
+		from = time.Date(y, m, 1, 0, 0, 0, 0, v.Location())
+		return from, from.AddDate(0, 1, 0)
+	case TimeUnitDay:
+		from = time.Date(y, m, d, 0, 0, 0, 0, v.Location())
+		return from, from.AddDate(0, 0, 1)
+	case TimeUnitHour:
+		from = time.Date(y, m, d, v.Hour(), 0, 0, 0, v.Location())
+		return from, from.Add(time.Hour)
+	case TimeUnitMinute:
+		from = time.Date(y, m, d, v.Hour(), v.Minute(), 0, 0, v.Location())
+		return from, from.Add(time.Minute)
+	}
+	panic(fmt.Sprintf("unsupported time unit %q", unit))
+}
+
+// truncFormats mysql DATE_FORMAT 及 sqlite strftime 截断的格式
+var truncFormats = map[string][2]string{
+	TimeUnitYear:   {"%Y-01-01 00:00:00", "%Y-01-01 00:00:00"},
+	TimeUnitMonth:  {"%Y-%m-01 00:00:00", "%Y-%m-01 00:00:00"},
+	TimeUnitDay:    {"%Y-%m-%d 00:00:00", "%Y-%m-%d 00:00:00"},
+	TimeUnitHour:   {"%Y-%m-%d %H:00:00", "%Y-%m-%d %H:00:00"},
+	TimeUnitMinute: {"%Y-%m-%d %H:%i:00", "%Y-%m-%d %H:%M:00"},
+}
+
+// timeForDialect TruncEq 在各个 dialect 中的写法, 不是 TruncEq 时 ok 为 false
+func (sc *singleCondition) timeForDialect(dialect string) (sql string, args []interface{}, ok bool) {
+	if sc.op != c_TruncEq {
+		return "", nil, false
+	}
+	col := sc.field.Column()
+	unit := sc.sqlArg1.(string)
+	from := sc.sqlArg2.(time.Time)
+	switch dialect {
+	case DialectMysql:
+		return fmt.Sprintf("DATE_FORMAT(%s, '%s') = ?", col, truncFormats[unit][0]), []interface{}{from.Format("2006-01-02 15:04:05")}, true
+	case DialectSqlite3:
+		// sqlite 的时间以带时区的文本存储, strftime 转换为 UTC 后截断
+		from, _ = TimeUnitRange(unit, sc.rawVal2.(time.Time).UTC())
+		return fmt.Sprintf("strftime('%s', %s) = ?", truncFormats[unit][1], col), []interface{}{from.Format("2006-01-02 15:04:05")}, true
+	}
+	return fmt.Sprintf("DATE_TRUNC('%s', %s) = ?", unit, col), []interface{}{from}, true
+}
@@ -0,0 +1,230 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+// TimeoutKind 超时的来源
+type TimeoutKind string
+
+const (
+	// TimeoutCallerDeadline 调用方的 ctx 超时或取消
+	TimeoutCallerDeadline TimeoutKind = "caller_deadline"
+	// TimeoutStatement 数据库的 statement_timeout (mysql max_execution_time)
+	TimeoutStatement TimeoutKind = "statement_timeout"
+	// TimeoutLock 数据库的 lock_timeout
+	TimeoutLock TimeoutKind = "lock_timeout"
+	// TimeoutPoolWait 等待连接池中的空闲连接时 ctx 超时
+	TimeoutPoolWait TimeoutKind = "pool_wait"
+)
+
+const metricQueryTimeout = "repository_query_timeout_total"
+
+// TimeoutError 带有超时来源的 error, 可以通过 errors.As 获取
+type TimeoutError struct {
+	Kind  TimeoutKind
+	Table string
+	Op    string
+	Err   error
+}
+
+func (te *TimeoutError) Error() string {
+	return fmt.Sprintf("%s %s timeout (%s): %v", te.Op, te.Table, te.Kind, te.Err)
+}
+
+func (te *TimeoutError) Unwrap() error {
+	return te.Err
+}
+
+// TimeoutKindOf returns the kind of a timeout error, empty if err is not a timeout
+func TimeoutKindOf(err error) TimeoutKind {
+	var te *TimeoutError
+	if errors.As(err, &te) {
+		return te.Kind
+	}
+	return ""
+}
+
+// classifyTimeout 识别数据库返回的超时; ctx 相关的超时由调用方根据场景判断
+func classifyTimeout(ctx context.Context, err error) TimeoutKind {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "57014":
+			if strings.Contains(pqErr.Message, "statement timeout") {
+				return TimeoutStatement
+			}
+			return TimeoutCallerDeadline
+		case "55P03":
+			return TimeoutLock
+		}
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "maximum statement execution time exceeded"):
+		return TimeoutStatement
+	case strings.Contains(msg, "Lock wait timeout exceeded"):
+		return TimeoutLock
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || ctx.Err() != nil {
+		return TimeoutCallerDeadline
+	}
+	return ""
+}
+
+// poolExhausted 连接池已用满时, ctx 超时大概率发生在等待连接上
+func poolExhausted(db *gorm.DB) bool {
+	if db == nil || db.DB() == nil {
+		return false
+	}
+	stats := db.DB().Stats()
+	return stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections
+}
+
+// wrapTimeout 超时错误包装为 TimeoutError, 并记录日志和 metrics; 其他错误原样返回
+func wrapTimeout(ctx context.Context, db *gorm.DB, table, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var te *TimeoutError
+	if errors.As(err, &te) {
+		return err
+	}
+	kind := classifyTimeout(ctx, err)
+	if kind == "" {
+		return err
+	}
+	if kind == TimeoutCallerDeadline && poolExhausted(db) {
+		kind = TimeoutPoolWait
+	}
+	Warn("[repository] timeout", zap.String("table", table), zap.String("op", op), zap.String("kind", string(kind)), zap.Error(err))
+	metricsOf(db).IncCounter(metricQueryTimeout, map[string]string{"table": table, "op": op, "kind": string(kind)})
+	return &TimeoutError{Kind: kind, Table: table, Op: op, Err: err}
+}
+
+func (e *Repository) wrapTimeout(ctx context.Context, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return wrapTimeout(ctx, e.getDb(ctx), e.TableName(), op, err)
+}
+
+type statementTimeoutOption struct {
+	d time.Duration
+}
+
+// WithTimeout 限制单次查询在数据库上的执行时间(postgres statement_timeout, mysql max_execution_time), 超时返回 TimeoutStatement.
+// 用于 Find/FindInto/Count/Exists. postgres 以 SET LOCAL 设置, 因此查询在事务中执行: 事务外的读操作在原本路由到的连接(从库或主库)上
+// 开启一个只读事务, 结束后恢复为外层的值. mysql 以 MAX_EXECUTION_TIME hint 设置, 只限制 SELECT. sqlite 忽略
+func WithTimeout(d time.Duration) *statementTimeoutOption {
+	return &statementTimeoutOption{d: d}
+}
+
+type statementTimeoutKey struct{}
+
+// timeoutAppliedKey 已设置了超时的连接上的 ctx, 嵌套的操作不再重复设置
+type timeoutAppliedKey struct{}
+
+// timedReadKey 事务外带超时的读操作所在的只读事务, tm 区分不同数据库的 Repository
+type timedReadKey struct {
+	tm TransactionManager
+}
+
+// ContextWithTimeout 同 WithTimeout, 作用于 ctx 中的所有操作, 包括 Create/Update/Delete 等没有 options 的写操作.
+// options 中的 WithTimeout 优先
+func ContextWithTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, statementTimeoutKey{}, d)
+}
+
+// Sql 超时在 withStatementTimeout 及 parseOptions 中设置, 这里不修改查询
+func (so *statementTimeoutOption) Sql(db *gorm.DB) *gorm.DB {
+	return db
+}
+
+// statementTimeout options 中的 WithTimeout, 没有时为 ctx 中的 ContextWithTimeout
+func statementTimeout(ctx context.Context, options []Option) time.Duration {
+	timeout, _ := ctx.Value(statementTimeoutKey{}).(time.Duration)
+	for _, opt := range options {
+		if so, ok := opt.(*statementTimeoutOption); ok {
+			timeout = so.d
+		}
+	}
+	return timeout
+}
+
+// maxExecutionTimeHint mysql 的超时 hint, 由 parseOptions 加在 SELECT 之后. 不是 mysql 或没有超时时为空
+func maxExecutionTimeHint(ctx context.Context, db *gorm.DB, options []Option) string {
+	timeout := statementTimeout(ctx, options)
+	if timeout <= 0 || db.Dialect().GetName() != DialectMysql {
+		return ""
+	}
+	return fmt.Sprintf("MAX_EXECUTION_TIME(%d)", timeout.Milliseconds())
+}
+
+// withStatementTimeout options 中有 WithTimeout 或 ctx 中有 ContextWithTimeout 时, 在设置了超时的连接上执行 fn. 只处理 postgres
+func (e *Repository) withStatementTimeout(ctx context.Context, options []Option, fn func(ctx context.Context) error) error {
+	timeout := statementTimeout(ctx, options)
+	if applied, _ := ctx.Value(timeoutAppliedKey{}).(time.Duration); timeout <= 0 || applied == timeout {
+		return fn(ctx)
+	}
+	db := e.getDb(ctx)
+	if db == nil {
+		return dbNilErr
+	}
+	if db.Dialect().GetName() != DialectPostgres {
+		return fn(ctx)
+	}
+	ctx = context.WithValue(ctx, timeoutAppliedKey{}, timeout)
+	op, _ := ctx.Value(stmtOpKey{}).(string)
+	if _, inTx := db.CommonDB().(*sql.Tx); !inTx && !isWriteOp(op) {
+		return e.timedRead(ctx, op, timeout, options, fn)
+	}
+	_, err := e.Tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		return nil, withLocalTimeout(ctx, e.getDb(ctx), timeout, fn)
+	})
+	return err
+}
+
+// timedRead 事务外的读操作不经过 Tm.Transaction (总是在主库), 在读操作原本使用的连接上开启只读事务
+func (e *Repository) timedRead(ctx context.Context, op string, timeout time.Duration, options []Option, fn func(ctx context.Context) error) error {
+	db := e.getDb(ctx)
+	if op == StmtFind {
+		db = e.getReadDb(ctx, options...)
+	}
+	tx := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if tx.Error != nil {
+		return wrapTimeout(ctx, db, e.TableName(), "begin", tx.Error)
+	}
+	ctx = context.WithValue(ctx, timedReadKey{tm: e.Tm}, tx)
+	if err := withLocalTimeout(ctx, tx, timeout, fn); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// withLocalTimeout 在 db 的事务中以 SET LOCAL 设置超时后执行 fn, 之后恢复为原来的值, 嵌套的 WithTimeout 结束后外层的超时仍然有效
+func withLocalTimeout(ctx context.Context, db *gorm.DB, timeout time.Duration, fn func(ctx context.Context) error) (err error) {
+	var prev string
+	if err = db.Raw("SELECT current_setting('statement_timeout')").Row().Scan(&prev); err != nil {
+		return err
+	}
+	if err = execRaw(ctx, db, fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout.Milliseconds())).Error; err != nil {
+		return err
+	}
+	defer func() {
+		// 语句超时后事务已经失败, 恢复会失败, 以 fn 的 error 为准
+		if resetErr := execRaw(ctx, db, "SELECT set_config('statement_timeout', ?, true)", prev).Error; resetErr != nil && err == nil {
+			err = resetErr
+		}
+	}()
+	return fn(ctx)
+}
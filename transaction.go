@@ -16,21 +16,69 @@ import (
 // 自定义类型, 防止外部直接通过 string 访问
 type wrapContextStringKey string
 
+// dbWrapper 保存在 ctx 中, 共享 ctx 的 goroutine 可能同时访问, 字段只能通过加锁的方法读写
 type dbWrapper struct {
+	mu            sync.Mutex
 	db            *gorm.DB
 	inTransaction bool
 	err           error
+	hooks         *TxHooks
+	// owner 非 0 时事务只能在该 goroutine 中使用, 参见 TransactionWithNewCtx
+	owner uint64
 }
 
 func (dbw *dbWrapper) reset() {
+	dbw.mu.Lock()
+	defer dbw.mu.Unlock()
 	dbw.db = nil
 	dbw.inTransaction = false
 	dbw.err = nil
+	dbw.hooks = nil
+	dbw.owner = 0
+}
+
+// current 当前的连接, 事务已结束时为 nil. 在 owner 以外的 goroutine 中返回 ErrTxCtxShared
+func (dbw *dbWrapper) current() (*gorm.DB, error) {
+	dbw.mu.Lock()
+	db, owner := dbw.db, dbw.owner
+	dbw.mu.Unlock()
+	if db != nil && owner != 0 && owner != goroutineId() {
+		return db, ErrTxCtxShared
+	}
+	return db, nil
+}
+
+// txHooks 事务中时返回事务的回调, 否则为 nil
+func (dbw *dbWrapper) txHooks() *TxHooks {
+	dbw.mu.Lock()
+	defer dbw.mu.Unlock()
+	if !dbw.inTransaction {
+		return nil
+	}
+	return dbw.hooks
+}
+
+func (dbw *dbWrapper) setErr(err error) {
+	dbw.mu.Lock()
+	defer dbw.mu.Unlock()
+	dbw.err = err
+}
+
+func (dbw *dbWrapper) getErr() error {
+	dbw.mu.Lock()
+	defer dbw.mu.Unlock()
+	return dbw.err
 }
 
 type TransactionManager interface {
 	GetDb(ctx context.Context) *gorm.DB
 	Transaction(ctx context.Context, doTransaction func(ctx context.Context) (res interface{}, err error)) (interface{}, error)
+	// WithAdvisoryLock 在事务中持有 key 对应的 advisory lock 执行 fn, 锁在事务提交或回滚后释放
+	WithAdvisoryLock(ctx context.Context, key int64, fn func(ctx context.Context) error) error
+	// AfterCommit 在 ctx 中最外层的事务提交后执行 fn (如缓存失效, 发送消息), 不在事务中时立即执行
+	AfterCommit(ctx context.Context, fn func())
+	// AfterRollback 在 ctx 中最外层的事务回滚后执行 fn, 不在事务中时忽略
+	AfterRollback(ctx context.Context, fn func())
 }
 
 type transactionManager struct {
@@ -45,9 +93,6 @@ var mutex sync.Mutex
 //NewTransactionManager 获取(或新建)一个事务管理器, 每个 serviceName, database 组合共享一个实例
 func NewTransactionManager(serviceName, database string) TransactionManager {
 	mapKey := serviceName + ":" + database
-	if tm, ok := tmMap[mapKey]; ok {
-		return tm
-	}
 	mutex.Lock()
 	defer mutex.Unlock()
 
@@ -73,14 +118,27 @@ func (tm *transactionManager) getDb() *gorm.DB {
 //
 // 优先从 ctx 获取已有的连接(可能已经开启了事务). 如果没有连接, 则新建一个没有开启事务的连接.
 func (tm *transactionManager) GetDb(ctx context.Context) *gorm.DB {
-	wrapper := tm.getDbWrapper(ctx)
-	if wrapper != nil && wrapper.db != nil {
-		return wrapper.db
+	if db := tm.txDb(ctx); db != nil {
+		return db
 	}
 	db := tm.getDb()
 	return db
 }
 
+// txDb ctx 中的连接, 没有时为 nil. 违反 TransactionWithNewCtx 的限制时返回的连接带有 ErrTxCtxShared, 执行语句时返回该 error
+func (tm *transactionManager) txDb(ctx context.Context) *gorm.DB {
+	wrapper := tm.getDbWrapper(ctx)
+	if wrapper == nil {
+		return nil
+	}
+	db, err := wrapper.current()
+	if err != nil {
+		db = db.Set(txSharedKey, true)
+		db.AddError(err)
+	}
+	return db
+}
+
 func (tm *transactionManager) getDbWrapper(ctx context.Context) *dbWrapper {
 	wrapper := ctx.Value(tm.ctxDbWrapperKey)
 	if dbWrapper0, ok := wrapper.(*dbWrapper); ok {
@@ -101,15 +159,41 @@ func (tm *transactionManager) Transaction(ctx context.Context, doTransaction fun
 	txOpenByMe := false
 
 	wrapper := tm.getDbWrapper(ctx)
+	// 开启事务时设置, 超过 DBConfig.MaxTxDuration 自动回滚
+	var deadline *txDeadline
+	committed := false
 
-	if wrapper == nil || wrapper.db == nil {
+	var wrapperDb *gorm.DB
+	if wrapper != nil {
+		var err error
+		if wrapperDb, err = wrapper.current(); err != nil {
+			return nil, err
+		}
+	}
+
+	if wrapperDb == nil {
 		db := tm.getDb()
 		if db != nil {
+			ctx, breaker, release, err := guardDb(ctx, db)
+			if err != nil {
+				return nil, err
+			}
+			// 事务结束后才释放
+			defer release()
+			deadline, ctx = tm.txDeadline(ctx)
+			defer deadline.stop()
 			tx := db.BeginTx(ctx, &sql.TxOptions{})
+			breaker.done(tx.Error)
+			if tx.Error != nil {
+				return nil, wrapTimeout(ctx, db, "", "begin", tx.Error)
+			}
 			wrapper = &dbWrapper{
 				db:            tx,
 				inTransaction: true,
 			}
+			if bound, _ := ctx.Value(boundTxKey{}).(bool); bound {
+				wrapper.owner = goroutineId()
+			}
 			ctx = tm.setDbWrapper(ctx, wrapper)
 			// 本方法开启的事务,由本方法提交
 			txOpenByMe = true
@@ -117,14 +201,46 @@ func (tm *transactionManager) Transaction(ctx context.Context, doTransaction fun
 			return nil, errors.New("can not get db connection")
 		}
 	} else {
-		if wrapper.err != nil {
-			return nil, fmt.Errorf("transaction already has error:%w", wrapper.err)
+		if err := wrapper.getErr(); err != nil {
+			return nil, fmt.Errorf("transaction already has error:%w", err)
 		}
+		// 检查与开启事务在同一把锁内, 共享 ctx 的 goroutine 同时进入时只开启一个事务
+		wrapper.mu.Lock()
 		if !wrapper.inTransaction {
-			wrapper.db = wrapper.db.BeginTx(ctx, &sql.TxOptions{})
+			deadline, ctx = tm.txDeadline(ctx)
+			defer deadline.stop()
+			tx := wrapperDb.BeginTx(ctx, &sql.TxOptions{})
+			if tx.Error != nil {
+				wrapper.mu.Unlock()
+				return nil, wrapTimeout(ctx, wrapperDb, "", "begin", tx.Error)
+			}
+			wrapper.db = tx
 			wrapper.inTransaction = true
 			txOpenByMe = true
 		}
+		wrapper.mu.Unlock()
+	}
+
+	var hooks *TxHooks
+	// tx 本方法开启的事务
+	var tx *gorm.DB
+	if txOpenByMe {
+		hooks = &TxHooks{}
+		var stats *txStats
+		stats, ctx = tm.beginTxStats(ctx)
+		// 在 AfterCommit/AfterRollback 的回调之后执行
+		defer func() {
+			stats.end(ctx, committed, err)
+		}()
+		wrapper.mu.Lock()
+		wrapper.hooks = hooks
+		wrapper.db = wrapper.db.Set(txStatsKey, stats)
+		if t := tm.trackTx(); t != nil {
+			wrapper.db = wrapper.db.Set(txTrackKey, t)
+			defer untrackTx(t)
+		}
+		tx = wrapper.db
+		wrapper.mu.Unlock()
 	}
 
 	defer func() {
@@ -135,15 +251,16 @@ func (tm *transactionManager) Transaction(ctx context.Context, doTransaction fun
 			}
 			err = err0
 			Error(ctx, "panic in Transaction", zap.Error(err))
-			wrapper.err = err
+			wrapper.setErr(err)
 			if !txOpenByMe {
 				return
 			}
-			rberr := wrapper.db.Rollback().Error
+			rberr := tx.Rollback().Error
 			if rberr != nil {
 				Error(ctx, "rollback failed in recover", zap.Any("panic", r), zap.Error(rberr))
 			}
 			wrapper.reset()
+			hooks.RolledBack()
 		}
 	}()
 
@@ -153,37 +270,49 @@ func (tm *transactionManager) Transaction(ctx context.Context, doTransaction fun
 	}
 	returnData, bizErr := doTransaction(ctx)
 	if bizErr != nil {
-		wrapper.err = bizErr
+		wrapper.setErr(bizErr)
 		Error(ctx, "doTransaction err", zap.Error(bizErr))
 	}
 	if ctx.Err() != nil {
 		// 执行完以后, context 已经超时或取消了, 不再 commit/rollback (其实已经rollback 了)
-		return nil, ctx.Err()
+		if txOpenByMe {
+			hooks.RolledBack()
+		}
+		return nil, deadline.err(ctx.Err())
 	}
 	if txOpenByMe {
+		// 在 reset 之后执行, 回调中使用 ctx 不会拿到已结束的事务
+		defer func() {
+			if committed {
+				hooks.Committed()
+			} else {
+				hooks.RolledBack()
+			}
+		}()
 		defer wrapper.reset()
 		// 当前doTransaction方法 返回 error
 		if bizErr != nil {
-			rberr := wrapper.db.Rollback().Error
+			rberr := tx.Rollback().Error
 			if rberr != nil {
 				Error(ctx, "rollback failed", zap.NamedError("bizErr", bizErr), zap.Error(rberr))
 			}
 			return returnData, bizErr
-		} else if wrapper.err != nil {
+		} else if innerErr := wrapper.getErr(); innerErr != nil {
 			// 如果执行当前doTransaction方法没有error, 但其内部嵌套的事务发生了错误, 且当前doTransaction方法没有返回这个 error, 同样要回滚
-			Error(ctx, "inner transaction has err, should rollback", zap.NamedError("bizErr", wrapper.err))
-			rberr := wrapper.db.Rollback().Error
+			Error(ctx, "inner transaction has err, should rollback", zap.NamedError("bizErr", innerErr))
+			rberr := tx.Rollback().Error
 			if rberr != nil {
-				Error(ctx, "rollback for inner transaction failed", zap.NamedError("bizErr", wrapper.err), zap.Error(rberr))
+				Error(ctx, "rollback for inner transaction failed", zap.NamedError("bizErr", innerErr), zap.Error(rberr))
 			}
-			return returnData, wrapper.err
+			return returnData, innerErr
 		}
 
-		commitError := wrapper.db.Commit().Error
+		commitError := tx.Commit().Error
 		if commitError != nil {
 			Error(ctx, "commit failed", zap.Error(commitError))
 		}
-		return returnData, commitError
+		committed = commitError == nil
+		return returnData, deadline.err(commitError)
 	}
 
 	return returnData, bizErr
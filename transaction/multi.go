@@ -0,0 +1,174 @@
+// Package transaction 跨多个数据库的事务协调
+package transaction
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/shaynewu/repository"
+	"go.uber.org/zap"
+)
+
+// PartialCommitError 部分数据库已提交, 之后的提交失败. 已提交的数据库执行了补偿, 补偿失败时记录在 CompensateErrs
+type PartialCommitError struct {
+	// Committed 已提交的数据库在 tms 中的下标, 按提交顺序
+	Committed []int
+	// Err 导致其余数据库回滚的错误
+	Err error
+	// CompensateErrs 补偿失败的数据库下标及其错误
+	CompensateErrs map[int]error
+}
+
+func (e *PartialCommitError) Error() string {
+	return fmt.Sprintf("multi transaction partially committed %v: %v (%d compensation failed)", e.Committed, e.Err, len(e.CompensateErrs))
+}
+
+func (e *PartialCommitError) Unwrap() error {
+	return e.Err
+}
+
+// Tx Multi 中 fn 的参数, 用于注册两阶段的回调
+type Tx struct {
+	tms []repository.TransactionManager
+
+	mu         sync.Mutex
+	prepare    []func(ctx context.Context) error
+	commit     []func()
+	compensate map[int][]func(ctx context.Context) error
+}
+
+// OnPrepare 在 fn 成功之后, 任何数据库提交之前执行(所有事务仍然开启), 返回 error 时所有数据库回滚.
+// 用于提交前的最终检查, 如锁定并校验余额
+func (t *Tx) OnPrepare(fn func(ctx context.Context) error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prepare = append(t.prepare, fn)
+}
+
+// OnCommit 所有数据库都提交后执行
+func (t *Tx) OnCommit(fn func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.commit = append(t.commit, fn)
+}
+
+// Compensate 注册 tm 已提交而其他数据库提交失败时执行的补偿(如删除已写入的行). 补偿在 tm 的新事务中执行,
+// 同一 tm 的多个补偿按注册的逆序执行. tm 不在 Multi 的 tms 中时 panic
+func (t *Tx) Compensate(tm repository.TransactionManager, fn func(ctx context.Context) error) {
+	i := t.indexOf(tm)
+	if i < 0 {
+		panic("transaction: Compensate with a TransactionManager not in Multi")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.compensate[i] = append(t.compensate[i], fn)
+}
+
+func (t *Tx) indexOf(tm repository.TransactionManager) int {
+	for i, m := range t.tms {
+		if m == tm {
+			return i
+		}
+	}
+	return -1
+}
+
+// Multi 在 tms 的每个数据库上开启事务并执行 fn, fn 中通过各自的 Repository(使用同一 ctx)写入.
+// 提交采用尽力而为的两阶段方式: fn 及 OnPrepare 成功后, 从 tms 的最后一个开始依次提交; 任何一个在提交前失败则全部回滚.
+// 某个数据库提交失败时, 尚未提交的回滚, 已提交的执行 Compensate 注册的补偿, 返回 *PartialCommitError.
+// 因此应把最可能失败的数据库放在 tms 的最后. 不应在 tms 中任何一个的事务中调用(否则该数据库的提交由外层事务决定)
+func Multi(ctx context.Context, tms []repository.TransactionManager, fn func(ctx context.Context, tx *Tx) error) error {
+	if len(tms) == 0 {
+		return errors.New("transaction: Multi without TransactionManager")
+	}
+	tx := &Tx{tms: tms, compensate: make(map[int][]func(ctx context.Context) error)}
+	var committed []int
+	var run func(ctx context.Context, i int) error
+	run = func(ctx context.Context, i int) error {
+		if i == len(tms) {
+			if err := fn(ctx, tx); err != nil {
+				return err
+			}
+			return tx.runPrepare(ctx)
+		}
+		_, err := tms[i].Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+			return nil, run(ctx, i+1)
+		})
+		if err == nil {
+			committed = append(committed, i)
+		}
+		return err
+	}
+	err := run(ctx, 0)
+	if err == nil {
+		tx.runCommit(ctx)
+		return nil
+	}
+	if len(committed) == 0 {
+		return err
+	}
+	repository.Error("[repository] multi transaction partially committed", zap.Ints("committed", committed), zap.Error(err))
+	return &PartialCommitError{Committed: committed, Err: err, CompensateErrs: tx.runCompensate(ctx, committed)}
+}
+
+func (t *Tx) runPrepare(ctx context.Context) error {
+	t.mu.Lock()
+	fns := t.prepare
+	t.mu.Unlock()
+	for _, fn := range fns {
+		if err := fn(ctx); err != nil {
+			return fmt.Errorf("prepare: %w", err)
+		}
+	}
+	return nil
+}
+
+func (t *Tx) runCommit(ctx context.Context) {
+	t.mu.Lock()
+	fns := t.commit
+	t.mu.Unlock()
+	for _, fn := range fns {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					repository.Error("[repository] panic in multi transaction commit hook", zap.Any("panic", r))
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+// runCompensate 按提交的逆序补偿已提交的数据库, 返回失败的补偿
+func (t *Tx) runCompensate(ctx context.Context, committed []int) map[int]error {
+	errs := make(map[int]error)
+	for k := len(committed) - 1; k >= 0; k-- {
+		i := committed[k]
+		t.mu.Lock()
+		fns := t.compensate[i]
+		t.mu.Unlock()
+		if len(fns) == 0 {
+			continue
+		}
+		_, err := t.tms[i].Transaction(ctx, func(ctx context.Context) (res interface{}, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("recover:%v", r)
+				}
+			}()
+			for j := len(fns) - 1; j >= 0; j-- {
+				if err := fns[j](ctx); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		})
+		if err != nil {
+			errs[i] = err
+			repository.Error("[repository] multi transaction compensation failed", zap.Int("tm", i), zap.Error(err))
+		}
+	}
+	return errs
+}
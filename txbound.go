@@ -0,0 +1,36 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+)
+
+// ErrTxCtxShared 在开启事务的 goroutine 以外使用了 TransactionWithNewCtx 的 ctx
+var ErrTxCtxShared = errors.New("transaction ctx is used by another goroutine")
+
+const txSharedKey = "repository:tx_shared"
+
+type boundTxKey struct{}
+
+// TransactionWithNewCtx 同 tm.Transaction, 但 fn 得到的 ctx 只能在当前 goroutine 中使用: 在其他 goroutine 中
+// 通过该 ctx 执行语句或开启(嵌套)事务返回 ErrTxCtxShared, 而不是并发使用同一个事务连接(可能导致结果错乱或 bad connection).
+// 需要在 fn 中启动 goroutine 时, 应传入不带事务的 ctx (参见 NotSupported). ctx 中已有事务时加入该事务, 不做限制.
+// 目前只有默认的 TransactionManager 会检测, 其他实现与 Transaction 相同
+func TransactionWithNewCtx(ctx context.Context, tm TransactionManager, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	return tm.Transaction(context.WithValue(ctx, boundTxKey{}, true), fn)
+}
+
+// goroutineId 从调用栈的第一行 "goroutine N [running]:" 解析, 仅用于检测 ctx 的跨 goroutine 使用
+func goroutineId() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// TxHooks 事务结束后执行的回调, 供 TransactionManager 实现 AfterCommit/AfterRollback 使用
+type TxHooks struct {
+	mu       sync.Mutex
+	commit   []func()
+	rollback []func()
+}
+
+// AfterCommit 注册提交后执行的回调
+func (h *TxHooks) AfterCommit(fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.commit = append(h.commit, fn)
+}
+
+// AfterRollback 注册回滚后执行的回调
+func (h *TxHooks) AfterRollback(fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rollback = append(h.rollback, fn)
+}
+
+// Committed 事务提交后调用, 按注册顺序执行 AfterCommit 的回调
+func (h *TxHooks) Committed() {
+	h.run(true)
+}
+
+// RolledBack 事务回滚(或提交失败)后调用, 按注册顺序执行 AfterRollback 的回调
+func (h *TxHooks) RolledBack() {
+	h.run(false)
+}
+
+// run 每个回调只执行一次, 回调中的 panic 被记录, 不影响其他回调
+func (h *TxHooks) run(committed bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	fns := h.rollback
+	if committed {
+		fns = h.commit
+	}
+	h.commit, h.rollback = nil, nil
+	h.mu.Unlock()
+	for _, fn := range fns {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					Error("[repository] panic in transaction hook", zap.Any("panic", r), zap.Bool("committed", committed))
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+// AfterCommit 参见 TransactionManager.AfterCommit
+func (tm *transactionManager) AfterCommit(ctx context.Context, fn func()) {
+	if w := tm.getDbWrapper(ctx); w != nil {
+		if hooks := w.txHooks(); hooks != nil {
+			hooks.AfterCommit(fn)
+			return
+		}
+	}
+	fn()
+}
+
+// AfterRollback 参见 TransactionManager.AfterRollback
+func (tm *transactionManager) AfterRollback(ctx context.Context, fn func()) {
+	if w := tm.getDbWrapper(ctx); w != nil {
+		if hooks := w.txHooks(); hooks != nil {
+			hooks.AfterRollback(fn)
+		}
+	}
+}
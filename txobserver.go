@@ -0,0 +1,121 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+)
+
+const txStatsKey = "repository:tx_stats"
+
+type txIdKey struct{}
+
+// TxInfo 一个事务的信息, 由 TxObserver 接收
+type TxInfo struct {
+	// Id 事务 ID, 同时记录在事务中每条 sql 的日志中(QueryLog.TxId), 参见 TxIdFrom
+	Id       string
+	Service  string
+	Database string
+	Begin    time.Time
+	// Duration 及 Statements 在 OnBegin 时为 0
+	Duration time.Duration
+	// Statements 事务中经过 gorm callback 执行的语句数, 不包括 db.Exec 执行的原生 sql
+	Statements int64
+	// Err 回滚的原因, 提交失败时为提交的 error
+	Err error
+}
+
+// TxObserver 事务开启, 提交, 回滚时的回调(如上报 metrics, tracing), 为 nil 的回调被忽略.
+// 只有最外层(实际开启事务)的 Transaction 会触发, 回调在事务的 goroutine 中同步执行
+type TxObserver struct {
+	OnBegin    func(ctx context.Context, info TxInfo)
+	OnCommit   func(ctx context.Context, info TxInfo)
+	OnRollback func(ctx context.Context, info TxInfo)
+}
+
+var (
+	txObserver     *TxObserver
+	txObserverLock sync.RWMutex
+)
+
+// SetTxObserver 注册全局的事务回调, 应在 main 中初始化时调用, nil 表示取消
+func SetTxObserver(o *TxObserver) {
+	txObserverLock.Lock()
+	defer txObserverLock.Unlock()
+	txObserver = o
+}
+
+func getTxObserver() *TxObserver {
+	txObserverLock.RLock()
+	defer txObserverLock.RUnlock()
+	return txObserver
+}
+
+// TxIdFrom 返回 ctx 中当前事务的 ID, 不在事务中时为空
+func TxIdFrom(ctx context.Context) string {
+	id, _ := ctx.Value(txIdKey{}).(string)
+	return id
+}
+
+type txStats struct {
+	info       TxInfo
+	statements int64
+}
+
+func newTxId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// beginTxStats 开启事务后调用, 返回带有事务 ID 的 ctx
+func (tm *transactionManager) beginTxStats(ctx context.Context) (*txStats, context.Context) {
+	s := &txStats{info: TxInfo{Id: newTxId(), Service: tm.serviceName, Database: tm.database, Begin: time.Now()}}
+	ctx = context.WithValue(ctx, txIdKey{}, s.info.Id)
+	if o := getTxObserver(); o != nil && o.OnBegin != nil {
+		s.notify(ctx, o.OnBegin, s.info)
+	}
+	return s, ctx
+}
+
+// end 事务结束后调用
+func (s *txStats) end(ctx context.Context, committed bool, err error) {
+	o := getTxObserver()
+	if o == nil {
+		return
+	}
+	info := s.info
+	info.Duration = time.Since(info.Begin)
+	info.Statements = atomic.LoadInt64(&s.statements)
+	fn := o.OnCommit
+	if !committed {
+		info.Err = err
+		fn = o.OnRollback
+	}
+	if fn != nil {
+		s.notify(ctx, fn, info)
+	}
+}
+
+// notify 回调中的 panic 被记录, 不影响事务
+func (s *txStats) notify(ctx context.Context, fn func(ctx context.Context, info TxInfo), info TxInfo) {
+	defer func() {
+		if r := recover(); r != nil {
+			Error("[repository] panic in transaction observer", zap.String("tx_id", info.Id), zap.Any("panic", r))
+		}
+	}()
+	fn(ctx, info)
+}
+
+// countTxStatement 在语句结束时调用
+func countTxStatement(scope *gorm.Scope) {
+	if v, ok := scope.Get(txStatsKey); ok {
+		atomic.AddInt64(&v.(*txStats).statements, 1)
+	}
+}
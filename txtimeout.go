@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TimeoutTransaction 事务超过 DBConfig.MaxTxDuration, 已自动回滚
+const TimeoutTransaction TimeoutKind = "max_tx_duration"
+
+// txDeadline 限制事务的持续时间. 事务使用 deadline 的 ctx 开启, 超时后 database/sql 自动回滚事务,
+// 同时 doTransaction 的 ctx 被取消, 避免长事务一直持有锁
+type txDeadline struct {
+	cancel context.CancelFunc
+	timer  *time.Timer
+	fired  int32
+}
+
+// txDeadline DBConfig.MaxTxDuration 为 0 时返回 nil 及原 ctx
+func (tm *transactionManager) txDeadline(ctx context.Context) (*txDeadline, context.Context) {
+	conf := tm.DBConfig()
+	if conf == nil || conf.MaxTxDuration <= 0 {
+		return nil, ctx
+	}
+	buf := make([]byte, 8<<10)
+	buf = buf[:runtime.Stack(buf, false)]
+	begin := time.Now()
+	d := &txDeadline{}
+	ctx, d.cancel = context.WithCancel(ctx)
+	d.timer = time.AfterFunc(conf.MaxTxDuration, func() {
+		atomic.StoreInt32(&d.fired, 1)
+		Warn("[repository] transaction exceeded max duration, rollback", zap.String("service", tm.serviceName), zap.String("database", tm.database),
+			zap.Time("begin", begin), zap.Duration("max", conf.MaxTxDuration), zap.String("stack", string(buf)))
+		getMetrics().IncCounter(metricQueryTimeout, map[string]string{"table": "", "op": "transaction", "kind": string(TimeoutTransaction)})
+		d.cancel()
+	})
+	return d, ctx
+}
+
+// exceeded 事务是否因超时被回滚
+func (d *txDeadline) exceeded() bool {
+	return d != nil && atomic.LoadInt32(&d.fired) == 1
+}
+
+// stop 事务结束后调用
+func (d *txDeadline) stop() {
+	if d == nil {
+		return
+	}
+	d.timer.Stop()
+	d.cancel()
+}
+
+// err 超时时返回 TimeoutError, 否则原样返回 err
+func (d *txDeadline) err(err error) error {
+	if !d.exceeded() {
+		return err
+	}
+	return &TimeoutError{Kind: TimeoutTransaction, Op: "transaction", Err: err}
+}
@@ -0,0 +1,252 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+// ErrUniqueViolation 未删除的数据中已存在相同的唯一键
+var ErrUniqueViolation = errors.New("unique key already exists among non-deleted rows")
+
+// UniqueIndex 描述 "未删除数据中唯一" 的索引, 对应 partial unique index (WHERE is_delete = 0)
+type UniqueIndex struct {
+	Name   string
+	Fields []FieldInterface
+}
+
+// uniqueCondition 用 model 中 fields 对应的值构造 Eq 条件, MandatoryCondition 会在 parseWhere 中加上
+func (e *Repository) uniqueCondition(scope *gorm.Scope, fields []FieldInterface) (Condition, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("unique check without fields")
+	}
+	var conds []Condition
+	for _, fld := range fields {
+		f, ok := scope.FieldByName(fld.Column())
+		if !ok {
+			return nil, fmt.Errorf("field %s not found in %s", fld.Column(), e.TableName())
+		}
+		conds = append(conds, fld.Eq(f.Field.Interface()))
+	}
+	return MatchAll(conds...), nil
+}
+
+// CheckUnique 检查未删除的数据中(受 MandatoryCondition 约束)是否已有与 model 在 fields 上相同的记录,
+// model 主键非零时排除自身. 存在时返回 ErrUniqueViolation
+func (e *Repository) CheckUnique(ctx context.Context, model Model, fields ...FieldInterface) error {
+	db := e.getDb(ctx)
+	if db == nil {
+		return dbNilErr
+	}
+	scope := db.NewScope(model)
+	cond, err := e.uniqueCondition(scope, fields)
+	if err != nil {
+		return err
+	}
+	if id, ok := e.primaryValue(model); ok {
+		cond = cond.And(e.PrimaryField().NotEq(id))
+	}
+	total, err := e.Count(ctx, cond)
+	if err != nil {
+		return err
+	}
+	if total > 0 {
+		return ErrUniqueViolation
+	}
+	return nil
+}
+
+// UpsertUnique 按 fields 在未删除的数据中查找记录, 找到则更新该记录(model 的主键会被设置为已有记录的主键), 否则新建.
+//
+// 在事务中执行, 但并发插入仍需要 partial unique index 兜底, 参见 EnsureIndexes
+func (e *Repository) UpsertUnique(ctx context.Context, model Model, fields ...FieldInterface) error {
+	_, err := e.Tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		db := e.getDb(ctx)
+		if db == nil {
+			return nil, dbNilErr
+		}
+		scope := db.NewScope(model)
+		cond, err := e.uniqueCondition(scope, fields)
+		if err != nil {
+			return nil, err
+		}
+		existing, err := e.FindOne(ctx, cond)
+		if IsRecordNotFound(err) {
+			return nil, e.Create(ctx, model)
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, _ := e.primaryValue(existing)
+		if err = scope.SetColumn(e.PrimaryField().Column(), id); err != nil {
+			return nil, err
+		}
+		return nil, e.Save(ctx, model)
+	})
+	return err
+}
+
+// FindOrCreate 按 condition 查找一条记录, 不存在时以 defaults 新建, 返回的 bool 表示是否新建.
+// condition 中 AND 连接的 Eq 条件会写入 defaults 对应的字段. 新建在事务中持有以表名和 condition 为 key 的锁
+// (postgres 为 pg_advisory_xact_lock, mysql 为另一个连接上的 GET_LOCK, 都在事务提交或回滚后释放)后再次查找, 并发调用不会重复新建
+func (e *Repository) FindOrCreate(ctx context.Context, condition Condition, defaults Model) (Model, bool, error) {
+	found, err := e.FindOne(ctx, condition)
+	if err == nil {
+		return found, false, nil
+	}
+	if !IsRecordNotFound(err) {
+		return nil, false, err
+	}
+	created := false
+	res, err := e.Tm.Transaction(ctx, func(ctx context.Context) (interface{}, error) {
+		db := e.getDb(ctx)
+		if db == nil {
+			return nil, dbNilErr
+		}
+		var where string
+		var args []interface{}
+		if condition != nil {
+			where, args = condition.flatten()
+		}
+		if err := advisoryTxLock(ctx, e.Tm, db, lockKeyOf(fmt.Sprintf("%s:%s:%v", e.TableName(), where, args))); err != nil {
+			return nil, err
+		}
+		found, err := e.FindOne(ctx, condition)
+		if err == nil {
+			return found, nil
+		}
+		if !IsRecordNotFound(err) {
+			return nil, err
+		}
+		if err = assignEq(db.NewScope(defaults), Inspect(condition)); err != nil {
+			return nil, err
+		}
+		if err = e.Create(ctx, defaults); err != nil {
+			return nil, err
+		}
+		created = true
+		return defaults, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return res.(Model), created, nil
+}
+
+// assignEq 把 node 中 AND 连接的 Eq 条件写入 scope 对应的字段
+func assignEq(scope *gorm.Scope, node *ConditionNode) error {
+	if node == nil {
+		return nil
+	}
+	if node.Logic == "AND" {
+		for _, child := range node.Children {
+			if err := assignEq(scope, child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !node.IsLeaf() || node.Op != OpEq {
+		return nil
+	}
+	if f, ok := scope.FieldByName(node.Column); ok && f.IsNormal {
+		return f.Set(node.RawArgs[0])
+	}
+	return nil
+}
+
+// UniqueIndexDDL 生成 partial unique index 的建表语句, where 部分取自 MandatoryCondition
+func (e *Repository) UniqueIndexDDL(index UniqueIndex) (string, error) {
+	if len(index.Fields) == 0 {
+		return "", errors.New("unique index without fields")
+	}
+	var cols []string
+	for _, f := range index.Fields {
+		cols = append(cols, f.Column())
+	}
+	name := index.Name
+	if name == "" {
+		name = "uix_" + e.TableName() + "_" + strings.Join(cols, "_")
+	}
+	ddl := fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s)", name, e.TableName(), strings.Join(cols, ", "))
+	if e.MandatoryCondition == nil {
+		return ddl, nil
+	}
+	where, args := e.MandatoryCondition.flatten()
+	if where == "" {
+		return ddl, nil
+	}
+	where, err := inlineSQL(where, args)
+	if err != nil {
+		return "", err
+	}
+	return ddl + " WHERE " + where, nil
+}
+
+// EnsureIndexes 创建 partial unique index. mysql 不支持 partial index, 此时返回的 error 中带有建议的 DDL,
+// 通常的做法是把 is_delete 改为删除时间戳, 并将其加入唯一索引
+func (e *Repository) EnsureIndexes(ctx context.Context, indexes ...UniqueIndex) error {
+	db := e.getDb(ctx)
+	if db == nil {
+		return dbNilErr
+	}
+	for _, index := range indexes {
+		ddl, err := e.UniqueIndexDDL(index)
+		if err != nil {
+			return err
+		}
+		if db.Dialect().GetName() == "mysql" && e.MandatoryCondition != nil {
+			return fmt.Errorf("mysql does not support partial index, create it manually instead of: %s", ddl)
+		}
+		Info("[repository] EnsureIndexes", ddl)
+		if err = db.Exec(ddl).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inlineSQL 把参数直接写入 sql, 仅用于 DDL 这种不支持绑定参数的场景
+func inlineSQL(sql string, args []interface{}) (string, error) {
+	var sb strings.Builder
+	i := 0
+	for _, r := range sql {
+		if r != '?' {
+			sb.WriteRune(r)
+			continue
+		}
+		if i >= len(args) {
+			return "", fmt.Errorf("not enough args for %q", sql)
+		}
+		lit, err := sqlLiteral(args[i])
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(lit)
+		i++
+	}
+	return sb.String(), nil
+}
+
+func sqlLiteral(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case nil:
+		return "NULL", nil
+	case string:
+		return "'" + strings.ReplaceAll(val, "'", "''") + "'", nil
+	case bool:
+		if val {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(val), nil
+	case time.Time:
+		return "'" + val.Format(time.RFC3339Nano) + "'", nil
+	default:
+		return "", fmt.Errorf("can not inline arg of type %T", v)
+	}
+}
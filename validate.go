@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// StructValidator 校验 struct tag, go-playground/validator 的 *validator.Validate 即满足此接口:
+//
+//	repository.SetValidator(validator.New())
+type StructValidator interface {
+	Struct(s interface{}) error
+}
+
+var (
+	structValidator     StructValidator
+	structValidatorLock sync.RWMutex
+)
+
+// SetValidator 设置后 Create/Save/CreateReturning 及 BatchCreate/BatchUpsert 的每个 model 在执行 sql 前校验, 应在 main 中初始化时调用. 为 nil 时不校验 struct tag
+func SetValidator(v StructValidator) {
+	structValidatorLock.Lock()
+	defer structValidatorLock.Unlock()
+	structValidator = v
+}
+
+func getValidator() StructValidator {
+	structValidatorLock.RLock()
+	defer structValidatorLock.RUnlock()
+	return structValidator
+}
+
+// FieldViolation 一个字段未通过的校验
+type FieldViolation struct {
+	// Field 字段的路径, 如 Order.Address.City
+	Field string
+	// Tag 未通过的规则, 如 required, max
+	Tag   string
+	Param string
+	// Message 可读的描述
+	Message string
+}
+
+// ValidationError 写入前校验失败时返回, 此时没有执行任何 sql
+type ValidationError struct {
+	Table      string
+	Violations []FieldViolation
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		fields = append(fields, v.Field+":"+v.Tag)
+	}
+	return fmt.Sprintf("validate %s failed: %s", e.Table, strings.Join(fields, ", "))
+}
+
+// fieldError go-playground/validator 的 FieldError 中用到的方法, 避免直接依赖
+type fieldError interface {
+	Namespace() string
+	Tag() string
+	Param() string
+	Error() string
+}
+
+// validate 依次执行 BeforeValidate 的回调, model 的 BeforeRepoValidate 以及 SetValidator 设置的校验
+func (e *Repository) validate(ctx context.Context, model Model) error {
+	err := e.runCallbacks(ctx, BeforeValidate, model, func() error {
+		if i0, ok := model.(interface {
+			BeforeRepoValidate(ctx context.Context) error
+		}); ok {
+			return i0.BeforeRepoValidate(ctx)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = e.validateEnums(modelColumns(model)); err != nil {
+		return err
+	}
+	v := getValidator()
+	if v == nil {
+		return nil
+	}
+	if err = v.Struct(model); err == nil {
+		return nil
+	}
+	// validator.ValidationErrors 是 []FieldError, 其他错误(如 InvalidValidationError)原样返回
+	rv := reflect.ValueOf(err)
+	if rv.Kind() != reflect.Slice {
+		return err
+	}
+	verr := &ValidationError{Table: e.TableName()}
+	for i := 0; i < rv.Len(); i++ {
+		fe, ok := rv.Index(i).Interface().(fieldError)
+		if !ok {
+			return err
+		}
+		verr.Violations = append(verr.Violations, FieldViolation{
+			Field:   fe.Namespace(),
+			Tag:     fe.Tag(),
+			Param:   fe.Param(),
+			Message: fe.Error(),
+		})
+	}
+	return verr
+}
@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"strings"
+)
+
+type windowField struct {
+	FieldInterface
+	partitionBy []FieldInterface
+	orderBy     []OrderPair
+}
+
+func (wf *windowField) Column() string {
+	var over []string
+	if len(wf.partitionBy) > 0 {
+		cols := make([]string, len(wf.partitionBy))
+		for i, f := range wf.partitionBy {
+			cols[i] = f.Column()
+		}
+		over = append(over, "PARTITION BY "+strings.Join(cols, ", "))
+	}
+	if len(wf.orderBy) > 0 {
+		items := make([]string, len(wf.orderBy))
+		for i, p := range wf.orderBy {
+			target := p.Expr
+			if target == "" {
+				target = p.Field.Column()
+			}
+			order := ASC
+			if p.Order < 0 {
+				order = DESC
+			}
+			items[i] = target + " " + order.String()
+		}
+		over = append(over, "ORDER BY "+strings.Join(items, ", "))
+	}
+	return wf.FieldInterface.Column() + " OVER (" + strings.Join(over, " ") + ")"
+}
+
+// RowNumberOver ROW_NUMBER() OVER (PARTITION BY ... ORDER BY ...), 用于 Select, 通常配合 As 及 Query.FindInto 查询每组的最新一行:
+//
+//	q := repo.Query(cond, Select(SimpleField("*"), As(RowNumberOver([]FieldInterface{fields.UserId},
+//		OrderPair{Field: fields.CreateTime, Order: DESC}), "rn")))
+//	err := q.FindInto(ctx, &rows, SimpleField("rn").Eq(1))
+//
+// orderBy 不支持 Args 及 Nulls
+func RowNumberOver(partitionBy []FieldInterface, orderBy ...OrderPair) FieldInterface {
+	return &windowField{FieldInterface: SimpleField("ROW_NUMBER()"), partitionBy: partitionBy, orderBy: orderBy}
+}
+
+// RankOver RANK() OVER (...), 参见 RowNumberOver
+func RankOver(partitionBy []FieldInterface, orderBy ...OrderPair) FieldInterface {
+	return &windowField{FieldInterface: SimpleField("RANK()"), partitionBy: partitionBy, orderBy: orderBy}
+}
+
+// DenseRankOver DENSE_RANK() OVER (...), 参见 RowNumberOver
+func DenseRankOver(partitionBy []FieldInterface, orderBy ...OrderPair) FieldInterface {
+	return &windowField{FieldInterface: SimpleField("DENSE_RANK()"), partitionBy: partitionBy, orderBy: orderBy}
+}